@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// injectPath is where the admin api takes synthetic upgrades
+	injectPath = "/debug/inject-upgrade"
+	// upgradePath takes upgrades from orchestration tooling, which are applied like trigger.json
+	upgradePath = "/upgrade"
+	// holdPath holds and approves upgrades
+	holdPath = "/hold"
+	// restartPath restarts the daemon
+	restartPath = "/restart"
+)
+
+// injections carries synthetic upgrade lines from the admin api to the running daemon, a send only
+// succeeds while WaitForUpgradeOrExit listens
+var injections = make(chan string)
+
+// restarts asks the running daemon to restart, a send only succeeds while LaunchProcess listens
+var restarts = make(chan struct{})
+
+// upgradeLine is the line x/upgrade logs for the upgrade
+func upgradeLine(name string, height int64, info string) string {
+	if info == "" {
+		info = "{}"
+	}
+	return fmt.Sprintf(`UPGRADE "%s" NEEDED at height: %d: %s`, name, height, info)
+}
+
+// adminHandler serves the admin api. Every request must carry DAEMON_ADMIN_TOKEN as bearer token, all of them are
+// refused without one.
+//
+// POST /debug/inject-upgrade with name, height and optionally info hands the upgrade to the daemon as if it logged it.
+// POST /upgrade with a json RemoteUpgrade writes it as the trigger, DELETE /upgrade removes the pending trigger.
+// POST /hold holds all upgrades, DELETE /hold approves them again.
+// POST /restart stops the daemon cleanly and starts it again.
+// GET /logs returns the recent output of the daemon, and follows it with ?follow=true.
+// GET /detectors reports how the upgrade detectors fared, as json.
+func (cfg *Config) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(injectPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		name := r.FormValue("name")
+		height, err := strconv.ParseInt(r.FormValue("height"), 10, 64)
+		if name == "" || err != nil || height <= 0 {
+			http.Error(w, "name and a positive height are needed", http.StatusBadRequest)
+			return
+		}
+		if !cfg.detects("inject") {
+			http.Error(w, fmt.Sprintf("the inject detector is not in %s", cfg.envName("DAEMON_DETECTORS")), http.StatusForbidden)
+			return
+		}
+		line := upgradeLine(name, height, r.FormValue("info"))
+		if info, err := matchUpgrade(line); err != nil || info == nil {
+			http.Error(w, fmt.Sprintf("%s is not recognized as an upgrade: %v", line, err), http.StatusBadRequest)
+			return
+		}
+		select {
+		case injections <- line:
+			fmt.Fprintf(w, "injected %s\n", line)
+		default:
+			http.Error(w, "the daemon is not running", http.StatusServiceUnavailable)
+		}
+	})
+	mux.HandleFunc(upgradePath, cfg.serveUpgrade)
+	mux.HandleFunc(holdPath, cfg.serveHold)
+	mux.HandleFunc(restartPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		select {
+		case restarts <- struct{}{}:
+			logger.Printf("restart requested through the admin api by %s", r.RemoteAddr)
+			fmt.Fprintln(w, "restarting the daemon")
+		default:
+			http.Error(w, "the daemon is not running", http.StatusServiceUnavailable)
+		}
+	})
+	mux.HandleFunc(logsPath, serveLogs)
+	mux.HandleFunc(detectorsPath, serveDetectors)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.AdminToken == "" {
+			http.Error(w, cfg.envName("DAEMON_ADMIN_TOKEN")+" is not set, the admin api is disabled", http.StatusForbidden)
+			return
+		}
+		if !cfg.authorized(r) {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// authorized is true if the request carries DAEMON_ADMIN_TOKEN
+func (cfg *Config) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) == 1
+}
+
+// RemoteUpgrade is what orchestration tooling posts to /upgrade. Binary is the url to download the binary
+// for this node from, or Info the whole upgrade info (eg. a binary map), and both may be left out
+// if the upgrade is staged already. SchemaVersion may tell which version of it the tooling speaks.
+type RemoteUpgrade struct {
+	SchemaVersion int `json:"schema_version,omitempty"`
+
+	Name   string `json:"name"`
+	Height int64  `json:"height"`
+	Binary string `json:"binary,omitempty"`
+	Info   string `json:"info,omitempty"`
+}
+
+// serveUpgrade writes a posted upgrade as the trigger, which is applied once the node reaches its height
+func (cfg *Config) serveUpgrade(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+	case "DELETE":
+		pending, err := cfg.PendingTrigger()
+		if err == nil && pending != nil {
+			err = os.Remove(cfg.TriggerFile())
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logger.Printf("pending trigger removed through the admin api")
+		fmt.Fprintln(w, "no upgrade pending")
+		return
+	default:
+		http.Error(w, "use POST or DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req RemoteUpgrade
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkSchema("the upgrade", req.SchemaVersion); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	info, err := req.UpgradeInfo()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if pending, err := cfg.PendingTrigger(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if pending != nil && *pending != *info {
+		http.Error(w, fmt.Sprintf("upgrade %s at height %d is pending, DELETE it first", pending.Name, pending.Height), http.StatusConflict)
+		return
+	}
+	if err := cfg.WriteTrigger(info); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cfg.Notify(Event{
+		Type:    "upgrade_requested",
+		Message: fmt.Sprintf("upgrade %s at height %d requested through the admin api by %s", info.Name, info.Height, r.RemoteAddr),
+		Fields:  map[string]string{"UPGRADE": info.Name, "HEIGHT": strconv.FormatInt(info.Height, 10)},
+	})
+	fmt.Fprintf(w, "upgrade %s at height %d pending\n", info.Name, info.Height)
+}
+
+// serveHold holds upgrades for POST, and approves them for DELETE
+func (cfg *Config) serveHold(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		if err := cfg.HoldUpgrades(r.RemoteAddr); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		cfg.Notify(Event{Type: "upgrades_held", Message: fmt.Sprintf("upgrades held through the admin api by %s", r.RemoteAddr)})
+		fmt.Fprintln(w, "upgrades held")
+	case "DELETE":
+		if err := cfg.ApproveUpgrades(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		cfg.Notify(Event{Type: "upgrades_approved", Message: fmt.Sprintf("upgrades approved through the admin api by %s", r.RemoteAddr)})
+		fmt.Fprintln(w, "upgrades approved")
+	default:
+		http.Error(w, "use POST or DELETE", http.StatusMethodNotAllowed)
+	}
+}
+
+// UpgradeInfo checks the request, and returns the upgrade to trigger
+func (req RemoteUpgrade) UpgradeInfo() (*UpgradeInfo, error) {
+	switch {
+	case req.Name == "":
+		return nil, errors.New("name is needed")
+	case req.Height <= 0:
+		// a trigger without height would stop the node right away, which a remote caller must not do by leaving it out
+		return nil, errors.New("height is needed")
+	case req.Binary != "" && req.Info != "":
+		return nil, errors.New("give either binary or info")
+	}
+	info := &UpgradeInfo{Name: req.Name, Height: req.Height, Info: req.Info}
+	if req.Binary != "" {
+		if _, err := url.Parse(req.Binary); err != nil {
+			return nil, errors.Wrap(err, "invalid binary url")
+		}
+		bz, err := json.Marshal(UpgradeConfig{Binaries: map[string]string{osArch(): req.Binary}})
+		if err != nil {
+			return nil, err
+		}
+		info.Info = string(bz)
+	}
+	return info, nil
+}
+
+// serveAdmin serves the admin api until we exit, a failure is only logged
+func (cfg *Config) serveAdmin() {
+	if cfg.AdminToken == "" {
+		logger.Printf("not serving the admin api on %s, %s is not set", cfg.AdminAddress, cfg.envName("DAEMON_ADMIN_TOKEN"))
+		return
+	}
+	logger.Printf("serving admin api on %s", cfg.AdminAddress)
+	if err := http.ListenAndServe(cfg.AdminAddress, cfg.adminHandler()); err != nil {
+		logger.Printf("cannot serve admin api: %v", err)
+	}
+}
+
+// cmdDebug has the tools to try out a configuration, `inject-upgrade` makes the running upgrade manager
+// act on an upgrade no proposal passed
+func cmdDebug(cfg *Config, args []string, out io.Writer) error {
+	if len(args) == 0 || args[0] != "inject-upgrade" {
+		return errors.New("usage: debug inject-upgrade -name <name> -height <height> [-info <info>]")
+	}
+	flags := flag.NewFlagSet("debug inject-upgrade", flag.ContinueOnError)
+	flags.SetOutput(out)
+	name := flags.String("name", "", "name of the upgrade")
+	height := flags.Int64("height", 0, "height of the upgrade")
+	info := flags.String("info", "", "info of the upgrade, eg. the binaries to download")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *name == "" || *height <= 0 {
+		return errors.New("-name and -height are needed")
+	}
+
+	form := url.Values{"name": {*name}, "height": {strconv.FormatInt(*height, 10)}, "info": {*info}}
+	body, err := cfg.callAdmin("POST", injectPath, form)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(out, body)
+	return err
+}
+
+// callAdmin sends a request to the admin api of the running upgrade manager, and returns what it answered
+func (cfg *Config) callAdmin(method, path string, form url.Values) (string, error) {
+	if cfg.AdminAddress == "" {
+		return "", errors.Errorf("%s is not set, so the upgrade manager serves no admin api", cfg.envName("DAEMON_ADMIN_ADDRESS"))
+	}
+	client := &http.Client{Timeout: orDefault(cfg.RPCTimeout, defaultRPCTimeout)}
+	req, err := http.NewRequest(method, adminURL(cfg.AdminAddress)+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", errors.Wrap(err, "creating request")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if cfg.AdminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.AdminToken)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "calling admin api")
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "reading response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("admin api: %s", strings.TrimSpace(string(body)))
+	}
+	return string(body), nil
+}
+
+// adminURL is where to reach the admin api listening on addr, eg. :9111
+func adminURL(addr string) string {
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+	return "http://" + addr
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testAdminToken is the DAEMON_ADMIN_TOKEN of the tests
+const testAdminToken = "s3cret"
+
+// adminRequest returns a request to the admin api carrying testAdminToken
+func adminRequest(method, target string, body io.Reader) *http.Request {
+	req := httptest.NewRequest(method, target, body)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	return req
+}
+
+func TestAdminHandler(t *testing.T) {
+	cases := map[string]struct {
+		method string
+		form   url.Values
+		status int
+	}{
+		"get":           {method: "GET", form: url.Values{"name": {"v2"}, "height": {"10"}}, status: http.StatusMethodNotAllowed},
+		"no name":       {method: "POST", form: url.Values{"height": {"10"}}, status: http.StatusBadRequest},
+		"no height":     {method: "POST", form: url.Values{"name": {"v2"}, "height": {"0"}}, status: http.StatusBadRequest},
+		"quoted name":   {method: "POST", form: url.Values{"name": {`v"2`}, "height": {"10"}}, status: http.StatusBadRequest},
+		"not launched":  {method: "POST", form: url.Values{"name": {"v2"}, "height": {"10"}}, status: http.StatusServiceUnavailable},
+		"info included": {method: "POST", form: url.Values{"name": {"v2"}, "height": {"10"}, "info": {`{"binaries":{}}`}}, status: http.StatusServiceUnavailable},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			req := adminRequest(tc.method, injectPath, strings.NewReader(tc.form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+			(&Config{AdminToken: testAdminToken}).adminHandler().ServeHTTP(rec, req)
+			assert.Equal(t, tc.status, rec.Code, rec.Body.String())
+		})
+	}
+
+	// every route needs the token, and nothing is served without one
+	for _, path := range []string{injectPath, upgradePath, logsPath, detectorsPath, holdPath, restartPath} {
+		rec := httptest.NewRecorder()
+		(&Config{AdminToken: testAdminToken}).adminHandler().ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, path)
+		rec = httptest.NewRecorder()
+		(&Config{}).adminHandler().ServeHTTP(rec, adminRequest("GET", path, nil))
+		assert.Equal(t, http.StatusForbidden, rec.Code, path)
+		rec = httptest.NewRecorder()
+		(&Config{}).adminHandler().ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, http.StatusForbidden, rec.Code, path)
+	}
+}
+
+func TestInjectUpgrade(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd", AdminToken: testAdminToken}
+	server := httptest.NewServer(cfg.adminHandler())
+	defer server.Close()
+	cfg.AdminAddress = strings.TrimPrefix(server.URL, "http://")
+
+	var out bytes.Buffer
+	err = cmdDebug(cfg, []string{"inject-upgrade", "-name", "chain2", "-height", "49"}, &out)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not running")
+	assert.Error(t, cmdDebug(cfg, []string{"inject-upgrade", "-name", "chain2"}, &out))
+	assert.Error(t, cmdDebug(cfg, []string{"eject"}, &out))
+
+	require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte("#!/bin/sh\nexec sleep 30\n"), 0755))
+	launched := make(chan error, 1)
+	go func() {
+		var stdout, stderr bytes.Buffer
+		launched <- LaunchProcess(cfg, []string{"start"}, &stdout, &stderr)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		out.Reset()
+		if err = cmdDebug(cfg, []string{"inject-upgrade", "-name", "chain2", "-height", "49"}, &out); err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	require.NoError(t, err)
+	assert.Equal(t, "injected UPGRADE \"chain2\" NEEDED at height: 49: {}\n", out.String())
+
+	select {
+	case err := <-launched:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("daemon was not stopped")
+	}
+	assert.Equal(t, cfg.UpgradeBin("chain2"), cfg.CurrentBin())
+}
+
+func TestRemoteUpgrade(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd", AdminToken: "s3cret"}
+
+	post := func(method, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, upgradePath, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		cfg.adminHandler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	withBinary := &UpgradeInfo{Name: "chain3", Height: 200, Info: `{"binaries":{"` + osArch() + `":"https://example.com/gaiad?checksum=sha256:abc"}}`}
+	cases := []struct {
+		name   string
+		method string
+		token  string
+		body   string
+		status int
+		// trigger is the pending trigger afterwards, nil for none
+		trigger *UpgradeInfo
+	}{
+		{name: "no token", method: "POST", body: `{"name":"chain2","height":100}`, status: http.StatusUnauthorized},
+		{name: "wrong token", method: "POST", token: "guess", body: `{"name":"chain2","height":100}`, status: http.StatusUnauthorized},
+		{name: "no name", method: "POST", token: "s3cret", body: `{"height":100}`, status: http.StatusBadRequest},
+		{name: "no height", method: "POST", token: "s3cret", body: `{"name":"chain2"}`, status: http.StatusBadRequest},
+		{name: "height 0", method: "POST", token: "s3cret", body: `{"name":"chain2","height":0}`, status: http.StatusBadRequest},
+		{name: "broken json", method: "POST", token: "s3cret", body: `{"name":`, status: http.StatusBadRequest},
+		{name: "binary and info", method: "POST", token: "s3cret", body: `{"name":"chain2","binary":"https://x/y","info":"{}"}`, status: http.StatusBadRequest},
+		{
+			name: "staged", method: "POST", token: "s3cret", body: `{"name":"chain2","height":100}`, status: http.StatusOK,
+			trigger: &UpgradeInfo{Name: "chain2", Height: 100},
+		},
+		{
+			name: "again", method: "POST", token: "s3cret", body: `{"name":"chain2","height":100}`, status: http.StatusOK,
+			trigger: &UpgradeInfo{Name: "chain2", Height: 100},
+		},
+		{
+			name: "another pending", method: "POST", token: "s3cret", body: `{"name":"chain3","height":200}`, status: http.StatusConflict,
+			trigger: &UpgradeInfo{Name: "chain2", Height: 100},
+		},
+		{name: "cancel", method: "DELETE", token: "s3cret", status: http.StatusOK},
+		{
+			name: "with binary", method: "POST", token: "s3cret", body: `{"name":"chain3","height":200,"binary":"https://example.com/gaiad?checksum=sha256:abc"}`, status: http.StatusOK,
+			trigger: withBinary,
+		},
+		{name: "get", method: "GET", token: "s3cret", status: http.StatusMethodNotAllowed, trigger: withBinary},
+	}
+
+	// in order, each case starts with the trigger of the one before
+	for _, tc := range cases {
+		rec := post(tc.method, tc.token, tc.body)
+		assert.Equal(t, tc.status, rec.Code, "%s: %s", tc.name, rec.Body.String())
+		trigger, err := cfg.PendingTrigger()
+		require.NoError(t, err)
+		assert.Equal(t, tc.trigger, trigger, tc.name)
+	}
+
+	// nor any without a token
+	cfg.AdminToken = ""
+	assert.Equal(t, http.StatusForbidden, post("POST", "", `{"name":"chain2","height":100}`).Code)
+}
+
+// TestDebugOfDaemon passes the debug commands of the daemon through, only inject-upgrade is ours
+func TestDebugOfDaemon(t *testing.T) {
+	assert.Equal(t, "debug addr cosmos1abc\n", runDaemonCommand(t, "debug", "addr", "cosmos1abc"))
+	assert.Equal(t, "debug pubkey abc\n", runDaemonCommand(t, "debug", "pubkey", "abc"))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	getter "github.com/hashicorp/go-getter"
+	"github.com/pkg/errors"
+)
+
+// detectArchive adds the archive type to a local (or staged) file whose name doesn't tell it, by its first bytes,
+// as release urls like https://example.com/download?asset=42 are common. Only zip and gzip (with or without tar)
+// are recognized, everything else is taken as the binary.
+func detectArchive(source string) (string, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return "", errors.Wrap(err, "parsing binary url")
+	}
+	if (u.Scheme != "" && u.Scheme != "file") || u.Query().Get("archive") != "" {
+		return source, nil
+	}
+	for ext := range getter.Decompressors {
+		if strings.HasSuffix(u.Path, "."+ext) {
+			return source, nil
+		}
+	}
+	f, err := os.Open(u.Path)
+	if err != nil {
+		// it is not a local file after all, go-getter tells why
+		return source, nil
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	head = head[:n]
+	archive := ""
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")):
+		archive = "zip"
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		archive = "gz"
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return "", errors.Wrap(err, "reading download")
+		}
+		if isTar(f) {
+			archive = "tar.gz"
+		}
+	default:
+		return source, nil
+	}
+	query := u.Query()
+	query.Set("archive", archive)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// isTar is whether the gzipped stream holds a tar archive
+func isTar(r io.Reader) bool {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return false
+	}
+	header := make([]byte, 512)
+	if _, err := io.ReadFull(zr, header); err != nil {
+		return false
+	}
+	return string(header[257:262]) == "ustar"
+}
+
+// installExecutable moves the binary out of an archive unpacked into the upgrade dir to bin/$DAEMON_NAME, unless
+// it is there already (as for archives of the upgrade dir). The binary is at path in the archive if given, or else
+// the only file named $DAEMON_NAME (or $DAEMON_NAME.exe) anywhere in it. Everything else in the archive is kept
+// where it is, eg. shared libraries next to the binary.
+func (cfg *Config) installExecutable(upgradeName, path string) error {
+	dir, bin := cfg.UpgradeDir(upgradeName), cfg.UpgradeBin(upgradeName)
+	var found string
+	if path != "" {
+		found = filepath.Join(dir, filepath.FromSlash(path))
+		if rel, err := filepath.Rel(dir, found); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return errors.Errorf("executable %s is outside of the archive", path)
+		}
+		if info, err := os.Stat(found); err != nil || !info.Mode().IsRegular() {
+			return errors.Errorf("the archive has no executable %s", path)
+		}
+	} else {
+		if _, err := os.Stat(bin); err == nil {
+			return nil
+		}
+		var matches []string
+		err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Mode().IsRegular() && (info.Name() == cfg.Name || info.Name() == cfg.Name+".exe") {
+				matches = append(matches, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return errors.Wrap(err, "searching the archive")
+		}
+		switch len(matches) {
+		case 0:
+			return errors.Errorf("the archive has no %s, set its path under \"executables\" in the upgrade info", cfg.Name)
+		case 1:
+			found = matches[0]
+		default:
+			sort.Strings(matches)
+			for i, m := range matches {
+				matches[i], _ = filepath.Rel(dir, m)
+			}
+			return errors.Errorf("the archive has %s, set the path of the binary under \"executables\" in the upgrade info",
+				strings.Join(matches, ", "))
+		}
+	}
+	if found == bin {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(bin), 0755); err != nil {
+		return errors.Wrap(err, "creating bin dir")
+	}
+	logger.Printf("installing %s of the archive as the binary of %s", filepath.ToSlash(strings.TrimPrefix(found, dir+string(filepath.Separator))), upgradeName)
+	return errors.Wrap(os.Rename(found, bin), "installing binary")
+}
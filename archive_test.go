@@ -0,0 +1,133 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTarGz writes files (by path) into a tar.gz
+func writeTarGz(t *testing.T, path string, files map[string][]byte) {
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	tw := tar.NewWriter(zw)
+	for name, body := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Size: int64(len(body)), Typeflag: tar.TypeReg}))
+		_, err := tw.Write(body)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, zw.Close())
+	require.NoError(t, ioutil.WriteFile(path, b.Bytes(), 0644))
+}
+
+// writeZip writes files (by path) into a zip
+func writeZip(t *testing.T, path string, files map[string][]byte) {
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for name, body := range files {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		_, err = w.Write(body)
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	require.NoError(t, ioutil.WriteFile(path, b.Bytes(), 0644))
+}
+
+func TestDownloadReleaseArchive(t *testing.T) {
+	bin, err := ioutil.ReadFile("testdata/repo/raw_binary/autod")
+	require.NoError(t, err)
+	dir, err := ioutil.TempDir("", "archive-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeTarGz(t, filepath.Join(dir, "autod-v2-linux-amd64.tar.gz"), map[string][]byte{
+		"autod-v2/autod":        bin,
+		"autod-v2/libwasmvm.so": []byte("lib"),
+		"autod-v2/README.md":    []byte("readme"),
+	})
+	writeZip(t, filepath.Join(dir, "release.zip"), map[string][]byte{
+		"dist/autod-linux": bin,
+		"dist/CHANGELOG":   []byte("changes"),
+	})
+	writeTarGz(t, filepath.Join(dir, "twice.tar.gz"), map[string][]byte{
+		"debug/autod":   []byte("#!/bin/sh\n"),
+		"release/autod": bin,
+	})
+	// a release url that doesn't tell the archive type
+	writeTarGz(t, filepath.Join(dir, "asset"), map[string][]byte{
+		"autod-v2/autod":        bin,
+		"autod-v2/libwasmvm.so": []byte("lib"),
+	})
+	server := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer server.Close()
+
+	cases := map[string]struct {
+		info  string
+		err   string
+		extra string
+	}{
+		"found by name": {
+			info:  fmt.Sprintf(`{"binaries":{"%s": "%s/autod-v2-linux-amd64.tar.gz"}}`, osArch(), server.URL),
+			extra: "autod-v2/libwasmvm.so",
+		},
+		"configured path": {
+			info:  fmt.Sprintf(`{"binaries":{"%s": "%s/release.zip"}, "executables":{"%s": "dist/autod-linux"}}`, osArch(), server.URL, osArch()),
+			extra: "dist/CHANGELOG",
+		},
+		"detected by content": {
+			info:  fmt.Sprintf(`{"binaries":{"%s": "%s/asset"}}`, osArch(), server.URL),
+			extra: "autod-v2/libwasmvm.so",
+		},
+		"ambiguous": {
+			info: fmt.Sprintf(`{"binaries":{"%s": "%s/twice.tar.gz"}}`, osArch(), server.URL),
+			err:  "debug/autod, release/autod",
+		},
+		"chosen": {
+			info: fmt.Sprintf(`{"binaries":{"%s": "%s/twice.tar.gz"}, "executables":{"%s": "release/autod"}}`, osArch(), server.URL, osArch()),
+		},
+		"missing": {
+			info: fmt.Sprintf(`{"binaries":{"%s": "%s/release.zip"}}`, osArch(), server.URL),
+			err:  "the archive has no autod",
+		},
+		"outside": {
+			info: fmt.Sprintf(`{"binaries":{"%s": "%s/release.zip"}, "executables":{"%s": "../../genesis/bin/autod"}}`, osArch(), server.URL, osArch()),
+			err:  "outside of the archive",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			home, err := copyTestData("download")
+			require.NoError(t, err)
+			defer os.RemoveAll(home)
+			cfg := &Config{Home: home, Name: "autod", AllowDownloadBinaries: true}
+
+			err = DownloadBinary(cfg, &UpgradeInfo{Name: "v2", Info: tc.info})
+			if tc.err != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+			hash, err := sha256File(cfg.UpgradeBin("v2"))
+			require.NoError(t, err)
+			assert.Equal(t, autodSHA256, hash)
+			require.NoError(t, EnsureBinary(cfg.UpgradeBin("v2")))
+			if tc.extra != "" {
+				assert.FileExists(t, filepath.Join(cfg.UpgradeDir("v2"), filepath.FromSlash(tc.extra)))
+			}
+		})
+	}
+}
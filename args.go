@@ -1,9 +1,17 @@
 package main
 
 import (
+	"crypto/x509"
+	"io/ioutil"
 	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -13,29 +21,248 @@ const (
 	genesisDir  = "genesis"
 	upgradesDir = "upgrades"
 	currentLink = "current"
+	// currentMarker names the upgrade a copied current dir was made from
+	currentMarker = ".upgrade"
+
+	defaultLeaseTTL = 30 * time.Second
 )
 
 // Config is the information passed in to control the daemon
 type Config struct {
+	// EnvPrefix is prepended to all DAEMON_* variables, so several instances can share one environment
+	EnvPrefix string
+	// RootName is the directory in Home everything lives in, upgrade_manager unless set
+	RootName string
+
 	Home                  string
 	Name                  string
 	AllowDownloadBinaries bool
 	RestartAfterUpgrade   bool
+	// ConfirmHeight checks upgrade lines against the height of the node, ConfirmMargin is the difference we allow
+	ConfirmHeight bool
+	ConfirmMargin int
+	// PreDownload downloads upgrades as soon as the node reports them scheduled
+	PreDownload bool
+	// HaltAtUpgrade passes --halt-height to the daemon, for the next upgrade we know the height of
+	HaltAtUpgrade bool
+	// CopySwitching copies the selected upgrade into current, rather than linking it
+	CopySwitching bool
+	// PointerSwitching writes the selected upgrade into current, a small file, rather than linking it
+	PointerSwitching bool
+	// MetricsAddress serves the metrics of the scanners, if set
+	MetricsAddress string
+	// AdminAddress serves the admin api, eg. to inject an upgrade, if set
+	AdminAddress string
+	// HealthAddress serves whether the daemon runs, without a token, if set
+	HealthAddress string
+	// AdminToken must be sent with every request to the admin api, which is not served without one
+	AdminToken string
+	// ScannerStall is how long reading the output may pause before it counts as a stall
+	ScannerStall time.Duration
+	// MaxLineLength is how much of every line of output we scan for the upgrade, longer lines are cut
+	MaxLineLength int
+	// PollInterval is how often we check for upgrade-info.json (and query the node)
+	PollInterval time.Duration
+	// WaitForBinary waits for the binary of an upgrade to be staged by hand, if it cannot be downloaded, and
+	// reminds the operator every WaitForBinaryRemind, for at most WaitForBinaryTimeout (0 for no limit)
+	WaitForBinary        bool
+	WaitForBinaryRemind  time.Duration
+	WaitForBinaryTimeout time.Duration
+	// RPCAddress is the tendermint rpc of the node, which we query for the upgrade plan if set
+	RPCAddress string
+	// RPCTimeout limits every query to RPCAddress, FleetTimeout every query to a fleet agent
+	RPCTimeout   time.Duration
+	FleetTimeout time.Duration
+	// RPCDisable are the features which must not use RPCAddress, RPCUnavailableAfter is how long it may not
+	// answer before we warn and carry on without it
+	RPCDisable          map[string]bool
+	RPCUnavailableAfter time.Duration
+	// HeightSources are asked in order for the height of the node (rpc, output or validator-state), the
+	// validator state is read from ValidatorState, or data/priv_validator_state.json of Home
+	HeightSources  []string
+	ValidatorState string
+	// Detectors find upgrades, by priority (file, trigger, planned, rpc, log or inject), all of them if empty
+	Detectors []string
+	// DownloadConnectTimeout limits connecting to download servers, a failed download at the upgrade height
+	// is retried DownloadRetries times, after DownloadRetryDelay doubled for every retry up to DownloadRetryMaxDelay.
+	// DownloadTimeout limits every request, DownloadTotalTimeout the whole download with all retries.
+	DownloadConnectTimeout time.Duration
+	DownloadRetries        int
+	DownloadRetryDelay     time.Duration
+	DownloadRetryMaxDelay  time.Duration
+	DownloadTimeout        time.Duration
+	DownloadTotalTimeout   time.Duration
+	// ShutdownGrace is how long the daemon may take to stop cleanly on upgrade, after ShutdownSignal (SIGTERM
+	// unless set), before it is killed
+	ShutdownGrace  time.Duration
+	ShutdownSignal syscall.Signal
+	// RequireChecksum refuses to download a binary without a sha256 (or sha512) to verify it with
+	RequireChecksum bool
+	// RequireHTTPS refuses to download anything over plain http, DownloadCAs replace the system roots for
+	// verifying download servers, if set
+	RequireHTTPS bool
+	DownloadCAs  *x509.CertPool
+	// ManifestKeyring holds the gpg keys SHA256SUMS manifests must be signed with
+	ManifestKeyring string
+	// ArtifactKeyring holds the gpg keys, and MinisignKey is the minisign public key (or its file), downloaded
+	// artifacts must be signed with
+	ArtifactKeyring string
+	MinisignKey     string
+	// CosignIdentity (a regexp) and CosignIssuer are who signed a cosign bundle of downloaded artifacts keyless,
+	// or CosignKey the public key
+	CosignIdentity string
+	CosignIssuer   string
+	CosignKey      string
+	// SLSASource is the repository downloaded artifacts must have SLSA provenance from, eg. github.com/cosmos/gaia
+	SLSASource string
+	// VerifySignature requires downloaded binaries to be signed on macOS and windows, optionally by Signer
+	// (the team id on macOS, part of the certificate subject on windows)
+	VerifySignature bool
+	Signer          string
+	// DownloadRateLimit caps all downloads together at this many bytes per second, if set
+	DownloadRateLimit uint64
+	// SharedCache keeps downloaded artifacts with a checksum for all upgrade managers of the host, if set, and
+	// removes those not used for SharedCacheMaxAge (0 keeps them)
+	SharedCache       string
+	SharedCacheMaxAge time.Duration
+	// DownloadPatches patches the current binary into the one of an upgrade, if the upgrade lists a patch from it
+	DownloadPatches bool
+	// DownloadConnections fetch a large file in as many ranges at once
+	DownloadConnections int
+	// DownloadMaxSize aborts every download (and unpacked archive) larger than this many bytes, if set
+	DownloadMaxSize uint64
+	// IPFSGateway serves ipfs:// urls, unless they are fetched from the api of a node at IPFSAPI
+	IPFSGateway string
+	IPFSAPI     string
+	// OCICredentials are user:password for the registries of oci:// urls
+	OCICredentials string
+	// TorrentClient fetches magnet: links and .torrent files, called like aria2c with --seed-time, --dir=<dir> and the
+	// link, and seeds what it fetched for TorrentSeedTime afterwards (0 not at all)
+	TorrentClient   []string
+	TorrentSeedTime time.Duration
+	// DownloadMirrors are tried in order for every download which fails on the url it starts with
+	DownloadMirrors []Mirror
+	// SocksProxy is used for all downloads if set, HTTPProxy overrides the proxy of HTTP_PROXY and HTTPS_PROXY
+	SocksProxy *url.URL
+	HTTPProxy  *url.URL
+	// DownloadHeaders are sent with the downloads from their host, eg. to authenticate with a private server
+	DownloadHeaders []DownloadHeader
+	// GitHubToken authenticates github:// lookups, GitHubAPI replaces api.github.com (eg. for enterprise)
+	GitHubToken string
+	GitHubAPI   string
+	// GitLabToken and GiteaToken authenticate gitlab:// and gitea:// lookups
+	GitLabToken string
+	GiteaToken  string
+	// BuildCommand builds the binary from source, if there is no prebuilt one for this platform
+	BuildCommand string
+	// PreSwitchCommand is run before we switch to an upgrade, which is aborted if it fails
+	PreSwitchCommand string
+	// PostUpgradeCommand is run once the daemon is up after an upgrade
+	PostUpgradeCommand string
+	// ToolchainProvider installs the go version pinned for a build (path, asdf or nix)
+	ToolchainProvider string
+	// LogColor is on or off to override the detection of a terminal, LogWidth cuts our longer log lines
+	LogColor string
+	LogWidth int
+	// FleetNodes are the other nodes of this chain fleet-compare checks, agent urls or home directories
+	FleetNodes []string
+	// Jailer is the command (eg. firejail or bwrap) the daemon is run with, its fields are templates of JailerData
+	Jailer []*template.Template
+	// ConfigCheck compares the config keys with the defaults of the binary we upgraded to, ConfigValidate
+	// are the args (eg. config validate) it checks the config with, both for at most ConfigCheckTimeout
+	ConfigCheck        bool
+	ConfigValidate     []string
+	ConfigCheckTimeout time.Duration
+	// SmokeTest are the args (eg. version) a new binary must run with successfully, within SmokeTestTimeout,
+	// before we switch to it
+	SmokeTest        []string
+	SmokeTestTimeout time.Duration
+	// ContainerRuntime (docker or podman) runs upgrades from their image rather than a binary, with ContainerArgs
+	// added to its run command
+	ContainerRuntime string
+	ContainerArgs    []string
+	// DefaultArgs are passed to the daemon when we are called without any arguments
+	DefaultArgs []string
+
+	// PIDFile and ChildPIDFile are written with our pid and the pid of the daemon (or its jailer) while it runs
+	PIDFile      string
+	ChildPIDFile string
+
+	// LeaseFile and LeaseCommand guard a validator against running on two hosts at once, LeaseReleaseCommand gives
+	// up the lease of LeaseCommand when we exit
+	LeaseFile           string
+	LeaseCommand        string
+	LeaseReleaseCommand string
+	LeaseOwner          string
+	LeaseTTL            time.Duration
+	// LeaseInstance is random for this run, LeaseKey is the consensus pubkey of the validator (if known)
+	LeaseInstance string
+	LeaseKey      string
+
+	// NotifyCommand is run for every event the operator should know about
+	NotifyCommand string
+	// NotifyTemplates render the payload of notifications, NotifyLinks and ChainID are passed to them
+	NotifyTemplates *template.Template
+	NotifyLinks     map[string]string
+	ChainID         string
+	// NodeLabel tells this node apart from the rest of the fleet, in every metric, event, report and history entry
+	NodeLabel string
+	// UnsafeSkipBackup disables backing up the data dir before upgrading
+	UnsafeSkipBackup bool
+	// UnsafeSkipUpgrades are the heights of upgrade plans we ignore, and pass to the daemon as --unsafe-skip-upgrades
+	UnsafeSkipUpgrades []int64
+	// PruneMinFree triggers removing old upgrades when less bytes are free
+	PruneMinFree uint64
+	// FatalPatterns halt the node when the daemon prints a matching line
+	FatalPatterns []*regexp.Regexp
+	// ConsensusFailure is what to do when the daemon reports a consensus failure: halt (the default), alert or off
+	ConsensusFailure string
+	// StopMarkers are the lines the daemon prints once it is safe to kill, after we asked it to stop
+	StopMarkers []*regexp.Regexp
+	// HistoryMaxAge and HistoryMaxEntries limit the history (0 for no limit), BackupsMaxAge and BackupsKeep the backups
+	HistoryMaxAge     time.Duration
+	HistoryMaxEntries int
+	BackupsMaxAge     time.Duration
+	BackupsKeep       int
+	// StallTimeout is how long the daemon may go without a new block, 0 if we don't watch
+	StallTimeout time.Duration
+	// StallAction is what to do then: alert (the default), restart or both
+	StallAction string
+	// PreUpgrade runs `pre-upgrade` of the binary we switched to before it starts, which may exit with 31
+	// PreUpgradeRetries times before we give up
+	PreUpgrade        bool
+	PreUpgradeRetries int
+	// RestartOnCrash starts the daemon again when it exits with an error by itself, after CrashRestartDelay doubled
+	// for every crash in a row, up to CrashRestartMaxDelay
+	RestartOnCrash       bool
+	CrashRestartDelay    time.Duration
+	CrashRestartMaxDelay time.Duration
 }
 
 // Root returns the root directory where all info lives
 func (cfg *Config) Root() string {
+	if cfg.RootName != "" {
+		return filepath.Join(cfg.Home, cfg.RootName)
+	}
 	return filepath.Join(cfg.Home, rootName)
 }
 
 // GenesisBin is the path to the genesis binary - must be in place to start manager
 func (cfg *Config) GenesisBin() string {
-	return filepath.Join(cfg.Root(), genesisDir, "bin", cfg.Name)
+	return filepath.Join(cfg.Root(), genesisDir, "bin", cfg.binName())
 }
 
 // UpgradeBin is the path to the binary for the named upgrade
 func (cfg *Config) UpgradeBin(upgradeName string) string {
-	return filepath.Join(cfg.UpgradeDir(upgradeName), "bin", cfg.Name)
+	return filepath.Join(cfg.UpgradeDir(upgradeName), "bin", cfg.binName())
+}
+
+// binName is the file name of the binary, $DAEMON_NAME.exe on windows
+func (cfg *Config) binName() string {
+	if strings.HasSuffix(strings.ToLower(cfg.Name), exeSuffix) {
+		return cfg.Name
+	}
+	return cfg.Name + exeSuffix
 }
 
 // UpgradeDir is the directory named upgrade
@@ -53,6 +280,21 @@ func (cfg *Config) CurrentBin() string {
 	if err != nil {
 		return cfg.GenesisBin()
 	}
+	// a copy made in copy mode is used as is
+	if info.IsDir() {
+		if _, err := os.Stat(filepath.Join(cur, currentMarker)); err == nil {
+			return filepath.Join(cur, "bin", cfg.binName())
+		}
+		return cfg.GenesisBin()
+	}
+	// as is the dir a pointer file names
+	if info.Mode().IsRegular() {
+		dest, err := cfg.readPointer(cur)
+		if err != nil {
+			return cfg.GenesisBin()
+		}
+		return filepath.Join(dest, "bin", cfg.binName())
+	}
 	// if it is there, ensure it is a symlink
 	if info.Mode()&os.ModeSymlink == 0 {
 		return cfg.GenesisBin()
@@ -65,41 +307,466 @@ func (cfg *Config) CurrentBin() string {
 	}
 
 	// and return the binary
-	return filepath.Join(dest, "bin", cfg.Name)
+	return filepath.Join(dest, "bin", cfg.binName())
+}
+
+// readPointer returns the dir a pointer file written in pointer mode names, relative to the root
+func (cfg *Config) readPointer(pointer string) (string, error) {
+	bz, err := ioutil.ReadFile(pointer)
+	if err != nil {
+		return "", err
+	}
+	rel := filepath.FromSlash(strings.TrimSpace(string(bz)))
+	if rel == "" || filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.Errorf("%s does not name a dir in %s", pointer, cfg.Root())
+	}
+	return filepath.Join(cfg.Root(), rel), nil
+}
+
+// CurrentUpgradeDir returns the genesis or upgrade directory current was last switched to,
+// and when that happened. It works for both the symlink and the copy mode.
+// ok is false if we never switched, and still run genesis.
+func (cfg *Config) CurrentUpgradeDir() (dir string, since time.Time, ok bool) {
+	genesis := filepath.Join(cfg.Root(), genesisDir)
+	cur := filepath.Join(cfg.Root(), currentLink)
+	info, err := os.Lstat(cur)
+	if err != nil {
+		return genesis, time.Time{}, false
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		dest, err := os.Readlink(cur)
+		if err != nil {
+			return genesis, time.Time{}, false
+		}
+		return dest, info.ModTime(), true
+	}
+	if info.Mode().IsRegular() {
+		dest, err := cfg.readPointer(cur)
+		if err != nil {
+			return genesis, time.Time{}, false
+		}
+		return dest, info.ModTime(), true
+	}
+
+	marker := filepath.Join(cur, currentMarker)
+	bz, err := ioutil.ReadFile(marker)
+	if err != nil {
+		return genesis, time.Time{}, false
+	}
+	markerInfo, err := os.Stat(marker)
+	if err != nil {
+		return genesis, time.Time{}, false
+	}
+	return filepath.Join(cfg.Root(), filepath.FromSlash(strings.TrimSpace(string(bz)))), markerInfo.ModTime(), true
+}
+
+// isCurrentUpgrade returns true if current was switched to the named upgrade
+func (cfg *Config) isCurrentUpgrade(upgradeName string) bool {
+	dir, _, ok := cfg.CurrentUpgradeDir()
+	return ok && filepath.Clean(dir) == filepath.Clean(cfg.UpgradeDir(upgradeName))
+}
+
+// currentUpgradeName returns the name of the upgrade current was switched to, or genesis
+func (cfg *Config) currentUpgradeName() string {
+	dir, _, ok := cfg.CurrentUpgradeDir()
+	if !ok {
+		return genesisDir
+	}
+	name, err := url.PathUnescape(filepath.Base(dir))
+	if err != nil {
+		return filepath.Base(dir)
+	}
+	return name
+}
+
+// ChildArgs returns the arguments to launch the daemon with, given our own command line
+func (cfg *Config) ChildArgs(args []string) []string {
+	if len(args) == 0 {
+		return cfg.DefaultArgs
+	}
+	return args
 }
 
 // GetConfigFromEnv will read the environmental variables into a config
 // and then validate it is reasonable
 func GetConfigFromEnv() (*Config, error) {
-	cfg := &Config{
-		Home: os.Getenv("DAEMON_HOME"),
-		Name: os.Getenv("DAEMON_NAME"),
+	cfg, err := readConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
 	}
-	if os.Getenv("DAEMON_ALLOW_DOWNLOAD_BINARIES") == "on" {
+	return cfg, nil
+}
+
+// readConfigFromEnv reads and validates the environmental variables,
+// but doesn't require the upgrade_manager directory to exist yet
+func readConfigFromEnv() (*Config, error) {
+	cfg := &Config{EnvPrefix: os.Getenv("COSMOSD_ENV_PREFIX")}
+	cfg.Home = cfg.getenv("DAEMON_HOME")
+	cfg.Name = cfg.getenv("DAEMON_NAME")
+	cfg.RootName = detectRoot(cfg.Home)
+	if cfg.enabled("DAEMON_ALLOW_DOWNLOAD_BINARIES") {
 		cfg.AllowDownloadBinaries = true
 	}
-	if os.Getenv("DAEMON_RESTART_AFTER_UPGRADE") == "on" {
+	if cfg.enabled("DAEMON_CONFIRM_HEIGHT") {
+		cfg.ConfirmHeight = true
+	}
+	cfg.ConfirmMargin = defaultConfirmMargin
+	if margin := cfg.getenv("DAEMON_CONFIRM_HEIGHT_MARGIN"); margin != "" {
+		n, err := strconv.Atoi(margin)
+		if err != nil || n < 0 {
+			return nil, errors.Errorf("%s must be a number of blocks, not %s", cfg.envName("DAEMON_CONFIRM_HEIGHT_MARGIN"), margin)
+		}
+		cfg.ConfirmMargin = n
+	}
+	if cfg.enabled("DAEMON_PREDOWNLOAD") {
+		cfg.PreDownload = true
+	}
+	if cfg.enabled("DAEMON_HALT_AT_UPGRADE") {
+		cfg.HaltAtUpgrade = true
+	}
+	if cfg.enabled("DAEMON_RESTART_AFTER_UPGRADE") {
 		cfg.RestartAfterUpgrade = true
 	}
-	if err := cfg.validate(); err != nil {
+	if cfg.enabled("DAEMON_PREUPGRADE") {
+		cfg.PreUpgrade = true
+	}
+	if cfg.enabled("DAEMON_RESTART_ON_CRASH") {
+		cfg.RestartOnCrash = true
+	}
+	defaultArgs, err := splitArgs(cfg.getenv("DAEMON_ARGS"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", cfg.envName("DAEMON_ARGS"))
+	}
+	cfg.DefaultArgs = defaultArgs
+	if cfg.enabled("DAEMON_CONFIG_CHECK") {
+		cfg.ConfigCheck = true
+	}
+	if cfg.ConfigValidate, err = splitArgs(cfg.getenv("DAEMON_CONFIG_VALIDATE")); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", cfg.envName("DAEMON_CONFIG_VALIDATE"))
+	}
+	switch smokeTest := cfg.getenv("DAEMON_SMOKE_TEST"); smokeTest {
+	case "":
+		cfg.SmokeTest = defaultSmokeTest
+	case "off":
+	default:
+		if cfg.SmokeTest, err = splitArgs(smokeTest); err != nil {
+			return nil, errors.Wrapf(err, "parsing %s", cfg.envName("DAEMON_SMOKE_TEST"))
+		}
+	}
+	jailer, err := parseJailer(cfg.getenv("DAEMON_JAILER"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", cfg.envName("DAEMON_JAILER"))
+	}
+	cfg.Jailer = jailer
+	cfg.ContainerRuntime = cfg.getenv("DAEMON_CONTAINER_RUNTIME")
+	if cfg.ContainerArgs, err = splitArgs(cfg.getenv("DAEMON_CONTAINER_ARGS")); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", cfg.envName("DAEMON_CONTAINER_ARGS"))
+	}
+	mode := cfg.getenv("DAEMON_SWITCH_MODE")
+	if mode == "" {
+		mode = defaultSwitchMode
+	}
+	switch mode {
+	case "symlink":
+	case "copy":
+		cfg.CopySwitching = true
+	case "pointer":
+		cfg.PointerSwitching = true
+	default:
+		return nil, errors.Errorf("%s must be symlink, copy or pointer, not %s", cfg.envName("DAEMON_SWITCH_MODE"), mode)
+	}
+	if cfg.enabled("DAEMON_REQUIRE_CHECKSUM") {
+		cfg.RequireChecksum = true
+	}
+	if cfg.enabled("DAEMON_WAIT_FOR_BINARY") {
+		cfg.WaitForBinary = true
+	}
+	if cfg.enabled("DAEMON_REQUIRE_HTTPS") {
+		cfg.RequireHTTPS = true
+	}
+	if bundle := cfg.getenv("DAEMON_DOWNLOAD_CA_BUNDLE"); bundle != "" {
+		if cfg.DownloadCAs, err = loadCABundle(bundle); err != nil {
+			return nil, errors.Wrapf(err, "parsing %s", cfg.envName("DAEMON_DOWNLOAD_CA_BUNDLE"))
+		}
+	}
+	cfg.ManifestKeyring = cfg.getenv("DAEMON_SHA256SUMS_KEYRING")
+	cfg.ArtifactKeyring = cfg.getenv("DAEMON_ARTIFACT_KEYRING")
+	cfg.MinisignKey = cfg.getenv("DAEMON_MINISIGN_PUBKEY")
+	cfg.CosignIdentity = cfg.getenv("DAEMON_COSIGN_IDENTITY")
+	cfg.CosignIssuer = cfg.getenv("DAEMON_COSIGN_ISSUER")
+	cfg.CosignKey = cfg.getenv("DAEMON_COSIGN_PUBKEY")
+	if (cfg.CosignIdentity == "") != (cfg.CosignIssuer == "") {
+		return nil, errors.Errorf("%s and %s are set together", cfg.envName("DAEMON_COSIGN_IDENTITY"), cfg.envName("DAEMON_COSIGN_ISSUER"))
+	}
+	cfg.SLSASource = cfg.getenv("DAEMON_SLSA_SOURCE")
+	if cfg.enabled("DAEMON_VERIFY_SIGNATURE") {
+		cfg.VerifySignature = true
+	}
+	cfg.Signer = cfg.getenv("DAEMON_SIGNER")
+	if limit := cfg.getenv("DAEMON_DOWNLOAD_RATE_LIMIT"); limit != "" {
+		if cfg.DownloadRateLimit, err = parseRate(limit); err != nil {
+			return nil, errors.Wrapf(err, "parsing %s", cfg.envName("DAEMON_DOWNLOAD_RATE_LIMIT"))
+		}
+	}
+	cfg.SharedCache = cfg.getenv("DAEMON_SHARED_CACHE")
+	if cfg.enabled("DAEMON_DOWNLOAD_PATCHES") {
+		cfg.DownloadPatches = true
+	}
+	if connections := cfg.getenv("DAEMON_DOWNLOAD_CONNECTIONS"); connections != "" {
+		n, err := strconv.Atoi(connections)
+		if err != nil || n < 1 {
+			return nil, errors.Errorf("%s must be a number of connections, not %s", cfg.envName("DAEMON_DOWNLOAD_CONNECTIONS"), connections)
+		}
+		cfg.DownloadConnections = n
+	}
+	if size := cfg.getenv("DAEMON_DOWNLOAD_MAX_SIZE"); size != "" {
+		if cfg.DownloadMaxSize, err = parseByteSize(size); err != nil {
+			return nil, errors.Wrapf(err, "parsing %s", cfg.envName("DAEMON_DOWNLOAD_MAX_SIZE"))
+		}
+	}
+	cfg.IPFSGateway = cfg.getenv("DAEMON_IPFS_GATEWAY")
+	cfg.IPFSAPI = cfg.getenv("DAEMON_IPFS_API")
+	cfg.OCICredentials = cfg.getenv("DAEMON_OCI_CREDENTIALS")
+	if cfg.TorrentClient, err = splitArgs(cfg.getenv("DAEMON_TORRENT_CLIENT")); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", cfg.envName("DAEMON_TORRENT_CLIENT"))
+	}
+	if len(cfg.TorrentClient) == 0 {
+		cfg.TorrentClient = defaultTorrentClient
+	}
+	if cfg.DownloadMirrors, err = parseMirrors(cfg.getenv("DAEMON_DOWNLOAD_MIRRORS")); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", cfg.envName("DAEMON_DOWNLOAD_MIRRORS"))
+	}
+	if proxy := cfg.getenv("DAEMON_DOWNLOAD_SOCKS5_PROXY"); proxy != "" {
+		u, err := parseSocksProxy(proxy)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing %s", cfg.envName("DAEMON_DOWNLOAD_SOCKS5_PROXY"))
+		}
+		cfg.SocksProxy = u
+	}
+	if proxy := cfg.getenv("DAEMON_HTTP_PROXY"); proxy != "" {
+		if cfg.SocksProxy != nil {
+			return nil, errors.Errorf("%s and %s cannot both be set", cfg.envName("DAEMON_HTTP_PROXY"), cfg.envName("DAEMON_DOWNLOAD_SOCKS5_PROXY"))
+		}
+		u, err := parseHTTPProxy(proxy)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing %s", cfg.envName("DAEMON_HTTP_PROXY"))
+		}
+		cfg.HTTPProxy = u
+	}
+	cfg.BuildCommand = cfg.getenv("DAEMON_BUILD_COMMAND")
+	if _, err := splitArgs(cfg.BuildCommand); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", cfg.envName("DAEMON_BUILD_COMMAND"))
+	}
+	cfg.PreSwitchCommand = cfg.getenv("DAEMON_PRE_SWITCH_COMMAND")
+	if _, err := splitArgs(cfg.PreSwitchCommand); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", cfg.envName("DAEMON_PRE_SWITCH_COMMAND"))
+	}
+	cfg.PostUpgradeCommand = cfg.getenv("DAEMON_POST_UPGRADE_COMMAND")
+	if _, err := splitArgs(cfg.PostUpgradeCommand); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", cfg.envName("DAEMON_POST_UPGRADE_COMMAND"))
+	}
+	cfg.ToolchainProvider = cfg.getenv("DAEMON_TOOLCHAIN_PROVIDER")
+	if _, ok := toolchainProviders[cfg.ToolchainProvider]; cfg.ToolchainProvider != "" && !ok {
+		return nil, errors.Errorf("%s must be path, asdf or nix, not %s", cfg.envName("DAEMON_TOOLCHAIN_PROVIDER"), cfg.ToolchainProvider)
+	}
+	if cfg.DownloadHeaders, err = parseDownloadHeaders(cfg.getenv("DAEMON_DOWNLOAD_HEADERS")); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", cfg.envName("DAEMON_DOWNLOAD_HEADERS"))
+	}
+	cfg.GitHubToken = cfg.getenv("DAEMON_GITHUB_TOKEN")
+	cfg.GitHubAPI = cfg.getenv("DAEMON_GITHUB_API")
+	cfg.GitLabToken = cfg.getenv("DAEMON_GITLAB_TOKEN")
+	cfg.GiteaToken = cfg.getenv("DAEMON_GITEA_TOKEN")
+	if length := cfg.getenv("DAEMON_MAX_LINE_LENGTH"); length != "" {
+		size, err := parseByteSize(length)
+		if err != nil || size == 0 {
+			return nil, errors.Errorf("%s must be a positive size, not %s", cfg.envName("DAEMON_MAX_LINE_LENGTH"), length)
+		}
+		cfg.MaxLineLength = int(size)
+	}
+	if err := cfg.readTimings(); err != nil {
+		return nil, err
+	}
+	cfg.RPCAddress = cfg.getenv("DAEMON_RPC_ADDRESS")
+	disable, err := parseRPCDisable(cfg.getenv("DAEMON_RPC_DISABLE"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", cfg.envName("DAEMON_RPC_DISABLE"))
+	}
+	cfg.RPCDisable = disable
+	if cfg.HeightSources, err = parseHeightSources(cfg.getenv("DAEMON_HEIGHT_SOURCE")); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", cfg.envName("DAEMON_HEIGHT_SOURCE"))
+	}
+	cfg.ValidatorState = cfg.getenv("DAEMON_VALIDATOR_STATE_FILE")
+	if cfg.Detectors, err = parseDetectors(cfg.getenv("DAEMON_DETECTORS")); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", cfg.envName("DAEMON_DETECTORS"))
+	}
+	cfg.MetricsAddress = cfg.getenv("DAEMON_METRICS_ADDRESS")
+	cfg.AdminAddress = cfg.getenv("DAEMON_ADMIN_ADDRESS")
+	cfg.AdminToken = cfg.getenv("DAEMON_ADMIN_TOKEN")
+	if cfg.AdminAddress != "" && cfg.AdminToken == "" {
+		return nil, errors.Errorf("%s needs %s, anyone reaching the admin api could upgrade the node", cfg.envName("DAEMON_ADMIN_ADDRESS"),
+			cfg.envName("DAEMON_ADMIN_TOKEN"))
+	}
+	cfg.HealthAddress = cfg.getenv("DAEMON_HEALTH_ADDRESS")
+	cfg.PIDFile = cfg.getenv("DAEMON_PID_FILE")
+	cfg.ChildPIDFile = cfg.getenv("DAEMON_CHILD_PID_FILE")
+	if cfg.PIDFile != "" && cfg.PIDFile == cfg.ChildPIDFile {
+		return nil, errors.Errorf("%s and %s must be different files", cfg.envName("DAEMON_PID_FILE"), cfg.envName("DAEMON_CHILD_PID_FILE"))
+	}
+	switch cfg.LogColor = cfg.getenv("DAEMON_LOG_COLOR"); cfg.LogColor {
+	case "", "auto", "on", "off":
+	default:
+		return nil, errors.Errorf("%s must be auto, on or off, not %s", cfg.envName("DAEMON_LOG_COLOR"), cfg.LogColor)
+	}
+	if width := cfg.getenv("DAEMON_LOG_WIDTH"); width != "" {
+		n, err := strconv.Atoi(width)
+		if err != nil || n < 0 {
+			return nil, errors.Errorf("%s must be a number of columns, not %s", cfg.envName("DAEMON_LOG_WIDTH"), width)
+		}
+		cfg.LogWidth = n
+	}
+	for _, node := range strings.Split(cfg.getenv("DAEMON_FLEET_NODES"), ",") {
+		if node = strings.TrimSpace(node); node != "" {
+			cfg.FleetNodes = append(cfg.FleetNodes, node)
+		}
+	}
+	if err := cfg.leaseFromEnv(); err != nil {
+		return nil, err
+	}
+	cfg.NotifyCommand = cfg.getenv("DAEMON_NOTIFY_COMMAND")
+	if _, err := splitArgs(cfg.NotifyCommand); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", cfg.envName("DAEMON_NOTIFY_COMMAND"))
+	}
+	if dir := cfg.getenv("DAEMON_NOTIFY_TEMPLATES"); dir != "" {
+		tmpl, err := loadNotifyTemplates(dir)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing %s", cfg.envName("DAEMON_NOTIFY_TEMPLATES"))
+		}
+		cfg.NotifyTemplates = tmpl
+	}
+	links, err := parseLinks(cfg.getenv("DAEMON_NOTIFY_LINKS"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", cfg.envName("DAEMON_NOTIFY_LINKS"))
+	}
+	cfg.NotifyLinks = links
+	cfg.ChainID = cfg.getenv("DAEMON_CHAIN_ID")
+	cfg.NodeLabel = cfg.readNodeLabel()
+	if cfg.enabled("DAEMON_UNSAFE_SKIP_BACKUP") || cfg.enabled("UNSAFE_SKIP_BACKUP") {
+		cfg.UnsafeSkipBackup = true
+	}
+	if skip := cfg.getenv("DAEMON_UNSAFE_SKIP_UPGRADES"); skip != "" {
+		heights, err := parseSkipUpgrades(skip)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing %s", cfg.envName("DAEMON_UNSAFE_SKIP_UPGRADES"))
+		}
+		cfg.UnsafeSkipUpgrades = heights
+	}
+	if minFree := cfg.getenv("DAEMON_PRUNE_MIN_FREE"); minFree != "" {
+		size, err := parseByteSize(minFree)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing %s", cfg.envName("DAEMON_PRUNE_MIN_FREE"))
+		}
+		cfg.PruneMinFree = size
+	}
+	if file := cfg.getenv("DAEMON_FATAL_PATTERNS_FILE"); file != "" {
+		patterns, err := loadFatalPatterns(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing %s", cfg.envName("DAEMON_FATAL_PATTERNS_FILE"))
+		}
+		cfg.FatalPatterns = patterns
+	}
+	switch cfg.ConsensusFailure = cfg.getenv("DAEMON_CONSENSUS_FAILURE"); cfg.ConsensusFailure {
+	case "", "halt", "alert", "off":
+	default:
+		return nil, errors.Errorf("%s must be halt, alert or off, not %s", cfg.envName("DAEMON_CONSENSUS_FAILURE"), cfg.ConsensusFailure)
+	}
+	switch cfg.StallAction = cfg.getenv("DAEMON_STALL_ACTION"); cfg.StallAction {
+	case "":
+		cfg.StallAction = "alert"
+	case "alert", "restart", "both":
+	default:
+		return nil, errors.Errorf("%s must be alert, restart or both, not %s", cfg.envName("DAEMON_STALL_ACTION"), cfg.StallAction)
+	}
+	if name := cfg.getenv("DAEMON_SHUTDOWN_SIGNAL"); name != "" {
+		if cfg.ShutdownSignal, err = parseSignal(name); err != nil {
+			return nil, errors.Wrapf(err, "parsing %s", cfg.envName("DAEMON_SHUTDOWN_SIGNAL"))
+		}
+	}
+	if file := cfg.getenv("DAEMON_STOP_MARKERS_FILE"); file != "" {
+		markers, err := loadPatterns(file, "stop marker")
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing %s", cfg.envName("DAEMON_STOP_MARKERS_FILE"))
+		}
+		cfg.StopMarkers = markers
+	}
+	if err := cfg.validateSettings(); err != nil {
 		return nil, err
 	}
 	return cfg, nil
 }
 
+// envName returns the name of the variable we read for the setting name,
+// eg. GAIA_DAEMON_HOME for DAEMON_HOME with COSMOSD_ENV_PREFIX=GAIA
+func (cfg *Config) envName(name string) string {
+	if cfg.EnvPrefix == "" {
+		return name
+	}
+	return cfg.EnvPrefix + "_" + name
+}
+
+// getenv reads the (possibly prefixed) variable for the setting name
+func (cfg *Config) getenv(name string) string {
+	return os.Getenv(cfg.envName(name))
+}
+
+// leaseFromEnv reads the optional lease settings
+func (cfg *Config) leaseFromEnv() error {
+	cfg.LeaseFile = cfg.getenv("DAEMON_LEASE_FILE")
+	cfg.LeaseCommand = cfg.getenv("DAEMON_LEASE_COMMAND")
+	if _, err := splitArgs(cfg.LeaseCommand); err != nil {
+		return errors.Wrapf(err, "parsing %s", cfg.envName("DAEMON_LEASE_COMMAND"))
+	}
+	cfg.LeaseReleaseCommand = cfg.getenv("DAEMON_LEASE_RELEASE_COMMAND")
+	if _, err := splitArgs(cfg.LeaseReleaseCommand); err != nil {
+		return errors.Wrapf(err, "parsing %s", cfg.envName("DAEMON_LEASE_RELEASE_COMMAND"))
+	}
+	if cfg.LeaseReleaseCommand != "" && cfg.LeaseCommand == "" {
+		return errors.Errorf("%s needs %s", cfg.envName("DAEMON_LEASE_RELEASE_COMMAND"), cfg.envName("DAEMON_LEASE_COMMAND"))
+	}
+	cfg.LeaseOwner = cfg.getenv("DAEMON_LEASE_OWNER")
+	if cfg.LeaseOwner == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return errors.Wrapf(err, "%s not set and cannot read hostname", cfg.envName("DAEMON_LEASE_OWNER"))
+		}
+		cfg.LeaseOwner = host
+	}
+	if !cfg.HasLease() {
+		return nil
+	}
+	instance, err := newLeaseInstance()
+	if err != nil {
+		return err
+	}
+	cfg.LeaseInstance = instance
+	keyFile := cfg.getenv("DAEMON_VALIDATOR_KEY_FILE")
+	if keyFile == "" {
+		keyFile = filepath.Join(cfg.Home, "config", "priv_validator_key.json")
+	}
+	if cfg.LeaseKey, err = readValidatorKey(keyFile); err != nil {
+		return errors.Wrapf(err, "parsing %s", cfg.envName("DAEMON_VALIDATOR_KEY_FILE"))
+	}
+	return nil
+}
+
 // validate returns an error if this config is invalid.
 // it enforces Home/upgrade_manager is a valid directory and exists,
 // and that Name is set
 func (cfg *Config) validate() error {
-	if cfg.Name == "" {
-		return errors.New("DAEMON_NAME is not set")
-	}
-	if cfg.Home == "" {
-		return errors.New("DAEMON_HOME is not set")
-	}
-
-	if !filepath.IsAbs(cfg.Home) {
-		return errors.New("DAEMON_HOME must be an absolute path")
+	if err := cfg.validateSettings(); err != nil {
+		return err
 	}
 
 	// ensure the root directory exists
@@ -110,6 +777,36 @@ func (cfg *Config) validate() error {
 	if !info.IsDir() {
 		return errors.Errorf("%s is not a directory", info.Name())
 	}
+	// rather than finding a typo at the upgrade height
+	_, err = cfg.PlannedUpgrades()
+	return err
+}
+
+// validateSettings checks everything but the directory layout, which doesn't exist before init
+func (cfg *Config) validateSettings() error {
+	if cfg.Name == "" {
+		return errors.Errorf("%s is not set", cfg.envName("DAEMON_NAME"))
+	}
+	if cfg.Home == "" {
+		return errors.Errorf("%s is not set", cfg.envName("DAEMON_HOME"))
+	}
+
+	if !filepath.IsAbs(cfg.Home) {
+		return errors.Errorf("%s must be an absolute path", cfg.envName("DAEMON_HOME"))
+	}
+
+	if cfg.HasLease() && cfg.LeaseTTL <= 0 {
+		return errors.Errorf("%s must be positive", cfg.envName("DAEMON_LEASE_TTL"))
+	}
+
+	if cfg.ConfirmHeight && len(cfg.NewHeights().sources) == 0 {
+		return errors.Errorf("%s needs a height source, %s lists only the rpc but %s is not set", cfg.envName("DAEMON_CONFIRM_HEIGHT"),
+			cfg.envName("DAEMON_HEIGHT_SOURCE"), cfg.envName("DAEMON_RPC_ADDRESS"))
+	}
+
+	if len(cfg.StopMarkers) > 0 && cfg.ShutdownGrace <= 0 {
+		return errors.Errorf("%s needs %s, the longest we wait for them", cfg.envName("DAEMON_STOP_MARKERS_FILE"), cfg.envName("DAEMON_SHUTDOWN_GRACE"))
+	}
 
 	return nil
 }
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"os"
 	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestConfigPaths(t *testing.T) {
@@ -127,3 +129,82 @@ func TestEnsureBin(t *testing.T) {
 		})
 	}
 }
+
+func TestGetConfigFromEnvPrefix(t *testing.T) {
+	home, err := filepath.Abs(filepath.Join("testdata", "validate"))
+	require.NoError(t, err)
+
+	defer setEnv(map[string]string{
+		"COSMOSD_ENV_PREFIX":                  "GAIA",
+		"GAIA_DAEMON_HOME":                    home,
+		"GAIA_DAEMON_NAME":                    "gaiad",
+		"GAIA_DAEMON_RESTART_AFTER_UPGRADE":   "on",
+		"DAEMON_HOME":                         "/some/other/home",
+		"DAEMON_NAME":                         "otherd",
+		"DAEMON_ALLOW_DOWNLOAD_BINARIES":      "on",
+		"GAIA_DAEMON_ALLOW_DOWNLOAD_BINARIES": "",
+		"GAIA_DAEMON_ARGS":                    " start  --x-crisis-skip-assert-invariants ",
+	})()
+
+	cfg, err := GetConfigFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, home, cfg.Home)
+	assert.Equal(t, "gaiad", cfg.Name)
+	assert.True(t, cfg.RestartAfterUpgrade)
+	assert.False(t, cfg.AllowDownloadBinaries)
+
+	// default args are only used if we got none
+	defaults := []string{"start", "--x-crisis-skip-assert-invariants"}
+	assert.Equal(t, defaults, cfg.ChildArgs(nil))
+	assert.Equal(t, []string{"version"}, cfg.ChildArgs([]string{"version"}))
+
+	// quoted args stay one argument
+	os.Setenv("GAIA_DAEMON_ARGS", `start --moniker "my node" --log_format='json'`)
+	cfg, err = GetConfigFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"start", "--moniker", "my node", "--log_format=json"}, cfg.DefaultArgs)
+	os.Setenv("GAIA_DAEMON_ARGS", `start --moniker "my node`)
+	_, err = GetConfigFromEnv()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "GAIA_DAEMON_ARGS")
+	os.Setenv("GAIA_DAEMON_ARGS", "")
+
+	// no admin api without a token
+	os.Setenv("GAIA_DAEMON_ADMIN_ADDRESS", "localhost:9111")
+	defer os.Unsetenv("GAIA_DAEMON_ADMIN_ADDRESS")
+	_, err = GetConfigFromEnv()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "GAIA_DAEMON_ADMIN_TOKEN")
+	os.Setenv("GAIA_DAEMON_ADMIN_TOKEN", "s3cret")
+	defer os.Unsetenv("GAIA_DAEMON_ADMIN_TOKEN")
+	_, err = GetConfigFromEnv()
+	require.NoError(t, err)
+
+	// errors refer to the variable we actually read
+	os.Setenv("GAIA_DAEMON_NAME", "")
+	_, err = GetConfigFromEnv()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "GAIA_DAEMON_NAME")
+}
+
+// setEnv sets all the given variables and returns a function to restore the previous environment
+func setEnv(vars map[string]string) func() {
+	prev := make(map[string]*string, len(vars))
+	for k, v := range vars {
+		if old, ok := os.LookupEnv(k); ok {
+			prev[k] = &old
+		} else {
+			prev[k] = nil
+		}
+		os.Setenv(k, v)
+	}
+	return func() {
+		for k, v := range prev {
+			if v == nil {
+				os.Unsetenv(k)
+			} else {
+				os.Setenv(k, *v)
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DownloadHeader is sent with every download from Host, eg. the credentials of a private release server
+type DownloadHeader struct {
+	Host  string
+	Name  string
+	Value string
+}
+
+// parseDownloadHeaders reads host=Name: value pairs, separated by commas, eg.
+// artifacts.example.com=Authorization: Bearer s3cret
+func parseDownloadHeaders(value string) ([]DownloadHeader, error) {
+	var headers []DownloadHeader
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, errors.Errorf("%s is not host=Name: value", pair)
+		}
+		header := strings.SplitN(kv[1], ":", 2)
+		if len(header) != 2 || strings.TrimSpace(header[0]) == "" {
+			return nil, errors.Errorf("%s is not host=Name: value", pair)
+		}
+		headers = append(headers, DownloadHeader{
+			Host:  strings.TrimSpace(kv[0]),
+			Name:  http.CanonicalHeaderKey(strings.TrimSpace(header[0])),
+			Value: strings.TrimSpace(header[1]),
+		})
+	}
+	return headers, nil
+}
+
+// downloadHeaders are DAEMON_DOWNLOAD_HEADERS, and the token for the assets of private GitHub releases, which are
+// downloaded from the api
+func (cfg *Config) downloadHeaders() []DownloadHeader {
+	headers := append([]DownloadHeader{}, cfg.DownloadHeaders...)
+	if cfg.GitHubToken != "" {
+		api := cfg.GitHubAPI
+		if api == "" {
+			api = defaultGitHubAPI
+		}
+		if u, err := url.Parse(api); err == nil {
+			headers = append(headers,
+				DownloadHeader{Host: u.Host, Name: "Authorization", Value: "Bearer " + cfg.GitHubToken},
+				DownloadHeader{Host: u.Host, Name: "Accept", Value: "application/octet-stream"},
+			)
+		}
+	}
+	return headers
+}
+
+// headerTransport adds the headers of the host to every request to it. They are never sent to another host, not even
+// the one a request is redirected to (eg. a signed url of a storage bucket), and never replace a header of the request.
+type headerTransport struct {
+	base    http.RoundTripper
+	headers []DownloadHeader
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var add []DownloadHeader
+	for _, h := range t.headers {
+		if (strings.EqualFold(h.Host, req.URL.Host) || strings.EqualFold(h.Host, req.URL.Hostname())) && req.Header.Get(h.Name) == "" {
+			add = append(add, h)
+		}
+	}
+	if len(add) == 0 {
+		return t.base.RoundTrip(req)
+	}
+	// a RoundTripper must not change the request it is given
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+len(add))
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	for _, h := range add {
+		r.Header.Add(h.Name, h.Value)
+	}
+	return t.base.RoundTrip(r)
+}
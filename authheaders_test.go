@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	getter "github.com/hashicorp/go-getter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDownloadHeaders(t *testing.T) {
+	headers, err := parseDownloadHeaders(" artifacts.example.com=authorization: Bearer s3cret, artifacts.example.com:8443=X-JFrog-Art-Api:key ,")
+	require.NoError(t, err)
+	assert.Equal(t, []DownloadHeader{
+		{Host: "artifacts.example.com", Name: "Authorization", Value: "Bearer s3cret"},
+		{Host: "artifacts.example.com:8443", Name: "X-Jfrog-Art-Api", Value: "key"},
+	}, headers)
+
+	headers, err = parseDownloadHeaders("")
+	require.NoError(t, err)
+	assert.Empty(t, headers)
+	_, err = parseDownloadHeaders("artifacts.example.com")
+	assert.Error(t, err)
+	_, err = parseDownloadHeaders("artifacts.example.com=Bearer s3cret")
+	assert.Error(t, err)
+	_, err = parseDownloadHeaders("=Authorization: Bearer s3cret")
+	assert.Error(t, err)
+}
+
+func TestDownloadHeaders(t *testing.T) {
+	var mutex sync.Mutex
+	leaked := ""
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		leaked = r.Header.Get("Authorization")
+		mutex.Unlock()
+		w.Write([]byte("#!/bin/sh\necho private\n"))
+	}))
+	defer storage.Close()
+	// the private server redirects to a signed url of its storage, on another host
+	private := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		http.Redirect(w, r, storage.URL+"/signed/autod", http.StatusFound)
+	}))
+	defer private.Close()
+	dir, err := ioutil.TempDir("", "headers-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	u, err := url.Parse(private.URL)
+	require.NoError(t, err)
+	dest := filepath.Join(dir, "autod")
+	assert.Error(t, getter.GetFile(dest, private.URL+"/autod", (&Config{}).getterOptions()...))
+
+	cfg := &Config{DownloadHeaders: []DownloadHeader{{Host: u.Host, Name: "Authorization", Value: "Bearer s3cret"}}}
+	require.NoError(t, getter.GetFile(dest, private.URL+"/autod", cfg.getterOptions()...))
+	bz, err := ioutil.ReadFile(dest)
+	require.NoError(t, err)
+	assert.Equal(t, "#!/bin/sh\necho private\n", string(bz))
+	assert.Empty(t, leaked)
+
+	// the GitHub token goes to the api only
+	cfg = &Config{GitHubToken: "t0ken", GitHubAPI: "https://github.example.com/api/v3"}
+	assert.Equal(t, []DownloadHeader{
+		{Host: "github.example.com", Name: "Authorization", Value: "Bearer t0ken"},
+		{Host: "github.example.com", Name: "Accept", Value: "application/octet-stream"},
+	}, cfg.downloadHeaders())
+}
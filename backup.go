@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const backupsDir = "backups"
+
+// DataDir is the application data of the daemon, which we back up before every upgrade
+func (cfg *Config) DataDir() string {
+	return filepath.Join(cfg.Home, "data")
+}
+
+// skipBackupEnv names the variable backups are skipped with, DAEMON_UNSAFE_SKIP_BACKUP or cosmovisor's UNSAFE_SKIP_BACKUP
+func (cfg *Config) skipBackupEnv() string {
+	if !cfg.enabled("DAEMON_UNSAFE_SKIP_BACKUP") && cfg.enabled("UNSAFE_SKIP_BACKUP") {
+		return cfg.envName("UNSAFE_SKIP_BACKUP")
+	}
+	return cfg.envName("DAEMON_UNSAFE_SKIP_BACKUP")
+}
+
+// BackupData copies the data dir to backups/<upgrade>-<time>, so a failed migration can be rolled back.
+// It does nothing if there is no data dir, and only warns if backups are disabled.
+func (cfg *Config) BackupData(upgradeName string) error {
+	if cfg.UnsafeSkipBackup {
+		cfg.Notify(Event{
+			Type:    "backup_skipped",
+			Message: fmt.Sprintf("WARNING: not backing up %s before upgrade %s, %s is on", cfg.DataDir(), upgradeName, cfg.skipBackupEnv()),
+			Fields:  map[string]string{"UPGRADE": upgradeName},
+		})
+		return nil
+	}
+	if _, err := os.Stat(cfg.DataDir()); os.IsNotExist(err) {
+		return nil
+	}
+
+	name := fmt.Sprintf("%s-%s", upgradeName, time.Now().UTC().Format("20060102T150405Z"))
+	dest := filepath.Join(cfg.Root(), backupsDir, url.PathEscape(name))
+	logger.Printf("backing up %s to %s", cfg.DataDir(), dest)
+	if err := copyDir(cfg.DataDir(), dest); err != nil {
+		os.RemoveAll(dest)
+		return errors.Wrap(err, "backing up data")
+	}
+	return nil
+}
+
+// copyDir recursively copies src to dest, keeping file modes and symlinks
+func copyDir(src, dest string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return copyFile(path, target, info.Mode().Perm())
+		default:
+			// sockets, devices, etc have no business in a data dir
+			return nil
+		}
+	})
+}
+
+func copyFile(src, dest string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSkipBackupEnv(t *testing.T) {
+	defer setEnv(map[string]string{"DAEMON_UNSAFE_SKIP_BACKUP": "", "UNSAFE_SKIP_BACKUP": "", "GAIA_DAEMON_UNSAFE_SKIP_BACKUP": "on"})()
+	assert.Equal(t, "DAEMON_UNSAFE_SKIP_BACKUP", (&Config{}).skipBackupEnv())
+	assert.Equal(t, "GAIA_DAEMON_UNSAFE_SKIP_BACKUP", (&Config{EnvPrefix: "GAIA"}).skipBackupEnv())
+
+	// the cosmovisor name, if only that is set
+	os.Setenv("UNSAFE_SKIP_BACKUP", "true")
+	assert.Equal(t, "UNSAFE_SKIP_BACKUP", (&Config{}).skipBackupEnv())
+	os.Setenv("DAEMON_UNSAFE_SKIP_BACKUP", "on")
+	assert.Equal(t, "DAEMON_UNSAFE_SKIP_BACKUP", (&Config{}).skipBackupEnv())
+}
+
+func TestBackupData(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+	backups := filepath.Join(cfg.Root(), backupsDir)
+
+	// no data yet, nothing to back up
+	require.NoError(t, cfg.BackupData("chain2"))
+	_, err = os.Stat(backups)
+	assert.True(t, os.IsNotExist(err))
+
+	require.NoError(t, os.MkdirAll(filepath.Join(cfg.DataDir(), "application.db"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.DataDir(), "application.db", "000001.log"), []byte("state"), 0600))
+	require.NoError(t, os.Symlink("application.db", filepath.Join(cfg.DataDir(), "app")))
+
+	// skipping leaves nothing behind
+	cfg.UnsafeSkipBackup = true
+	require.NoError(t, cfg.BackupData("chain2"))
+	_, err = os.Stat(backups)
+	assert.True(t, os.IsNotExist(err))
+
+	cfg.UnsafeSkipBackup = false
+	require.NoError(t, cfg.BackupData("chain 2"))
+	dirs, err := ioutil.ReadDir(backups)
+	require.NoError(t, err)
+	require.Len(t, dirs, 1)
+	assert.Regexp(t, `^chain%202-\d{8}T\d{6}Z$`, dirs[0].Name())
+
+	backup := filepath.Join(backups, dirs[0].Name())
+	bz, err := ioutil.ReadFile(filepath.Join(backup, "application.db", "000001.log"))
+	require.NoError(t, err)
+	assert.Equal(t, "state", string(bz))
+	info, err := os.Stat(filepath.Join(backup, "application.db", "000001.log"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	link, err := os.Readlink(filepath.Join(backup, "app"))
+	require.NoError(t, err)
+	assert.Equal(t, "application.db", link)
+}
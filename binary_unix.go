@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// exeSuffix is what the name of a binary ends in
+	exeSuffix = ""
+	// defaultSwitchMode is how current is switched unless DAEMON_SWITCH_MODE is set
+	defaultSwitchMode = "symlink"
+)
+
+// checkExecutable returns an error unless anyone may run the file at path
+func checkExecutable(path string, info os.FileInfo) error {
+	// this checks if the world-executable bit is set (we cannot check owner easily)
+	if info.Mode().Perm()&0001 == 0 {
+		return errors.Errorf("%s is not world executable", info.Name())
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// exeSuffix is what the name of a binary ends in
+	exeSuffix = ".exe"
+	// symlinks take an administrator (or developer mode) on windows, a pointer file works for everyone
+	defaultSwitchMode = "pointer"
+)
+
+// checkExecutable returns an error unless windows runs the file at path, which has no exec bits but goes by the extension
+func checkExecutable(path string, info os.FileInfo) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".exe", ".com", ".bat", ".cmd":
+		return nil
+	}
+	return errors.Errorf("%s is not an executable (.exe)", info.Name())
+}
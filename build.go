@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// UpgradeSource is the git checkout a binary can be built from
+type UpgradeSource struct {
+	Repo string `json:"repo"`
+	Tag  string `json:"tag"`
+	// Commit optionally pins the tag to a (full or abbreviated) commit hash
+	Commit string `json:"commit,omitempty"`
+	// Toolchain optionally pins the go version and make targets
+	Toolchain *Toolchain `json:"toolchain,omitempty"`
+}
+
+// errNoArtifact is the cause of all errors about there being no prebuilt binary for this platform
+var errNoArtifact = errors.New("no prebuilt binary")
+
+// BuildSource returns the source to build from, if the upgrade info names one, or the binary is
+// a release reference (which is built from its tag)
+func (c *UpgradeConfig) BuildSource(binary string) *UpgradeSource {
+	if c.Source != nil {
+		return c.Source
+	}
+	if !isReleaseRef(binary) {
+		return nil
+	}
+	ref, err := ParseReleaseRef(binary)
+	if err != nil {
+		return nil
+	}
+	host := ref.Host
+	if host == "" {
+		host = "github.com"
+	}
+	return &UpgradeSource{Repo: "https://" + host + "/" + ref.Repo + ".git", Tag: ref.Tag}
+}
+
+// BuildBinary checks out the tag of source, runs the build command in it and stages the result as the
+// named upgrade. The build command must place the binary in $COSMOSD_BUILD_OUTPUT (which is also set as
+// GOBIN, so `make install` works for most chains).
+func (cfg *Config) BuildBinary(upgradeName string, source *UpgradeSource) error {
+	if source.Repo == "" || source.Tag == "" {
+		return errors.New("source needs a repo and a tag to build")
+	}
+	workspace, err := ioutil.TempDir("", "upgrade-manager-build")
+	if err != nil {
+		return errors.Wrap(err, "create build workspace")
+	}
+	defer os.RemoveAll(workspace)
+	checkout := filepath.Join(workspace, "src")
+
+	command := cfg.BuildCommand
+	if source.Toolchain != nil && len(source.Toolchain.MakeTargets) > 0 {
+		command = quoteArgs(append([]string{"make"}, source.Toolchain.MakeTargets...))
+	}
+	path, err := cfg.PrepareToolchain(source.Toolchain)
+	if err != nil {
+		return err
+	}
+
+	logger.Printf("building %s from %s at %s", upgradeName, source.Repo, source.Tag)
+	if _, err := git("", "-c", "advice.detachedHead=false", "clone", "--quiet", "--depth", "1", "--branch", source.Tag, "--", source.Repo, checkout); err != nil {
+		return err
+	}
+	commit, err := git(checkout, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	if source.Commit != "" && !strings.HasPrefix(commit, strings.ToLower(source.Commit)) {
+		return errors.Errorf("tag %s is at commit %s, not the pinned %s", source.Tag, commit, source.Commit)
+	}
+
+	// stage next to the upgrades, so the result can be moved in place
+	if err := os.MkdirAll(filepath.Join(cfg.Root(), upgradesDir), 0755); err != nil {
+		return errors.Wrap(err, "creating upgrades dir")
+	}
+	stage, err := ioutil.TempDir(filepath.Join(cfg.Root(), upgradesDir), ".build-")
+	if err != nil {
+		return errors.Wrap(err, "create build stage")
+	}
+	defer os.RemoveAll(stage)
+	output := filepath.Join(stage, "bin")
+	if err := os.Mkdir(output, 0755); err != nil {
+		return errors.Wrap(err, "create build stage")
+	}
+
+	env := map[string]string{
+		"PATH":                 path,
+		"GOBIN":                output,
+		"COSMOSD_BUILD_OUTPUT": output,
+		"COSMOSD_UPGRADE_NAME": upgradeName,
+		"COSMOSD_TAG":          source.Tag,
+		"COSMOSD_COMMIT":       commit,
+	}
+	if err := runHookIn(checkout, command, env); err != nil {
+		return errors.Wrap(err, "building binary")
+	}
+	bin := filepath.Join(output, cfg.binName())
+	if err := EnsureBinary(bin); err != nil {
+		return errors.Wrapf(err, "build did not produce %s", cfg.Name)
+	}
+	hash, err := sha256File(bin)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(stage, 0755); err != nil {
+		return errors.Wrap(err, "staging build")
+	}
+	if err := os.Rename(stage, cfg.UpgradeDir(upgradeName)); err != nil {
+		return errors.Wrap(err, "staging build")
+	}
+
+	return cfg.RecordHistory(HistoryEntry{
+		Type:    "built",
+		Upgrade: upgradeName,
+		Fields:  map[string]string{"repo": source.Repo, "tag": source.Tag, "commit": commit, "sha256": hash, "command": command},
+	})
+}
+
+// git runs git in dir (if not empty) and returns its trimmed stdout
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	// never wait for credentials on a terminal nobody is looking at
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "running git %s", quoteArgs(args))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// makeSourceRepo creates a git repo with a build script (and make target) for dummyd, tagged v1.0.0, and returns its commit
+func makeSourceRepo(t *testing.T, dir string) string {
+	script := "#!/bin/sh\nprintf '#!/bin/sh\\necho built from source\\n' > \"$COSMOSD_BUILD_OUTPUT/dummyd\"\nchmod 755 \"$COSMOSD_BUILD_OUTPUT/dummyd\"\n"
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "build.sh"), []byte(script), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "Makefile"), []byte("release:\n\tsh build.sh\n"), 0644))
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"add", "build.sh", "Makefile"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--quiet", "-m", "release"},
+		{"tag", "v1.0.0"},
+	} {
+		out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+	commit, err := git(dir, "rev-parse", "HEAD")
+	require.NoError(t, err)
+	return commit
+}
+
+func TestBuildFromSource(t *testing.T) {
+	repo, err := ioutil.TempDir("", "source")
+	require.NoError(t, err)
+	defer os.RemoveAll(repo)
+	commit := makeSourceRepo(t, repo)
+
+	cases := map[string]struct {
+		buildCommand string
+		pin          string
+		toolchain    string
+		canBuild     bool
+	}{
+		"builds": {
+			buildCommand: "sh build.sh",
+			canBuild:     true,
+		},
+		"pinned commit": {
+			buildCommand: "sh build.sh",
+			pin:          commit[:12],
+			canBuild:     true,
+		},
+		"wrong pin": {
+			buildCommand: "sh build.sh",
+			pin:          "0123456789abcdef",
+		},
+		"make targets": {
+			buildCommand: "false",
+			toolchain:    `{"make_targets":["release"]}`,
+			canBuild:     true,
+		},
+		"building disabled": {},
+		"build fails": {
+			buildCommand: "false",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			home, err := copyTestData("validate")
+			require.NoError(t, err)
+			defer os.RemoveAll(home)
+			cfg := &Config{Home: home, Name: "dummyd", AllowDownloadBinaries: true, BuildCommand: tc.buildCommand}
+
+			toolchain := tc.toolchain
+			if toolchain == "" {
+				toolchain = "null"
+			}
+			info := &UpgradeInfo{
+				Name:   "v1",
+				Height: 123,
+				Info:   fmt.Sprintf(`{"binaries":{},"source":{"repo":"file://%s","tag":"v1.0.0","commit":"%s","toolchain":%s}}`, filepath.ToSlash(repo), tc.pin, toolchain),
+			}
+			err = DownloadBinary(cfg, info)
+			if !tc.canBuild {
+				require.Error(t, err)
+				_, err := os.Stat(cfg.UpgradeDir("v1"))
+				assert.True(t, os.IsNotExist(err))
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, EnsureBinary(cfg.UpgradeBin("v1")))
+			out, err := exec.Command(cfg.UpgradeBin("v1")).Output()
+			require.NoError(t, err)
+			assert.Equal(t, "built from source\n", string(out))
+
+			history, err := cfg.History()
+			require.NoError(t, err)
+			require.Len(t, history, 1)
+			assert.Equal(t, "built", history[0].Type)
+			assert.Equal(t, "v1", history[0].Upgrade)
+			assert.Equal(t, commit, history[0].Fields["commit"])
+			assert.Equal(t, "v1.0.0", history[0].Fields["tag"])
+		})
+	}
+}
+
+func TestBuildSource(t *testing.T) {
+	cases := map[string]struct {
+		config UpgradeConfig
+		binary string
+		expect *UpgradeSource
+	}{
+		"explicit": {
+			config: UpgradeConfig{Source: &UpgradeSource{Repo: "https://example.com/chain.git", Tag: "v2"}},
+			binary: "github://cosmos/gaia@v4.2.1",
+			expect: &UpgradeSource{Repo: "https://example.com/chain.git", Tag: "v2"},
+		},
+		"github release": {
+			binary: "github://cosmos/gaia@v4.2.1",
+			expect: &UpgradeSource{Repo: "https://github.com/cosmos/gaia.git", Tag: "v4.2.1"},
+		},
+		"gitlab release": {
+			binary: "gitlab://gitlab.example.com/group/chain@v2",
+			expect: &UpgradeSource{Repo: "https://gitlab.example.com/group/chain.git", Tag: "v2"},
+		},
+		"plain url": {
+			binary: "https://example.com/gaiad",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expect, tc.config.BuildSource(tc.binary))
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+const cacheDir = "cache"
+
+// CacheDir is where downloaded files are stored by their sha256 hash
+func (cfg *Config) CacheDir() string {
+	return filepath.Join(cfg.Root(), cacheDir, "sha256")
+}
+
+// AddToCache moves every regular file under dir into the content addressed cache and
+// leaves a hard link in its place. Identical files of different upgrades end up sharing
+// one copy on disk.
+func (cfg *Config) AddToCache(dir string) error {
+	if err := os.MkdirAll(cfg.CacheDir(), 0755); err != nil {
+		return errors.Wrap(err, "creating cache dir")
+	}
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		hash, err := sha256File(path)
+		if err != nil {
+			return err
+		}
+		cached := filepath.Join(cfg.CacheDir(), hash)
+		cachedInfo, err := os.Stat(cached)
+		if os.IsNotExist(err) {
+			// first time we see it, the cache entry is just another name for this file
+			return errors.Wrap(os.Link(path, cached), "adding to cache")
+		}
+		if err != nil {
+			return errors.Wrap(err, "checking cache")
+		}
+		if os.SameFile(info, cachedInfo) {
+			return nil
+		}
+		// we have it, so replace the file with a link. Link and rename, so path is never missing
+		tmp := path + ".cache"
+		if err := os.Link(cached, tmp); err != nil {
+			return errors.Wrap(err, "linking from cache")
+		}
+		return errors.Wrap(os.Rename(tmp, path), "linking from cache")
+	})
+}
+
+// CleanCache removes all files from the cache which are no longer linked from any upgrade
+func (cfg *Config) CleanCache() error {
+	files, err := ioutil.ReadDir(cfg.CacheDir())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "listing cache")
+	}
+	for _, info := range files {
+		if info.Mode().IsRegular() && linkCount(filepath.Join(cfg.CacheDir(), info.Name()), info) == 1 {
+			if err := os.Remove(filepath.Join(cfg.CacheDir(), info.Name())); err != nil {
+				return errors.Wrap(err, "cleaning cache")
+			}
+		}
+	}
+	return nil
+}
+
+// VerifyCache re-hashes every file in the cache and returns the names of those
+// which no longer match their hash
+func (cfg *Config) VerifyCache() ([]string, error) {
+	var corrupt []string
+	err := filepath.Walk(cfg.CacheDir(), func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == cfg.CacheDir() {
+			// nothing downloaded yet
+			return nil
+		}
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		hash, err := sha256File(path)
+		if err != nil {
+			return err
+		}
+		if hash != info.Name() {
+			corrupt = append(corrupt, info.Name())
+		}
+		return nil
+	})
+	return corrupt, err
+}
+
+// sha256File returns the hex encoded sha256 hash of the file
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", errors.Wrap(err, "opening file to hash")
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", errors.Wrapf(err, "hashing %s", path)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
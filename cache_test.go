@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddToCache(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+
+	// nothing there yet is fine
+	corrupt, err := cfg.VerifyCache()
+	require.NoError(t, err)
+	assert.Empty(t, corrupt)
+
+	// two upgrades with the same binary
+	src := filepath.Join("testdata", "repo", "raw_binary", "autod")
+	hash, err := sha256File(src)
+	require.NoError(t, err)
+	assert.Equal(t, "e6bc7851600a2a9917f7bf88eb7bdee1ec162c671101485690b4deb089077b0d", hash)
+	bz, err := ioutil.ReadFile(src)
+	require.NoError(t, err)
+	for _, name := range []string{"chain2", "chain3"} {
+		require.NoError(t, ioutil.WriteFile(cfg.UpgradeBin(name), bz, 0755))
+		require.NoError(t, cfg.AddToCache(cfg.UpgradeDir(name)))
+	}
+
+	// they are now the same file on disk
+	cached, err := os.Stat(filepath.Join(cfg.CacheDir(), hash))
+	require.NoError(t, err)
+	for _, name := range []string{"chain2", "chain3"} {
+		info, err := os.Stat(cfg.UpgradeBin(name))
+		require.NoError(t, err)
+		assert.True(t, os.SameFile(cached, info), name)
+		assert.NoError(t, EnsureBinary(cfg.UpgradeBin(name)))
+	}
+
+	// adding again changes nothing
+	require.NoError(t, cfg.AddToCache(cfg.UpgradeDir("chain2")))
+	corrupt, err = cfg.VerifyCache()
+	require.NoError(t, err)
+	assert.Empty(t, corrupt)
+
+	// the cache keeps files as long as an upgrade uses them
+	require.NoError(t, os.Remove(cfg.UpgradeBin("chain2")))
+	require.NoError(t, cfg.CleanCache())
+	_, err = os.Stat(filepath.Join(cfg.CacheDir(), hash))
+	require.NoError(t, err)
+
+	// changing one of them on disk is detected
+	require.NoError(t, ioutil.WriteFile(cfg.UpgradeBin("chain3"), []byte("#!/bin/sh\necho evil\n"), 0755))
+	corrupt, err = cfg.VerifyCache()
+	require.NoError(t, err)
+	assert.Equal(t, []string{hash}, corrupt)
+
+	// and once nothing uses it, it is gone
+	require.NoError(t, os.Remove(cfg.UpgradeBin("chain3")))
+	require.NoError(t, cfg.CleanCache())
+	_, err = os.Stat(filepath.Join(cfg.CacheDir(), hash))
+	assert.True(t, os.IsNotExist(err))
+}
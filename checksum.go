@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	getter "github.com/hashicorp/go-getter"
+	"github.com/pkg/errors"
+)
+
+// ChecksumFromManifest looks up the artifact in the SHA256SUMS manifest and returns the artifact url
+// with the matching ?checksum= set, so go-getter verifies the download.
+// If a keyring is configured, the detached signature (manifest url + .asc) must verify as well.
+func (cfg *Config) ChecksumFromManifest(artifact, manifest string, opts ...getter.ClientOption) (string, error) {
+	tmpDir, err := ioutil.TempDir("", "upgrade-manager-manifest")
+	if err != nil {
+		return "", errors.Wrap(err, "create tempdir for manifest")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	sumsPath := filepath.Join(tmpDir, "SHA256SUMS")
+	source, err := sourceURL(manifest)
+	if err != nil {
+		return "", err
+	}
+	if err := getter.GetFile(sumsPath, source, opts...); err != nil {
+		return "", errors.Wrapf(err, "downloading manifest %s", manifest)
+	}
+	if cfg.ManifestKeyring != "" {
+		sigURL, err := signatureURL(manifest)
+		if err != nil {
+			return "", err
+		}
+		sigPath := sumsPath + ".asc"
+		if sigURL, err = sourceURL(sigURL); err != nil {
+			return "", err
+		}
+		if err := getter.GetFile(sigPath, sigURL, opts...); err != nil {
+			return "", errors.Wrapf(err, "downloading manifest signature %s", sigURL)
+		}
+		if err := verifyGPG(cfg.ManifestKeyring, sigPath, sumsPath); err != nil {
+			return "", errors.Wrapf(err, "verifying manifest %s", manifest)
+		}
+	}
+
+	// the file name of a forced url (eg. git::https://...) is in the url it forces
+	name := artifact
+	if i := strings.Index(name, "::"); i >= 0 {
+		name = name[i+2:]
+	}
+	u, err := url.Parse(name)
+	if err != nil {
+		return "", errors.Wrap(err, "parsing binary url")
+	}
+	sums, err := parseSHA256Sums(sumsPath)
+	if err != nil {
+		return "", err
+	}
+	filename := u.Query().Get("filename")
+	if filename == "" {
+		filename = path.Base(u.Path)
+	}
+	sum, ok := sums[filename]
+	if !ok {
+		return "", errors.Errorf("%s not listed in manifest %s", filename, manifest)
+	}
+
+	return withChecksum(artifact, "sha256:"+sum)
+}
+
+// withChecksum sets ?checksum=expected on the artifact url, so go-getter verifies the download.
+// It fails if the url already holds a different checksum.
+func withChecksum(artifact, expected string) (string, error) {
+	u, err := url.Parse(artifact)
+	if err != nil {
+		return "", errors.Wrap(err, "parsing binary url")
+	}
+	query := u.Query()
+	if current := query.Get("checksum"); current != "" && !sameChecksum(current, expected) {
+		return "", errors.Errorf("checksum %s in url doesn't match %s", current, expected)
+	}
+	query.Set("checksum", expected)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// sameChecksum compares two checksums, with or without their type
+func sameChecksum(a, b string) bool {
+	na, errA := normalizeChecksum(a)
+	nb, errB := normalizeChecksum(b)
+	if errA != nil || errB != nil {
+		return strings.EqualFold(a, b)
+	}
+	return na == nb
+}
+
+// checksumSizes are the hashes go-getter verifies with, by the size of their digest
+var checksumSizes = map[string]int{"md5": 16, "sha1": 20, "sha256": 32, "sha512": 64}
+
+// checksumHashes compute the checksums go-getter verifies with
+var checksumHashes = map[string]func() hash.Hash{"md5": md5.New, "sha1": sha1.New, "sha256": sha256.New, "sha512": sha512.New}
+
+// matchesChecksum is whether the file at path has the checksum sum, as normalizeChecksum takes it
+func matchesChecksum(path, sum string) (bool, error) {
+	sum, err := normalizeChecksum(sum)
+	if err != nil {
+		return false, err
+	}
+	i := strings.Index(sum, ":")
+	if i < 0 || checksumHashes[sum[:i]] == nil {
+		return false, errors.Errorf("cannot verify checksum %s", sum)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false, errors.Wrap(err, "opening file to hash")
+	}
+	defer f.Close()
+	h := checksumHashes[sum[:i]]()
+	if _, err := io.Copy(h, f); err != nil {
+		return false, errors.Wrapf(err, "hashing %s", path)
+	}
+	return hex.EncodeToString(h.Sum(nil)) == sum[i+1:], nil
+}
+
+// normalizeChecksum turns a checksum as go-getter takes it in ?checksum=, <type>:<hex> or just the hex (its length
+// tells the type), into <type>:<hex> in lower case. Checksum files (file:<url>) are left to go-getter.
+func normalizeChecksum(sum string) (string, error) {
+	sum = strings.ToLower(strings.TrimSpace(sum))
+	if sum == "" || strings.HasPrefix(sum, "file:") {
+		return sum, nil
+	}
+	kind, hash := "", sum
+	if i := strings.Index(sum, ":"); i >= 0 {
+		kind, hash = sum[:i], sum[i+1:]
+	}
+	bz, err := hex.DecodeString(hash)
+	if err != nil {
+		return "", errors.Errorf("checksum %s is not <type>:<hex>", sum)
+	}
+	if kind == "" {
+		for k, size := range checksumSizes {
+			if size == len(bz) {
+				kind = k
+			}
+		}
+	}
+	if size, ok := checksumSizes[kind]; !ok || size != len(bz) {
+		return "", errors.Errorf("checksum %s is no md5, sha1, sha256 or sha512", sum)
+	}
+	return kind + ":" + hash, nil
+}
+
+// checkURLChecksum fails for a ?checksum= go-getter would only refuse once downloading
+func checkURLChecksum(artifact string) error {
+	u, err := url.Parse(artifact)
+	if err != nil {
+		return errors.Wrap(err, "parsing binary url")
+	}
+	_, err = normalizeChecksum(u.Query().Get("checksum"))
+	return errors.Wrapf(err, "checksum in %s", redactURL(artifact))
+}
+
+// parseSHA256 reads sha256:<hex>, or just the hex, as go-getter takes it in ?checksum=
+func parseSHA256(sum string) (string, error) {
+	hash := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(sum)), "sha256:")
+	if bz, err := hex.DecodeString(hash); err != nil || len(bz) != 32 {
+		return "", errors.Errorf("checksum %s is not sha256:<hex>", sum)
+	}
+	return "sha256:" + hash, nil
+}
+
+// hasChecksum is whether go-getter verifies the download of artifact with a sha256 or sha512, given with its
+// type or as just the hex
+func hasChecksum(artifact string) bool {
+	u, err := url.Parse(artifact)
+	if err != nil {
+		return false
+	}
+	sum := strings.ToLower(u.Query().Get("checksum"))
+	if bz, err := hex.DecodeString(sum); err == nil {
+		return len(bz) == checksumSizes["sha256"] || len(bz) == checksumSizes["sha512"]
+	}
+	return strings.HasPrefix(sum, "sha256:") || strings.HasPrefix(sum, "sha512:")
+}
+
+// signatureURL adds .asc to the path of the manifest url, keeping the query
+func signatureURL(manifest string) (string, error) {
+	u, err := url.Parse(manifest)
+	if err != nil {
+		return "", errors.Wrap(err, "parsing manifest url")
+	}
+	u.Path += ".asc"
+	return u.String(), nil
+}
+
+// parseSHA256Sums reads the output of sha256sum, "<hex>  <file>" (or "<hex> *<file>" in binary mode)
+func parseSHA256Sums(manifest string) (map[string]string, error) {
+	f, err := os.Open(manifest)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening manifest")
+	}
+	defer f.Close()
+
+	sums := make(map[string]string)
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		fields := strings.Fields(scan.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		hash, name := strings.ToLower(fields[0]), strings.TrimPrefix(fields[1], "*")
+		if len(hash) != 64 {
+			return nil, errors.Errorf("invalid sha256 in manifest: %s", hash)
+		}
+		// entries are sometimes listed with a directory, we match on the file name
+		sums[path.Base(name)] = hash
+	}
+	return sums, errors.Wrap(scan.Err(), "reading manifest")
+}
+
+// verifyGPG checks the detached signature of file against the keys in keyring, using gpgv
+func verifyGPG(keyring, sig, file string) error {
+	out, err := exec.Command("gpgv", "--keyring", keyring, sig, file).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "gpg signature invalid: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
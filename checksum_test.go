@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const autodSHA256 = "e6bc7851600a2a9917f7bf88eb7bdee1ec162c671101485690b4deb089077b0d"
+
+func TestChecksumFromManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	manifest := filepath.Join(dir, "SHA256SUMS")
+	sums := fmt.Sprintf("%s *release/autod\n%s  autod.zip\n", autodSHA256, "3784e4574cad69b67e34d4ea4425eff140063a3870270a301d6bb24a098a27ae")
+	require.NoError(t, ioutil.WriteFile(manifest, []byte(sums), 0644))
+
+	cases := map[string]struct {
+		artifact string
+		expect   string
+		isErr    bool
+	}{
+		"binary": {
+			artifact: "https://example.com/v1.0/autod",
+			expect:   "https://example.com/v1.0/autod?checksum=sha256%3A" + autodSHA256,
+		},
+		"archive with query": {
+			artifact: "https://example.com/v1.0/autod.zip?archive=zip",
+			expect:   "https://example.com/v1.0/autod.zip?archive=zip&checksum=sha256%3A3784e4574cad69b67e34d4ea4425eff140063a3870270a301d6bb24a098a27ae",
+		},
+		"matching checksum": {
+			artifact: "https://example.com/v1.0/autod?checksum=sha256:" + autodSHA256,
+			expect:   "https://example.com/v1.0/autod?checksum=sha256%3A" + autodSHA256,
+		},
+		"matching bare checksum": {
+			artifact: "https://example.com/v1.0/autod?checksum=" + strings.ToUpper(autodSHA256),
+			expect:   "https://example.com/v1.0/autod?checksum=sha256%3A" + autodSHA256,
+		},
+		"conflicting checksum": {
+			artifact: "https://example.com/v1.0/autod?checksum=sha256:73e2bd6cbb99261733caf137015d5cc58e3f96248d8b01da68be8564989dd906",
+			isErr:    true,
+		},
+		"s3": {
+			artifact: "s3://releases/v1.0/autod",
+			expect:   "s3://releases/v1.0/autod?checksum=sha256%3A" + autodSHA256,
+		},
+		"forced url": {
+			artifact: "s3::https://s3.amazonaws.com/releases/v1.0/autod",
+			expect:   "s3::https://s3.amazonaws.com/releases/v1.0/autod?checksum=sha256%3A" + autodSHA256,
+		},
+		"not listed": {
+			artifact: "https://example.com/v1.0/gaiad",
+			isErr:    true,
+		},
+	}
+
+	cfg := &Config{}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			url, err := cfg.ChecksumFromManifest(tc.artifact, manifest)
+			if tc.isErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expect, url)
+		})
+	}
+}
+
+func TestChecksumFromSignedManifest(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg not installed")
+	}
+	if _, err := exec.LookPath("gpgv"); err != nil {
+		t.Skip("gpgv not installed")
+	}
+	dir, err := ioutil.TempDir("", "manifest-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// a throwaway release key
+	gpg := func(args ...string) {
+		cmd := exec.Command("gpg", append([]string{"--homedir", dir, "--batch", "--yes"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+	require.NoError(t, os.Chmod(dir, 0700))
+	defer exec.Command("gpgconf", "--homedir", dir, "--kill", "gpg-agent").Run()
+	gpg("--passphrase", "", "--quick-gen-key", "release@example.com", "ed25519", "sign", "never")
+	keyring := filepath.Join(dir, "release.gpg")
+	gpg("--output", keyring, "--export", "release@example.com")
+
+	manifest := filepath.Join(dir, "SHA256SUMS")
+	require.NoError(t, ioutil.WriteFile(manifest, []byte(autodSHA256+"  autod\n"), 0644))
+	cfg := &Config{ManifestKeyring: keyring}
+
+	// unsigned is refused
+	_, err = cfg.ChecksumFromManifest("https://example.com/autod", manifest)
+	require.Error(t, err)
+
+	gpg("--armor", "--output", manifest+".asc", "--detach-sign", manifest)
+	url, err := cfg.ChecksumFromManifest("https://example.com/autod", manifest)
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/autod?checksum=sha256%3A"+autodSHA256, url)
+
+	// a modified manifest is refused
+	require.NoError(t, ioutil.WriteFile(manifest, []byte("73e2bd6cbb99261733caf137015d5cc58e3f96248d8b01da68be8564989dd906  autod\n"), 0644))
+	_, err = cfg.ChecksumFromManifest("https://example.com/autod", manifest)
+	require.Error(t, err)
+}
+
+func TestParseSHA256(t *testing.T) {
+	sum, err := parseSHA256(" SHA256:" + strings.ToUpper(autodSHA256))
+	require.NoError(t, err)
+	assert.Equal(t, "sha256:"+autodSHA256, sum)
+	sum, err = parseSHA256(autodSHA256)
+	require.NoError(t, err)
+	assert.Equal(t, "sha256:"+autodSHA256, sum)
+	_, err = parseSHA256("md5:d41d8cd98f00b204e9800998ecf8427e")
+	assert.Error(t, err)
+
+	assert.True(t, hasChecksum("https://example.com/autod?checksum=sha256:"+autodSHA256))
+	assert.True(t, hasChecksum("https://example.com/autod?checksum=SHA512:ab"))
+	assert.False(t, hasChecksum("https://example.com/autod?checksum=md5:d41d8cd98f00b204e9800998ecf8427e"))
+	assert.False(t, hasChecksum("https://example.com/autod"))
+	assert.True(t, hasChecksum("https://example.com/autod?checksum="+autodSHA256))
+	assert.False(t, hasChecksum("https://example.com/autod?checksum=d41d8cd98f00b204e9800998ecf8427e"))
+}
+
+func TestNormalizeChecksum(t *testing.T) {
+	cases := map[string]struct {
+		input  string
+		expect string
+		isErr  bool
+	}{
+		"typed":        {input: "SHA256:" + strings.ToUpper(autodSHA256), expect: "sha256:" + autodSHA256},
+		"bare sha256":  {input: autodSHA256, expect: "sha256:" + autodSHA256},
+		"bare md5":     {input: "d41d8cd98f00b204e9800998ecf8427e", expect: "md5:d41d8cd98f00b204e9800998ecf8427e"},
+		"file":         {input: "file:https://example.com/autod.sha256", expect: "file:https://example.com/autod.sha256"},
+		"none":         {input: "", expect: ""},
+		"short":        {input: "sha256:e6bc78", isErr: true},
+		"not hex":      {input: "sha256:" + strings.Repeat("z", 64), isErr: true},
+		"unknown type": {input: "crc32:" + autodSHA256, isErr: true},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			sum, err := normalizeChecksum(tc.input)
+			if tc.isErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expect, sum)
+		})
+	}
+	assert.True(t, sameChecksum(autodSHA256, "sha256:"+strings.ToUpper(autodSHA256)))
+	assert.False(t, sameChecksum("md5:d41d8cd98f00b204e9800998ecf8427e", "sha256:"+autodSHA256))
+}
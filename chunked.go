@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+
+	getter "github.com/hashicorp/go-getter"
+	"github.com/pkg/errors"
+)
+
+// minChunkSize is the least a connection of a parallel download fetches, smaller files take one connection
+const minChunkSize = 8 << 20
+
+// errNoRanges is a server which doesn't answer range requests after all
+var errNoRanges = errors.New("the server ignores ranges")
+
+// chunkedGetter fetches large files over http(s) with several connections, each one a range of the file, which
+// cuts the time a validator is down at the upgrade height when a distant server is slow per connection. Every range
+// goes to its own .part file, so a download that breaks off resumes with what each connection fetched. Anything
+// else (a small file, a server without ranges, a directory) is left to the http getter.
+type chunkedGetter struct {
+	*getter.HttpGetter
+	connections int
+}
+
+func (g *chunkedGetter) GetFile(dst string, src *url.URL) error {
+	if g.connections < 2 {
+		return g.HttpGetter.GetFile(dst, src)
+	}
+	// the ranges all go to where the url redirects, eg. a signed url of a storage bucket
+	head, err := g.Client.Head(src.String())
+	if err != nil {
+		return g.HttpGetter.GetFile(dst, src)
+	}
+	head.Body.Close()
+	size := head.ContentLength
+	if head.StatusCode != http.StatusOK || head.Header.Get("Accept-Ranges") != "bytes" || size < 2*minChunkSize {
+		return g.HttpGetter.GetFile(dst, src)
+	}
+	// a download started with one connection goes on with one
+	if info, err := os.Stat(dst); err == nil {
+		if info.Size() == size {
+			return nil
+		}
+		return g.HttpGetter.GetFile(dst, src)
+	}
+
+	chunks := int64(g.connections)
+	if size/chunks < minChunkSize {
+		chunks = size / minChunkSize
+	}
+	chunk := (size + chunks - 1) / chunks
+	var wg sync.WaitGroup
+	errs := make([]error, chunks)
+	for i := int64(0); i < chunks; i++ {
+		end := (i+1)*chunk - 1
+		if end >= size {
+			end = size - 1
+		}
+		wg.Add(1)
+		go func(i, start, end int64) {
+			defer wg.Done()
+			errs[i] = g.fetchRange(head.Request.URL.String(), partFile(dst, i), start, end)
+		}(i, i*chunk, end)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err == errNoRanges {
+			removeParts(dst, chunks)
+			return g.HttpGetter.GetFile(dst, src)
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return joinParts(dst, chunks)
+}
+
+// fetchRange appends the bytes from start to end (inclusive) to part, from where an earlier attempt left off
+func (g *chunkedGetter) fetchRange(src, part string, start, end int64) error {
+	f, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if start += info.Size(); start > end {
+		return nil
+	}
+	req, err := http.NewRequest("GET", src, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	resp, err := g.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		return errNoRanges
+	default:
+		return errors.Errorf("bad response code: %d", resp.StatusCode)
+	}
+	if offset, _ := contentRange(resp); offset != start {
+		return errNoRanges
+	}
+	n, err := io.Copy(f, io.LimitReader(resp.Body, end-start+1))
+	if err != nil {
+		return err
+	}
+	if n != end-start+1 {
+		return errors.Errorf("range %d-%d of %s broke off after %d bytes", start, end, redactURL(src), n)
+	}
+	return nil
+}
+
+func partFile(dst string, i int64) string {
+	return dst + ".part" + strconv.FormatInt(i, 10)
+}
+
+// joinParts writes the parts to dst in order, and removes them
+func joinParts(dst string, chunks int64) error {
+	tmp := dst + ".joining"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	for i := int64(0); i < chunks; i++ {
+		part, err := os.Open(partFile(dst, i))
+		if err != nil {
+			f.Close()
+			return err
+		}
+		_, err = io.Copy(f, part)
+		part.Close()
+		if err != nil {
+			f.Close()
+			return errors.Wrap(err, "joining parts")
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return err
+	}
+	removeParts(dst, chunks)
+	return nil
+}
+
+func removeParts(dst string, chunks int64) {
+	for i := int64(0); i < chunks; i++ {
+		os.Remove(partFile(dst, i))
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	getter "github.com/hashicorp/go-getter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChunkedDownload(t *testing.T) {
+	content := make([]byte, 4*minChunkSize+123)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	var mutex sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			mutex.Lock()
+			ranges = append(ranges, r.URL.Path+" "+r.Header.Get("Range"))
+			mutex.Unlock()
+		}
+		switch r.URL.Path {
+		case "/redirect/gaiad":
+			http.Redirect(w, r, "/gaiad", http.StatusFound)
+		case "/gaiad":
+			http.ServeContent(w, r, "gaiad", time.Time{}, bytes.NewReader(content))
+		case "/liar/gaiad":
+			// announces ranges, but sends everything
+			w.Header().Set("Accept-Ranges", "bytes")
+			http.ServeContent(w, &http.Request{Method: r.Method, URL: r.URL, Header: http.Header{}}, "gaiad", time.Time{}, bytes.NewReader(content))
+		}
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "chunked-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cases := map[string]struct {
+		path        string
+		connections int
+		// part0 is what an earlier attempt left of the first range
+		part0  int
+		ranges []string
+	}{
+		"one connection": {
+			path:        "/gaiad",
+			connections: 1,
+			ranges:      []string{"/gaiad bytes=0-"},
+		},
+		"four connections": {
+			path:        "/redirect/gaiad",
+			connections: 4,
+			ranges: []string{
+				"/gaiad bytes=0-8388638",
+				"/gaiad bytes=8388639-16777277",
+				"/gaiad bytes=16777278-25165916",
+				"/gaiad bytes=25165917-33554554",
+			},
+		},
+		"at most one connection per chunk": {
+			path:        "/gaiad",
+			connections: 100,
+			ranges: []string{
+				"/gaiad bytes=0-8388638",
+				"/gaiad bytes=8388639-16777277",
+				"/gaiad bytes=16777278-25165916",
+				"/gaiad bytes=25165917-33554554",
+			},
+		},
+		"resumed": {
+			path:        "/gaiad",
+			connections: 2,
+			part0:       1000,
+			ranges:      []string{"/gaiad bytes=1000-16777277", "/gaiad bytes=16777278-33554554"},
+		},
+		"ranges ignored": {
+			path:        "/liar/gaiad",
+			connections: 2,
+			// both ranges got everything, so it is fetched again with one connection
+			ranges: []string{"/liar/gaiad bytes=0-16777277", "/liar/gaiad bytes=16777278-33554554", "/liar/gaiad bytes=0-"},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			ranges = nil
+			dest := filepath.Join(dir, name, "gaiad")
+			require.NoError(t, os.MkdirAll(filepath.Dir(dest), 0755))
+			if tc.part0 > 0 {
+				require.NoError(t, ioutil.WriteFile(dest+".part0", content[:tc.part0], 0644))
+			}
+			cfg := &Config{DownloadConnections: tc.connections}
+			require.NoError(t, getter.GetFile(dest, server.URL+tc.path, cfg.getterOptions()...))
+			bz, err := ioutil.ReadFile(dest)
+			require.NoError(t, err)
+			assert.True(t, bytes.Equal(content, bz))
+			// the parts are gone
+			files, err := ioutil.ReadDir(filepath.Dir(dest))
+			require.NoError(t, err)
+			assert.Len(t, files, 1)
+
+			sort.Strings(ranges)
+			sort.Strings(tc.ranges)
+			assert.Equal(t, tc.ranges, ranges)
+		})
+	}
+}
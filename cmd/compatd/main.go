@@ -0,0 +1,49 @@
+// Command compatd stands in for the daemon in `cosmosd compat-test`, which looks for it next to cosmosd or in the
+// PATH. It is only built for that, with `go build ./cmd/compatd`.
+//
+// The genesis binary announces the upgrade (as COSMOSD_COMPAT_DAEMON says, with the log line or upgrade-info.json)
+// and waits to be stopped, the upgrade binary prints that it runs and fails. Both answer the smoke test.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// upgraded is what compat-test looks for in the output of the upgrade
+const upgraded = "compat daemon running the upgrade"
+
+func main() {
+	// we are started through the current link
+	path, err := filepath.EvalSymlinks(os.Args[0])
+	if err != nil {
+		path = os.Args[0]
+	}
+	if len(os.Args) > 1 && os.Args[1] == "version" {
+		fmt.Println("compatd v2")
+		return
+	}
+	if strings.Contains(filepath.ToSlash(path), "/upgrades/") {
+		fmt.Println(upgraded)
+		os.Exit(3)
+	}
+	switch os.Getenv("COSMOSD_COMPAT_DAEMON") {
+	case "log":
+		fmt.Println(`UPGRADE "v2" NEEDED at height: 10: {}`)
+	case "file":
+		bz, _ := json.Marshal(map[string]interface{}{"name": "v2", "height": 10})
+		// the home is in the cosmovisor layout, where x/upgrade writes it
+		file := filepath.Join(os.Getenv("DAEMON_HOME"), "data", "upgrade-info.json")
+		if err := ioutil.WriteFile(file, bz, 0644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	time.Sleep(30 * time.Second)
+	os.Exit(1)
+}
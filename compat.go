@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// cosmovisorRoot is where cosmovisor keeps the same layout, we use it if there is no upgrade_manager
+const cosmovisorRoot = "cosmovisor"
+
+// compatDaemonEnv tells the daemon of compat-test what to do
+const compatDaemonEnv = "COSMOSD_COMPAT_DAEMON"
+
+// compatName is the daemon of compat-test, the test-only binary of cmd/compatd
+const compatName = "compatd"
+
+// compatUpgraded is what the daemon of compat-test prints when run as the upgrade binary
+const compatUpgraded = "compat daemon running the upgrade"
+
+// detectRoot returns the directory in home to use, cosmovisor's if it is the only one there
+func detectRoot(home string) string {
+	if _, err := os.Stat(filepath.Join(home, rootName)); err == nil || home == "" {
+		return ""
+	}
+	if info, err := os.Stat(filepath.Join(home, cosmovisorRoot)); err == nil && info.IsDir() {
+		return cosmovisorRoot
+	}
+	return ""
+}
+
+// enabled reads a switch: on, or anything strconv.ParseBool takes as true (eg. true, as with cosmovisor)
+func (cfg *Config) enabled(name string) bool {
+	value := cfg.getenv(name)
+	if value == "on" {
+		return true
+	}
+	b, err := strconv.ParseBool(value)
+	return err == nil && b
+}
+
+// compatDifferences are the parts of the cosmovisor contract we knowingly don't follow
+var compatDifferences = []string{
+	"DAEMON_RESTART_AFTER_UPGRADE defaults to off (cosmovisor: true), set it to true to match",
+	"backups are written to <root>/backups, DAEMON_DATA_BACKUP_DIR is not read",
+	"DAEMON_RESTART_DELAY and COSMOVISOR_* are not read, and `pre-upgrade` is only run with DAEMON_PREUPGRADE=true",
+	"a new binary must pass DAEMON_SMOKE_TEST (default `version`) before we switch to it, cosmovisor switches unchecked",
+}
+
+// compatCheck runs this binary as the supervisor of compatd
+type compatCheck struct {
+	name string
+	// mode is what the genesis daemon does, see cmd/compatd
+	mode string
+	env  []string
+	// staged says the upgrade binary is in place
+	staged bool
+	check  func(cfg *Config, out string, err error) error
+}
+
+var compatChecks = []compatCheck{
+	{
+		name:   "UPGRADE NEEDED line, cosmovisor/ layout and true/false switches",
+		mode:   "log",
+		env:    []string{"DAEMON_RESTART_AFTER_UPGRADE=true", "DAEMON_ALLOW_DOWNLOAD_BINARIES=false"},
+		staged: true,
+		check:  compatRestarted,
+	},
+	{
+		name:   "upgrade-info.json in DAEMON_HOME/data, DAEMON_POLL_INTERVAL in milliseconds",
+		mode:   "file",
+		env:    []string{"DAEMON_RESTART_AFTER_UPGRADE=true", "DAEMON_POLL_INTERVAL=100"},
+		staged: true,
+		check:  compatRestarted,
+	},
+	{
+		name:   "DAEMON_RESTART_AFTER_UPGRADE=false exits after switching",
+		mode:   "log",
+		env:    []string{"DAEMON_RESTART_AFTER_UPGRADE=false"},
+		staged: true,
+		check: func(cfg *Config, out string, err error) error {
+			if err != nil {
+				return errors.Wrap(err, "supervisor failed")
+			}
+			if strings.Contains(out, compatUpgraded) {
+				return errors.New("restarted the daemon")
+			}
+			return compatSwitched(cfg)
+		},
+	},
+	{
+		name: "DAEMON_ALLOW_DOWNLOAD_BINARIES=false fails without the upgrade binary",
+		mode: "log",
+		env:  []string{"DAEMON_ALLOW_DOWNLOAD_BINARIES=false"},
+		check: func(cfg *Config, out string, err error) error {
+			if err == nil {
+				return errors.New("supervisor succeeded")
+			}
+			if cfg.CurrentBin() != cfg.GenesisBin() {
+				return errors.Errorf("current is %s, not genesis", cfg.CurrentBin())
+			}
+			return nil
+		},
+	},
+	{
+		name:   "UNSAFE_SKIP_BACKUP=true skips the backup of data",
+		mode:   "log",
+		env:    []string{"UNSAFE_SKIP_BACKUP=true"},
+		staged: true,
+		check: func(cfg *Config, out string, err error) error {
+			if err != nil {
+				return errors.Wrap(err, "supervisor failed")
+			}
+			if _, err := os.Stat(filepath.Join(cfg.Root(), backupsDir)); !os.IsNotExist(err) {
+				return errors.New("data was backed up")
+			}
+			return compatSwitched(cfg)
+		},
+	},
+}
+
+// compatRestarted checks we switched to the upgrade, and ran it. The fake upgrade exits with an error,
+// so the supervisor does not restart it forever.
+func compatRestarted(cfg *Config, out string, err error) error {
+	if !strings.Contains(out, compatUpgraded) {
+		return errors.Errorf("the upgrade was not started (%v)", err)
+	}
+	return compatSwitched(cfg)
+}
+
+func compatSwitched(cfg *Config) error {
+	if cfg.CurrentBin() != cfg.UpgradeBin("v2") {
+		return errors.Errorf("current is %s, not the upgrade", cfg.CurrentBin())
+	}
+	return nil
+}
+
+// cmdCompatTest runs all checks against this binary, and lists what we do differently. The daemon is the compatd
+// given in args, or else found next to this binary or in the PATH.
+func cmdCompatTest(args []string, out io.Writer) error {
+	self, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "cannot find this binary")
+	}
+	daemon, err := findCompatDaemon(self, args)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, c := range compatChecks {
+		if err := c.run(self, daemon); err != nil {
+			failed++
+			fmt.Fprintf(out, "FAIL %s: %v\n", c.name, err)
+		} else {
+			fmt.Fprintf(out, "ok   %s\n", c.name)
+		}
+	}
+	for _, diff := range compatDifferences {
+		fmt.Fprintf(out, "NOTE %s\n", diff)
+	}
+	if failed > 0 {
+		return errors.Errorf("%d of %d checks failed", failed, len(compatChecks))
+	}
+	return nil
+}
+
+// findCompatDaemon returns the compatd given in args, or the one next to self, or in the PATH
+func findCompatDaemon(self string, args []string) (string, error) {
+	if len(args) > 0 {
+		return args[0], nil
+	}
+	exe := compatName
+	if runtime.GOOS == "windows" {
+		exe += ".exe"
+	}
+	next := filepath.Join(filepath.Dir(self), exe)
+	if _, err := os.Stat(next); err == nil {
+		return next, nil
+	}
+	path, err := exec.LookPath(exe)
+	if err != nil {
+		return "", errors.Errorf("cannot find %s next to %s or in the PATH, build it with `go build ./cmd/compatd`", exe, self)
+	}
+	return path, nil
+}
+
+// run sets up a fresh home in cosmovisor layout with daemon, and supervises it with self
+func (c compatCheck) run(self, daemon string) error {
+	home, err := ioutil.TempDir("", "compat-test")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: compatName, RootName: cosmovisorRoot}
+	if err := cfg.Init(daemon); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cfg.DataDir(), 0755); err != nil {
+		return err
+	}
+	if c.staged {
+		if err := os.MkdirAll(filepath.Dir(cfg.UpgradeBin("v2")), 0755); err != nil {
+			return err
+		}
+		if err := copyFile(daemon, cfg.UpgradeBin("v2"), 0755); err != nil {
+			return err
+		}
+	}
+
+	cmd := exec.Command(self, "run", "start")
+	cmd.Env = append(compatEnviron(), "DAEMON_HOME="+home, "DAEMON_NAME="+compatName, compatDaemonEnv+"="+c.mode)
+	cmd.Env = append(cmd.Env, c.env...)
+	timer := time.AfterFunc(time.Minute, func() { _ = cmd.Process.Kill() })
+	bz, err := cmd.CombinedOutput()
+	timer.Stop()
+	return c.check(cfg, string(bz), err)
+}
+
+// compatEnviron is our environment, without any of the settings of the operator
+func compatEnviron() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.Contains(kv, "DAEMON_") && !strings.HasPrefix(kv, "COSMOSD_") && !strings.HasPrefix(kv, "UNSAFE_SKIP_BACKUP=") {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectRoot(t *testing.T) {
+	home, err := ioutil.TempDir("", "compat")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+
+	assert.Equal(t, "", detectRoot(home))
+	require.NoError(t, os.Mkdir(filepath.Join(home, cosmovisorRoot), 0755))
+	assert.Equal(t, cosmovisorRoot, detectRoot(home))
+	cfg := &Config{Home: home, Name: "gaiad", RootName: detectRoot(home)}
+	assert.Equal(t, filepath.Join(home, "cosmovisor", "genesis", "bin", "gaiad"), cfg.GenesisBin())
+
+	// ours wins if both exist
+	require.NoError(t, os.Mkdir(filepath.Join(home, rootName), 0755))
+	assert.Equal(t, "", detectRoot(home))
+}
+
+func TestCosmovisorEnv(t *testing.T) {
+	home, err := filepath.Abs(filepath.Join("testdata", "validate"))
+	require.NoError(t, err)
+
+	cases := map[string]struct {
+		env   map[string]string
+		check func(t *testing.T, cfg *Config)
+	}{
+		"true and false": {
+			env: map[string]string{"DAEMON_RESTART_AFTER_UPGRADE": "true", "DAEMON_ALLOW_DOWNLOAD_BINARIES": "false"},
+			check: func(t *testing.T, cfg *Config) {
+				assert.True(t, cfg.RestartAfterUpgrade)
+				assert.False(t, cfg.AllowDownloadBinaries)
+			},
+		},
+		"on still works": {
+			env: map[string]string{"DAEMON_ALLOW_DOWNLOAD_BINARIES": "on"},
+			check: func(t *testing.T, cfg *Config) {
+				assert.True(t, cfg.AllowDownloadBinaries)
+			},
+		},
+		"skip backup without prefix": {
+			env: map[string]string{"UNSAFE_SKIP_BACKUP": "true"},
+			check: func(t *testing.T, cfg *Config) {
+				assert.True(t, cfg.UnsafeSkipBackup)
+			},
+		},
+		"poll interval in milliseconds": {
+			env: map[string]string{"DAEMON_POLL_INTERVAL": "300"},
+			check: func(t *testing.T, cfg *Config) {
+				assert.Equal(t, 300*time.Millisecond, cfg.PollInterval)
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			env := map[string]string{
+				"DAEMON_HOME": home, "DAEMON_NAME": "dummyd",
+				"DAEMON_RESTART_AFTER_UPGRADE": "", "DAEMON_ALLOW_DOWNLOAD_BINARIES": "",
+				"UNSAFE_SKIP_BACKUP": "", "DAEMON_UNSAFE_SKIP_BACKUP": "", "DAEMON_POLL_INTERVAL": "",
+			}
+			for k, v := range tc.env {
+				env[k] = v
+			}
+			defer setEnv(env)()
+			cfg, err := readConfigFromEnv()
+			require.NoError(t, err)
+			tc.check(t, cfg)
+		})
+	}
+
+	// other durations are not cosmovisor's, and need a unit
+	defer setEnv(map[string]string{"DAEMON_HOME": home, "DAEMON_NAME": "dummyd", "DAEMON_SHUTDOWN_GRACE": "300"})()
+	_, err = readConfigFromEnv()
+	assert.Error(t, err)
+}
+
+func TestCompatEnviron(t *testing.T) {
+	defer setEnv(map[string]string{"GAIA_DAEMON_HOME": "/gaia", "COSMOSD_ENV_PREFIX": "GAIA", "UNSAFE_SKIP_BACKUP": "true", "COMPAT_KEEP": "yes"})()
+	env := compatEnviron()
+	assert.Contains(t, env, "COMPAT_KEEP=yes")
+	assert.NotContains(t, env, "GAIA_DAEMON_HOME=/gaia")
+	assert.NotContains(t, env, "COSMOSD_ENV_PREFIX=GAIA")
+	assert.NotContains(t, env, "UNSAFE_SKIP_BACKUP=true")
+}
+
+func TestFindCompatDaemon(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compat")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer setEnv(map[string]string{"PATH": dir})()
+	self := filepath.Join(dir, "bin", "cosmosd")
+
+	_, err = findCompatDaemon(self, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "go build ./cmd/compatd")
+	daemon, err := findCompatDaemon(self, []string{"/opt/compatd"})
+	require.NoError(t, err)
+	assert.Equal(t, "/opt/compatd", daemon)
+
+	exe := compatName
+	if runtime.GOOS == "windows" {
+		exe += ".exe"
+	}
+	require.NoError(t, os.MkdirAll(filepath.Dir(self), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "bin", exe), []byte("#!/bin/sh\n"), 0755))
+	daemon, err = findCompatDaemon(self, nil)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "bin", exe), daemon)
+}
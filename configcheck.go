@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// configFiles are compared between the defaults of a new binary and the config of the operator
+var configFiles = []string{"app.toml", "config.toml", "client.toml"}
+
+// ConfigReport is how the config of the operator differs from what the binary we upgraded to writes by default
+type ConfigReport struct {
+	// Added are keys only the defaults have, Removed keys only the operator has, as <file>:<table>.<key>
+	Added   []string
+	Removed []string
+	// Invalid is the output of DAEMON_CONFIG_VALIDATE, if it failed
+	Invalid string
+}
+
+// Fields are added to the upgraded event and history entry
+func (r *ConfigReport) Fields() map[string]string {
+	fields := map[string]string{}
+	if len(r.Added) > 0 {
+		fields["NEW_CONFIG_KEYS"] = strings.Join(r.Added, ",")
+	}
+	if len(r.Removed) > 0 {
+		fields["REMOVED_CONFIG_KEYS"] = strings.Join(r.Removed, ",")
+	}
+	if r.Invalid != "" {
+		fields["CONFIG_INVALID"] = r.Invalid
+	}
+	return fields
+}
+
+// checkConfig runs the binary of the upgrade to tell what changed in its config. With DAEMON_CONFIG_CHECK, it
+// writes its defaults into an empty home to compare the keys with, with DAEMON_CONFIG_VALIDATE it checks
+// the config of the node. Neither stops the upgrade, a failure to check is only logged. It runs once the upgrade
+// is up (see runPostUpgrade), so it never holds up the restart.
+func (cfg *Config) checkConfig(upgradeName string) *ConfigReport {
+	bin := cfg.UpgradeBin(upgradeName)
+	report := &ConfigReport{}
+	if cfg.ConfigCheck {
+		added, removed, err := cfg.diffDefaultConfig(bin)
+		if err != nil {
+			logger.Printf("cannot compare the config with the defaults of %s: %v", upgradeName, err)
+		}
+		report.Added, report.Removed = added, removed
+	}
+	if len(cfg.ConfigValidate) > 0 {
+		args := append(append([]string{}, cfg.ConfigValidate...), "--home", cfg.Home)
+		if out, err := cfg.runConfigCheck(bin, args); err != nil {
+			report.Invalid = strings.TrimSpace(out)
+			if report.Invalid == "" {
+				report.Invalid = err.Error()
+			}
+		}
+	}
+	return report
+}
+
+// checksConfig is whether DAEMON_CONFIG_CHECK or DAEMON_CONFIG_VALIDATE ask to check the config after an upgrade
+func (cfg *Config) checksConfig() bool {
+	return cfg.ConfigCheck || len(cfg.ConfigValidate) > 0
+}
+
+// notifyConfigChanges tells the operator what changed in the config of the upgrade, and records it in the history
+func (cfg *Config) notifyConfigChanges(upgradeName string) {
+	report := cfg.checkConfig(upgradeName)
+	fields := report.Fields()
+	if len(fields) == 0 {
+		return
+	}
+	var changes []string
+	if len(report.Added) > 0 {
+		changes = append(changes, fmt.Sprintf("new config keys %s", strings.Join(report.Added, ", ")))
+	}
+	if len(report.Removed) > 0 {
+		changes = append(changes, fmt.Sprintf("config keys %s are no longer in the defaults", strings.Join(report.Removed, ", ")))
+	}
+	if report.Invalid != "" {
+		changes = append(changes, fmt.Sprintf("the config does not validate: %s", report.Invalid))
+	}
+	fields["UPGRADE"] = upgradeName
+	cfg.Notify(Event{
+		Type:    "config_changed",
+		Message: fmt.Sprintf("upgraded to %s: %s", upgradeName, strings.Join(changes, "; ")),
+		Fields:  fields,
+	})
+	entry := HistoryEntry{Type: "config_changed", Upgrade: upgradeName, Fields: map[string]string{}}
+	for k, v := range report.Fields() {
+		entry.Fields[strings.ToLower(k)] = v
+	}
+	if err := cfg.RecordHistory(entry); err != nil {
+		logger.Printf("cannot record history: %v", err)
+	}
+}
+
+// diffDefaultConfig has bin init an empty home, and compares the keys of its config files to the ones in Home
+func (cfg *Config) diffDefaultConfig(bin string) (added, removed []string, err error) {
+	// in our root rather than the tmp of the system, which a jail may not share with us
+	tmpHome, err := ioutil.TempDir(cfg.Root(), "config-check")
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "create tempdir for the default config")
+	}
+	defer os.RemoveAll(tmpHome)
+	if out, err := cfg.runConfigCheck(bin, []string{"init", "config-check", "--home", tmpHome}); err != nil {
+		return nil, nil, errors.Wrapf(err, "writing the default config: %s", strings.TrimSpace(out))
+	}
+
+	for _, name := range configFiles {
+		defaults, err := readTOMLKeys(filepath.Join(tmpHome, "config", name))
+		if os.IsNotExist(errors.Cause(err)) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		current, err := readTOMLKeys(filepath.Join(cfg.Home, "config", name))
+		if os.IsNotExist(errors.Cause(err)) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		for key := range defaults {
+			if !current[key] {
+				added = append(added, name+":"+key)
+			}
+		}
+		for key := range current {
+			if !defaults[key] {
+				removed = append(removed, name+":"+key)
+			}
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed, nil
+}
+
+// runConfigCheck runs bin with args in the jailer for at most DAEMON_CONFIG_CHECK_TIMEOUT, and returns what it wrote
+func (cfg *Config) runConfigCheck(bin string, args []string) (string, error) {
+	out, err := cfg.runJailed(bin, args, orDefault(cfg.ConfigCheckTimeout, defaultConfigCheckTimeout))
+	return out, errors.Wrapf(err, "running %s", quoteArgs(args))
+}
+
+var (
+	tomlTable = regexp.MustCompile(`^\[\[?\s*([^\]]+?)\s*\]\]?`)
+	tomlKey   = regexp.MustCompile(`^("[^"]*"|'[^']*'|[A-Za-z0-9_.-]+)\s*=`)
+)
+
+// readTOMLKeys lists the keys of a toml file as <table>.<key>, it reads just enough toml for the config of a node
+func readTOMLKeys(file string) (map[string]bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading config")
+	}
+	defer f.Close()
+	return parseTOMLKeys(f)
+}
+
+func parseTOMLKeys(r io.Reader) (map[string]bool, error) {
+	keys := map[string]bool{}
+	table := ""
+	// a multi-line string may hold anything that looks like a key, until it is closed
+	closing := ""
+	scan := bufio.NewScanner(r)
+	scan.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scan.Scan() {
+		line := strings.TrimSpace(scan.Text())
+		if closing != "" {
+			if strings.Contains(line, closing) {
+				closing = ""
+			}
+			continue
+		}
+		if match := tomlTable.FindStringSubmatch(line); match != nil {
+			table = strings.Replace(match[1], `"`, "", -1) + "."
+			continue
+		}
+		match := tomlKey.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		keys[table+strings.Trim(match[1], `"'`)] = true
+		for _, quotes := range []string{`"""`, `'''`} {
+			if strings.Count(line, quotes) == 1 {
+				closing = quotes
+			}
+		}
+	}
+	return keys, errors.Wrap(scan.Err(), "reading config")
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTOMLKeys(t *testing.T) {
+	doc := `# This is a TOML config file.
+minimum-gas-prices = "0.025uatom"
+halt-height = 0
+
+[api]
+enable = true
+"max-open-connections" = 1000
+
+[[telemetry.global-labels]]
+chain_id = "cosmoshub-4"
+
+[state-sync]
+note = """
+not = a key
+"""
+snapshot-interval = 0
+unsafe-cors = [
+  "*",
+]
+`
+	keys, err := parseTOMLKeys(strings.NewReader(doc))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{
+		"minimum-gas-prices":               true,
+		"halt-height":                      true,
+		"api.enable":                       true,
+		"api.max-open-connections":         true,
+		"telemetry.global-labels.chain_id": true,
+		"state-sync.note":                  true,
+		"state-sync.snapshot-interval":     true,
+		"state-sync.unsafe-cors":           true,
+	}, keys)
+}
+
+func TestCheckConfig(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as binary")
+	}
+	home, err := ioutil.TempDir("", "upgrade-manager-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd", ConfigCheck: true, ConfigValidate: []string{"config", "validate"}}
+
+	require.NoError(t, os.MkdirAll(filepath.Join(home, "config"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(home, "config", "app.toml"), []byte("pruning = \"default\"\n[api]\nswagger = false\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(home, "config", "config.toml"), []byte("moniker = \"node\"\n"), 0644))
+
+	// init writes the defaults of the new version, config validate fails on the old app.toml
+	script := `#!/bin/sh
+if [ "$1" = init ]; then
+  mkdir -p "$4/config"
+  printf 'pruning = "default"\n[api]\nenable = false\n[mempool]\nmax-txs = 5000\n' > "$4/config/app.toml"
+  printf 'moniker = "config-check"\n' > "$4/config/config.toml"
+  exit 0
+fi
+[ "$1 $2 $3 $4" = "config validate --home $HOME_DIR" ] || exit 3
+echo "api.swagger: unknown key" >&2
+exit 1
+`
+	bin := cfg.UpgradeBin("v2")
+	require.NoError(t, os.MkdirAll(filepath.Dir(bin), 0755))
+	require.NoError(t, ioutil.WriteFile(bin, []byte(strings.Replace(script, "$HOME_DIR", home, 1)), 0755))
+
+	report := cfg.checkConfig("v2")
+	assert.Equal(t, []string{"app.toml:api.enable", "app.toml:mempool.max-txs"}, report.Added)
+	assert.Equal(t, []string{"app.toml:api.swagger"}, report.Removed)
+	assert.Equal(t, "api.swagger: unknown key", report.Invalid)
+	assert.Equal(t, map[string]string{
+		"NEW_CONFIG_KEYS":     "app.toml:api.enable,app.toml:mempool.max-txs",
+		"REMOVED_CONFIG_KEYS": "app.toml:api.swagger",
+		"CONFIG_INVALID":      "api.swagger: unknown key",
+	}, report.Fields())
+
+	cfg.notifyConfigChanges("v2")
+	history, err := cfg.History()
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, "config_changed", history[0].Type)
+	assert.Equal(t, "app.toml:api.swagger", history[0].Fields["removed_config_keys"])
+
+	// the checks run in the jailer
+	cfg.Jailer, err = parseJailer(`/usr/bin/env JAILED=1 {{.Bin}}`)
+	require.NoError(t, err)
+	jailed := "#!/bin/sh\n[ \"$JAILED\" = 1 ] || exit 2\n"
+	require.NoError(t, ioutil.WriteFile(bin, []byte(jailed), 0755))
+	assert.Empty(t, cfg.checkConfig("v2").Invalid)
+	cfg.Jailer = nil
+
+	// a binary that hangs is given up on
+	require.NoError(t, ioutil.WriteFile(bin, []byte("#!/bin/sh\nexec sleep 30\n"), 0755))
+	cfg.ConfigCheckTimeout = 100 * time.Millisecond
+	start := time.Now()
+	report = cfg.checkConfig("v2")
+	assert.Empty(t, report.Added)
+	assert.Contains(t, report.Invalid, "deadline exceeded")
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// defaultConfirmMargin is how many blocks the node may be off the upgrade height
+const defaultConfirmMargin = 10
+
+// confirmHeight checks the upgrade in a line of output against the height the node committed last, which is
+// the block before the upgrade height. A line without height (a plan due at a time) or a node we cannot ask
+// leave nothing to check against, so the line is refused: a real upgrade is still found in upgrade-info.json,
+// which x/upgrade writes as it stops the node.
+func (cfg *Config) confirmHeight(heights *Heights, info *UpgradeInfo) error {
+	if info.Height <= 0 {
+		return cfg.refuseUpgrade(info, "the line has no height to confirm", nil)
+	}
+	height, err := heights.Height("confirm")
+	if err != nil {
+		return cfg.refuseUpgrade(info, fmt.Sprintf("cannot get the height of the node: %v", err), nil)
+	}
+	diff := info.Height - 1 - height
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff <= int64(cfg.ConfirmMargin) {
+		return nil
+	}
+	return cfg.refuseUpgrade(info, fmt.Sprintf("the node is at height %d", height), map[string]string{
+		"NODE_HEIGHT": strconv.FormatInt(height, 10),
+	})
+}
+
+// refuseUpgrade tells why the upgrade of a line was not confirmed, and returns it as the error
+func (cfg *Config) refuseUpgrade(info *UpgradeInfo, reason string, fields map[string]string) error {
+	if fields == nil {
+		fields = map[string]string{}
+	}
+	fields["UPGRADE"] = info.Name
+	fields["HEIGHT"] = strconv.FormatInt(info.Height, 10)
+	fields["REASON"] = reason
+	cfg.Notify(Event{
+		Type:    "upgrade_refused",
+		Message: fmt.Sprintf("refusing upgrade %s at height %d, %s", info.Name, info.Height, reason),
+		Fields:  fields,
+	})
+	return errors.New(reason)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// nodeAt serves the status of a node at height
+func nodeAt(height int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":-1,"result":{"sync_info":{"latest_block_height":"%d","catching_up":false}}}`, height)
+	}))
+}
+
+func TestConfirmHeight(t *testing.T) {
+	node := nodeAt(48)
+	defer node.Close()
+
+	cases := map[string]struct {
+		rpc    string
+		info   UpgradeInfo
+		margin int
+		isErr  bool
+	}{
+		"at the height":  {rpc: node.URL, info: UpgradeInfo{Name: "chain2", Height: 49}},
+		"within margin":  {rpc: node.URL, info: UpgradeInfo{Name: "chain2", Height: 55}, margin: 10},
+		"far ahead":      {rpc: node.URL, info: UpgradeInfo{Name: "chain2", Height: 5000}, margin: 10, isErr: true},
+		"long past":      {rpc: node.URL, info: UpgradeInfo{Name: "chain2", Height: 20}, margin: 10, isErr: true},
+		"no margin":      {rpc: node.URL, info: UpgradeInfo{Name: "chain2", Height: 50}, isErr: true},
+		"time plan":      {rpc: node.URL, info: UpgradeInfo{Name: "chain2"}, isErr: true},
+		"node went away": {rpc: "http://127.0.0.1:1", info: UpgradeInfo{Name: "chain2", Height: 49}, isErr: true},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cfg := &Config{RPCAddress: tc.rpc, ConfirmHeight: true, ConfirmMargin: tc.margin}
+			err := cfg.confirmHeight(cfg.NewHeights(), &tc.info)
+			if tc.isErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+// TestLaunchProcessRefusesUpgrade keeps running the genesis binary, as the node is nowhere near the upgrade height
+func TestLaunchProcessRefusesUpgrade(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	node := nodeAt(3)
+	defer node.Close()
+	cfg := &Config{Home: home, Name: "dummyd", RPCAddress: node.URL, ConfirmHeight: true, ConfirmMargin: 10}
+
+	var stdout, stderr bytes.Buffer
+	require.NoError(t, LaunchProcess(cfg, []string{"start"}, &stdout, &stderr))
+	assert.Equal(t, "Genesis start\nUPGRADE \"chain2\" NEEDED at height 49: {}\nNever should be printed!!!\n", stdout.String())
+	assert.Equal(t, cfg.GenesisBin(), cfg.CurrentBin())
+}
+
+// TestLaunchProcessRefusesTimePlan ignores a line of a plan due at a time, as there is no height to confirm it with
+func TestLaunchProcessRefusesTimePlan(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	node := nodeAt(48)
+	defer node.Close()
+	cfg := &Config{Home: home, Name: "dummyd", RPCAddress: node.URL, ConfirmHeight: true, ConfirmMargin: 10}
+	script := "#!/bin/sh\necho 'memo: UPGRADE \"chain2\" NEEDED at time: 2021-01-01T00:00:00Z: {}'\necho still running\n"
+	require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+
+	var stdout, stderr bytes.Buffer
+	require.NoError(t, LaunchProcess(cfg, []string{"start"}, &stdout, &stderr))
+	assert.Contains(t, stdout.String(), "still running\n")
+	assert.Equal(t, cfg.GenesisBin(), cfg.CurrentBin())
+}
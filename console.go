@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	colorReset = "\x1b[0m"
+	colorDim   = "\x1b[90m"
+	colorName  = "\x1b[1;35m"
+	colorCode  = "\x1b[33m"
+)
+
+// Console formats the messages of the upgrade manager itself, so they stand out from the output of the
+// daemon we pass through: an RFC3339 timestamp, a colored cosmosd prefix and the event code, if any
+type Console struct {
+	mutex sync.Mutex
+	out   io.Writer
+	// Color enables the escape codes, Width cuts longer lines (0 for no limit)
+	Color bool
+	Width int
+	now   func() time.Time
+}
+
+// console writes everything logged by the upgrade manager
+var console = newConsole(os.Stderr)
+
+// newConsole enables color and the width of the terminal if out is one, and NO_COLOR is not set
+func newConsole(out io.Writer) *Console {
+	c := &Console{out: out, now: time.Now}
+	if f, ok := out.(*os.File); ok {
+		if info, err := f.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			_, noColor := os.LookupEnv("NO_COLOR")
+			c.Color = !noColor
+			c.Width, _ = strconv.Atoi(os.Getenv("COLUMNS"))
+		}
+	}
+	return c
+}
+
+// Configure applies our settings, noColor is set with the --no-color flag
+func (c *Console) Configure(cfg *Config, noColor bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	switch cfg.LogColor {
+	case "on":
+		c.Color = true
+	case "off":
+		c.Color = false
+	}
+	if noColor {
+		c.Color = false
+	}
+	if cfg.LogWidth > 0 {
+		c.Width = cfg.LogWidth
+	}
+}
+
+// Write lets the console be the output of a log.Logger, every write is one message without code
+func (c *Console) Write(p []byte) (int, error) {
+	c.Event("", string(p))
+	return len(p), nil
+}
+
+// Event writes the message, with every line prefixed
+func (c *Console) Event(code, msg string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ts := c.now().Format(time.RFC3339)
+	prefix := ts + " cosmosd "
+	colored := colorDim + ts + colorReset + " " + colorName + "cosmosd" + colorReset + " "
+	if code != "" {
+		prefix += "[" + code + "] "
+		colored += colorCode + "[" + code + "]" + colorReset + " "
+	}
+	for _, line := range strings.Split(strings.TrimRight(msg, "\n"), "\n") {
+		// the width applies to what is visible, escape codes don't take any room
+		if c.Width > 0 {
+			line = truncate(line, c.Width-utf8.RuneCountInString(prefix))
+		}
+		if c.Color {
+			fmt.Fprintf(c.out, "%s%s\n", colored, line)
+		} else {
+			fmt.Fprintf(c.out, "%s%s\n", prefix, line)
+		}
+	}
+}
+
+// truncate cuts s to width runes, marking the cut with an ellipsis
+func truncate(s string, width int) string {
+	if width < 4 {
+		width = 4
+	}
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:width-3]) + "..."
+}
+
+// stripNoColor removes the --no-color flag given before the command, as in `cosmosd --no-color start`
+func stripNoColor(args []string) ([]string, bool) {
+	return stripLeadingFlag(args, "--no-color")
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsole(t *testing.T) {
+	now := func() time.Time { return time.Date(2020, 2, 3, 11, 22, 33, 0, time.UTC) }
+
+	cases := map[string]struct {
+		color bool
+		width int
+		code  string
+		msg   string
+		out   string
+	}{
+		"plain": {
+			msg: "polling for upgrade: timeout\n",
+			out: "2020-02-03T11:22:33Z cosmosd polling for upgrade: timeout\n",
+		},
+		"event": {
+			code: "halted",
+			msg:  "output matched",
+			out:  "2020-02-03T11:22:33Z cosmosd [halted] output matched\n",
+		},
+		"multi line": {
+			msg: "first\nsecond",
+			out: "2020-02-03T11:22:33Z cosmosd first\n2020-02-03T11:22:33Z cosmosd second\n",
+		},
+		"width": {
+			width: 50,
+			code:  "upgrade",
+			msg:   "switched to chain2",
+			out:   "2020-02-03T11:22:33Z cosmosd [upgrade] switched...\n",
+		},
+		"color": {
+			color: true,
+			code:  "halted",
+			msg:   "stop",
+			out:   "\x1b[90m2020-02-03T11:22:33Z\x1b[0m \x1b[1;35mcosmosd\x1b[0m \x1b[33m[halted]\x1b[0m stop\n",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			var out bytes.Buffer
+			c := &Console{out: &out, Color: tc.color, Width: tc.width, now: now}
+			c.Event(tc.code, tc.msg)
+			assert.Equal(t, tc.out, out.String())
+		})
+	}
+
+	// a logger writing to the console
+	var out bytes.Buffer
+	c := &Console{out: &out, Color: true, now: now}
+	c.Configure(&Config{LogWidth: 80}, true)
+	log.New(c, "", 0).Printf("cannot record history: %s", "disk full")
+	assert.Equal(t, "2020-02-03T11:22:33Z cosmosd cannot record history: disk full\n", out.String())
+	assert.Equal(t, 80, c.Width)
+
+	args, noColor := stripNoColor([]string{"--no-color", "start", "--no-color"})
+	assert.True(t, noColor)
+	assert.Equal(t, []string{"start", "--no-color"}, args)
+	args, noColor = stripNoColor([]string{"--detach", "--no-color", "start"})
+	assert.True(t, noColor)
+	assert.Equal(t, []string{"--detach", "start"}, args)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// superviseProcess launches the daemon until it exits for good. With RestartAfterUpgrade it is launched again
+// after a successful upgrade (the only condition LaunchProcess returns nil), and always after the watchdog stopped a
+// stalled daemon, after a backoff. With RestartOnCrash, a daemon that crashed is launched again after a backoff.
+func superviseProcess(cfg *Config, args []string, stdout, stderr io.Writer) error {
+	crashes, stalls := 0, 0
+	for {
+		started := time.Now()
+		err := LaunchProcess(cfg, args, stdout, stderr)
+		if cfg.RestartAfterUpgrade && err == nil || err == errRestarted {
+			crashes, stalls = 0, 0
+			continue
+		}
+		if err == errStalled {
+			// a chain which stays stalled would be restarted at every stall timeout, so it backs off like crashes do.
+			// The daemon always runs the stall timeout, it made blocks if it ran for longer than the backoff too.
+			crashes = 0
+			if time.Since(started)-cfg.StallTimeout >= orDefault(cfg.CrashRestartMaxDelay, defaultCrashRestartMaxDelay) {
+				stalls = 0
+			}
+			stalls++
+			delay := cfg.crashRestartDelay(stalls)
+			logger.Printf("the chain stalled %d times in a row, restarting the daemon in %s", stalls, delay)
+			time.Sleep(delay)
+			continue
+		}
+		stalls = 0
+		if !cfg.RestartOnCrash || !crashed(err) {
+			return err
+		}
+		// a daemon which ran for a while crashed anew, rather than in a row
+		ran := time.Since(started)
+		if ran >= orDefault(cfg.CrashRestartMaxDelay, defaultCrashRestartMaxDelay) {
+			crashes = 0
+		}
+		crashes++
+		delay := cfg.crashRestartDelay(crashes)
+		cfg.Notify(Event{
+			Type:    "daemon_crashed",
+			Message: fmt.Sprintf("the daemon crashed after %s (%v), restarting in %s", ran.Round(time.Second), err, delay),
+			Fields: map[string]string{
+				"ERROR":      err.Error(),
+				"CRASHES":    fmt.Sprint(crashes),
+				"RESTART_IN": delay.String(),
+			},
+		})
+		entry := HistoryEntry{Type: "daemon_crashed", Upgrade: cfg.currentUpgradeName(), Fields: map[string]string{"error": err.Error()}}
+		if err := cfg.RecordHistory(entry); err != nil {
+			logger.Printf("cannot record history: %v", err)
+		}
+		time.Sleep(delay)
+	}
+}
+
+// crashed is whether the daemon exited with an error by itself (a panic, the OOM killer, ...), rather than
+// being stopped by us or the operator, or failing to start at all
+func crashed(err error) bool {
+	switch errors.Cause(err).(type) {
+	case *exec.ExitError, *OOMError:
+		return true
+	}
+	return false
+}
+
+// crashRestartDelay is how long to wait before launching the daemon after crash (from 1) in a row:
+// CrashRestartDelay doubled for every crash before, at most CrashRestartMaxDelay
+func (cfg *Config) crashRestartDelay(crash int) time.Duration {
+	delay := cfg.CrashRestartDelay
+	max := orDefault(cfg.CrashRestartMaxDelay, defaultCrashRestartMaxDelay)
+	for i := 1; i < crash && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
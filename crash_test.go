@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestartOnCrash(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as daemon")
+	}
+	cases := map[string]struct {
+		restart bool
+		// the daemon crashes that many times before it exits cleanly
+		crashes  int
+		launches string
+		err      bool
+	}{
+		"off":                {crashes: 2, launches: "run\n", err: true},
+		"restarted":          {restart: true, crashes: 2, launches: "run\nrun\nrun\n"},
+		"clean exit as ever": {restart: true, launches: "run\n"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			home, err := copyTestData("validate")
+			require.NoError(t, err)
+			defer os.RemoveAll(home)
+			launches := filepath.Join(home, "launches")
+			script := fmt.Sprintf("#!/bin/sh\necho run >> %s\n[ $(wc -l < %s) -gt %d ] || exit 1\n", launches, launches, tc.crashes)
+			cfg := &Config{Home: home, Name: "dummyd", RestartOnCrash: tc.restart, CrashRestartDelay: 10 * time.Millisecond}
+			require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+
+			var stdout, stderr bytes.Buffer
+			err = superviseProcess(cfg, []string{"start"}, &stdout, &stderr)
+			if tc.err {
+				assert.True(t, crashed(err), "%v", err)
+			} else {
+				assert.NoError(t, err)
+			}
+			bz, err := ioutil.ReadFile(launches)
+			require.NoError(t, err)
+			assert.Equal(t, tc.launches, string(bz))
+		})
+	}
+}
+
+func TestRestartStalled(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as daemon")
+	}
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	launches := filepath.Join(home, "launches")
+	// stalls twice, then exits cleanly
+	script := fmt.Sprintf("#!/bin/sh\necho run >> %s\n[ $(wc -l < %s) -gt 2 ] && exit 0\n"+
+		"echo 'INF committed state height=1 module=state'\nexec sleep 30\n", launches, launches)
+	cfg := &Config{Home: home, Name: "dummyd", StallTimeout: 200 * time.Millisecond, StallAction: "restart",
+		CrashRestartDelay: 300 * time.Millisecond}
+	require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+
+	var stdout, stderr bytes.Buffer
+	start := time.Now()
+	require.NoError(t, superviseProcess(cfg, []string{"start"}, &stdout, &stderr))
+	bz, err := ioutil.ReadFile(launches)
+	require.NoError(t, err)
+	assert.Equal(t, "run\nrun\nrun\n", string(bz))
+	// backed off 300ms, then 600ms
+	assert.True(t, time.Since(start) >= 900*time.Millisecond, "%s", time.Since(start))
+}
+
+func TestRestartRequested(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as daemon")
+	}
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	launches := filepath.Join(home, "launches")
+	// runs until restarted once, then exits cleanly
+	script := fmt.Sprintf("#!/bin/sh\necho run >> %s\n[ $(wc -l < %s) -gt 1 ] && exit 0\nexec sleep 30\n", launches, launches)
+	cfg := &Config{Home: home, Name: "dummyd", ShutdownGrace: time.Second}
+	require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+
+	go func() {
+		// the file exists before the shell wrote to it
+		for {
+			if bz, _ := ioutil.ReadFile(launches); string(bz) == "run\n" {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		restarts <- struct{}{}
+	}()
+	var stdout, stderr bytes.Buffer
+	require.NoError(t, superviseProcess(cfg, []string{"start"}, &stdout, &stderr))
+	bz, err := ioutil.ReadFile(launches)
+	require.NoError(t, err)
+	assert.Equal(t, "run\nrun\n", string(bz))
+}
+
+func TestCrashed(t *testing.T) {
+	exitErr := exec.Command("false").Run()
+	assert.True(t, crashed(exitErr))
+	assert.True(t, crashed(&OOMError{Evidence: "the kernel log", Err: exitErr}))
+	assert.True(t, crashed(errors.Wrap(exitErr, "running")))
+	assert.False(t, crashed(nil))
+	assert.False(t, crashed(errStopped))
+	assert.False(t, crashed(errStalled))
+	assert.False(t, crashed(errRestarted))
+	assert.False(t, crashed(&FatalError{}))
+}
+
+func TestCrashRestartDelay(t *testing.T) {
+	cfg := &Config{CrashRestartDelay: time.Second, CrashRestartMaxDelay: 10 * time.Second}
+	var delays []time.Duration
+	for crash := 1; crash <= 6; crash++ {
+		delays = append(delays, cfg.crashRestartDelay(crash))
+	}
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}, delays)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// detachedEnv tells the upgrade manager started by --detach that it runs in the background, and reports the
+	// pid of the daemon on detachFD once it started it
+	detachedEnv = "COSMOSD_DETACHED"
+	detachFD    = 3
+	// detachLog and detachPIDFile are in the root, the pid file unless DAEMON_PID_FILE is set
+	detachLog     = "cosmosd.log"
+	detachPIDFile = "cosmosd.pid"
+)
+
+// stripDetach removes the --detach flag given before the command, as in `cosmosd --detach start`
+func stripDetach(args []string) ([]string, bool) {
+	return stripLeadingFlag(args, "--detach")
+}
+
+// executable is the upgrade manager --detach starts again
+var executable = os.Executable
+
+// detached reports the daemon started to whoever started us with --detach, once
+var detached = struct {
+	sync.Mutex
+	w *os.File
+}{}
+
+// openDetached is called in the upgrade manager started by --detach, so the daemon we start is reported back
+func (cfg *Config) openDetached() {
+	os.Unsetenv(detachedEnv)
+	detached.w = os.NewFile(detachFD, "detach")
+	closeOnExec(detached.w)
+	if cfg.PIDFile == "" {
+		cfg.PIDFile = filepath.Join(cfg.Root(), detachPIDFile)
+	}
+}
+
+// reportDetached tells whoever started us with --detach that the daemon runs with pid
+func reportDetached(pid int) {
+	detached.Lock()
+	defer detached.Unlock()
+	if detached.w == nil {
+		return
+	}
+	fmt.Fprintln(detached.w, pid)
+	detached.w.Close()
+	detached.w = nil
+}
+
+// detach starts the upgrade manager again in the background to run args (with --no-color if noColor), its output
+// going to cosmosd.log, and returns once it started the daemon, or failed
+func (cfg *Config) detach(args []string, noColor bool, out io.Writer) error {
+	attr, err := detachAttr()
+	if err != nil {
+		return err
+	}
+	args = append([]string{"run"}, args...)
+	if noColor {
+		args = append([]string{"--no-color"}, args...)
+	}
+	exe, err := executable()
+	if err != nil {
+		return errors.Wrap(err, "finding our executable")
+	}
+	logPath := filepath.Join(cfg.Root(), detachLog)
+	logFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrap(err, "opening log")
+	}
+	defer logFile.Close()
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(exe, args...)
+	cmd.Env = append(os.Environ(), detachedEnv+"=1")
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = attr
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return errors.Wrap(err, "starting in the background")
+	}
+	// we don't wait for it, but the pipe closes if it exits before the daemon started
+	go cmd.Wait()
+	line, _ := bufio.NewReader(r).ReadString('\n')
+	pid := strings.TrimSpace(line)
+	if pid == "" {
+		return errors.Errorf("the upgrade manager exited before the daemon started, see %s", logPath)
+	}
+	pidFile := cfg.PIDFile
+	if pidFile == "" {
+		pidFile = filepath.Join(cfg.Root(), detachPIDFile)
+	}
+	fmt.Fprintf(out, "cosmosd runs in the background with pid %d (in %s), the daemon with pid %s, logging to %s\n",
+		cmd.Process.Pid, pidFile, pid, logPath)
+	return nil
+}
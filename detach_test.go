@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStripDetach(t *testing.T) {
+	args, detach := stripDetach([]string{"--detach", "start", "--home", "/node"})
+	assert.True(t, detach)
+	assert.Equal(t, []string{"start", "--home", "/node"}, args)
+	// only before the command, after it the flag is the daemon's
+	args, detach = stripDetach([]string{"start", "--detach"})
+	assert.False(t, detach)
+	assert.Equal(t, []string{"start", "--detach"}, args)
+	// our flags come in any order
+	args, detach = stripDetach([]string{"--no-color", "--detach", "start"})
+	assert.True(t, detach)
+	assert.Equal(t, []string{"--no-color", "start"}, args)
+}
+
+// TestDetach starts a script in place of the upgrade manager, which reports a daemon
+func TestDetach(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as the upgrade manager")
+	}
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+	argsFile := filepath.Join(home, "args")
+	script := filepath.Join(home, "cosmosd")
+	run := "#!/bin/sh\necho \"$@\" $" + detachedEnv + " > " + argsFile + "\necho 4242 >&3\n"
+	require.NoError(t, ioutil.WriteFile(script, []byte(run), 0755))
+	defer func(exe func() (string, error)) { executable = exe }(executable)
+	executable = func() (string, error) { return script, nil }
+
+	var out bytes.Buffer
+	require.NoError(t, cfg.detach([]string{"start", "--home", home}, true, &out))
+	assert.Contains(t, out.String(), "the daemon with pid 4242")
+	assert.Contains(t, out.String(), filepath.Join(cfg.Root(), detachLog))
+	bz, err := ioutil.ReadFile(argsFile)
+	require.NoError(t, err)
+	assert.Equal(t, "--no-color run start --home "+home+" 1\n", string(bz))
+
+	// without a daemon started, it fails
+	require.NoError(t, ioutil.WriteFile(script, []byte("#!/bin/sh\nexit 1\n"), 0755))
+	err = cfg.detach([]string{"start"}, false, &out)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "exited before the daemon started")
+}
+
+func TestReportDetached(t *testing.T) {
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+	detached.w = w
+
+	// only the first daemon is reported, and the pipe closed
+	reportDetached(4242)
+	reportDetached(4343)
+	bz, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "4242\n", string(bz))
+}
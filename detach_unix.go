@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// detachAttr starts the upgrade manager in a session of its own, so it outlives the terminal we were started from
+func detachAttr() (*syscall.SysProcAttr, error) {
+	return &syscall.SysProcAttr{Setsid: true}, nil
+}
+
+// closeOnExec keeps f from the daemon
+func closeOnExec(f *os.File) {
+	syscall.CloseOnExec(int(f.Fd()))
+}
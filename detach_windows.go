@@ -0,0 +1,15 @@
+package main
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// detachAttr fails, as the pid of the daemon cannot be passed back on windows
+func detachAttr() (*syscall.SysProcAttr, error) {
+	return nil, errors.New("--detach is not supported on windows")
+}
+
+func closeOnExec(f *os.File) {}
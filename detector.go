@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// detectorsPath is where the admin api tells how each detector fared
+const detectorsPath = "/detectors"
+
+// defaultDetectors are all ways an upgrade is found, by priority: upgrade-info.json, trigger.json, upgrades.json,
+// the plan the node reports, a line of output, and an upgrade injected through the admin api
+var defaultDetectors = []string{"file", "trigger", "planned", "rpc", "log", "inject"}
+
+// parseDetectors reads the detectors to use by priority, separated by commas
+func parseDetectors(value string) ([]string, error) {
+	var detectors []string
+	seen := map[string]bool{}
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if !hasToken([]string{name}, defaultDetectors) {
+			return nil, errors.Errorf("%s is not one of %s", name, strings.Join(defaultDetectors, ", "))
+		}
+		if seen[name] {
+			return nil, errors.Errorf("%s is listed twice", name)
+		}
+		seen[name] = true
+		detectors = append(detectors, name)
+	}
+	return detectors, nil
+}
+
+// detectors returns the detectors of DAEMON_DETECTORS by priority, or all of them
+func (cfg *Config) detectors() []string {
+	if len(cfg.Detectors) == 0 {
+		return defaultDetectors
+	}
+	return cfg.Detectors
+}
+
+// detects is whether the named detector is used
+func (cfg *Config) detects(name string) bool {
+	return hasToken([]string{name}, cfg.detectors())
+}
+
+// DetectorStatus is what the admin api reports for each detector
+type DetectorStatus struct {
+	// SchemaVersion is the version of the status, see SchemaVersion
+	SchemaVersion int `json:"schema_version"`
+
+	Name     string `json:"name"`
+	Priority int    `json:"priority"`
+	Enabled  bool   `json:"enabled"`
+	// Detected counts the upgrades it found which were applied, Ignored the ones a detector of higher priority disagreed with
+	Detected    uint64       `json:"detected"`
+	Ignored     uint64       `json:"ignored"`
+	Last        *UpgradeInfo `json:"last,omitempty"`
+	LastTime    time.Time    `json:"last_time,omitempty"`
+	LastIgnored *UpgradeInfo `json:"last_ignored,omitempty"`
+	Conflict    string       `json:"conflict,omitempty"`
+}
+
+// detectorStatus is kept over all launches of the daemon
+var detectorStatus = struct {
+	sync.Mutex
+	byName map[string]*DetectorStatus
+}{byName: map[string]*DetectorStatus{}}
+
+// Detectors find upgrades in the order of DAEMON_DETECTORS. An upgrade a detector finds is ignored if one of
+// higher priority knows the same upgrade at another height, or another upgrade at the same height.
+type Detectors struct {
+	cfg   *Config
+	order []string
+	// poll are the detectors checked every poll interval, known tell what a detector knows of before it is due
+	poll  map[string]func() (*UpgradeInfo, error)
+	known map[string]func() *UpgradeInfo
+}
+
+// NewDetectors sets up the detectors for a launch of the daemon, the ones only known after it exited don't poll
+func (cfg *Config) NewDetectors(upgradeFile *UpgradeInfoWatcher, trigger *Trigger, heights *Heights, plans *PlanDetector) *Detectors {
+	d := &Detectors{
+		cfg:   cfg,
+		order: cfg.detectors(),
+		poll: map[string]func() (*UpgradeInfo, error){
+			"file":    upgradeFile.Check,
+			"trigger": trigger.Check,
+			"planned": func() (*UpgradeInfo, error) { return cfg.checkPlanned(heights) },
+		},
+		known: map[string]func() *UpgradeInfo{
+			"file": upgradeFile.Peek,
+			"trigger": func() *UpgradeInfo {
+				info, _ := cfg.PendingTrigger()
+				return info
+			},
+			"planned": func() *UpgradeInfo {
+				info, _ := cfg.NextPlannedUpgrade()
+				return info
+			},
+		},
+	}
+	if plans != nil {
+		d.poll["rpc"] = plans.Check
+		d.known["rpc"] = plans.Plan
+	}
+	detectorStatus.Lock()
+	defer detectorStatus.Unlock()
+	for _, name := range defaultDetectors {
+		status, ok := detectorStatus.byName[name]
+		if !ok {
+			status = &DetectorStatus{Name: name}
+			detectorStatus.byName[name] = status
+		}
+		status.Enabled, status.Priority = false, 0
+	}
+	for i, name := range d.order {
+		detectorStatus.byName[name].Enabled, detectorStatus.byName[name].Priority = true, i+1
+	}
+	return d
+}
+
+// Poll asks the polling detectors by priority, and returns the first upgrade that is due
+func (d *Detectors) Poll() (*UpgradeInfo, error) {
+	for _, name := range d.order {
+		check, ok := d.poll[name]
+		if !ok {
+			continue
+		}
+		info, err := check()
+		if err != nil {
+			return nil, err
+		}
+		if info != nil && d.Accept(name, info) == nil {
+			return info, nil
+		}
+	}
+	return nil, nil
+}
+
+// Accept returns an error if the detector is not used, or one of higher priority disagrees with the upgrade
+// it found. Otherwise, the upgrade is counted as detected by it.
+func (d *Detectors) Accept(name string, info *UpgradeInfo) error {
+	priority := -1
+	for i, detector := range d.order {
+		if detector == name {
+			priority = i
+		}
+	}
+	if priority < 0 {
+		return errors.Errorf("the %s detector is not in %s", name, d.cfg.envName("DAEMON_DETECTORS"))
+	}
+	for _, higher := range d.order[:priority] {
+		known, ok := d.known[higher]
+		if !ok {
+			continue
+		}
+		if other := known(); other != nil && disagree(other, info) {
+			conflict := fmt.Sprintf("%s knows upgrade %s at height %d", higher, other.Name, other.Height)
+			d.ignored(name, info, conflict)
+			return errors.New(conflict)
+		}
+	}
+	detectorStatus.Lock()
+	defer detectorStatus.Unlock()
+	status := detectorStatus.byName[name]
+	status.Detected++
+	status.Last, status.LastTime = info, time.Now()
+	return nil
+}
+
+// ignored counts the upgrade the detector found as ignored, and tells the operator the first time
+func (d *Detectors) ignored(name string, info *UpgradeInfo, conflict string) {
+	detectorStatus.Lock()
+	status := detectorStatus.byName[name]
+	status.Ignored++
+	repeated := status.LastIgnored != nil && *status.LastIgnored == *info && status.Conflict == conflict
+	status.LastIgnored, status.Conflict = info, conflict
+	detectorStatus.Unlock()
+	if repeated {
+		return
+	}
+	d.cfg.Notify(Event{
+		Type:    "detector_conflict",
+		Message: fmt.Sprintf("ignoring upgrade %s at height %d from %s, %s", info.Name, info.Height, name, conflict),
+		Fields:  map[string]string{"DETECTOR": name, "UPGRADE": info.Name, "HEIGHT": strconv.FormatInt(info.Height, 10), "CONFLICT": conflict},
+	})
+}
+
+// disagree is true if two detectors tell different heights for one upgrade, or different upgrades at one height.
+// An upgrade without a height (eg. a trigger to apply at once) only has its name to go by.
+func disagree(a, b *UpgradeInfo) bool {
+	if a.Height <= 0 || b.Height <= 0 {
+		return false
+	}
+	return (a.Name == b.Name) != (a.Height == b.Height)
+}
+
+// serveDetectors reports the detectors by priority, the unused ones last
+func serveDetectors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	detectorStatus.Lock()
+	var enabled, disabled []DetectorStatus
+	for _, name := range defaultDetectors {
+		status, ok := detectorStatus.byName[name]
+		switch {
+		case !ok:
+			disabled = append(disabled, DetectorStatus{Name: name})
+		case status.Enabled:
+			enabled = append(enabled, *status)
+		default:
+			disabled = append(disabled, *status)
+		}
+	}
+	detectorStatus.Unlock()
+	sort.SliceStable(enabled, func(i, j int) bool { return enabled[i].Priority < enabled[j].Priority })
+	all := append(enabled, disabled...)
+	for i := range all {
+		all[i].SchemaVersion = SchemaVersion
+	}
+	writeJSON(w, all)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDetectors(t *testing.T) {
+	detectors, err := parseDetectors(" trigger, log ,file")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"trigger", "log", "file"}, detectors)
+
+	detectors, err = parseDetectors("")
+	require.NoError(t, err)
+	assert.Empty(t, detectors)
+	assert.Equal(t, defaultDetectors, (&Config{}).detectors())
+
+	_, err = parseDetectors("file,journald")
+	assert.Error(t, err)
+	_, err = parseDetectors("file,log,file")
+	assert.Error(t, err)
+}
+
+func TestDetectors(t *testing.T) {
+	home, err := ioutil.TempDir("", "upgrade-manager-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd", AdminToken: testAdminToken}
+	require.NoError(t, os.MkdirAll(cfg.Root(), 0755))
+	require.NoError(t, os.MkdirAll(cfg.DataDir(), 0755))
+	// the status is kept over all launches, including the ones of other tests
+	detectorStatus.Lock()
+	detectorStatus.byName = map[string]*DetectorStatus{}
+	detectorStatus.Unlock()
+
+	detectors := func() *Detectors {
+		heights := cfg.NewHeights()
+		trigger := cfg.NewTrigger(heights)
+		defer trigger.Stop()
+		return cfg.NewDetectors(NewUpgradeInfoWatcher(cfg.UpgradeInfoFile()), trigger, heights, nil)
+	}
+
+	// the file has priority over the log, which may not tell another height for its upgrade
+	d := detectors()
+	info, err := d.Poll()
+	require.NoError(t, err)
+	assert.Nil(t, info)
+	require.NoError(t, ioutil.WriteFile(cfg.UpgradeInfoFile(), []byte(`{"name":"v2","height":100}`), 0644))
+	err = d.Accept("log", &UpgradeInfo{Name: "v2", Height: 90})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "file knows upgrade v2 at height 100")
+	assert.Error(t, d.Accept("log", &UpgradeInfo{Name: "v3", Height: 100}))
+	assert.NoError(t, d.Accept("log", &UpgradeInfo{Name: "v2", Height: 100}))
+	assert.NoError(t, d.Accept("log", &UpgradeInfo{Name: "v3", Height: 200}))
+	info, err = d.Poll()
+	require.NoError(t, err)
+	assert.Equal(t, &UpgradeInfo{Name: "v2", Height: 100}, info)
+
+	// with the trigger first, the file disagreeing with it is ignored
+	cfg.Detectors = []string{"trigger", "file", "log"}
+	d = detectors()
+	require.NoError(t, cfg.WriteTrigger(&UpgradeInfo{Name: "v2-fixed", Height: 120}))
+	require.NoError(t, ioutil.WriteFile(cfg.UpgradeInfoFile(), []byte(`{"name":"v2","height":120}`), 0644))
+	info, err = d.Poll()
+	require.NoError(t, err)
+	assert.Nil(t, info)
+	err = d.Accept("inject", &UpgradeInfo{Name: "v2-fixed", Height: 120})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not in DAEMON_DETECTORS")
+
+	rec := httptest.NewRecorder()
+	cfg.adminHandler().ServeHTTP(rec, adminRequest("GET", detectorsPath, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var status []DetectorStatus
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	require.Len(t, status, len(defaultDetectors))
+	assert.Equal(t, "trigger", status[0].Name)
+	assert.Equal(t, "file", status[1].Name)
+	assert.Equal(t, 2, status[1].Priority)
+	assert.Equal(t, "v2", status[1].LastIgnored.Name)
+	assert.Contains(t, status[1].Conflict, "trigger knows upgrade v2-fixed at height 120")
+	assert.Equal(t, "log", status[2].Name)
+	assert.Equal(t, uint64(2), status[2].Detected)
+	assert.Equal(t, uint64(2), status[2].Ignored)
+	assert.False(t, status[3].Enabled)
+
+	// injecting is refused along with the detector
+	rec = httptest.NewRecorder()
+	req := adminRequest("POST", injectPath+"?name=v3&height=10", nil)
+	cfg.adminHandler().ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var byteUnits = []struct {
+	suffix string
+	size   uint64
+}{
+	// longest suffixes first, so "MB" is not read as "B"
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"T", 1 << 40},
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+	{"B", 1},
+}
+
+// parseByteSize reads a human readable size like 512MB, 10G or 1024 into bytes.
+// Units are powers of 1024.
+func parseByteSize(s string) (uint64, error) {
+	val := strings.ToUpper(strings.TrimSpace(s))
+	mult := uint64(1)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(val, unit.suffix) {
+			val = strings.TrimSpace(strings.TrimSuffix(val, unit.suffix))
+			mult = unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(val, 64)
+	if err != nil || n < 0 {
+		return 0, errors.Errorf("invalid size: %s", s)
+	}
+	return uint64(n * float64(mult)), nil
+}
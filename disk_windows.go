@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// freeSpace is not implemented on windows
+func freeSpace(path string) (uint64, error) {
+	return 0, errors.New("free space check not supported on windows")
+}
+
+// linkCount returns the number of hard links to the file at path, which windows only tells of an open file.
+// It is 0 if the file cannot be opened, so we never assume a file is unused.
+func linkCount(path string, info os.FileInfo) uint64 {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0
+	}
+	share := uint32(syscall.FILE_SHARE_READ | syscall.FILE_SHARE_WRITE | syscall.FILE_SHARE_DELETE)
+	h, err := syscall.CreateFile(name, 0, share, nil, syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return 0
+	}
+	defer syscall.CloseHandle(h)
+	var data syscall.ByHandleFileInformation
+	if err := syscall.GetFileInformationByHandle(h, &data); err != nil {
+		return 0
+	}
+	return uint64(data.NumberOfLinks)
+}
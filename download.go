@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	getter "github.com/hashicorp/go-getter"
+	"github.com/pkg/errors"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// downloadClient returns the http client used for all downloads
+func (cfg *Config) downloadClient() *http.Client {
+	transport := &http.Transport{
+		Proxy: cfg.httpProxy(),
+		DialContext: (&net.Dialer{
+			Timeout:   orDefault(cfg.DownloadConnectTimeout, defaultDownloadConnectTimeout),
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	// host names are passed to the socks proxy unresolved, so this works with .onion mirrors
+	if cfg.SocksProxy != nil {
+		transport.Proxy = http.ProxyURL(cfg.SocksProxy)
+	}
+	if cfg.DownloadCAs != nil {
+		transport.TLSClientConfig = &tls.Config{RootCAs: cfg.DownloadCAs}
+	}
+	var base http.RoundTripper = transport
+	if headers := cfg.downloadHeaders(); len(headers) > 0 {
+		base = &headerTransport{base: base, headers: headers}
+	}
+	if cfg.RequireHTTPS {
+		base = &httpsTransport{base: base, env: cfg.envName("DAEMON_REQUIRE_HTTPS")}
+	}
+	if cfg.DownloadMaxSize > 0 {
+		base = &sizeLimitedTransport{base: base, max: cfg.DownloadMaxSize, env: cfg.envName("DAEMON_DOWNLOAD_MAX_SIZE")}
+	}
+	if cfg.DownloadRateLimit > 0 {
+		base = &throttledTransport{base: base, limiter: sharedRateLimiter(cfg.DownloadRateLimit)}
+	}
+	return &http.Client{Transport: base, Timeout: cfg.DownloadTimeout}
+}
+
+// httpsTransport refuses every request in cleartext, redirects included. env names the setting it is for.
+type httpsTransport struct {
+	base http.RoundTripper
+	env  string
+}
+
+func (t *httpsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := checkHTTPS(req.URL, t.env); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
+
+// checkHTTPS refuses plain http, as the setting env says, except to this host (eg. the api of a local ipfs node),
+// where nothing goes over the network
+func checkHTTPS(u *url.URL, env string) error {
+	if u.Scheme != "http" {
+		return nil
+	}
+	host := u.Hostname()
+	if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return nil
+	}
+	return errors.Errorf("refusing to download %s over plain http, %s is on", redactURL(u.String()), env)
+}
+
+// requireHTTPS checks a url we download from, with DAEMON_REQUIRE_HTTPS on. Urls of other getters (eg.
+// git::http://) are checked here, the ones of http(s) downloads again by the download client for every redirect.
+func (cfg *Config) requireHTTPS(artifact string) error {
+	if !cfg.RequireHTTPS {
+		return nil
+	}
+	if i := strings.Index(artifact, "::"); i >= 0 && !strings.Contains(artifact[:i], "/") {
+		artifact = artifact[i+2:]
+	}
+	u, err := url.Parse(artifact)
+	if err != nil {
+		return errors.Wrap(err, "parsing binary url")
+	}
+	return checkHTTPS(u, cfg.envName("DAEMON_REQUIRE_HTTPS"))
+}
+
+// loadCABundle reads the pem certificates downloads are verified with, instead of the ones of the system
+func loadCABundle(file string) (*x509.CertPool, error) {
+	bz, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bz) {
+		return nil, errors.Errorf("no pem certificates in %s", file)
+	}
+	return pool, nil
+}
+
+// contextTransport gives up every request once ctx is done, even one stuck reading the body from a stalled
+// connection, which go-getter only checks its context between reads for
+type contextTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(req.WithContext(t.ctx))
+}
+
+// getterOptions makes go-getter fetch http(s) and oci:// urls with our download client, and ipfs:// urls and
+// torrents as configured
+func (cfg *Config) getterOptions() []getter.ClientOption {
+	return cfg.downloadOptions(context.Background())
+}
+
+// downloadOptions work like getterOptions, but give up every download once ctx is done
+func (cfg *Config) downloadOptions(ctx context.Context) []getter.ClientOption {
+	client := cfg.downloadClient()
+	if ctx != context.Background() {
+		client.Transport = &contextTransport{ctx: ctx, base: client.Transport}
+	}
+	httpGetter := &getter.HttpGetter{
+		Netrc:  true,
+		Client: client,
+	}
+	getters := make(map[string]getter.Getter, len(getter.Getters))
+	for scheme, g := range getter.Getters {
+		getters[scheme] = g
+	}
+	chunkedGetter := &chunkedGetter{HttpGetter: httpGetter, connections: cfg.DownloadConnections}
+	getters["http"] = chunkedGetter
+	getters["https"] = chunkedGetter
+	getters["ipfs"] = &ipfsGetter{gateway: cfg.IPFSGateway, api: cfg.IPFSAPI, http: httpGetter, client: client}
+	getters["oci"] = &ociGetter{name: cfg.Name, client: client, credentials: cfg.OCICredentials}
+	torrentGetter := &torrentGetter{ctx: ctx, name: cfg.Name, command: cfg.TorrentClient, seedDir: filepath.Join(cfg.Root(), seedingDir),
+		seedTime: cfg.TorrentSeedTime}
+	getters["torrent"] = torrentGetter
+	getters["magnet"] = torrentGetter
+	// the rest do not use our client, so they would connect around the proxy
+	if cfg.SocksProxy != nil {
+		for _, scheme := range []string{"git", "hg", "s3", "gcs", "torrent", "magnet"} {
+			getters[scheme] = &unproxiedGetter{scheme: scheme}
+		}
+	}
+
+	return []getter.ClientOption{getter.WithContext(ctx), func(c *getter.Client) error {
+		c.Getters = getters
+		return nil
+	}}
+}
+
+// unproxiedGetter refuses the downloads which cannot go through DAEMON_DOWNLOAD_SOCKS5_PROXY, as the proxy may well
+// be all that hides the node (eg. Tor)
+type unproxiedGetter struct {
+	scheme string
+}
+
+func (g *unproxiedGetter) ClientMode(*url.URL) (getter.ClientMode, error) {
+	return getter.ClientModeFile, nil
+}
+
+func (g *unproxiedGetter) SetClient(*getter.Client) {}
+
+func (g *unproxiedGetter) Get(dst string, u *url.URL) error {
+	return g.GetFile(dst, u)
+}
+
+func (g *unproxiedGetter) GetFile(dst string, u *url.URL) error {
+	return errors.Errorf("%s downloads cannot go through the socks proxy, refusing to fetch %s", g.scheme, redactURL(u.String()))
+}
+
+// singleFileOnly is the Get of the getters which fetch single files only, it tells why the url cannot be fetched as a
+// directory (what go-getter falls back to) without fetching it again
+func singleFileOnly(u *url.URL, publish string) error {
+	return errors.Errorf("%s is fetched as a single file, %s directories as an archive", redactURL(u.String()), publish)
+}
+
+const downloadsDir = "downloads"
+
+// stagedDownload is where an http(s) artifact is downloaded to first, so a download that broke off resumes
+// with a range request, on the next attempt or after a restart, rather than starting over. oci artifacts and
+// torrents are staged too, to be unpacked like any other download.
+func (cfg *Config) stagedDownload(artifact string) (string, bool) {
+	u, err := url.Parse(artifact)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "oci" && u.Scheme != "magnet") {
+		return "", false
+	}
+	name := u.Query().Get("filename")
+	switch {
+	case name != "":
+	case u.Scheme == "oci":
+		name = ociStagedName(u)
+	case isTorrent(artifact):
+		name = torrentStagedName(u)
+	default:
+		name = path.Base(u.Path)
+	}
+	if name == "" || name == "." || name == "/" {
+		return "", false
+	}
+	// the same file name may well be downloaded from elsewhere
+	key := *u
+	query := key.Query()
+	for _, param := range []string{"checksum", "archive", "filename"} {
+		query.Del(param)
+	}
+	key.RawQuery = query.Encode()
+	hash := sha256.Sum256([]byte(key.String()))
+	return filepath.Join(cfg.Root(), downloadsDir, hex.EncodeToString(hash[:8]), name), true
+}
+
+// stageDownload downloads an http(s) artifact to its staged file, resuming what an earlier attempt left there,
+// or takes it from the shared cache, and returns where the rest of the download takes it from, with the checksum
+// and archive of the url. Other urls are returned as they are.
+func (cfg *Config) stageDownload(artifact string, opts ...getter.ClientOption) (string, error) {
+	staged, ok := cfg.stagedDownload(artifact)
+	if !ok {
+		return artifact, nil
+	}
+	u, err := url.Parse(artifact)
+	if err != nil {
+		return "", errors.Wrap(err, "parsing binary url")
+	}
+	local := url.Values{}
+	query := u.Query()
+	for _, param := range []string{"checksum", "archive"} {
+		if value := query.Get(param); value != "" {
+			local.Set(param, value)
+		}
+		query.Del(param)
+	}
+	query.Del("filename")
+	// the file is taken as it comes, it is verified and unpacked from where it is staged
+	query.Set("archive", "false")
+	u.RawQuery = query.Encode()
+	fetch := u.String()
+	if isTorrent(artifact) && u.Scheme != "magnet" {
+		fetch = "torrent::" + fetch
+	}
+	if cached, ok := cfg.fromSharedCache(artifact); ok {
+		staged = cached
+	} else if err := getter.GetFile(staged, fetch, opts...); err != nil {
+		return "", err
+	}
+	if len(local) == 0 {
+		return staged, nil
+	}
+	return staged + "?" + local.Encode(), nil
+}
+
+// removeStaged removes the staged file of artifact, once it is unpacked or turned out to be corrupt
+func (cfg *Config) removeStaged(artifact string) {
+	if staged, ok := cfg.stagedDownload(artifact); ok {
+		os.RemoveAll(filepath.Dir(staged))
+	}
+}
+
+// copyingOptions fetches local files as copies rather than links, for files which are removed afterwards
+func copyingOptions(opts []getter.ClientOption) []getter.ClientOption {
+	return append(opts, func(c *getter.Client) error {
+		getters := make(map[string]getter.Getter, len(c.Getters))
+		for scheme, g := range c.Getters {
+			getters[scheme] = g
+		}
+		getters["file"] = &getter.FileGetter{Copy: true}
+		c.Getters = getters
+		return nil
+	})
+}
+
+// sourceURL turns s3://bucket/key (with an optional ?region=) and gs://bucket/path (or gcs://) into the urls
+// go-getter takes for them. Either is fetched with the credentials the standard SDKs find: for s3 the
+// AWS_ACCESS_KEY_ID and friends, ~/.aws/credentials (of AWS_PROFILE) or the role of the instance, for gcs
+// GOOGLE_APPLICATION_CREDENTIALS or the service account of the instance. Everything else, eg. git::https://...,
+// is passed on as it is.
+func sourceURL(artifact string) (string, error) {
+	u, err := url.Parse(artifact)
+	if err != nil {
+		return "", errors.Wrap(err, "parsing binary url")
+	}
+	switch u.Scheme {
+	case "s3", "gs", "gcs":
+	default:
+		return artifact, nil
+	}
+	if u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return "", errors.Errorf("%s must be %s://bucket/path", artifact, u.Scheme)
+	}
+	query := u.Query()
+	if u.Scheme == "s3" {
+		host := "s3.amazonaws.com"
+		if region := query.Get("region"); region != "" {
+			host = "s3-" + region + ".amazonaws.com"
+			query.Del("region")
+		}
+		forced := url.URL{Scheme: "https", Host: host, Path: "/" + u.Host + u.Path, RawQuery: query.Encode()}
+		return "s3::" + forced.String(), nil
+	}
+	forced := url.URL{Scheme: "https", Host: "www.googleapis.com", Path: "/storage/v1/" + u.Host + u.Path, RawQuery: query.Encode()}
+	return "gcs::" + forced.String(), nil
+}
+
+// httpProxy picks the proxy of each download like HTTP_PROXY, HTTPS_PROXY and NO_PROXY (or their lowercase forms)
+// tell, with DAEMON_HTTP_PROXY taking the place of both proxies if set. Hosts in NO_PROXY, and loopback addresses,
+// are never proxied.
+func (cfg *Config) httpProxy() func(*http.Request) (*url.URL, error) {
+	env := httpproxy.FromEnvironment()
+	if cfg.HTTPProxy != nil {
+		env.HTTPProxy, env.HTTPSProxy = cfg.HTTPProxy.String(), cfg.HTTPProxy.String()
+	}
+	proxy := env.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxy(req.URL)
+	}
+}
+
+// parseHTTPProxy reads host:port or http(s)://[user:pass@]host:port
+func parseHTTPProxy(proxy string) (*url.URL, error) {
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid http proxy")
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.Errorf("invalid http proxy: %s", proxy)
+	}
+	return u, nil
+}
+
+// parseSocksProxy reads host:port or socks5://[user:pass@]host:port
+func parseSocksProxy(proxy string) (*url.URL, error) {
+	if !strings.Contains(proxy, "://") {
+		proxy = "socks5://" + proxy
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid socks proxy")
+	}
+	// we never resolve names locally with socks, so socks5h means the same
+	if u.Scheme == "socks5h" {
+		u.Scheme = "socks5"
+	}
+	if u.Scheme != "socks5" || u.Host == "" {
+		return nil, errors.Errorf("invalid socks proxy: %s", proxy)
+	}
+	return u, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// the lock file of a download is touched every downloadLockRefresh while we hold it, and taken over once
+// it wasn't for downloadLockStale, as its holder died. Waiting for it, we check every downloadLockPoll.
+var (
+	downloadLockRefresh = 10 * time.Second
+	downloadLockStale   = time.Minute
+	downloadLockPoll    = time.Second
+)
+
+// DownloadLock is held while an upgrade is downloaded, so other upgrade managers sharing the upgrades dir
+// (on the same host, or over NFS) wait for the download instead of writing the same files
+type DownloadLock struct {
+	path  string
+	owner string
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// downloadLockFile is next to the dir of the upgrade, which doesn't exist yet when we start downloading
+func (cfg *Config) downloadLockFile(upgradeName string) string {
+	return filepath.Join(cfg.Root(), upgradesDir, "."+url.PathEscape(upgradeName)+".lock")
+}
+
+// LockDownload waits until no one else downloads the upgrade and takes the lock, until ctx is done
+func (cfg *Config) LockDownload(ctx context.Context, upgradeName string) (*DownloadLock, error) {
+	path := cfg.downloadLockFile(upgradeName)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, errors.Wrap(err, "creating upgrades dir")
+	}
+	host, _ := os.Hostname()
+	owner := fmt.Sprintf("%s pid %d since %s", host, os.Getpid(), time.Now().UTC().Format(time.RFC3339))
+	waiting := false
+	for {
+		locked, err := createLockFile(path, owner, downloadLockStale)
+		if err != nil {
+			return nil, errors.Wrap(err, "download lock")
+		}
+		if locked {
+			lock := &DownloadLock{path: path, owner: owner, stop: make(chan struct{}), done: make(chan struct{})}
+			go lock.refresh()
+			return lock, nil
+		}
+		holder := readLockOwner(path)
+		if !waiting {
+			logger.Printf("waiting for %s to finish downloading %s", holder, upgradeName)
+			waiting = true
+		}
+		select {
+		case <-time.After(downloadLockPoll):
+		case <-ctx.Done():
+			return nil, errors.Wrapf(ctx.Err(), "waiting for %s to finish downloading %s", holder, upgradeName)
+		}
+	}
+}
+
+// refresh touches the lock file, so no one takes it over while we are still downloading
+func (l *DownloadLock) refresh() {
+	defer close(l.done)
+	ticker := time.NewTicker(downloadLockRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			if holder := readLockOwner(l.path); holder != l.owner {
+				logger.Printf("the download lock %s was taken over by %s", l.path, holder)
+				return
+			}
+			now := time.Now()
+			if err := os.Chtimes(l.path, now, now); err != nil {
+				logger.Printf("cannot renew download lock: %v", err)
+			}
+		}
+	}
+}
+
+// Unlock releases the lock, unless someone took it over in the meantime
+func (l *DownloadLock) Unlock() {
+	close(l.stop)
+	<-l.done
+	removeLockFile(l.path, l.owner)
+}
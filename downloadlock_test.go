@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadLock(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as binary")
+	}
+	home, err := ioutil.TempDir("", "upgrade-manager-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	defer func(refresh, stale, poll time.Duration) {
+		downloadLockRefresh, downloadLockStale, downloadLockPoll = refresh, stale, poll
+	}(downloadLockRefresh, downloadLockStale, downloadLockPoll)
+	downloadLockRefresh, downloadLockStale, downloadLockPoll = 20*time.Millisecond, 200*time.Millisecond, 10*time.Millisecond
+
+	// two upgrade managers sharing one home
+	ours := &Config{Home: home, Name: "dummyd", AllowDownloadBinaries: true, UnsafeSkipBackup: true}
+	theirs := &Config{Home: home, Name: "dummyd", AllowDownloadBinaries: true, UnsafeSkipBackup: true}
+	require.NoError(t, os.MkdirAll(ours.DataDir(), 0755))
+
+	// they are downloading, so we wait and take their binary rather than downloading it again, which would
+	// fail, as the upgrade info has no binary for us
+	lock, err := theirs.LockDownload(context.Background(), "v2")
+	require.NoError(t, err)
+	upgraded := make(chan error)
+	go func() {
+		upgraded <- DoUpgrade(ours, &UpgradeInfo{Name: "v2", Info: `{"binaries":{}}`})
+	}()
+	time.Sleep(5 * downloadLockRefresh)
+	select {
+	case err := <-upgraded:
+		t.Fatalf("did not wait for the download: %v", err)
+	default:
+	}
+	bin := theirs.UpgradeBin("v2")
+	require.NoError(t, os.MkdirAll(filepath.Dir(bin), 0755))
+	require.NoError(t, ioutil.WriteFile(bin, []byte("#!/bin/sh\necho v2\n"), 0755))
+	lock.Unlock()
+	require.NoError(t, <-upgraded)
+	assert.Equal(t, bin, ours.CurrentBin())
+	_, err = os.Stat(ours.downloadLockFile("v2"))
+	assert.True(t, os.IsNotExist(err))
+
+	// a lock held longer than it is stale is still ours
+	lock, err = theirs.LockDownload(context.Background(), "v3")
+	require.NoError(t, err)
+	time.Sleep(2 * downloadLockStale)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = ours.LockDownload(ctx, "v3")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "pid")
+	lock.Unlock()
+
+	// the lock of a crashed upgrade manager is taken over
+	path := ours.downloadLockFile("v4")
+	require.NoError(t, ioutil.WriteFile(path, []byte("crashed pid 1\n"), 0644))
+	old := time.Now().Add(-2 * downloadLockStale)
+	require.NoError(t, os.Chtimes(path, old, old))
+	lock, err = ours.LockDownload(context.Background(), "v4")
+	require.NoError(t, err)
+	assert.NotEqual(t, "crashed pid 1", readLockOwner(path))
+	lock.Unlock()
+}
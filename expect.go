@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const expectFile = "expected.json"
+
+// Expectation is what validators agreed out-of-band the chain must look like after an upgrade.
+// It lives in expected.json of the upgrade directory.
+type Expectation struct {
+	Height int64 `json:"height"`
+	// AppHash is the app_hash in the header of block Height (the result of executing the block before)
+	AppHash string `json:"app_hash,omitempty"`
+	// BlockHash is the hash of block Height
+	BlockHash string `json:"block_hash,omitempty"`
+}
+
+// LoadExpectation reads the expectation of the upgrade directory holding bin, or returns nil if it has none
+func LoadExpectation(bin string) (*Expectation, error) {
+	path := filepath.Join(filepath.Dir(filepath.Dir(bin)), expectFile)
+	bz, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "reading expectation")
+	}
+	var exp Expectation
+	if err := json.Unmarshal(bz, &exp); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", path)
+	}
+	if exp.Height <= 0 || (exp.AppHash == "" && exp.BlockHash == "") {
+		return nil, errors.Errorf("%s needs a height and an app_hash or block_hash", path)
+	}
+	return &exp, nil
+}
+
+// blockResponse is the part of the tendermint /block response we compare
+type blockResponse struct {
+	Result struct {
+		BlockID struct {
+			Hash string `json:"hash"`
+		} `json:"block_id"`
+		Block struct {
+			Header struct {
+				AppHash string `json:"app_hash"`
+			} `json:"header"`
+		} `json:"block"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+		Data    string `json:"data"`
+	} `json:"error"`
+}
+
+// CheckExpectation compares the block at the expected height with the expectation.
+// It returns false if the node doesn't have that block yet.
+func (cfg *Config) CheckExpectation(exp *Expectation) (bool, error) {
+	endpoint := strings.TrimSuffix(cfg.RPCAddress, "/") + "/block?height=" + url.QueryEscape(strconv.FormatInt(exp.Height, 10))
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return false, errors.Wrap(err, "creating request")
+	}
+	var res blockResponse
+	client := cfg.rpcClient()
+	err = getJSON(client, req, &res)
+	// the node answers with an error while the height is in the future, which still is an answer
+	if _, answered := err.(*statusError); !answered {
+		cfg.rpcResult(err)
+	}
+	if err != nil || res.Error != nil || res.Result.BlockID.Hash == "" {
+		return false, nil
+	}
+
+	var mismatches []string
+	if exp.AppHash != "" && !strings.EqualFold(exp.AppHash, res.Result.Block.Header.AppHash) {
+		mismatches = append(mismatches, fmt.Sprintf("app hash %s, expected %s", res.Result.Block.Header.AppHash, exp.AppHash))
+	}
+	if exp.BlockHash != "" && !strings.EqualFold(exp.BlockHash, res.Result.BlockID.Hash) {
+		mismatches = append(mismatches, fmt.Sprintf("block hash %s, expected %s", res.Result.BlockID.Hash, exp.BlockHash))
+	}
+	if len(mismatches) > 0 {
+		return true, errors.Errorf("block %d has %s", exp.Height, strings.Join(mismatches, " and "))
+	}
+	return true, nil
+}
+
+// WatchExpectation checks the expectation of the current upgrade every PollInterval, until the block is there
+// or done is closed. A mismatch is notified loudly. The outcome is recorded in the history, so every upgrade is
+// only checked once.
+func (cfg *Config) WatchExpectation(exp *Expectation, upgradeName string, done <-chan struct{}) {
+	history, err := cfg.History()
+	if err != nil {
+		logger.Printf("cannot check expectation: %v", err)
+		return
+	}
+	for _, entry := range history {
+		if entry.Upgrade == upgradeName && (entry.Type == "expectation_met" || entry.Type == "expectation_failed") {
+			return
+		}
+	}
+
+	interval := orDefault(cfg.PollInterval, defaultPollInterval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		found, err := cfg.CheckExpectation(exp)
+		if !found {
+			continue
+		}
+		entry := HistoryEntry{Type: "expectation_met", Upgrade: upgradeName, Fields: map[string]string{"height": strconv.FormatInt(exp.Height, 10)}}
+		if err != nil {
+			entry.Type = "expectation_failed"
+			cfg.Notify(Event{
+				Type:    "expectation_failed",
+				Message: fmt.Sprintf("ALERT: upgrade %s went wrong, %v", upgradeName, err),
+				Fields:  map[string]string{"UPGRADE": upgradeName, "HEIGHT": strconv.FormatInt(exp.Height, 10)},
+			})
+		} else {
+			logger.Printf("block %d after upgrade %s matches the expectation", exp.Height, upgradeName)
+		}
+		if err := cfg.RecordHistory(entry); err != nil {
+			logger.Printf("cannot record history: %v", err)
+		}
+		return
+	}
+}
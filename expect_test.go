@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testAppHash   = "5E1C7C4BB1CF6A8AAFEDE3CC0963CB1B0A5440ED7AC0B1D0E7B7B7AF257E0ABA"
+	testBlockHash = "9F1D2DBA7D0F9B3E2A8A5D7D1E3AD1F0F5E60D5A14B1C27B0AB5B4CDA54C53F2"
+)
+
+// blockNode serves block 101 over a fake tendermint rpc
+func blockNode() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/block" || r.URL.Query().Get("height") != "101" {
+			fmt.Fprint(w, `{"jsonrpc":"2.0","id":-1,"error":{"code":-32603,"message":"Internal error","data":"height 102 must be less than or equal to the current blockchain height 101"}}`)
+			return
+		}
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":-1,"result":{"block_id":{"hash":"%s"},"block":{"header":{"height":"101","app_hash":"%s"}}}}`, testBlockHash, testAppHash)
+	}))
+}
+
+func TestCheckExpectation(t *testing.T) {
+	srv := blockNode()
+	defer srv.Close()
+	cfg := &Config{RPCAddress: srv.URL}
+
+	cases := map[string]struct {
+		exp   Expectation
+		found bool
+		valid bool
+	}{
+		"app hash":         {exp: Expectation{Height: 101, AppHash: testAppHash}, found: true, valid: true},
+		"lower case":       {exp: Expectation{Height: 101, AppHash: "5e1c7c4bb1cf6a8aafede3cc0963cb1b0a5440ed7ac0b1d0e7b7b7af257e0aba"}, found: true, valid: true},
+		"both":             {exp: Expectation{Height: 101, AppHash: testAppHash, BlockHash: testBlockHash}, found: true, valid: true},
+		"wrong app hash":   {exp: Expectation{Height: 101, AppHash: testBlockHash}, found: true},
+		"wrong block hash": {exp: Expectation{Height: 101, AppHash: testAppHash, BlockHash: testAppHash}, found: true},
+		"not there yet":    {exp: Expectation{Height: 102, AppHash: testAppHash}, valid: true},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			found, err := cfg.CheckExpectation(&tc.exp)
+			assert.Equal(t, tc.found, found)
+			if tc.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestWatchExpectation(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	srv := blockNode()
+	defer srv.Close()
+
+	cfg := &Config{Home: home, Name: "dummyd", RPCAddress: srv.URL, PollInterval: 10 * time.Millisecond}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.UpgradeDir("chain2"), expectFile), []byte(`{"height":101,"app_hash":"`+testBlockHash+`"}`), 0644))
+	exp, err := LoadExpectation(cfg.UpgradeBin("chain2"))
+	require.NoError(t, err)
+	require.Equal(t, &Expectation{Height: 101, AppHash: testBlockHash}, exp)
+
+	done := make(chan struct{})
+	defer close(done)
+	cfg.WatchExpectation(exp, "chain2", done)
+	history, err := cfg.History()
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, "expectation_failed", history[0].Type)
+	assert.Equal(t, "chain2", history[0].Upgrade)
+
+	// checked once only
+	cfg.WatchExpectation(exp, "chain2", done)
+	history, err = cfg.History()
+	require.NoError(t, err)
+	assert.Len(t, history, 1)
+
+	// no expectation, or an incomplete one
+	exp, err = LoadExpectation(cfg.UpgradeBin("chain3"))
+	assert.NoError(t, err)
+	assert.Nil(t, exp)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.UpgradeDir("chain3"), expectFile), []byte(`{"height":101}`), 0644))
+	_, err = LoadExpectation(cfg.UpgradeBin("chain3"))
+	assert.Error(t, err)
+}
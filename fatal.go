@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const haltFile = "halted.json"
+
+// FatalError is returned when the daemon printed a line matching one of the fatal patterns.
+// Restarting such a node will only fail again, so we halt until the operator steps in.
+type FatalError struct {
+	Pattern string    `json:"pattern"`
+	Line    string    `json:"line"`
+	Time    time.Time `json:"time"`
+}
+
+func (e *FatalError) Error() string {
+	return fmt.Sprintf("output matched fatal pattern %q: %s", e.Pattern, e.Line)
+}
+
+// loadFatalPatterns compiles the regular expressions in path, one per line
+func loadFatalPatterns(path string) ([]*regexp.Regexp, error) {
+	return loadPatterns(path, "fatal pattern")
+}
+
+// loadPatterns compiles the regular expressions in path, one per line, what names them in errors
+func loadPatterns(path, what string) ([]*regexp.Regexp, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, errors.Wrapf(err, "reading %ss", what)
+	}
+	lines, err := readLines(path)
+	if err != nil {
+		return nil, err
+	}
+	patterns := make([]*regexp.Regexp, len(lines))
+	for i, line := range lines {
+		if patterns[i], err = regexp.Compile(line); err != nil {
+			return nil, errors.Wrapf(err, "invalid %s %q", what, line)
+		}
+	}
+	return patterns, nil
+}
+
+// consensusFailures are what tendermint prints when the node cannot make progress anymore,
+// restarting it only replays into the same failure
+var consensusFailures = []*regexp.Regexp{
+	regexp.MustCompile(`CONSENSUS FAILURE!!!`),
+	regexp.MustCompile(`wrong Block\.Header\.AppHash`),
+	regexp.MustCompile(`wrong Block\.Header\.LastResultsHash`),
+}
+
+// watchLine is passed every line the daemon prints, and fails on the first fatal pattern it matches.
+// Consensus failures are fatal as well, unless DAEMON_CONSENSUS_FAILURE says to only alert (or ignore them).
+func (cfg *Config) watchLine(line string) error {
+	for _, pattern := range cfg.FatalPatterns {
+		if pattern.MatchString(line) {
+			return &FatalError{Pattern: pattern.String(), Line: line, Time: time.Now()}
+		}
+	}
+	if cfg.ConsensusFailure == "off" {
+		return nil
+	}
+	for _, pattern := range consensusFailures {
+		if !pattern.MatchString(line) {
+			continue
+		}
+		if cfg.ConsensusFailure == "alert" {
+			cfg.Notify(Event{
+				Type:    "consensus_failure",
+				Message: fmt.Sprintf("ALERT: consensus failure, the node will not make progress: %s", line),
+				Fields:  map[string]string{"PATTERN": pattern.String(), "LINE": line},
+			})
+			return nil
+		}
+		return &FatalError{Pattern: pattern.String(), Line: line, Time: time.Now()}
+	}
+	return nil
+}
+
+// HaltFile marks a node we stopped after a fatal error, as long as it exists we don't start again
+func (cfg *Config) HaltFile() string {
+	return filepath.Join(cfg.Root(), haltFile)
+}
+
+// Halt records the fatal error, so we (and anyone restarting us) refuse to launch the daemon
+func (cfg *Config) Halt(fatal *FatalError) error {
+	cfg.Notify(Event{
+		Type:    "halted",
+		Message: fmt.Sprintf("%s, not restarting until %s is removed", fatal.Error(), cfg.HaltFile()),
+		Fields:  map[string]string{"PATTERN": fatal.Pattern, "LINE": fatal.Line},
+	})
+	bz, err := json.MarshalIndent(fatal, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "encode halt")
+	}
+	return errors.Wrap(ioutil.WriteFile(cfg.HaltFile(), bz, 0644), "writing halt")
+}
+
+// Halted returns the fatal error we halted on, or nil if we may run
+func (cfg *Config) Halted() (*FatalError, error) {
+	bz, err := ioutil.ReadFile(cfg.HaltFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "reading halt")
+	}
+	var fatal FatalError
+	if err := json.Unmarshal(bz, &fatal); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", cfg.HaltFile())
+	}
+	return &fatal, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadFatalPatterns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fatal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cases := map[string]struct {
+		content string
+		lines   []string
+		matches []bool
+		isErr   bool
+	}{
+		"simple": {
+			content: "# consensus broke\nwrong Block.Header.AppHash\n\ncorrupt(ed)? database\n",
+			lines:   []string{"panic: wrong Block.Header.AppHash", "leveldb: corrupted database", "committed state"},
+			matches: []bool{true, true, false},
+		},
+		"invalid regexp": {
+			content: "AppHash(\n",
+			isErr:   true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			require.NoError(t, ioutil.WriteFile(path, []byte(tc.content), 0644))
+			patterns, err := loadFatalPatterns(path)
+			if tc.isErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			cfg := &Config{FatalPatterns: patterns}
+			for i, line := range tc.lines {
+				err := cfg.watchLine(line)
+				assert.Equal(t, tc.matches[i], err != nil, line)
+			}
+		})
+	}
+
+	_, err = loadFatalPatterns(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+// TestLaunchProcessHalts ensures a fatal line stops the daemon, and it is not restarted until the halt is cleared
+func TestLaunchProcessHalts(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+
+	patterns := []*regexp.Regexp{regexp.MustCompile("wrong Block.Header.AppHash")}
+	cfg := &Config{Home: home, Name: "dummyd", FatalPatterns: patterns}
+	script := `#!/bin/sh
+echo "Starting"
+echo "panic: wrong Block.Header.AppHash. Expected 5E1A, got 2B3C" >&2
+while true; do sleep 0.1; done
+`
+	require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+
+	var stdout, stderr bytes.Buffer
+	err = LaunchProcess(cfg, []string{"start"}, &stdout, &stderr)
+	require.Error(t, err)
+	fatal, ok := err.(*FatalError)
+	require.True(t, ok, "%v", err)
+	assert.Equal(t, "wrong Block.Header.AppHash", fatal.Pattern)
+	assert.Equal(t, "Starting\n", stdout.String())
+
+	halted, err := cfg.Halted()
+	require.NoError(t, err)
+	require.NotNil(t, halted)
+	assert.Equal(t, fatal.Line, halted.Line)
+
+	// we refuse to start again
+	stdout.Reset()
+	err = LaunchProcess(cfg, []string{"start"}, &stdout, &stderr)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), cfg.HaltFile())
+	assert.Equal(t, "", stdout.String())
+
+	// until the operator clears it
+	require.NoError(t, os.Remove(cfg.HaltFile()))
+	require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte("#!/bin/sh\necho fixed\n"), 0755))
+	err = LaunchProcess(cfg, []string{"start"}, &stdout, &stderr)
+	require.NoError(t, err)
+	assert.Equal(t, "fixed\n", stdout.String())
+}
+
+func TestWatchConsensusFailure(t *testing.T) {
+	failure := `E[2020-06-01|10:02:11.123] CONSENSUS FAILURE!!! module=consensus err="+2/3 committed an invalid block"`
+	json := `{"level":"error","module":"consensus","err":"wrong Block.Header.AppHash.  Expected 5E1A, got 2B3C","message":"CONSENSUS FAILURE!!!"}`
+
+	cases := map[string]struct {
+		mode  string
+		line  string
+		fatal bool
+	}{
+		"halt by default": {line: failure, fatal: true},
+		"json log":        {mode: "halt", line: json, fatal: true},
+		"results hash":    {line: "panic: wrong Block.Header.LastResultsHash", fatal: true},
+		"only alert":      {mode: "alert", line: failure},
+		"off":             {mode: "off", line: failure},
+		"healthy":         {line: "I[2020-06-01|10:02:11.123] Committed state module=state height=120"},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cfg := &Config{ConsensusFailure: tc.mode}
+			err := cfg.watchLine(tc.line)
+			assert.Equal(t, tc.fatal, err != nil, "%v", err)
+		})
+	}
+
+	// operator patterns still apply when consensus failures don't halt
+	cfg := &Config{ConsensusFailure: "off", FatalPatterns: []*regexp.Regexp{regexp.MustCompile("CONSENSUS FAILURE")}}
+	assert.Error(t, cfg.watchLine(failure))
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// NodeReport is what we compare across the nodes of a fleet
+type NodeReport struct {
+	// SchemaVersion is the version of the report, see SchemaVersion
+	SchemaVersion int `json:"schema_version"`
+
+	Name string `json:"name"`
+	// Node is the label of the node, it is not compared
+	Node string `json:"node,omitempty"`
+	// Upgrade is the upgrade current points to, or genesis
+	Upgrade string `json:"upgrade"`
+	// Binary is the sha256 of the current binary
+	Binary string `json:"binary"`
+	// Staged maps genesis and every staged upgrade to the sha256 of its binary
+	Staged map[string]string `json:"staged"`
+	// Upgrades lists the upgrades we switched to, oldest first
+	Upgrades []string `json:"upgrades"`
+}
+
+// Report describes this node for fleet-compare
+func (cfg *Config) Report() (*NodeReport, error) {
+	checks, err := cfg.CheckBinaries()
+	if err != nil {
+		return nil, err
+	}
+	report := &NodeReport{SchemaVersion: SchemaVersion, Name: cfg.Name, Node: cfg.NodeLabel, Upgrade: cfg.currentUpgradeName(), Staged: map[string]string{}}
+	for _, check := range checks {
+		if check.Status == checkMissing {
+			continue
+		}
+		name, err := url.PathUnescape(filepath.Base(check.Upgrade))
+		if err != nil {
+			name = filepath.Base(check.Upgrade)
+		}
+		report.Staged[name] = check.Hash
+	}
+	if report.Binary, err = sha256File(cfg.CurrentBin()); err != nil {
+		return nil, err
+	}
+	history, err := cfg.History()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range history {
+		if entry.Type == "upgraded" {
+			report.Upgrades = append(report.Upgrades, entry.Upgrade)
+		}
+	}
+	return report, nil
+}
+
+// reportHandler serves the report of this node, for the fleet-compare of other nodes
+func (cfg *Config) reportHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report, err := cfg.Report()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, report)
+	})
+}
+
+// FetchReport returns the report of a node in the fleet, which is the url of its agent,
+// or the home directory of another node on this host
+func (cfg *Config) FetchReport(node string) (*NodeReport, error) {
+	if strings.HasPrefix(node, "http://") || strings.HasPrefix(node, "https://") {
+		req, err := http.NewRequest("GET", node, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "creating request")
+		}
+		var report NodeReport
+		client := &http.Client{Timeout: orDefault(cfg.FleetTimeout, defaultFleetTimeout)}
+		if err := getJSON(client, req, &report); err != nil {
+			return nil, err
+		}
+		if err := checkSchema("the report of "+node, report.SchemaVersion); err != nil {
+			return nil, err
+		}
+		return &report, nil
+	}
+	other := &Config{Home: node, Name: cfg.Name}
+	return other.Report()
+}
+
+// CompareReports lists how node differs from the reference report
+func CompareReports(reference, node *NodeReport) []string {
+	var drift []string
+	if node.Name != reference.Name {
+		drift = append(drift, fmt.Sprintf("runs %s, expected %s", node.Name, reference.Name))
+	}
+	if node.Upgrade != reference.Upgrade {
+		drift = append(drift, fmt.Sprintf("current is %s, expected %s", node.Upgrade, reference.Upgrade))
+	}
+	if node.Binary != reference.Binary {
+		drift = append(drift, fmt.Sprintf("current binary is %s, expected %s", node.Binary, reference.Binary))
+	}
+
+	names := make([]string, 0, len(reference.Staged)+len(node.Staged))
+	for name := range reference.Staged {
+		names = append(names, name)
+	}
+	for name := range node.Staged {
+		if _, ok := reference.Staged[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		want, ok := reference.Staged[name]
+		got, has := node.Staged[name]
+		switch {
+		case !has:
+			drift = append(drift, fmt.Sprintf("%s is not staged", name))
+		case !ok:
+			drift = append(drift, fmt.Sprintf("%s is staged, but not on the reference", name))
+		case got != want:
+			drift = append(drift, fmt.Sprintf("%s has binary %s, expected %s", name, got, want))
+		}
+	}
+
+	if strings.Join(node.Upgrades, ",") != strings.Join(reference.Upgrades, ",") {
+		drift = append(drift, fmt.Sprintf("upgraded through [%s], expected [%s]",
+			strings.Join(node.Upgrades, " "), strings.Join(reference.Upgrades, " ")))
+	}
+	return drift
+}
+
+// cmdFleetCompare compares this node against every node in DAEMON_FLEET_NODES and fails on any drift.
+// With -agent, it rather serves the report of this node for the other nodes to compare against.
+func cmdFleetCompare(cfg *Config, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("fleet-compare", flag.ContinueOnError)
+	flags.SetOutput(out)
+	agent := flags.String("agent", "", "serve the report of this node on this address, eg. localhost:26680")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *agent != "" {
+		logger.Printf("serving fleet report on %s", *agent)
+		return errors.Wrap(http.ListenAndServe(*agent, cfg.reportHandler()), "serving fleet report")
+	}
+	if len(cfg.FleetNodes) == 0 {
+		return errors.Errorf("%s lists no nodes to compare with", cfg.envName("DAEMON_FLEET_NODES"))
+	}
+
+	reference, err := cfg.Report()
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, node := range cfg.FleetNodes {
+		report, err := cfg.FetchReport(node)
+		if err != nil {
+			fmt.Fprintf(out, "%-10s %s: %v\n", "UNKNOWN", node, err)
+			failed++
+			continue
+		}
+		drift := CompareReports(reference, report)
+		if len(drift) == 0 {
+			fmt.Fprintf(out, "%-10s %s\n", checkOK, node)
+			continue
+		}
+		for _, d := range drift {
+			fmt.Fprintf(out, "%-10s %s: %s\n", "DRIFT", node, d)
+		}
+		failed++
+	}
+	if failed > 0 {
+		return errors.Errorf("%d of %d nodes differ from this one", failed, len(cfg.FleetNodes))
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompareReports(t *testing.T) {
+	reference := &NodeReport{
+		Name:     "gaiad",
+		Upgrade:  "chain2",
+		Binary:   "b2",
+		Staged:   map[string]string{"genesis": "b1", "chain2": "b2", "chain3": "b3"},
+		Upgrades: []string{"chain2"},
+	}
+
+	cases := map[string]struct {
+		node  NodeReport
+		drift []string
+	}{
+		"same": {
+			node: *reference,
+		},
+		"missed upgrade": {
+			node: NodeReport{Name: "gaiad", Upgrade: "genesis", Binary: "b1", Staged: map[string]string{"genesis": "b1", "chain2": "b2"}},
+			drift: []string{
+				"current is genesis, expected chain2",
+				"current binary is b1, expected b2",
+				"chain3 is not staged",
+				"upgraded through [], expected [chain2]",
+			},
+		},
+		"different binary": {
+			node: NodeReport{Name: "gaiad", Upgrade: "chain2", Binary: "b2", Staged: map[string]string{"genesis": "b1", "chain2": "b2", "chain3": "x3", "chain4": "b4"}, Upgrades: []string{"chain2"}},
+			drift: []string{
+				"chain3 has binary x3, expected b3",
+				"chain4 is staged, but not on the reference",
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.drift, CompareReports(reference, &tc.node))
+		})
+	}
+}
+
+func TestFleetCompare(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	other, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(other)
+
+	cfg := &Config{Home: home, Name: "dummyd"}
+	report, err := cfg.Report()
+	require.NoError(t, err)
+	assert.Equal(t, "genesis", report.Upgrade)
+	assert.Equal(t, report.Staged["genesis"], report.Binary)
+	assert.Len(t, report.Staged, 4)
+
+	// the other node is served by its agent
+	agent := httptest.NewServer((&Config{Home: other, Name: "dummyd"}).reportHandler())
+	defer agent.Close()
+	cfg.FleetNodes = []string{agent.URL, other}
+
+	var out bytes.Buffer
+	require.NoError(t, cmdFleetCompare(cfg, nil, &out))
+	assert.Equal(t, "ok         "+agent.URL+"\nok         "+other+"\n", out.String())
+
+	// the binary of an upgrade was replaced on the other node
+	otherCfg := &Config{Home: other, Name: "dummyd"}
+	require.NoError(t, ioutil.WriteFile(otherCfg.UpgradeBin("chain3"), []byte("#!/bin/sh\necho patched\n"), 0755))
+	out.Reset()
+	err = cmdFleetCompare(cfg, nil, &out)
+	require.Error(t, err)
+	assert.Contains(t, out.String(), "DRIFT      "+agent.URL+": chain3 has binary")
+	assert.Contains(t, out.String(), "DRIFT      "+other+": chain3 has binary")
+
+	// unreachable nodes are drift as well
+	agent.Close()
+	cfg.FleetNodes = []string{agent.URL}
+	out.Reset()
+	require.Error(t, cmdFleetCompare(cfg, nil, &out))
+	assert.Contains(t, out.String(), "UNKNOWN")
+}
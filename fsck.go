@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// BinaryCheck is the result of re-verifying one binary on disk
+type BinaryCheck struct {
+	// Upgrade is the name of the upgrade dir, or genesis
+	Upgrade string
+	Path    string
+	Hash    string
+	Status  string
+}
+
+const (
+	checkOK        = "ok"
+	checkUntracked = "untracked"
+	checkCorrupt   = "CORRUPT"
+	checkMissing   = "MISSING"
+)
+
+// CheckBinaries re-hashes all staged binaries and compares them to what we recorded when storing them.
+// Binaries that were placed manually have no record and are reported as untracked.
+func (cfg *Config) CheckBinaries() ([]BinaryCheck, error) {
+	res := []BinaryCheck{cfg.checkBinary(genesisDir, cfg.GenesisBin())}
+
+	dirs, err := ioutil.ReadDir(filepath.Join(cfg.Root(), upgradesDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "listing upgrades")
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		bin := filepath.Join(cfg.Root(), upgradesDir, dir.Name(), "bin", cfg.binName())
+		res = append(res, cfg.checkBinary(filepath.Join(upgradesDir, dir.Name()), bin))
+	}
+	return res, nil
+}
+
+func (cfg *Config) checkBinary(upgrade, path string) BinaryCheck {
+	check := BinaryCheck{Upgrade: upgrade, Path: path}
+	info, err := os.Stat(path)
+	if err != nil {
+		check.Status = checkMissing
+		return check
+	}
+	if check.Hash, err = sha256File(path); err != nil {
+		check.Status = checkMissing
+		return check
+	}
+
+	// downloaded binaries are links into the cache, named by the hash they had when stored
+	if cached, err := os.Stat(filepath.Join(cfg.CacheDir(), check.Hash)); err == nil && os.SameFile(info, cached) {
+		check.Status = checkOK
+		return check
+	}
+	if cfg.cachedName(info) != "" {
+		check.Status = checkCorrupt
+		return check
+	}
+	check.Status = checkUntracked
+	return check
+}
+
+// cachedName returns the name of the cache entry that is the same file as info, if any
+func (cfg *Config) cachedName(info os.FileInfo) string {
+	files, err := ioutil.ReadDir(cfg.CacheDir())
+	if err != nil {
+		return ""
+	}
+	for _, f := range files {
+		if os.SameFile(info, f) {
+			return f.Name()
+		}
+	}
+	return ""
+}
+
+// cmdFsck prints the state of all binaries and the cache, and fails if anything drifted
+func cmdFsck(cfg *Config, args []string, out io.Writer) error {
+	checks, err := cfg.CheckBinaries()
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, check := range checks {
+		fmt.Fprintf(out, "%-10s %-30s %s\n", check.Status, check.Upgrade, check.Hash)
+		if check.Status == checkCorrupt {
+			failed++
+		}
+	}
+
+	corrupt, err := cfg.VerifyCache()
+	if err != nil {
+		return err
+	}
+	for _, hash := range corrupt {
+		fmt.Fprintf(out, "%-10s %-30s %s\n", checkCorrupt, filepath.Join(cacheDir, "sha256", hash), hash)
+	}
+	failed += len(corrupt)
+
+	if failed > 0 {
+		return errors.Errorf("integrity check failed with %d problems", failed)
+	}
+	return nil
+}
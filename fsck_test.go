@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckBinaries(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+
+	// pretend chain3 was downloaded
+	require.NoError(t, cfg.AddToCache(cfg.UpgradeDir("chain3")))
+
+	statuses := func() map[string]string {
+		checks, err := cfg.CheckBinaries()
+		require.NoError(t, err)
+		res := make(map[string]string)
+		for _, check := range checks {
+			res[check.Upgrade] = check.Status
+		}
+		return res
+	}
+	assert.Equal(t, map[string]string{
+		"genesis":         checkUntracked,
+		"upgrades/chain2": checkUntracked,
+		"upgrades/chain3": checkOK,
+		"upgrades/nobin":  checkMissing,
+		"upgrades/noexec": checkUntracked,
+	}, statuses())
+
+	var out bytes.Buffer
+	require.NoError(t, cmdFsck(cfg, nil, &out))
+	assert.Contains(t, out.String(), "upgrades/chain3")
+
+	// someone tampered with the downloaded binary
+	f, err := os.OpenFile(cfg.UpgradeBin("chain3"), os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.WriteString("echo evil\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	assert.Equal(t, checkCorrupt, statuses()["upgrades/chain3"])
+	out.Reset()
+	require.Error(t, cmdFsck(cfg, nil, &out))
+	files, err := ioutil.ReadDir(cfg.CacheDir())
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Contains(t, out.String(), filepath.Join(cacheDir, "sha256", files[0].Name()))
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+// giteaFetcher resolves gitea://host/owner/repo@tag with the releases API of a Gitea or Forgejo instance
+type giteaFetcher struct {
+	token  string
+	client *http.Client
+}
+
+type giteaRelease struct {
+	Body   string `json:"body"`
+	Assets []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+// Fetch looks up the release by tag. Gitea lists no digests, only the checksum manifest can verify the assets.
+func (f *giteaFetcher) Fetch(ref *ReleaseRef) (*Release, error) {
+	endpoint := fmt.Sprintf("https://%s/api/v1/repos/%s/releases/tags/%s", ref.Host, ref.Repo, url.PathEscape(ref.Tag))
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating request")
+	}
+	if f.token != "" {
+		req.Header.Set("Authorization", "token "+f.token)
+	}
+
+	var release giteaRelease
+	if err := getJSON(f.client, req, &release); err != nil {
+		return nil, err
+	}
+	assets := make([]Asset, len(release.Assets))
+	for i, a := range release.Assets {
+		assets[i] = Asset{Name: a.Name, URL: a.URL}
+	}
+	return &Release{Assets: assets, Notes: release.Body}, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const defaultGitHubAPI = "https://api.github.com"
+
+// githubFetcher resolves github://owner/repo@tag with the releases API
+type githubFetcher struct {
+	api    string
+	token  string
+	client *http.Client
+}
+
+type githubRelease struct {
+	Body   string `json:"body"`
+	Assets []struct {
+		Name   string `json:"name"`
+		URL    string `json:"browser_download_url"`
+		Digest string `json:"digest"`
+		// APIURL downloads the asset with the token, for a private repository
+		APIURL string `json:"url"`
+	} `json:"assets"`
+}
+
+// Fetch looks up the release by tag
+func (f *githubFetcher) Fetch(ref *ReleaseRef) (*Release, error) {
+	api := f.api
+	if api == "" {
+		api = defaultGitHubAPI
+	}
+	endpoint := fmt.Sprintf("%s/repos/%s/releases/tags/%s", strings.TrimSuffix(api, "/"), ref.Repo, url.PathEscape(ref.Tag))
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating request")
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	// anonymous requests are limited to 60 per hour and ip
+	if f.token != "" {
+		req.Header.Set("Authorization", "Bearer "+f.token)
+	}
+
+	var release githubRelease
+	if err := getJSON(f.client, req, &release); err != nil {
+		return nil, err
+	}
+	assets := make([]Asset, len(release.Assets))
+	for i, a := range release.Assets {
+		assets[i] = Asset{Name: a.Name, URL: a.URL, Digest: a.Digest}
+		// the browser url of an asset of a private repository doesn't take the token, the api does. Its url doesn't
+		// end with the name of the asset, which tells its archive and its entry in a checksums asset.
+		if f.token != "" && a.APIURL != "" {
+			assets[i].URL = a.APIURL + "?filename=" + url.QueryEscape(a.Name)
+		}
+	}
+	return &Release{Assets: assets, Notes: release.Body}, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadGitHubRelease(t *testing.T) {
+	binary, err := ioutil.ReadFile("testdata/repo/raw_binary/autod")
+	require.NoError(t, err)
+	asset := fmt.Sprintf("autod-v2.0.0-%s-%s", runtime.GOOS, runtime.GOARCH)
+
+	cases := map[string]struct {
+		digest      string
+		manifest    bool
+		token       string
+		private     bool
+		canDownload bool
+	}{
+		"with digest": {
+			digest:      "sha256:" + autodSHA256,
+			canDownload: true,
+		},
+		"with token": {
+			digest:      "sha256:" + autodSHA256,
+			token:       "s3cret",
+			canDownload: true,
+		},
+		"private repository": {
+			manifest:    true,
+			token:       "s3cret",
+			private:     true,
+			canDownload: true,
+		},
+		"private repository without token": {
+			manifest:    true,
+			private:     true,
+			canDownload: false,
+		},
+		"wrong digest": {
+			digest:      "sha256:73e2bd6cbb99261733caf137015d5cc58e3f96248d8b01da68be8564989dd906",
+			canDownload: false,
+		},
+		"checksums asset": {
+			manifest:    true,
+			canDownload: true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			var srv *httptest.Server
+			srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/repos/cosmos/autod/releases/tags/v2.0.0":
+					if tc.token != "" && r.Header.Get("Authorization") != "Bearer "+tc.token {
+						http.Error(w, "rate limited", http.StatusForbidden)
+						return
+					}
+					type ghAsset struct {
+						Name   string `json:"name"`
+						URL    string `json:"browser_download_url"`
+						Digest string `json:"digest,omitempty"`
+						APIURL string `json:"url"`
+					}
+					assets := []ghAsset{
+						{Name: "autod-v2.0.0-plan9-mips", URL: srv.URL + "/dl/other", APIURL: srv.URL + "/repos/cosmos/autod/releases/assets/1"},
+						{Name: asset, URL: srv.URL + "/dl/" + asset, Digest: tc.digest, APIURL: srv.URL + "/repos/cosmos/autod/releases/assets/2"},
+					}
+					if tc.manifest {
+						assets = append(assets, ghAsset{Name: "checksums.txt", URL: srv.URL + "/dl/checksums.txt", APIURL: srv.URL + "/repos/cosmos/autod/releases/assets/3"})
+					}
+					json.NewEncoder(w).Encode(map[string]interface{}{"body": "## Changes\n* faster", "assets": assets})
+				case "/dl/" + asset:
+					// the assets of a private repository are only downloaded through the api
+					if tc.private {
+						http.NotFound(w, r)
+						return
+					}
+					w.Write(binary)
+				case "/dl/checksums.txt":
+					if tc.private {
+						http.NotFound(w, r)
+						return
+					}
+					fmt.Fprintf(w, "%s  %s\n", autodSHA256, asset)
+				case "/repos/cosmos/autod/releases/assets/2", "/repos/cosmos/autod/releases/assets/3":
+					if r.Header.Get("Authorization") != "Bearer "+tc.token || r.Header.Get("Accept") != "application/octet-stream" {
+						http.NotFound(w, r)
+						return
+					}
+					if r.URL.Path == "/repos/cosmos/autod/releases/assets/2" {
+						w.Write(binary)
+					} else {
+						fmt.Fprintf(w, "%s  %s\n", autodSHA256, asset)
+					}
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer srv.Close()
+
+			home, err := copyTestData("download")
+			require.NoError(t, err)
+			defer os.RemoveAll(home)
+			cfg := &Config{Home: home, Name: "autod", AllowDownloadBinaries: true, GitHubAPI: srv.URL, GitHubToken: tc.token}
+
+			info := &UpgradeInfo{Name: "amazonas", Height: 789, Info: "github://cosmos/autod@v2.0.0"}
+			err = DownloadBinary(cfg, info)
+			if !tc.canDownload {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, EnsureBinary(cfg.UpgradeBin("amazonas")))
+			notes, err := ioutil.ReadFile(filepath.Join(cfg.UpgradeDir("amazonas"), releaseNotesFile))
+			require.NoError(t, err)
+			assert.Equal(t, "## Changes\n* faster", string(notes))
+		})
+	}
+}
+
+func TestGitHubFetcherError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	cfg := &Config{Name: "autod", GitHubAPI: srv.URL}
+	_, err := cfg.ResolveRelease("github://cosmos/autod@v9")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "404")
+}
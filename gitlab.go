@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+// gitlabFetcher resolves gitlab://host/group/repo@tag with the releases API of the instance
+type gitlabFetcher struct {
+	token  string
+	client *http.Client
+}
+
+type gitlabRelease struct {
+	Description string `json:"description"`
+	Assets      struct {
+		Links []struct {
+			Name      string `json:"name"`
+			URL       string `json:"url"`
+			DirectURL string `json:"direct_asset_url"`
+		} `json:"links"`
+	} `json:"assets"`
+}
+
+// Fetch looks up the release by tag. GitLab lists no digests, only the checksum manifest can verify the assets.
+func (f *gitlabFetcher) Fetch(ref *ReleaseRef) (*Release, error) {
+	endpoint := fmt.Sprintf("https://%s/api/v4/projects/%s/releases/%s", ref.Host, url.PathEscape(ref.Repo), url.PathEscape(ref.Tag))
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating request")
+	}
+	if f.token != "" {
+		req.Header.Set("PRIVATE-TOKEN", f.token)
+	}
+
+	var release gitlabRelease
+	if err := getJSON(f.client, req, &release); err != nil {
+		return nil, err
+	}
+	assets := make([]Asset, len(release.Assets.Links))
+	for i, link := range release.Assets.Links {
+		assets[i] = Asset{Name: link.Name, URL: link.URL}
+		if link.DirectURL != "" {
+			assets[i].URL = link.DirectURL
+		}
+	}
+	return &Release{Assets: assets, Notes: release.Description}, nil
+}
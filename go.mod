@@ -6,6 +6,7 @@ require (
 	github.com/hashicorp/go-getter v1.4.0
 	github.com/homedepot/flop v0.1.4
 	github.com/pkg/errors v0.8.1
+	golang.org/x/net v0.0.0-20190620200207-3b0461eec859
 
 	// test dependencies
 	github.com/stretchr/testify v1.4.0
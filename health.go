@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// healthPath is where the health endpoint answers
+const healthPath = "/health"
+
+// Health is what the health endpoint reports on the daemon, for load balancers and monitoring
+type Health struct {
+	// SchemaVersion is the version of the report, see SchemaVersion
+	SchemaVersion int `json:"schema_version"`
+
+	Running bool `json:"running"`
+	// PID is the pid of the daemon (or of its jailer) while it runs
+	PID           int        `json:"pid,omitempty"`
+	Started       *time.Time `json:"started,omitempty"`
+	UptimeSeconds int64      `json:"uptime_seconds"`
+	// Upgrade is the upgrade current is switched to, or genesis
+	Upgrade string `json:"upgrade"`
+}
+
+// daemonState is the daemon LaunchProcess runs, if any
+var daemonState = struct {
+	sync.Mutex
+	pid     int
+	started time.Time
+}{}
+
+// daemonStarted records that the daemon runs with pid
+func daemonStarted(pid int) {
+	daemonState.Lock()
+	defer daemonState.Unlock()
+	daemonState.pid, daemonState.started = pid, time.Now()
+}
+
+// daemonExited records that the daemon is gone
+func daemonExited() {
+	daemonState.Lock()
+	defer daemonState.Unlock()
+	daemonState.pid, daemonState.started = 0, time.Time{}
+}
+
+// health reports on the daemon as of now
+func (cfg *Config) health() Health {
+	daemonState.Lock()
+	pid, started := daemonState.pid, daemonState.started
+	daemonState.Unlock()
+	h := Health{SchemaVersion: SchemaVersion, Upgrade: cfg.currentUpgradeName()}
+	if pid != 0 {
+		h.Running, h.PID, h.Started = true, pid, &started
+		h.UptimeSeconds = int64(time.Since(started) / time.Second)
+	}
+	return h
+}
+
+// healthHandler answers with the health of the daemon, 200 while it runs and 503 while it doesn't, eg. while
+// the upgrade manager switches binaries
+func (cfg *Config) healthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(healthPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "use GET", http.StatusMethodNotAllowed)
+			return
+		}
+		h := cfg.health()
+		status := http.StatusOK
+		if !h.Running {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSONStatus(w, status, h)
+	})
+	return mux
+}
+
+// serveHealth serves the health endpoint until we exit, a failure is only logged
+func (cfg *Config) serveHealth() {
+	logger.Printf("serving health on %s%s", cfg.HealthAddress, healthPath)
+	if err := http.ListenAndServe(cfg.HealthAddress, cfg.healthHandler()); err != nil {
+		logger.Printf("cannot serve health: %v", err)
+	}
+}
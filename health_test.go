@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealth(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as daemon")
+	}
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+	require.NoError(t, cfg.SetCurrentUpgrade("chain2"))
+	require.NoError(t, ioutil.WriteFile(cfg.UpgradeBin("chain2"), []byte("#!/bin/sh\necho started\nsleep 0.5\n"), 0755))
+	server := httptest.NewServer(cfg.healthHandler())
+	defer server.Close()
+
+	check := func(status int) Health {
+		resp, err := http.Get(server.URL + healthPath)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, status, resp.StatusCode)
+		var h Health
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&h))
+		return h
+	}
+	h := check(http.StatusServiceUnavailable)
+	assert.Equal(t, Health{SchemaVersion: SchemaVersion, Upgrade: "chain2"}, h)
+
+	done := make(chan error)
+	var stdout, stderr bytes.Buffer
+	go func() {
+		done <- LaunchProcess(cfg, []string{"start"}, &stdout, &stderr)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	h = check(http.StatusOK)
+	assert.True(t, h.Running)
+	assert.NotZero(t, h.PID)
+	require.NotNil(t, h.Started)
+	assert.WithinDuration(t, time.Now(), *h.Started, time.Second)
+	assert.Equal(t, "chain2", h.Upgrade)
+
+	require.NoError(t, <-done)
+	assert.Equal(t, Health{SchemaVersion: SchemaVersion, Upgrade: "chain2"}, check(http.StatusServiceUnavailable))
+}
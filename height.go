@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// defaultHeightSources are asked when DAEMON_HEIGHT_SOURCE is not set
+var defaultHeightSources = []string{"rpc", "output"}
+
+// HeightSource tells the height of the block the node committed last
+type HeightSource interface {
+	Height() (int64, error)
+}
+
+// rpcHeight asks /status of the rpc
+type rpcHeight struct {
+	cfg *Config
+}
+
+func (s rpcHeight) Height() (int64, error) {
+	status, err := s.cfg.NodeStatus()
+	s.cfg.rpcResult(err)
+	if err != nil {
+		return 0, err
+	}
+	return status.Height, nil
+}
+
+// committedLine is the line tendermint logs once it committed a block: the message right after the level (Committed
+// state, or committed state since v0.34.? with zerolog), then nothing but key=value fields
+var committedLine = regexp.MustCompile(`^(?:I\[[^\]]*\]|(?:\S+ )?INF) +[Cc]ommitted state((?: +\w+=[^\s"=]*)+) *$`)
+
+// committedHeight returns the height of the block a line of tendermint says it committed, in text or json. Only the
+// message of tendermint from its state module counts, not any line with a height in it (like a tx memo).
+func committedHeight(line string) (int64, bool) {
+	fields := make(map[string]string)
+	if match := committedLine.FindStringSubmatch(line); match != nil {
+		for _, field := range strings.Fields(match[1]) {
+			kv := strings.SplitN(field, "=", 2)
+			fields[kv[0]] = kv[1]
+		}
+	} else if !jsonCommitted(line, fields) {
+		return 0, false
+	}
+	if fields["module"] != "state" {
+		return 0, false
+	}
+	height, err := parseHeight(fields["height"])
+	if err != nil || height <= 0 {
+		return 0, false
+	}
+	return height, true
+}
+
+// jsonCommitted reads the fields of a json line into fields, if its message is the one of a committed block
+func jsonCommitted(line string, fields map[string]string) bool {
+	trimmed := strings.TrimSpace(line)
+	if !strings.HasPrefix(trimmed, "{") {
+		return false
+	}
+	decoder := json.NewDecoder(strings.NewReader(trimmed))
+	decoder.UseNumber()
+	var values map[string]interface{}
+	if err := decoder.Decode(&values); err != nil {
+		return false
+	}
+	for key, value := range values {
+		switch value := value.(type) {
+		case string:
+			fields[key] = value
+		case json.Number:
+			fields[key] = value.String()
+		}
+	}
+	for _, key := range messageKeys {
+		if msg, ok := values[key].(string); ok {
+			return strings.EqualFold(msg, "committed state")
+		}
+	}
+	return false
+}
+
+// outputHeight remembers the height of the last committed block the daemon logged
+type outputHeight struct {
+	mutex  sync.Mutex
+	height int64
+}
+
+// Observe reads the height of a committed block from a line of output
+func (s *outputHeight) Observe(line string) {
+	height, ok := committedHeight(line)
+	if !ok {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if height > s.height {
+		s.height = height
+	}
+}
+
+func (s *outputHeight) Height() (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.height == 0 {
+		return 0, errors.New("no block committed in the output yet")
+	}
+	return s.height, nil
+}
+
+// validatorState reads priv_validator_state.json, which tendermint writes before signing a height.
+// A height is signed before it is committed, so the one before it is the last surely committed.
+type validatorState struct {
+	path string
+}
+
+func (s validatorState) Height() (int64, error) {
+	bz, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return 0, errors.Wrap(err, "reading validator state")
+	}
+	var state struct {
+		Height json.Number `json:"height"`
+	}
+	if err := json.Unmarshal(bz, &state); err != nil {
+		return 0, errors.Wrapf(err, "parsing %s", s.path)
+	}
+	height, err := parseHeight(state.Height.String())
+	if err != nil || height <= 1 {
+		return 0, errors.Errorf("no height signed in %s", s.path)
+	}
+	return height - 1, nil
+}
+
+// ValidatorStateFile is where tendermint keeps the last height the validator signed
+func (cfg *Config) ValidatorStateFile() string {
+	if cfg.ValidatorState != "" {
+		return cfg.ValidatorState
+	}
+	return filepath.Join(cfg.Home, "data", "priv_validator_state.json")
+}
+
+// parseHeightSources reads the sources to ask in order, separated by commas
+func parseHeightSources(value string) ([]string, error) {
+	var sources []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		switch name {
+		case "rpc", "output", "validator-state":
+		default:
+			return nil, errors.Errorf("%s is not rpc, output or validator-state", name)
+		}
+		sources = append(sources, name)
+	}
+	return sources, nil
+}
+
+// Heights asks the sources of DAEMON_HEIGHT_SOURCE in order, until one knows the height. The output of
+// the daemon it runs is fed to Observe.
+type Heights struct {
+	cfg     *Config
+	names   []string
+	sources []HeightSource
+	output  *outputHeight
+}
+
+// NewHeights returns the height sources configured for this node, the rpc only if there is an address
+func (cfg *Config) NewHeights() *Heights {
+	names := cfg.HeightSources
+	if len(names) == 0 {
+		names = defaultHeightSources
+	}
+	h := &Heights{cfg: cfg}
+	for _, name := range names {
+		var source HeightSource
+		switch name {
+		case "rpc":
+			if cfg.RPCAddress == "" {
+				continue
+			}
+			source = rpcHeight{cfg: cfg}
+		case "output":
+			h.output = &outputHeight{}
+			source = h.output
+		case "validator-state":
+			source = validatorState{path: cfg.ValidatorStateFile()}
+		}
+		h.names = append(h.names, name)
+		h.sources = append(h.sources, source)
+	}
+	return h
+}
+
+// stoppedAt returns whether the node stopped at the height of info, for feature: the last block it committed is the
+// one before (where the old binary stops, for the new one to run the upgrade height) or the upgrade height itself
+// (where it stops at a --halt-height without a plan on chain). An unknown height is never it.
+func (h *Heights) stoppedAt(feature string, info *UpgradeInfo) bool {
+	height, err := h.Height(feature)
+	if err != nil {
+		logger.Printf("the height the daemon stopped at is unknown, not applying upgrade %s: %v", info.Name, err)
+		return false
+	}
+	if height != info.Height-1 && height != info.Height {
+		logger.Printf("the daemon stopped at height %d, not at upgrade %s at height %d", height, info.Name, info.Height)
+		return false
+	}
+	return true
+}
+
+// Observe reads the output of the daemon, if it is one of the sources
+func (h *Heights) Observe(line string) {
+	if h.output != nil {
+		h.output.Observe(line)
+	}
+}
+
+// Height asks the sources for feature, the rpc is left out if DAEMON_RPC_DISABLE lists the feature
+func (h *Heights) Height(feature string) (int64, error) {
+	var failures []string
+	for i, source := range h.sources {
+		if h.names[i] == "rpc" && !h.cfg.usesRPC(feature) {
+			continue
+		}
+		height, err := source.Height()
+		if err == nil {
+			return height, nil
+		}
+		failures = append(failures, h.names[i]+": "+err.Error())
+	}
+	if len(failures) == 0 {
+		return 0, errors.New("no height source")
+	}
+	return 0, errors.Errorf("height unknown (%s)", strings.Join(failures, ", "))
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHeightSources(t *testing.T) {
+	sources, err := parseHeightSources("output, validator-state")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"output", "validator-state"}, sources)
+	sources, err = parseHeightSources("")
+	require.NoError(t, err)
+	assert.Empty(t, sources)
+	_, err = parseHeightSources("rpc,blockstore")
+	assert.Error(t, err)
+}
+
+func TestOutputHeight(t *testing.T) {
+	cases := map[string]struct {
+		lines  []string
+		height int64
+	}{
+		"nothing yet": {lines: []string{"starting ABCI with Tendermint"}},
+		"v0.34": {
+			lines:  []string{`I[2021-06-01|10:00:00.000] Committed state  module=state height=1205 txs=3 appHash=AB12`},
+			height: 1205,
+		},
+		"v0.37": {
+			lines:  []string{`11:00AM INF committed state app_hash=AB12 height=88 module=state num_txs=0`},
+			height: 88,
+		},
+		"json": {
+			lines:  []string{`{"level":"info","module":"state","height":"311","message":"committed state"}`},
+			height: 311,
+		},
+		// anyone can put a height in a memo, only committed blocks count
+		"tmlog json": {
+			lines:  []string{`{"_msg":"Committed state","appHash":"AB12","height":312,"level":"info","module":"state","txs":0}`},
+			height: 312,
+		},
+		// anyone can put a height in a memo, only the blocks tendermint committed count
+		"other heights": {
+			lines: []string{
+				`11:00AM INF committed state app_hash=AB height=10 module=state`,
+				`11:00AM INF received proposal height=11 module=consensus`,
+				`UPGRADE "v2" NEEDED at height: 500: {}`,
+				`11:00AM INF added tx memo="committed state height=900" module=mempool`,
+				`11:00AM INF tx memo: committed state height=901 module=state`,
+				`11:00AM INF committed state height=902 module=p2p`,
+				`11:00AM INF committed state height=903 module=state memo="x`,
+				`{"level":"info","module":"mempool","height":"904","message":"committed state"}`,
+				`{"level":"info","module":"state","height":"905","message":"tx committed state"}`,
+			},
+			height: 10,
+		},
+		"never back": {
+			lines:  []string{`INF committed state height=10 module=state`, `INF committed state height=9 module=state`},
+			height: 10,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			var s outputHeight
+			for _, line := range tc.lines {
+				s.Observe(line)
+			}
+			height, err := s.Height()
+			if tc.height == 0 {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.height, height)
+		})
+	}
+}
+
+func TestValidatorState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validator-state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "priv_validator_state.json")
+	s := validatorState{path: path}
+
+	_, err = s.Height()
+	assert.Error(t, err)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"height":"1200","round":0,"step":3}`), 0644))
+	height, err := s.Height()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1199), height)
+
+	// as fresh nodes write it
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"height":"0","round":0,"step":0}`), 0644))
+	_, err = s.Height()
+	assert.Error(t, err)
+}
+
+func TestHeights(t *testing.T) {
+	node := nodeAt(48)
+	defer node.Close()
+
+	// the rpc is left out without an address
+	h := (&Config{}).NewHeights()
+	assert.Equal(t, []string{"output"}, h.names)
+	_, err := h.Height("trigger")
+	assert.Error(t, err)
+	h.Observe("INF committed state app_hash=AB height=40 module=state")
+	height, err := h.Height("trigger")
+	require.NoError(t, err)
+	assert.Equal(t, int64(40), height)
+
+	// in order, but not the rpc for features which must not use it
+	cfg := &Config{RPCAddress: node.URL, RPCDisable: map[string]bool{"confirm": true}}
+	h = cfg.NewHeights()
+	h.Observe("INF committed state app_hash=AB height=40 module=state")
+	height, err = h.Height("trigger")
+	require.NoError(t, err)
+	assert.Equal(t, int64(48), height)
+	height, err = h.Height("confirm")
+	require.NoError(t, err)
+	assert.Equal(t, int64(40), height)
+
+	_, err = (&Config{HeightSources: []string{"rpc"}}).NewHeights().Height("trigger")
+	assert.Error(t, err)
+}
+
+// TestLaunchProcessTriggerFromOutput applies a trigger at its height without any rpc, from the blocks the daemon logs
+func TestLaunchProcessTriggerFromOutput(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd", UnsafeSkipBackup: true, PollInterval: 20 * time.Millisecond}
+	script := "#!/bin/sh\necho 'INF committed state app_hash=AB height=47 module=state'\nsleep 0.2\necho 'INF committed state app_hash=AB height=48 module=state'\nexec sleep 30\n"
+	require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+	require.NoError(t, cfg.WriteTrigger(&UpgradeInfo{Name: "chain2", Height: 49}))
+
+	var stdout, stderr bytes.Buffer
+	require.NoError(t, LaunchProcess(cfg, []string{"start"}, &stdout, &stderr))
+	assert.Equal(t, "INF committed state app_hash=AB height=47 module=state\nINF committed state app_hash=AB height=48 module=state\n", stdout.String())
+	assert.Equal(t, cfg.UpgradeBin("chain2"), cfg.CurrentBin())
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const holdFile = "hold.json"
+
+// UpgradeHold keeps every upgrade from being applied, until an operator approves them again
+type UpgradeHold struct {
+	Since time.Time `json:"since"`
+	// By tells who put the hold, eg. the address of an admin api client
+	By string `json:"by,omitempty"`
+}
+
+// HoldFile is where the hold is kept while upgrades are held
+func (cfg *Config) HoldFile() string {
+	return filepath.Join(cfg.Root(), holdFile)
+}
+
+// HoldUpgrades holds all upgrades until ApproveUpgrades, an upgrade detected meanwhile waits before it is applied.
+// A hold which is in place already is kept as is.
+func (cfg *Config) HoldUpgrades(by string) error {
+	if hold, err := cfg.UpgradeHold(); err != nil || hold != nil {
+		return err
+	}
+	bz, err := json.MarshalIndent(UpgradeHold{Since: time.Now().UTC(), By: by}, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "encode hold")
+	}
+	tmp := cfg.HoldFile() + ".tmp"
+	if err := ioutil.WriteFile(tmp, bz, 0644); err != nil {
+		return errors.Wrap(err, "writing hold")
+	}
+	return errors.Wrap(os.Rename(tmp, cfg.HoldFile()), "writing hold")
+}
+
+// ApproveUpgrades lifts the hold, an upgrade waiting for it goes on
+func (cfg *Config) ApproveUpgrades() error {
+	if err := os.Remove(cfg.HoldFile()); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "removing hold")
+	}
+	return nil
+}
+
+// UpgradeHold returns the hold, or nil if upgrades are not held
+func (cfg *Config) UpgradeHold() (*UpgradeHold, error) {
+	bz, err := ioutil.ReadFile(cfg.HoldFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "reading hold")
+	}
+	var hold UpgradeHold
+	if err := json.Unmarshal(bz, &hold); err != nil {
+		return nil, errors.Wrap(err, "parsing hold")
+	}
+	return &hold, nil
+}
+
+// awaitApproval waits until the hold is lifted before info is applied, checking every DAEMON_POLL_INTERVAL.
+// It returns errStopped for SIGINT or SIGTERM, or if ctx is done, and the upgrade is detected again on the next start.
+func (cfg *Config) awaitApproval(ctx context.Context, info *UpgradeInfo) error {
+	hold, err := cfg.UpgradeHold()
+	if err != nil || hold == nil {
+		return err
+	}
+	ctx, stop := stopOnSignal(ctx)
+	defer stop()
+	cfg.Notify(Event{
+		Type:    "upgrade_held",
+		Message: fmt.Sprintf("upgrade %s at height %d is held since %s, waiting for approval", info.Name, info.Height, hold.Since.Format(time.RFC3339)),
+		Fields:  map[string]string{"UPGRADE": info.Name, "HEIGHT": strconv.FormatInt(info.Height, 10)},
+	})
+	ticker := time.NewTicker(orDefault(cfg.PollInterval, defaultPollInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return errStopped
+		}
+		if hold, err := cfg.UpgradeHold(); err != nil {
+			logger.Printf("cannot read hold: %v", err)
+		} else if hold == nil {
+			logger.Printf("upgrade %s was approved", info.Name)
+			return nil
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAwaitApproval(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd", UnsafeSkipBackup: true, PollInterval: 20 * time.Millisecond}
+
+	require.NoError(t, cfg.HoldUpgrades("operator"))
+	hold, err := cfg.UpgradeHold()
+	require.NoError(t, err)
+	require.NotNil(t, hold)
+	assert.Equal(t, "operator", hold.By)
+	// holding again keeps the first hold
+	require.NoError(t, cfg.HoldUpgrades("someone else"))
+	hold, err = cfg.UpgradeHold()
+	require.NoError(t, err)
+	assert.Equal(t, "operator", hold.By)
+
+	upgraded := make(chan error)
+	go func() {
+		upgraded <- DoUpgrade(cfg, &UpgradeInfo{Name: "chain2", Height: 100})
+	}()
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case err := <-upgraded:
+		t.Fatalf("did not wait for approval: %v", err)
+	default:
+	}
+	assert.Equal(t, cfg.GenesisBin(), cfg.CurrentBin())
+
+	require.NoError(t, cfg.ApproveUpgrades())
+	select {
+	case err := <-upgraded:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the approved upgrade was not applied")
+	}
+	assert.Equal(t, cfg.UpgradeBin("chain2"), cfg.CurrentBin())
+	// approving without a hold is fine
+	require.NoError(t, cfg.ApproveUpgrades())
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// RunHook executes an operator supplied command, passing the given values as extra environmental
+// variables. The command is split into arguments like splitArgs does, and never passed through a shell.
+// Output of the hook is forwarded to our stderr, so it ends up in the same log as the daemon.
+func RunHook(command string, env map[string]string) error {
+	return runHookIn("", command, env)
+}
+
+// runHookIn works like RunHook, but runs the command in dir
+func runHookIn(dir, command string, env map[string]string) error {
+	parts, err := splitArgs(command)
+	if err != nil {
+		return errors.Wrapf(err, "parsing hook %s", command)
+	}
+	if len(parts) == 0 {
+		return errors.New("empty hook command")
+	}
+	cmd := exec.Command(parts[0], parts[1:]...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), hookEnv(env)...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "running hook %s", command)
+	}
+	return nil
+}
+
+// hookEnv turns the map into KEY=value pairs with a stable order
+func hookEnv(env map[string]string) []string {
+	res := make([]string, 0, len(env))
+	for k, v := range env {
+		res = append(res, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(res)
+	return res
+}
+
+// splitArgs splits an operator supplied command or argument list on whitespace, like a shell would but without
+// expanding anything: '...' is taken as is, "..." as is except for \" and \\, and outside of quotes a backslash
+// only escapes a space, tab or quote, so windows paths like C:\tools\hook.exe need no quoting.
+func splitArgs(value string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	// inArg is set once anything (even an empty '') was read for the current argument
+	inArg := false
+	quote := rune(0)
+	runes := []rune(value)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case quote == '"':
+			if r == '\\' && i+1 < len(runes) && (runes[i+1] == '"' || runes[i+1] == '\\') {
+				i++
+				arg.WriteRune(runes[i])
+			} else if r == '"' {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case r == '\\' && i+1 < len(runes) && strings.ContainsRune(" \t'\"", runes[i+1]):
+			i++
+			arg.WriteRune(runes[i])
+			inArg = true
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.Errorf("unterminated %c", quote)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// safeArg matches arguments a shell takes as they are
+var safeArg = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// quoteArgs joins args for logging, quoting them so splitArgs (or a shell) reads them back the same
+func quoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if safeArg.MatchString(arg) {
+			quoted[i] = arg
+		} else {
+			quoted[i] = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitArgs(t *testing.T) {
+	cases := map[string]struct {
+		value string
+		args  []string
+		err   bool
+	}{
+		"empty":          {value: "  ", args: nil},
+		"plain":          {value: " notify-send  -u critical ", args: []string{"notify-send", "-u", "critical"}},
+		"single quotes":  {value: `'/opt/my hooks/notify' '$HOME "x"'`, args: []string{"/opt/my hooks/notify", `$HOME "x"`}},
+		"double quotes":  {value: `"/opt/my hooks/notify" "say \"hi\" \\ \n"`, args: []string{"/opt/my hooks/notify", `say "hi" \ \n`}},
+		"joined":         {value: `--name="my node"'s'`, args: []string{"--name=my nodes"}},
+		"empty quotes":   {value: `hook '' ""`, args: []string{"hook", "", ""}},
+		"escaped space":  {value: `/opt/my\ hooks/notify it\'s`, args: []string{"/opt/my hooks/notify", "it's"}},
+		"windows path":   {value: `C:\tools\notify.exe \\server\share`, args: []string{`C:\tools\notify.exe`, `\\server\share`}},
+		"unicode":        {value: "/home/nœud/bin/gaiad ノード", args: []string{"/home/nœud/bin/gaiad", "ノード"}},
+		"metacharacters": {value: "hook ; rm -rf / && $(id) `id` | >x", args: []string{"hook", ";", "rm", "-rf", "/", "&&", "$(id)", "`id`", "|", ">x"}},
+		"unterminated":   {value: `hook "my node`, err: true},
+		"unterminated '": {value: `hook 'my node`, err: true},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			args, err := splitArgs(tc.value)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.args, args)
+		})
+	}
+}
+
+func TestQuoteArgs(t *testing.T) {
+	args := []string{"/home/my node/bin/gaiad", "start", "--moniker=it's mine", "", "$(id);`id`|&>", "ノード", `C:\tools`, "--home=/srv/gaia"}
+	quoted := quoteArgs(args)
+	assert.Equal(t, `'/home/my node/bin/gaiad' start '--moniker=it'\''s mine' '' '$(id);`+"`id`"+`|&>' 'ノード' 'C:\tools' --home=/srv/gaia`, quoted)
+	back, err := splitArgs(quoted)
+	require.NoError(t, err)
+	assert.Equal(t, args, back)
+}
+
+func TestRunHookPaths(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as hook")
+	}
+	dir, err := ioutil.TempDir("", "upgrade-manager-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// a hook in a directory no shell would take unquoted, getting arguments and values which must stay as they are
+	hookDir := filepath.Join(dir, "my hooks; $(touch pwned) ノード")
+	require.NoError(t, os.MkdirAll(hookDir, 0755))
+	out := filepath.Join(dir, "out")
+	hook := filepath.Join(hookDir, "notify it's")
+	script := "#!/bin/sh\nfor arg in \"$@\"; do echo \"[$arg]\"; done > \"$OUT\"\necho \"[$COSMOSD_MESSAGE]\" >> \"$OUT\"\n"
+	require.NoError(t, ioutil.WriteFile(hook, []byte(script), 0755))
+
+	command := quoteArgs([]string{hook, "--to", "ops team", "$HOME"})
+	require.NoError(t, RunHook(command, map[string]string{"OUT": out, "COSMOSD_MESSAGE": "upgraded `id` $(id)"}))
+	bz, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, "[--to]\n[ops team]\n[$HOME]\n[upgraded `id` $(id)]\n", string(bz))
+	_, err = os.Stat(filepath.Join(hookDir, "pwned"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat("pwned")
+	assert.True(t, os.IsNotExist(err))
+
+	err = RunHook(`"`+hook, nil)
+	require.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "unterminated"))
+}
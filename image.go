@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// imageFile holds the image an upgrade runs in, pinned by its digest, next to the bin dir
+const imageFile = "image"
+
+// pinned is whether the image reference names a digest, eg. ghcr.io/cosmos/gaia:v2@sha256:...
+func pinned(ref string) bool {
+	return strings.Contains(ref, "@sha256:")
+}
+
+// runtimeOutput runs the container runtime with args, and returns what it printed
+func (cfg *Config) runtimeOutput(args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(cfg.ContainerRuntime, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "running %s: %s", quoteArgs(cmd.Args), strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// PullImage pulls the image of an upgrade, and installs a launcher running it as the binary of the upgrade in dir.
+// An image given by tag is pinned to the digest pulled, so a tag moved later doesn't change what the upgrade runs.
+func (cfg *Config) PullImage(dir, ref string) error {
+	if cfg.RequireChecksum && !pinned(ref) {
+		return errors.Errorf("image %s has no digest, and %s is on", ref, cfg.envName("DAEMON_REQUIRE_CHECKSUM"))
+	}
+	logger.Printf("pulling image %s", ref)
+	if _, err := cfg.runtimeOutput("pull", ref); err != nil {
+		return err
+	}
+	if !pinned(ref) {
+		digests, err := cfg.runtimeOutput("image", "inspect", "--format", "{{range .RepoDigests}}{{println .}}{{end}}", ref)
+		if err != nil {
+			return err
+		}
+		repo := ref
+		// the tag goes, but not the port of a registry like localhost:5000/gaia
+		if colon := strings.LastIndex(repo, ":"); colon > strings.LastIndex(repo, "/") {
+			repo = repo[:colon]
+		}
+		for _, digest := range strings.Fields(digests) {
+			if at := strings.Index(digest, "@"); at >= 0 && (digest[:at] == repo || strings.HasSuffix(digest[:at], "/"+repo)) {
+				ref = ref + digest[at:]
+				break
+			}
+		}
+		if !pinned(ref) {
+			return errors.Errorf("%s reports no digest for image %s", cfg.ContainerRuntime, ref)
+		}
+	}
+	return cfg.installLauncher(dir, ref)
+}
+
+// installLauncher writes the image to dir, and a script running it with the home mounted as bin/$DAEMON_NAME, so
+// everything that checks, hashes or switches binaries works on images just the same. The hash of the launcher
+// changes with the image digest, so fleet-compare finds nodes running other images.
+func (cfg *Config) installLauncher(dir, ref string) error {
+	if runtime.GOOS == "windows" {
+		return errors.New("images are not supported on windows")
+	}
+	bin := filepath.Join(dir, "bin", cfg.Name)
+	if err := os.MkdirAll(filepath.Dir(bin), 0755); err != nil {
+		return errors.Wrap(err, "creating bin dir")
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, imageFile), []byte(ref+"\n"), 0644); err != nil {
+		return errors.Wrap(err, "writing image")
+	}
+	run := []string{cfg.ContainerRuntime, "run", "--rm", "-i", "--init", "-v", cfg.Home + ":" + cfg.Home,
+		"--user", fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())}
+	run = append(append(run, cfg.ContainerArgs...), ref)
+	script := fmt.Sprintf("#!/bin/sh\n# runs the daemon in %s, written by the upgrade manager\nexec %s \"$@\"\n", ref, quoteArgs(run))
+	return errors.Wrap(ioutil.WriteFile(bin, []byte(script), 0755), "writing launcher")
+}
+
+// UpgradeImage returns the image the upgrade runs in, or "" if it has a binary
+func (cfg *Config) UpgradeImage(upgradeName string) string {
+	bz, err := ioutil.ReadFile(filepath.Join(cfg.UpgradeDir(upgradeName), imageFile))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(bz))
+}
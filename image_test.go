@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRuntime writes a container runtime which records its calls to log, and reports digest for inspected images
+func fakeRuntime(t *testing.T, dir, digest string) (string, string) {
+	log := filepath.Join(dir, "runtime.log")
+	script := filepath.Join(dir, "docker")
+	body := fmt.Sprintf("#!/bin/sh\necho \"$*\" >> %s\n[ \"$1\" = image ] && echo %s\nexit 0\n", log, digest)
+	require.NoError(t, ioutil.WriteFile(script, []byte(body), 0755))
+	return script, log
+}
+
+func TestPullImage(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("images are not supported on windows")
+	}
+	home, err := copyTestData("download")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	digest := "sha256:" + autodSHA256
+	docker, log := fakeRuntime(t, home, "other/gaia@sha256:abc ghcr.io/cosmos/gaia@"+digest)
+	cfg := &Config{Home: home, Name: "gaiad", AllowDownloadBinaries: true, ContainerRuntime: docker,
+		ContainerArgs: []string{"--network", "host"}}
+
+	// a tag is pinned to the digest pulled
+	require.NoError(t, DownloadBinary(cfg, &UpgradeInfo{Name: "v2", Info: `{"image":"ghcr.io/cosmos/gaia:v2"}`}))
+	assert.Equal(t, "ghcr.io/cosmos/gaia:v2@"+digest, cfg.UpgradeImage("v2"))
+	require.NoError(t, EnsureBinary(cfg.UpgradeBin("v2")))
+	calls, err := ioutil.ReadFile(log)
+	require.NoError(t, err)
+	assert.Equal(t, "pull ghcr.io/cosmos/gaia:v2\nimage inspect --format {{range .RepoDigests}}{{println .}}{{end}} ghcr.io/cosmos/gaia:v2\n", string(calls))
+
+	// the launcher runs the image with the home mounted
+	require.NoError(t, os.Remove(log))
+	out, err := exec.Command(cfg.UpgradeBin("v2"), "start", "--home", home).CombinedOutput()
+	require.NoError(t, err, string(out))
+	calls, err = ioutil.ReadFile(log)
+	require.NoError(t, err)
+	run := strings.Fields(string(calls))
+	assert.Equal(t, []string{"run", "--rm", "-i", "--init", "-v", home + ":" + home}, run[:6])
+	assert.Equal(t, []string{"--network", "host", "ghcr.io/cosmos/gaia:v2@" + digest, "start", "--home", home}, run[len(run)-6:])
+
+	// digests may be required, and a plan without an image cannot run
+	cfg.RequireChecksum = true
+	err = DownloadBinary(cfg, &UpgradeInfo{Name: "v3", Info: `{"image":"ghcr.io/cosmos/gaia:v3"}`})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "has no digest")
+	require.NoError(t, DownloadBinary(cfg, &UpgradeInfo{Name: "v3", Info: `{"image":"ghcr.io/cosmos/gaia:v3@` + digest + `"}`}))
+	err = DownloadBinary(cfg, &UpgradeInfo{Name: "v4", Info: fmt.Sprintf(`{"binaries":{"%s":"https://example.com/gaiad"}}`, osArch())})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "has no image")
+}
+
+func TestInitImage(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("images are not supported on windows")
+	}
+	home, err := ioutil.TempDir("", "upgrade-manager-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	docker, _ := fakeRuntime(t, home, "")
+	cfg := &Config{Home: home, Name: "gaiad"}
+	assert.Error(t, cfg.InitImage("ghcr.io/cosmos/gaia:v1@sha256:"+autodSHA256))
+
+	cfg.ContainerRuntime = docker
+	require.NoError(t, cmdInit(cfg, []string{"-image", "ghcr.io/cosmos/gaia:v1@sha256:" + autodSHA256}, ioutil.Discard))
+	require.NoError(t, EnsureBinary(cfg.GenesisBin()))
+	bz, err := ioutil.ReadFile(filepath.Join(cfg.Root(), genesisDir, imageFile))
+	require.NoError(t, err)
+	assert.Equal(t, "ghcr.io/cosmos/gaia:v1@sha256:"+autodSHA256+"\n", string(bz))
+	// an image without a digest in the registry is refused
+	require.NoError(t, os.RemoveAll(cfg.Root()))
+	assert.Error(t, cfg.InitImage("ghcr.io/cosmos/gaia:v1"))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Init creates the directory layout and installs the genesis binary from src
+func (cfg *Config) Init(src string) error {
+	if err := EnsureBinary(src); err != nil {
+		return errors.Wrap(err, "invalid genesis binary")
+	}
+	if err := cfg.initLayout(); err != nil {
+		return err
+	}
+	if err := copyFile(src, cfg.GenesisBin(), 0755); err != nil {
+		os.Remove(cfg.GenesisBin())
+		return errors.Wrap(err, "copying genesis binary")
+	}
+	return MarkExecutable(cfg.GenesisBin())
+}
+
+// InitImage creates the directory layout and installs a launcher of the genesis image
+func (cfg *Config) InitImage(ref string) error {
+	if cfg.ContainerRuntime == "" {
+		return errors.Errorf("%s is needed to run images", cfg.envName("DAEMON_CONTAINER_RUNTIME"))
+	}
+	if err := cfg.initLayout(); err != nil {
+		return err
+	}
+	return cfg.PullImage(filepath.Join(cfg.Root(), genesisDir), ref)
+}
+
+// initLayout creates genesis/bin and upgrades, unless there is a genesis binary already
+func (cfg *Config) initLayout() error {
+	if _, err := os.Stat(cfg.GenesisBin()); !os.IsNotExist(err) {
+		return errors.Errorf("%s already exists, won't overwrite", cfg.GenesisBin())
+	}
+	for _, dir := range []string{filepath.Dir(cfg.GenesisBin()), filepath.Join(cfg.Root(), upgradesDir)} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return errors.Wrap(err, "creating layout")
+		}
+	}
+	return nil
+}
+
+// WriteStarterConfig writes an environment file (as read by systemd's EnvironmentFile=) with the
+// required settings, and the most common optional ones commented out. It won't overwrite a file.
+func (cfg *Config) WriteStarterConfig(path string) error {
+	lines := []string{
+		"# upgrade manager settings, see https://github.com/regen-network/cosmosd#arguments",
+		cfg.envName("DAEMON_HOME") + "=" + cfg.Home,
+		cfg.envName("DAEMON_NAME") + "=" + cfg.Name,
+		"",
+		"#" + cfg.envName("DAEMON_RESTART_AFTER_UPGRADE") + "=on",
+		"#" + cfg.envName("DAEMON_ALLOW_DOWNLOAD_BINARIES") + "=on",
+		"#" + cfg.envName("DAEMON_SHUTDOWN_GRACE") + "=30s",
+		"#" + cfg.envName("DAEMON_ARGS") + "=start",
+		"#" + cfg.envName("DAEMON_NOTIFY_COMMAND") + "=",
+		"#" + cfg.envName("DAEMON_PRUNE_MIN_FREE") + "=10GB",
+	}
+	if cfg.EnvPrefix != "" {
+		lines = append([]string{"COSMOSD_ENV_PREFIX=" + cfg.EnvPrefix}, lines...)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return errors.Wrap(err, "creating config")
+	}
+	if _, err := io.WriteString(f, strings.Join(lines, "\n")+"\n"); err != nil {
+		f.Close()
+		return errors.Wrap(err, "writing config")
+	}
+	return errors.Wrap(f.Close(), "writing config")
+}
+
+// cmdInit handles `init [-config <file>] [-image] <genesis binary or image>`
+func cmdInit(cfg *Config, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("init", flag.ContinueOnError)
+	flags.SetOutput(out)
+	config := flags.String("config", "", "also write a starter environment file here")
+	image := flags.Bool("image", false, "run genesis in this image, with DAEMON_CONTAINER_RUNTIME")
+	// cosmosd init used to be the init of the daemon, which is `run init` now
+	daemonInit := "to run the init of the daemon, use: " + os.Args[0] + " run init " + quoteArgs(args)
+	if err := flags.Parse(args); err != nil {
+		return errors.Wrap(err, daemonInit)
+	}
+	if flags.NArg() != 1 {
+		return errors.Errorf("usage: init [-config <file>] [-image] <genesis binary or image> (%s)", daemonInit)
+	}
+
+	init := cfg.Init
+	if *image {
+		init = cfg.InitImage
+	}
+	if err := init(flags.Arg(0)); err != nil {
+		if _, statErr := os.Stat(flags.Arg(0)); !*image && os.IsNotExist(statErr) {
+			return errors.Wrap(err, daemonInit)
+		}
+		return err
+	}
+	fmt.Fprintf(out, "installed %s\n", cfg.GenesisBin())
+	if *config != "" {
+		if err := cfg.WriteStarterConfig(*config); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "wrote %s\n", *config)
+	}
+	return nil
+}
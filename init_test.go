@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCmdInit(t *testing.T) {
+	home, err := ioutil.TempDir("", "init")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+
+	cfg := &Config{Home: home, Name: "dummyd", EnvPrefix: "GAIA"}
+	// no layout yet
+	require.Error(t, cfg.validate())
+	src, err := filepath.Abs(filepath.Join("testdata", "validate", "upgrade_manager", "genesis", "bin", "dummyd"))
+	require.NoError(t, err)
+
+	config := filepath.Join(home, "cosmosd.env")
+	var out bytes.Buffer
+	require.NoError(t, cmdInit(cfg, []string{"-config", config, src}, &out))
+	assert.NoError(t, cfg.validate())
+	assert.NoError(t, EnsureBinary(cfg.GenesisBin()))
+	assert.Equal(t, cfg.GenesisBin(), cfg.CurrentBin())
+	assert.DirExists(t, filepath.Join(cfg.Root(), upgradesDir))
+
+	env, err := ioutil.ReadFile(config)
+	require.NoError(t, err)
+	assert.Contains(t, string(env), "COSMOSD_ENV_PREFIX=GAIA\n")
+	assert.Contains(t, string(env), "\nGAIA_DAEMON_HOME="+home+"\nGAIA_DAEMON_NAME=dummyd\n")
+
+	// never overwrite
+	assert.Error(t, cmdInit(cfg, []string{src}, &out))
+	// and need a binary
+	assert.Error(t, cmdInit(cfg, nil, &out))
+	// which the init of the daemon was once called like
+	for _, args := range [][]string{{"mynode", "--chain-id", "test"}, {"mynode"}} {
+		other := &Config{Home: filepath.Join(home, "other"), Name: "dummyd"}
+		err := cmdInit(other, args, &out)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "run init "+quoteArgs(args))
+	}
+	other := &Config{Home: filepath.Join(home, "other"), Name: "dummyd"}
+	assert.Error(t, cmdInit(other, []string{filepath.Join(home, "missing")}, &out))
+	_, err = os.Stat(other.Root())
+	assert.True(t, os.IsNotExist(err))
+}
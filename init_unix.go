@@ -0,0 +1,82 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// isInit is whether we are pid 1, eg. the entrypoint of a container without tini or docker --init
+func isInit() bool {
+	return os.Getpid() == 1
+}
+
+// runAsInit does what init does in a container, for the upgrade manager it runs again as its only child: pass on
+// the signals we get (eg. the SIGTERM of docker stop), and reap every process that exits, including the orphans of
+// the daemon which are reparented to us and nothing else would wait for. It returns the exit code of the child.
+func runAsInit() int {
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot find our executable: %v\n", err)
+		return 1
+	}
+	signals := make(chan os.Signal, 16)
+	signal.Notify(signals)
+	child, err := os.StartProcess(exe, os.Args, &os.ProcAttr{
+		Env:   os.Environ(),
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot start %s: %v\n", exe, err)
+		return 1
+	}
+	// a SIGCHLD is dropped if signals is full, so we reap now and then regardless
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	return initLoop(child, signals, ticker.C)
+}
+
+// initLoop passes signals on to child and reaps whatever exited, until child did
+func initLoop(child *os.Process, signals <-chan os.Signal, tick <-chan time.Time) int {
+	for {
+		select {
+		case sig := <-signals:
+			switch sig {
+			// SIGURG preempts goroutines of the runtime, it is not meant for the child
+			case syscall.SIGCHLD, syscall.SIGURG:
+			default:
+				child.Signal(sig)
+			}
+		case <-tick:
+		}
+		if code, exited := reap(child.Pid); exited {
+			return code
+		}
+	}
+}
+
+// reap waits for every process which exited, and returns the exit code of pid if it was one of them
+func reap(pid int) (code int, exited bool) {
+	for {
+		var status syscall.WaitStatus
+		reaped, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || reaped <= 0 {
+			return code, exited
+		}
+		if reaped == pid {
+			exited = true
+			code = status.ExitStatus()
+			if status.Signaled() {
+				code = 128 + int(status.Signal())
+			}
+		}
+	}
+}
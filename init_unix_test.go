@@ -0,0 +1,65 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInitLoop(t *testing.T) {
+	start := func(script string) *os.Process {
+		proc, err := os.StartProcess("/bin/sh", []string{"sh", "-c", script}, &os.ProcAttr{})
+		require.NoError(t, err)
+		return proc
+	}
+	cases := map[string]struct {
+		script string
+		signal os.Signal
+		code   int
+	}{
+		"exit code": {
+			script: "exit 3",
+			code:   3,
+		},
+		"stopped by a signal we pass on": {
+			script: "trap 'exit 7' TERM; while true; do sleep 0.05; done",
+			signal: syscall.SIGTERM,
+			code:   7,
+		},
+		"killed": {
+			script: "while true; do sleep 0.05; done",
+			signal: syscall.SIGKILL,
+			code:   128 + 9,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			// a process exiting before the child, which nobody waits for
+			zombie := start("exit 0")
+			time.Sleep(50 * time.Millisecond)
+			child := start(tc.script)
+			signals := make(chan os.Signal, 1)
+			if tc.signal != nil {
+				go func() {
+					time.Sleep(100 * time.Millisecond)
+					signals <- tc.signal
+				}()
+			}
+			ticker := time.NewTicker(20 * time.Millisecond)
+			defer ticker.Stop()
+			assert.Equal(t, tc.code, initLoop(child, signals, ticker.C))
+			// both were reaped
+			for _, proc := range []*os.Process{zombie, child} {
+				_, err := syscall.Wait4(proc.Pid, nil, syscall.WNOHANG, nil)
+				assert.Equal(t, syscall.ECHILD, err)
+			}
+		})
+	}
+}
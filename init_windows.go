@@ -0,0 +1,11 @@
+package main
+
+// isInit is false, windows containers have no pid 1 to act as
+func isInit() bool {
+	return false
+}
+
+// runAsInit is never called, as we are never init on windows
+func runAsInit() int {
+	return 0
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	getter "github.com/hashicorp/go-getter"
+	"github.com/pkg/errors"
+)
+
+// defaultIPFSGateway serves ipfs:// urls if neither a gateway nor the api of a local node is set
+const defaultIPFSGateway = "https://ipfs.io"
+
+// ipfsGetter fetches ipfs://<cid>/<path> as a single file, from the api of a node if there is one (which verifies
+// every block against its hash), or else over http(s) from a gateway. A gateway could serve anything, so the url
+// needs a checksum then. A directory must be published as an archive.
+type ipfsGetter struct {
+	gateway string
+	api     string
+	http    *getter.HttpGetter
+	client  *http.Client
+	// src is the url go-getter was given, which still has the checksum it verifies the file with afterwards
+	src string
+}
+
+// ipfsPath is the content path of an ipfs:// url, eg. /ipfs/bafy.../gaiad
+func ipfsPath(u *url.URL) (string, error) {
+	if u.Host == "" {
+		return "", errors.Errorf("%s must be ipfs://<cid>[/path]", u)
+	}
+	return "/ipfs/" + u.Host + u.Path, nil
+}
+
+func (g *ipfsGetter) ClientMode(*url.URL) (getter.ClientMode, error) {
+	return getter.ClientModeFile, nil
+}
+
+func (g *ipfsGetter) SetClient(c *getter.Client) {
+	g.src = c.Src
+}
+
+func (g *ipfsGetter) Get(dst string, u *url.URL) error {
+	return singleFileOnly(u, "publish")
+}
+
+func (g *ipfsGetter) GetFile(dst string, u *url.URL) error {
+	path, err := ipfsPath(u)
+	if err != nil {
+		return err
+	}
+	if g.api == "" {
+		if !hasChecksum(g.src) {
+			return errors.Errorf("%s needs a checksum to be fetched from a gateway, or %s set", redactURL(u.String()),
+				"DAEMON_IPFS_API")
+		}
+		gateway := g.gateway
+		if gateway == "" {
+			gateway = defaultIPFSGateway
+		}
+		gateway = strings.TrimSuffix(gateway, "/") + path
+		forced, err := url.Parse(gateway)
+		if err != nil {
+			return errors.Wrap(err, "parsing ipfs gateway")
+		}
+		return g.http.GetFile(dst, forced)
+	}
+
+	// the rpc api of kubo only takes POST
+	api := fmt.Sprintf("%s/api/v0/cat?arg=%s", strings.TrimSuffix(g.api, "/"), url.QueryEscape(path))
+	resp, err := g.client.Post(api, "", nil)
+	if err != nil {
+		return errors.Wrapf(err, "fetching %s from the ipfs api", path)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.Errorf("fetching %s from the ipfs api: %s: %s", path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "fetching %s from the ipfs api", path)
+	}
+	return f.Close()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadFromIPFS(t *testing.T) {
+	bin, err := ioutil.ReadFile("testdata/repo/raw_binary/autod")
+	require.NoError(t, err)
+	const cid = "bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi"
+	info := fmt.Sprintf(`{"binaries":{"%s":"ipfs://%s/autod?checksum=sha256:%s"}}`, osArch(), cid, autodSHA256)
+	infoSum := sha256.Sum256([]byte(info))
+
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ipfs/" + cid + "/autod":
+			w.Write(bin)
+		case "/ipfs/" + cid + "/info.json":
+			fmt.Fprint(w, info)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer gateway.Close()
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/v0/cat" {
+			http.Error(w, "405 - Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.URL.Query().Get("arg") != "/ipfs/"+cid+"/autod" {
+			http.Error(w, `{"Message":"no link named \"gaiad\"","Code":0,"Type":"error"}`, http.StatusInternalServerError)
+			return
+		}
+		w.Write(bin)
+	}))
+	defer api.Close()
+
+	cases := map[string]struct {
+		cfg  Config
+		info string
+		err  string
+	}{
+		"gateway": {
+			cfg:  Config{IPFSGateway: gateway.URL},
+			info: info,
+		},
+		"info from gateway": {
+			cfg:  Config{IPFSGateway: gateway.URL + "/"},
+			info: "ipfs://" + cid + "/info.json?checksum=sha256:" + hex.EncodeToString(infoSum[:]),
+		},
+		// a gateway could serve anything
+		"gateway without checksum": {
+			cfg:  Config{IPFSGateway: gateway.URL},
+			info: fmt.Sprintf(`{"binaries":{"%s":"ipfs://%s/autod"}}`, osArch(), cid),
+			err:  "needs a checksum to be fetched from a gateway",
+		},
+		"api without checksum": {
+			cfg:  Config{IPFSAPI: api.URL},
+			info: fmt.Sprintf(`{"binaries":{"%s":"ipfs://%s/autod"}}`, osArch(), cid),
+		},
+		"api": {
+			cfg:  Config{IPFSAPI: api.URL, IPFSGateway: "http://127.0.0.1:1"},
+			info: info,
+		},
+		"missing": {
+			cfg:  Config{IPFSAPI: api.URL},
+			info: fmt.Sprintf(`{"binaries":{"%s":"ipfs://%s/gaiad"}}`, osArch(), cid),
+			err:  "no link named",
+		},
+		"no cid": {
+			cfg:  Config{IPFSGateway: gateway.URL},
+			info: fmt.Sprintf(`{"binaries":{"%s":"ipfs:///autod"}}`, osArch()),
+			err:  "must be ipfs://<cid>",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			home, err := copyTestData("download")
+			require.NoError(t, err)
+			defer os.RemoveAll(home)
+			cfg := tc.cfg
+			cfg.Home, cfg.Name, cfg.AllowDownloadBinaries = home, "autod", true
+
+			err = DownloadBinary(&cfg, &UpgradeInfo{Name: "v2", Info: tc.info})
+			if tc.err != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+			hash, err := sha256File(cfg.UpgradeBin("v2"))
+			require.NoError(t, err)
+			assert.Equal(t, autodSHA256, hash)
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// JailerData is what every field of DAEMON_JAILER may use, eg. firejail --private={{.Home}} {{.Bin}}
+type JailerData struct {
+	// Bin is the resolved binary of the upgrade we run, not the current link
+	Bin     string
+	Home    string
+	Name    string
+	Upgrade string
+}
+
+// parseJailer reads the command the daemon is run with, split into fields (quoted like splitArgs reads them)
+// before they are filled in, so paths with spaces stay one argument. One of the fields must name the binary.
+func parseJailer(value string) ([]*template.Template, error) {
+	args, err := splitArgs(value)
+	if err != nil {
+		return nil, err
+	}
+	var fields []*template.Template
+	for i, field := range args {
+		tmpl, err := template.New(field).Option("missingkey=error").Parse(field)
+		if err != nil {
+			return nil, errors.Wrapf(err, "field %d", i+1)
+		}
+		fields = append(fields, tmpl)
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	jail, err := renderJailer(fields, JailerData{Bin: "\x00"})
+	if err != nil {
+		return nil, err
+	}
+	for _, arg := range jail {
+		if strings.Contains(arg, "\x00") {
+			return fields, nil
+		}
+	}
+	return nil, errors.New("no field holds {{.Bin}}")
+}
+
+func renderJailer(fields []*template.Template, data JailerData) ([]string, error) {
+	jail := make([]string, len(fields))
+	for i, field := range fields {
+		var buf bytes.Buffer
+		if err := field.Execute(&buf, data); err != nil {
+			return nil, errors.Wrapf(err, "field %d", i+1)
+		}
+		jail[i] = buf.String()
+	}
+	return jail, nil
+}
+
+// Command runs bin with args, in the jailer if DAEMON_JAILER is set. A jailed daemon is signaled along with
+// its jailer, so it stops cleanly for an upgrade whether or not the jailer passes signals on, and its exit
+// code is the one of the jailer.
+func (cfg *Config) Command(bin string, args []string) (*exec.Cmd, []string, error) {
+	if len(cfg.Jailer) == 0 {
+		return exec.Command(bin, args...), nil, nil
+	}
+	// the jailer may not follow links, or only allow what they resolve to
+	resolved, err := filepath.EvalSymlinks(bin)
+	if err == nil {
+		resolved, err = filepath.Abs(resolved)
+	}
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "resolving binary")
+	}
+	jail, err := renderJailer(cfg.Jailer, JailerData{Bin: resolved, Home: cfg.Home, Name: cfg.Name, Upgrade: cfg.currentUpgradeName()})
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "rendering %s", cfg.envName("DAEMON_JAILER"))
+	}
+	cmd := exec.Command(jail[0], append(jail[1:], args...)...)
+	jailProcess(cmd)
+	return cmd, jail, nil
+}
+
+// runJailed runs bin with args like the daemon is run (see Command), with the env of its overrides, for at most
+// timeout, and returns what it wrote. Once the time is up, it is killed along with its jailer.
+func (cfg *Config) runJailed(bin string, args []string, timeout time.Duration) (string, error) {
+	cmd, _, err := cfg.Command(bin, args)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := withOverrideEnv(cmd, bin); err != nil {
+		return "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	timer := time.AfterFunc(timeout, func() {
+		signalProcess(cmd, syscall.SIGKILL)
+	})
+	err = cmd.Wait()
+	if !timer.Stop() {
+		return out.String(), errors.Wrapf(context.DeadlineExceeded, "no exit within %s", timeout)
+	}
+	return out.String(), err
+}
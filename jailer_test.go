@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseJailer(t *testing.T) {
+	jailer, err := parseJailer("")
+	require.NoError(t, err)
+	assert.Nil(t, jailer)
+
+	jailer, err = parseJailer("bwrap --ro-bind / / --bind {{.Home}} {{.Home}} --die-with-parent {{.Bin}}")
+	require.NoError(t, err)
+	jail, err := renderJailer(jailer, JailerData{Bin: "/my node/bin/gaiad", Home: "/my node"})
+	require.NoError(t, err)
+	// a path with spaces stays one argument
+	assert.Equal(t, []string{"bwrap", "--ro-bind", "/", "/", "--bind", "/my node", "/my node", "--die-with-parent", "/my node/bin/gaiad"}, jail)
+
+	// and so does one given quoted
+	jailer, err = parseJailer(`"/opt/my jail/jail" --profile='a b' '{{ .Bin }}'`)
+	require.NoError(t, err)
+	jail, err = renderJailer(jailer, JailerData{Bin: "/my node/bin/gaiad"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/opt/my jail/jail", "--profile=a b", "/my node/bin/gaiad"}, jail)
+	_, err = parseJailer(`firejail "{{.Bin}}`)
+	assert.Error(t, err)
+
+	_, err = parseJailer("firejail --quiet")
+	assert.Error(t, err)
+	_, err = parseJailer("firejail {{.Bin")
+	assert.Error(t, err)
+	_, err = parseJailer("firejail {{.Binary}}")
+	assert.Error(t, err)
+}
+
+func TestCommand(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+	require.NoError(t, cfg.SetCurrentUpgrade("chain2"))
+
+	cmd, jail, err := cfg.Command(cfg.CurrentBin(), []string{"start"})
+	require.NoError(t, err)
+	assert.Nil(t, jail)
+	assert.Equal(t, []string{cfg.CurrentBin(), "start"}, cmd.Args)
+
+	cfg.Jailer, err = parseJailer("firejail --name={{.Name}}-{{.Upgrade}} {{.Bin}}")
+	require.NoError(t, err)
+	cmd, jail, err = cfg.Command(cfg.CurrentBin(), []string{"start"})
+	require.NoError(t, err)
+	resolved, err := filepath.EvalSymlinks(cfg.UpgradeBin("chain2"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"firejail", "--name=dummyd-chain2", resolved}, jail)
+	assert.Equal(t, []string{"firejail", "--name=dummyd-chain2", resolved, "start"}, cmd.Args)
+}
+
+// TestLaunchProcessJailed stops a daemon for the upgrade through a jailer which doesn't pass SIGTERM on
+func TestLaunchProcessJailed(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no jailers on windows")
+	}
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	jail := filepath.Join(home, "jail")
+	require.NoError(t, ioutil.WriteFile(jail, []byte("#!/bin/sh\ntrap true TERM\n\"$@\"\n"), 0755))
+	script := "#!/bin/sh\ntrap 'echo stopped; exit 0' TERM\necho 'UPGRADE \"chain2\" NEEDED at height 49: {}'\nwhile true; do sleep 0.05; done\n"
+	cfg := &Config{Home: home, Name: "dummyd", UnsafeSkipBackup: true, ShutdownGrace: 10 * time.Second}
+	require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+	cfg.Jailer, err = parseJailer(jail + " {{.Bin}}")
+	require.NoError(t, err)
+
+	var stdout, stderr bytes.Buffer
+	start := time.Now()
+	require.NoError(t, LaunchProcess(cfg, []string{"start"}, &stdout, &stderr))
+	assert.True(t, time.Since(start) < 5*time.Second, "the daemon was not signaled")
+	assert.Equal(t, "UPGRADE \"chain2\" NEEDED at height 49: {}\nstopped\n", stdout.String())
+	assert.Equal(t, cfg.UpgradeBin("chain2"), cfg.CurrentBin())
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// there are no jailers on windows, the daemon is signaled (or killed) itself
+
+func jailProcess(cmd *exec.Cmd) {}
+
+func signalProcess(cmd *exec.Cmd, sig syscall.Signal) error {
+	if sig == syscall.SIGKILL {
+		return cmd.Process.Kill()
+	}
+	return cmd.Process.Signal(sig)
+}
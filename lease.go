@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Lease is the record stored on shared storage by the node currently allowed to run the validator.
+// A standby node may only take over once the lease of the active node expired.
+type Lease struct {
+	Owner string `json:"owner"`
+	// Instance is random for every run of the upgrade manager, so a cloned host with the same name
+	// doesn't pass for the owner
+	Instance string `json:"instance,omitempty"`
+	// Key is the consensus pubkey of the validator the lease is for, if we know it
+	Key     string    `json:"key,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// newLeaseInstance returns a random id for this run
+func newLeaseInstance() (string, error) {
+	bz := make([]byte, 8)
+	if _, err := rand.Read(bz); err != nil {
+		return "", errors.Wrap(err, "creating lease instance")
+	}
+	return hex.EncodeToString(bz), nil
+}
+
+// readValidatorKey returns the consensus pubkey in the priv_validator_key.json at path, or "" if there
+// is no such file (eg. with a remote signer). The whole file is read, private key included, but only the
+// pubkey is kept.
+func readValidatorKey(path string) (string, error) {
+	bz, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "reading validator key")
+	}
+	var key struct {
+		PubKey struct {
+			Value string `json:"value"`
+		} `json:"pub_key"`
+	}
+	if err := json.Unmarshal(bz, &key); err != nil || key.PubKey.Value == "" {
+		return "", errors.Errorf("%s has no pub_key", path)
+	}
+	return key.PubKey.Value, nil
+}
+
+// lease is the lease we hold, or want to
+func (cfg *Config) lease() Lease {
+	return Lease{Owner: cfg.LeaseOwner, Instance: cfg.LeaseInstance, Key: cfg.LeaseKey}
+}
+
+// leasePath is the lease file, which is named after the validator key if DAEMON_LEASE_FILE is a directory,
+// so several validators can share one
+func (cfg *Config) leasePath() (string, error) {
+	info, err := os.Stat(cfg.LeaseFile)
+	if err != nil || !info.IsDir() {
+		return cfg.LeaseFile, nil
+	}
+	if cfg.LeaseKey == "" {
+		return "", errors.Errorf("%s is a directory, but there is no validator key to name the lease after", cfg.LeaseFile)
+	}
+	hash := sha256.Sum256([]byte(cfg.LeaseKey))
+	return filepath.Join(cfg.LeaseFile, hex.EncodeToString(hash[:8])+".lease"), nil
+}
+
+// leaseEnv is passed to the lease command
+func (cfg *Config) leaseEnv(action string) map[string]string {
+	return map[string]string{
+		"COSMOSD_LEASE_ACTION":   action,
+		"COSMOSD_LEASE_OWNER":    cfg.LeaseOwner,
+		"COSMOSD_LEASE_INSTANCE": cfg.LeaseInstance,
+		"COSMOSD_LEASE_KEY":      cfg.LeaseKey,
+		"COSMOSD_LEASE_TTL":      cfg.LeaseTTL.String(),
+	}
+}
+
+// HasLease returns true if this node must hold a lease before starting the child
+func (cfg *Config) HasLease() bool {
+	return cfg.LeaseFile != "" || cfg.LeaseCommand != ""
+}
+
+// AcquireLease makes sure we hold the lease, or returns an error if anyone else does.
+// It is also used to renew a lease we already hold.
+func (cfg *Config) AcquireLease() error {
+	if cfg.LeaseFile != "" {
+		path, err := cfg.leasePath()
+		if err != nil {
+			return err
+		}
+		if err := acquireLeaseFile(path, cfg.lease(), cfg.LeaseTTL); err != nil {
+			return err
+		}
+	}
+	if cfg.LeaseCommand != "" {
+		if err := RunHook(cfg.LeaseCommand, cfg.leaseEnv("acquire")); err != nil {
+			return errors.Wrap(err, "lease command refused")
+		}
+	}
+	return nil
+}
+
+// ReleaseLease gives up the lease we hold, so the next start (of us, or the standby) doesn't wait for it to expire.
+// Failures are only logged, the lease expires anyway.
+func (cfg *Config) ReleaseLease() {
+	if cfg.LeaseFile != "" {
+		path, err := cfg.leasePath()
+		if err == nil {
+			var current *Lease
+			if current, err = readLease(path); err == nil && current != nil && current.Owner == cfg.LeaseOwner && current.Instance == cfg.LeaseInstance {
+				err = os.Remove(path)
+			}
+		}
+		if err != nil {
+			logger.Printf("cannot release lease: %v", err)
+		}
+	}
+	// the lease command may not know of releasing, it only grants
+	if cfg.LeaseReleaseCommand != "" {
+		if err := RunHook(cfg.LeaseReleaseCommand, cfg.leaseEnv("release")); err != nil {
+			logger.Printf("cannot release lease: %v", err)
+		}
+	}
+}
+
+// the lock file of a lease is only held while deciding whether the lease is free and writing it, we wait at most
+// leaseLockWait for it, polling every leaseLockPoll. Its holder died if it is leaseLockStale old.
+var (
+	leaseLockWait  = 5 * time.Second
+	leaseLockPoll  = 50 * time.Millisecond
+	leaseLockStale = 30 * time.Second
+)
+
+// acquireLeaseFile writes our lease, unless another owner (or another instance of ours, on a cloned host)
+// holds a lease which didn't expire yet. The lease is read, checked and written holding <lease>.lock, so two
+// nodes never both decide that the lease is free.
+func acquireLeaseFile(path string, ours Lease, ttl time.Duration) error {
+	lock := path + ".lock"
+	owner := ours.Owner + " " + ours.Instance
+	for deadline := time.Now().Add(leaseLockWait); ; {
+		locked, err := createLockFile(lock, owner, leaseLockStale)
+		if err != nil {
+			return errors.Wrap(err, "locking lease")
+		}
+		if locked {
+			break
+		}
+		if time.Now().After(deadline) {
+			return errors.Errorf("lease is being written by %s", readLockOwner(lock))
+		}
+		time.Sleep(leaseLockPoll)
+	}
+	defer removeLockFile(lock, owner)
+
+	current, err := readLease(path)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if current != nil && now.Before(current.Expires) {
+		if current.Owner != ours.Owner {
+			return errors.Errorf("lease held by %s until %s", current.Owner, current.Expires.Format(time.RFC3339))
+		}
+		if current.Instance != ours.Instance {
+			return errors.Errorf("lease held by another instance of %s until %s, is this host cloned?",
+				current.Owner, current.Expires.Format(time.RFC3339))
+		}
+	}
+
+	ours.Expires = now.Add(ttl)
+	bz, err := json.Marshal(ours)
+	if err != nil {
+		return errors.Wrap(err, "encode lease")
+	}
+	// write to a temp file and rename, so the other node never reads a partial lease
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+"."+ours.Owner+ours.Instance)
+	if err := ioutil.WriteFile(tmp, bz, 0644); err != nil {
+		return errors.Wrap(err, "writing lease")
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "writing lease")
+	}
+	// and make sure no one (not taking the lock) wrote over it
+	written, err := readLease(path)
+	if err != nil {
+		return err
+	}
+	if written == nil || written.Owner != ours.Owner || written.Instance != ours.Instance || !written.Expires.Equal(ours.Expires) {
+		return errors.New("lease was written by someone else meanwhile")
+	}
+	return nil
+}
+
+// readLease returns the lease stored at path, or nil if there is none
+func readLease(path string) (*Lease, error) {
+	bz, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "reading lease")
+	}
+	var lease Lease
+	if err := json.Unmarshal(bz, &lease); err != nil {
+		return nil, errors.Wrapf(err, "parsing lease %s", path)
+	}
+	return &lease, nil
+}
+
+// RenewLease renews the lease every third of the ttl until done is closed.
+// If we fail to renew, the error is sent on lost and the child is killed, so we never
+// keep signing without holding the lease.
+func (cfg *Config) RenewLease(cmd *exec.Cmd, done <-chan struct{}, lost chan<- error) {
+	ticker := time.NewTicker(cfg.LeaseTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := cfg.AcquireLease(); err != nil {
+				lost <- err
+				_ = signalProcess(cmd, syscall.SIGKILL)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcquireLeaseFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lease-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "validator.lease")
+
+	// first one to come gets it, and can renew it
+	require.NoError(t, acquireLeaseFile(path, Lease{Owner: "alpha"}, time.Minute))
+	require.NoError(t, acquireLeaseFile(path, Lease{Owner: "alpha"}, time.Minute))
+
+	// the standby is refused while the lease is valid
+	err = acquireLeaseFile(path, Lease{Owner: "beta"}, time.Minute)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "alpha")
+	lease, err := readLease(path)
+	require.NoError(t, err)
+	assert.Equal(t, "alpha", lease.Owner)
+
+	// once it expired, the standby can take over
+	require.NoError(t, acquireLeaseFile(path, Lease{Owner: "alpha"}, -time.Second))
+	require.NoError(t, acquireLeaseFile(path, Lease{Owner: "beta"}, time.Minute))
+	require.Error(t, acquireLeaseFile(path, Lease{Owner: "alpha"}, time.Minute))
+
+	// a clone of the host holding the lease has the same name, but not the same instance
+	require.NoError(t, acquireLeaseFile(path, Lease{Owner: "beta"}, -time.Second))
+	require.NoError(t, acquireLeaseFile(path, Lease{Owner: "gamma", Instance: "1"}, time.Minute))
+	err = acquireLeaseFile(path, Lease{Owner: "gamma", Instance: "2"}, time.Minute)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cloned")
+
+	// garbage in the lease file is never treated as a free lease
+	require.NoError(t, ioutil.WriteFile(path, []byte("not json"), 0644))
+	require.Error(t, acquireLeaseFile(path, Lease{Owner: "alpha"}, time.Minute))
+}
+
+func TestAcquireLeaseFileConcurrently(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lease-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "validator.lease")
+
+	// of many nodes finding the lease free at once, only one gets it
+	var wg sync.WaitGroup
+	var acquired int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if acquireLeaseFile(path, Lease{Owner: fmt.Sprintf("node%d", i)}, time.Minute) == nil {
+				atomic.AddInt32(&acquired, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), acquired)
+	_, err = os.Stat(path + ".lock")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestAcquireLeaseFileLock(t *testing.T) {
+	defer func(wait, stale time.Duration) {
+		leaseLockWait, leaseLockStale = wait, stale
+	}(leaseLockWait, leaseLockStale)
+	leaseLockWait, leaseLockStale = 100*time.Millisecond, time.Minute
+	dir, err := ioutil.TempDir("", "lease-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "validator.lease")
+
+	// someone is writing the lease
+	require.NoError(t, ioutil.WriteFile(path+".lock", []byte("beta 1\n"), 0644))
+	err = acquireLeaseFile(path, Lease{Owner: "alpha"}, time.Minute)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "beta 1")
+
+	// and died doing so
+	old := time.Now().Add(-2 * time.Minute)
+	require.NoError(t, os.Chtimes(path+".lock", old, old))
+	require.NoError(t, acquireLeaseFile(path, Lease{Owner: "alpha"}, time.Minute))
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, "validator.lease", files[0].Name())
+}
+
+func TestAcquireLeaseCommand(t *testing.T) {
+	cases := map[string]struct {
+		command string
+		isErr   bool
+	}{
+		"granted": {command: "true"},
+		"refused": {command: "false", isErr: true},
+		"missing": {command: "/no/such/lock-tool --acquire", isErr: true},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cfg := &Config{LeaseCommand: tc.command, LeaseOwner: "alpha", LeaseTTL: time.Minute}
+			require.True(t, cfg.HasLease())
+			err := cfg.AcquireLease()
+			if tc.isErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestReleaseLeaseCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as lease command")
+	}
+	dir, err := ioutil.TempDir("", "lease-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	calls := filepath.Join(dir, "calls")
+	command := filepath.Join(dir, "lock-tool")
+	require.NoError(t, ioutil.WriteFile(command, []byte("#!/bin/sh\necho \"$@ $COSMOSD_LEASE_ACTION\" >> "+calls+"\n"), 0755))
+
+	// the lease command is only asked to grant
+	cfg := &Config{LeaseCommand: command + " grant", LeaseOwner: "alpha", LeaseTTL: time.Minute}
+	require.NoError(t, cfg.AcquireLease())
+	cfg.ReleaseLease()
+	cfg.LeaseReleaseCommand = command + " free"
+	cfg.ReleaseLease()
+	bz, err := ioutil.ReadFile(calls)
+	require.NoError(t, err)
+	assert.Equal(t, "grant acquire\nfree release\n", string(bz))
+}
+
+func TestLaunchProcessWithoutLease(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+
+	leaseFile := filepath.Join(home, "validator.lease")
+	require.NoError(t, acquireLeaseFile(leaseFile, Lease{Owner: "other-host"}, time.Minute))
+
+	cfg := &Config{Home: home, Name: "dummyd", LeaseFile: leaseFile, LeaseOwner: "this-host", LeaseTTL: time.Minute}
+	err = LaunchProcess(cfg, []string{"start"}, ioutil.Discard, ioutil.Discard)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot acquire lease")
+	// we never started, so no upgrade happened
+	assert.Equal(t, cfg.GenesisBin(), cfg.CurrentBin())
+}
+
+func TestLeaseByValidatorKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lease-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "priv_validator_key.json")
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte(`{
+  "address": "B5A2A6B8C8D44D6F3C1B9A43D1F4E1F36A7B2C11",
+  "pub_key": {"type": "tendermint/PubKeyEd25519", "value": "zD9VC1ut7Dwm2u3tD1sb7BmTNQ5L8B9DR3Z0cXEuyr4="},
+  "priv_key": {"type": "tendermint/PrivKeyEd25519", "value": "secret"}
+}`), 0600))
+	key, err := readValidatorKey(keyFile)
+	require.NoError(t, err)
+	assert.Equal(t, "zD9VC1ut7Dwm2u3tD1sb7BmTNQ5L8B9DR3Z0cXEuyr4=", key)
+	key, err = readValidatorKey(filepath.Join(dir, "missing.json"))
+	require.NoError(t, err)
+	assert.Equal(t, "", key)
+
+	// a shared directory holds one lease per validator
+	leases := filepath.Join(dir, "leases")
+	require.NoError(t, os.Mkdir(leases, 0755))
+	alpha := &Config{LeaseFile: leases, LeaseOwner: "alpha", LeaseInstance: "1", LeaseKey: "key1", LeaseTTL: time.Minute}
+	other := &Config{LeaseFile: leases, LeaseOwner: "beta", LeaseInstance: "2", LeaseKey: "key2", LeaseTTL: time.Minute}
+	clone := &Config{LeaseFile: leases, LeaseOwner: "alpha", LeaseInstance: "3", LeaseKey: "key1", LeaseTTL: time.Minute}
+	require.NoError(t, alpha.AcquireLease())
+	require.NoError(t, other.AcquireLease())
+	require.Error(t, clone.AcquireLease())
+	path, err := alpha.leasePath()
+	require.NoError(t, err)
+	lease, err := readLease(path)
+	require.NoError(t, err)
+	assert.Equal(t, "key1", lease.Key)
+
+	// the clone may start once we released it
+	clone.ReleaseLease()
+	assert.FileExists(t, path)
+	alpha.ReleaseLease()
+	require.NoError(t, clone.AcquireLease())
+
+	// without a key, there is nothing to name the lease after
+	noKey := &Config{LeaseFile: leases, LeaseOwner: "gamma", LeaseTTL: time.Minute}
+	assert.Error(t, noKey.AcquireLease())
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// createLockFile creates the lock file at path holding owner. O_EXCL makes this atomic over NFS (v3 and later) too,
+// unlike flock. A lock file which was not touched for stale is taken over, as its holder died. It returns false
+// if someone else holds the lock.
+func createLockFile(path, owner string, stale time.Duration) (bool, error) {
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = f.WriteString(owner + "\n")
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(path)
+				return false, errors.Wrap(err, "writing lock")
+			}
+			return true, nil
+		}
+		if !os.IsExist(err) {
+			return false, errors.Wrap(err, "creating lock")
+		}
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			// released in the meantime
+			continue
+		}
+		if err != nil {
+			return false, errors.Wrap(err, "reading lock")
+		}
+		if time.Since(info.ModTime()) <= stale {
+			return false, nil
+		}
+		logger.Printf("taking over the lock %s from %s, it was not renewed for %s", path, readLockOwner(path),
+			time.Since(info.ModTime()).Round(time.Second))
+		if err := removeStaleLock(path, info); err != nil {
+			return false, err
+		}
+	}
+}
+
+// removeStaleLock moves the stale lock file at path out of the way under a name of our own, which only one of several
+// upgrade managers taking it over at once can. If the file moved is not the stale one, because another one took over
+// and locked again before us, it is put back.
+func removeStaleLock(path string, stale os.FileInfo) error {
+	suffix, err := newLeaseInstance()
+	if err != nil {
+		return err
+	}
+	aside := path + "." + suffix + ".stale"
+	if err := os.Rename(path, aside); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrap(err, "removing stale lock")
+	}
+	defer os.Remove(aside)
+	moved, err := os.Stat(aside)
+	if err != nil {
+		return errors.Wrap(err, "removing stale lock")
+	}
+	if !os.SameFile(stale, moved) || !stale.ModTime().Equal(moved.ModTime()) {
+		// a link fails if someone locked again meanwhile, who holds the lock then
+		if err := os.Link(aside, path); err != nil && !os.IsExist(err) {
+			return errors.Wrap(err, "restoring lock")
+		}
+	}
+	return nil
+}
+
+// removeLockFile removes the lock file at path, unless someone took it over in the meantime
+func removeLockFile(path, owner string) {
+	if readLockOwner(path) == strings.TrimSpace(owner) {
+		os.Remove(path)
+	}
+}
+
+// readLockOwner says who holds a lock, for the log
+func readLockOwner(path string) string {
+	bz, err := ioutil.ReadFile(path)
+	if owner := strings.TrimSpace(string(bz)); err == nil && owner != "" {
+		return owner
+	}
+	return "another upgrade manager"
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateLockFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "x.lock")
+
+	locked, err := createLockFile(path, "alpha", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, locked)
+	locked, err = createLockFile(path, "beta", time.Minute)
+	require.NoError(t, err)
+	assert.False(t, locked)
+	assert.Equal(t, "alpha", readLockOwner(path))
+
+	// only the holder removes it
+	removeLockFile(path, "beta")
+	assert.Equal(t, "alpha", readLockOwner(path))
+	removeLockFile(path, "alpha")
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCreateLockFileTakeover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "x.lock")
+
+	// of many taking over a stale lock at once, only one gets it, and no stale file is left behind
+	require.NoError(t, ioutil.WriteFile(path, []byte("crashed\n"), 0644))
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(path, old, old))
+	var wg sync.WaitGroup
+	var locked int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ok, err := createLockFile(path, fmt.Sprintf("node%d", i), time.Minute)
+			assert.NoError(t, err)
+			if ok {
+				atomic.AddInt32(&locked, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), locked)
+	assert.NotEqual(t, "crashed", readLockOwner(path))
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// logsPath is where the admin api serves the output of the daemon
+	logsPath = "/logs"
+	// logBufferLines is how many lines of output are kept for /logs
+	logBufferLines = 2000
+	// maxLogLine cuts lines kept for /logs, the daemon still sees them whole
+	maxLogLine = 16 * 1024
+	// defaultLogTail is how many recent lines /logs returns without ?lines=
+	defaultLogTail = 100
+)
+
+// outputLog keeps the recent output of all launches of the daemon
+var outputLog = NewLogBuffer(logBufferLines)
+
+// LogLine is a line the daemon wrote to Stream, stdout or stderr
+type LogLine struct {
+	Stream string
+	Text   string
+}
+
+// LogBuffer is a ring of the last lines of output, and passes new lines on to whoever follows them
+type LogBuffer struct {
+	mutex sync.Mutex
+	lines []LogLine
+	// next is where the next line goes, the oldest one once the ring is full
+	next      int
+	full      bool
+	followers map[chan LogLine]struct{}
+}
+
+// NewLogBuffer keeps up to size lines
+func NewLogBuffer(size int) *LogBuffer {
+	return &LogBuffer{lines: make([]LogLine, size), followers: map[chan LogLine]struct{}{}}
+}
+
+// Add keeps the line. A follower that doesn't keep up misses lines, rather than blocking the daemon.
+func (b *LogBuffer) Add(stream, text string) {
+	if len(text) > maxLogLine {
+		text = text[:maxLogLine]
+	}
+	line := LogLine{Stream: stream, Text: text}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.lines[b.next] = line
+	b.next = (b.next + 1) % len(b.lines)
+	b.full = b.full || b.next == 0
+	for follower := range b.followers {
+		select {
+		case follower <- line:
+		default:
+		}
+	}
+}
+
+// Recent returns the last n lines, oldest first
+func (b *LogBuffer) Recent(n int) []LogLine {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.recent(n)
+}
+
+func (b *LogBuffer) recent(n int) []LogLine {
+	count := b.next
+	if b.full {
+		count = len(b.lines)
+	}
+	if n < 0 || n > count {
+		n = count
+	}
+	recent := make([]LogLine, n)
+	for i := range recent {
+		recent[i] = b.lines[(b.next-n+i+len(b.lines))%len(b.lines)]
+	}
+	return recent
+}
+
+// Follow returns the last n lines, and the lines added after them until stop is called
+func (b *LogBuffer) Follow(n int) (recent []LogLine, lines <-chan LogLine, stop func()) {
+	follower := make(chan LogLine, 256)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.followers[follower] = struct{}{}
+	return b.recent(n), follower, func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		delete(b.followers, follower)
+	}
+}
+
+// Writer adds what is written to it to the buffer line by line, as written by stream
+func (b *LogBuffer) Writer(stream string) io.Writer {
+	return &logWriter{buffer: b, stream: stream}
+}
+
+type logWriter struct {
+	buffer  *LogBuffer
+	stream  string
+	partial []byte
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	rest := p
+	for {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			break
+		}
+		w.partial = append(w.partial, rest[:i]...)
+		w.buffer.Add(w.stream, strings.TrimSuffix(string(w.partial), "\r"))
+		w.partial = w.partial[:0]
+		rest = rest[i+1:]
+	}
+	// a huge line is kept cut only, anyway
+	if room := maxLogLine + 1 - len(w.partial); room > 0 {
+		if len(rest) > room {
+			rest = rest[:room]
+		}
+		w.partial = append(w.partial, rest...)
+	}
+	return len(p), nil
+}
+
+// LogFilter selects the lines /logs returns
+type LogFilter struct {
+	// Stream is stdout or stderr, or empty for both
+	Stream string
+	Grep   *regexp.Regexp
+}
+
+// Match is whether the line passes the filter
+func (f LogFilter) Match(line LogLine) bool {
+	if f.Stream != "" && f.Stream != line.Stream {
+		return false
+	}
+	return f.Grep == nil || f.Grep.MatchString(line.Text)
+}
+
+// serveLogs writes the recent output of the daemon, ?lines= of them, and with ?follow=true keeps writing new
+// lines until the client goes away. ?stream=stdout|stderr and ?grep=<regexp> filter the lines.
+func serveLogs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	filter := LogFilter{Stream: query.Get("stream")}
+	if filter.Stream != "" && filter.Stream != "stdout" && filter.Stream != "stderr" {
+		http.Error(w, "stream is stdout or stderr", http.StatusBadRequest)
+		return
+	}
+	if grep := query.Get("grep"); grep != "" {
+		re, err := regexp.Compile(grep)
+		if err != nil {
+			http.Error(w, "invalid grep: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter.Grep = re
+	}
+	n := defaultLogTail
+	if lines := query.Get("lines"); lines != "" {
+		var err error
+		if n, err = strconv.Atoi(lines); err != nil || n < 0 {
+			http.Error(w, "lines must be a count", http.StatusBadRequest)
+			return
+		}
+	}
+	follow, _ := strconv.ParseBool(query.Get("follow"))
+
+	// the filter applies before the count, so ?lines=10&grep=ERR are the last 10 errors
+	var recent []LogLine
+	var lines <-chan LogLine
+	if follow {
+		var stop func()
+		recent, lines, stop = outputLog.Follow(-1)
+		defer stop()
+	} else {
+		recent = outputLog.Recent(-1)
+	}
+	var selected []LogLine
+	for _, line := range recent {
+		if filter.Match(line) {
+			selected = append(selected, line)
+		}
+	}
+	if len(selected) > n {
+		selected = selected[len(selected)-n:]
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, line := range selected {
+		fmt.Fprintln(w, line.Text)
+	}
+	if !follow {
+		return
+	}
+	flusher, _ := w.(http.Flusher)
+	for {
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case line := <-lines:
+			if filter.Match(line) {
+				if _, err := fmt.Fprintln(w, line.Text); err != nil {
+					return
+				}
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// cmdLogs prints the output of the daemon run by the upgrade manager, through its admin api
+func cmdLogs(cfg *Config, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("logs", flag.ContinueOnError)
+	flags.SetOutput(out)
+	follow := flags.Bool("f", false, "keep printing new output")
+	lines := flags.Int("n", defaultLogTail, "how many recent lines to print")
+	stream := flags.String("stream", "", "only print stdout or stderr")
+	grep := flags.String("grep", "", "only print lines matching the regexp")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if cfg.AdminAddress == "" {
+		return errors.Errorf("%s is not set, so the upgrade manager serves no admin api", cfg.envName("DAEMON_ADMIN_ADDRESS"))
+	}
+
+	query := url.Values{"lines": {strconv.Itoa(*lines)}, "follow": {strconv.FormatBool(*follow)}}
+	if *stream != "" {
+		query.Set("stream", *stream)
+	}
+	if *grep != "" {
+		query.Set("grep", *grep)
+	}
+	// following has no end, so the timeout only applies to a tail
+	client := &http.Client{}
+	if !*follow {
+		client.Timeout = orDefault(cfg.RPCTimeout, defaultRPCTimeout)
+	}
+	req, err := http.NewRequest("GET", adminURL(cfg.AdminAddress)+logsPath+"?"+query.Encode(), nil)
+	if err != nil {
+		return errors.Wrap(err, "creating request")
+	}
+	if cfg.AdminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.AdminToken)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "calling admin api")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("admin api: %s", strings.TrimSpace(string(body)))
+	}
+	_, err = io.Copy(out, resp.Body)
+	return errors.Wrap(err, "reading logs")
+}
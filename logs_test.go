@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogBuffer(t *testing.T) {
+	b := NewLogBuffer(3)
+	assert.Empty(t, b.Recent(-1))
+
+	w := b.Writer("stdout")
+	fmt.Fprint(w, "one\r\ntw")
+	fmt.Fprint(w, "o\nthree\n")
+	assert.Equal(t, []LogLine{{"stdout", "one"}, {"stdout", "two"}, {"stdout", "three"}}, b.Recent(-1))
+
+	b.Add("stderr", "four")
+	assert.Equal(t, []LogLine{{"stdout", "two"}, {"stdout", "three"}, {"stderr", "four"}}, b.Recent(-1))
+	assert.Equal(t, []LogLine{{"stdout", "three"}, {"stderr", "four"}}, b.Recent(2))
+
+	recent, lines, stop := b.Follow(1)
+	assert.Equal(t, []LogLine{{"stderr", "four"}}, recent)
+	b.Add("stdout", "five")
+	assert.Equal(t, LogLine{"stdout", "five"}, <-lines)
+	stop()
+	b.Add("stdout", "six")
+	assert.Empty(t, lines)
+
+	fmt.Fprint(w, strings.Repeat("x", 2*maxLogLine)+"\n")
+	assert.Len(t, b.Recent(1)[0].Text, maxLogLine)
+}
+
+// withOutputLog replaces the output log with an empty one of lines, until the returned function restores it
+func withOutputLog(lines int) func() {
+	saved := outputLog
+	outputLog = NewLogBuffer(lines)
+	return func() { outputLog = saved }
+}
+
+func TestServeLogs(t *testing.T) {
+	defer withOutputLog(10)()
+	outputLog.Add("stdout", "committed state height=1")
+	outputLog.Add("stderr", "ERR dialing peer")
+	outputLog.Add("stdout", "committed state height=2")
+
+	cases := map[string]struct {
+		query  string
+		status int
+		body   string
+	}{
+		"all":        {status: http.StatusOK, body: "committed state height=1\nERR dialing peer\ncommitted state height=2\n"},
+		"tail":       {query: "lines=1", status: http.StatusOK, body: "committed state height=2\n"},
+		"stream":     {query: "stream=stderr", status: http.StatusOK, body: "ERR dialing peer\n"},
+		"grep":       {query: "grep=height=[0-9]&lines=1", status: http.StatusOK, body: "committed state height=2\n"},
+		"bad grep":   {query: "grep=(", status: http.StatusBadRequest},
+		"bad lines":  {query: "lines=many", status: http.StatusBadRequest},
+		"bad stream": {query: "stream=stdin", status: http.StatusBadRequest},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			req := adminRequest("GET", logsPath+"?"+tc.query, nil)
+			rec := httptest.NewRecorder()
+			(&Config{AdminToken: testAdminToken}).adminHandler().ServeHTTP(rec, req)
+			require.Equal(t, tc.status, rec.Code, rec.Body.String())
+			if tc.status == http.StatusOK {
+				assert.Equal(t, tc.body, rec.Body.String())
+			}
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	(&Config{AdminToken: testAdminToken}).adminHandler().ServeHTTP(rec, httptest.NewRequest("GET", logsPath, nil))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestFollowLogs(t *testing.T) {
+	defer withOutputLog(10)()
+	outputLog.Add("stdout", "before")
+	cfg := &Config{AdminToken: testAdminToken}
+	server := httptest.NewServer(cfg.adminHandler())
+	defer server.Close()
+	cfg.AdminAddress = strings.TrimPrefix(server.URL, "http://")
+
+	var out bytes.Buffer
+	require.NoError(t, cmdLogs(cfg, []string{"-n", "5"}, &out))
+	assert.Equal(t, "before\n", out.String())
+
+	reader, writer := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- cmdLogs(cfg, []string{"-f", "-grep", "^keep"}, writer)
+		writer.Close()
+	}()
+	scan := bufio.NewScanner(reader)
+
+	// the follower only exists once the request arrived
+	stop := make(chan struct{})
+	defer close(stop)
+	logs := outputLog
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			logs.Add("stdout", "drop")
+			logs.Add("stderr", fmt.Sprintf("keep %d", i))
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	require.True(t, scan.Scan())
+	assert.Regexp(t, `^keep \d+$`, scan.Text())
+	server.CloseClientConnections()
+	go io.Copy(ioutil.Discard, reader)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("logs -f did not end with the connection")
+	}
+}
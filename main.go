@@ -2,10 +2,53 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
+	"strings"
 )
 
+// commands are handled by the upgrade manager itself, rather than passed to the daemon
+var commands = map[string]func(cfg *Config, args []string, out io.Writer) error{
+	"fsck":          cmdFsck,
+	"plan":          cmdPlan,
+	"fleet-compare": cmdFleetCompare,
+	"top":           cmdTop,
+	"history":       cmdHistory,
+	"debug":         cmdDebug,
+	"logs":          cmdLogs,
+	"maintenance":   cmdMaintenance,
+}
+
+// sharedCommands are commands of the daemon as well, of which only these subcommands are ours. Any other
+// invocation (eg. `debug addr` or `config chain-id`) goes to the daemon.
+var sharedCommands = map[string][]string{
+	"debug":  {"inject-upgrade"},
+	"config": {"defaults", "show"},
+}
+
+// ownCommand is whether args are one of our commands, rather than the daemon's
+func ownCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	subcommands, shared := sharedCommands[args[0]]
+	if !shared {
+		_, ok := commands[args[0]]
+		return ok
+	}
+	for _, sub := range subcommands {
+		if len(args) > 1 && args[1] == sub {
+			return true
+		}
+	}
+	return false
+}
+
 func main() {
+	// as pid 1 of a container, we leave the upgrades to a child and do the work of init
+	if isInit() {
+		os.Exit(runAsInit())
+	}
 	err := Run(os.Args[1:])
 	if err != nil {
 		fmt.Printf("%+v\n", err)
@@ -13,17 +56,97 @@ func main() {
 	}
 }
 
+// stripLeadingFlag removes flag from the flags of our own given before the command, in any order, as in
+// `cosmosd --detach --no-color start`. After the command, flags are the daemon's.
+func stripLeadingFlag(args []string, flag string) ([]string, bool) {
+	for i, arg := range args {
+		if !strings.HasPrefix(arg, "--") {
+			break
+		}
+		if arg == flag {
+			return append(append([]string{}, args[:i]...), args[i+1:]...), true
+		}
+	}
+	return args, false
+}
+
 // Run is the main loop, but returns an error
 func Run(args []string) error {
+	args, noColor := stripNoColor(args)
+	if noColor {
+		console.Color = false
+	}
+	args, detach := stripDetach(args)
+
+	// init creates the layout the rest of the config is checked against
+	if len(args) > 0 && args[0] == "init" {
+		cfg, err := readConfigFromEnv()
+		if err != nil {
+			return err
+		}
+		console.Configure(cfg, noColor)
+		return cmdInit(cfg, args[1:], os.Stdout)
+	}
+
+	// compat-test sets up its own homes
+	if len(args) > 0 && args[0] == "compat-test" {
+		return cmdCompatTest(args[1:], os.Stdout)
+	}
+
+	// config explains the settings, so it must work before they are valid
+	if ownCommand(args) && args[0] == "config" {
+		return cmdConfig(args[1:], os.Stdout)
+	}
+
 	cfg, err := GetConfigFromEnv()
 	if err != nil {
 		return err
 	}
-	err = LaunchProcess(cfg, args, os.Stdout, os.Stderr)
+	console.Configure(cfg, noColor)
+	if len(args) > 0 {
+		if ownCommand(args) {
+			return commands[args[0]](cfg, args[1:], os.Stdout)
+		}
+		// run passes everything after it to the daemon, eg. `run init` for the init of the daemon
+		if args[0] == "run" {
+			args = args[1:]
+		}
+	}
 
-	// if RestartAfterUpgrade, we launch after a successful upgrade (only condition LaunchProcess returns nil)
-	for cfg.RestartAfterUpgrade && err == nil {
-		err = LaunchProcess(cfg, args, os.Stdout, os.Stderr)
+	// --detach runs all of the below in the background
+	if detach {
+		return cfg.detach(args, noColor, os.Stdout)
+	}
+	if os.Getenv(detachedEnv) != "" {
+		cfg.openDetached()
+	}
+
+	if cfg.MetricsAddress != "" {
+		metrics.SetNode(cfg.NodeLabel)
+		go serveMetrics(cfg.MetricsAddress)
+	}
+	if cfg.AdminAddress != "" {
+		go cfg.serveAdmin()
+	}
+	if cfg.HealthAddress != "" {
+		go cfg.serveHealth()
+	}
+
+	if cfg.PIDFile != "" {
+		if err := writePIDFile(cfg.PIDFile, os.Getpid()); err != nil {
+			return err
+		}
+		defer removePIDFile(cfg.PIDFile, os.Getpid())
+	}
+	// our lease is of no use to anyone once we exit
+	if cfg.HasLease() {
+		defer cfg.ReleaseLease()
+	}
+	args = cfg.ChildArgs(args)
+	err = superviseProcess(cfg, args, os.Stdout, os.Stderr)
+	// a node stopped by the operator (eg. systemctl stop) exits cleanly
+	if err == errStopped {
+		return nil
 	}
 	return err
 }
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metrics counts what the scanners do, for all launches of the daemon
+var metrics = NewMetrics()
+
+// latencyBuckets are the upper bounds (in seconds) of the detection latency histogram
+var latencyBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 60}
+
+// Metrics are the internals of the upgrade detection, served in the prometheus text format
+type Metrics struct {
+	mutex  sync.Mutex
+	lines  map[string]uint64
+	bytes  map[string]uint64
+	stalls map[string]uint64
+	// latency counts the detections per bucket, the last one is +Inf
+	latency    []uint64
+	latencySum float64
+	detected   uint64
+	oomKills   uint64
+	// node is added as a label to every metric, if set
+	node string
+}
+
+// NewMetrics starts all counters at zero
+func NewMetrics() *Metrics {
+	return &Metrics{
+		lines:   map[string]uint64{},
+		bytes:   map[string]uint64{},
+		stalls:  map[string]uint64{},
+		latency: make([]uint64, len(latencyBuckets)+1),
+	}
+}
+
+// Reader counts the output of stream as it is read. Whenever we took longer than stall to read
+// again (eg. scanning a huge line), the daemon may have blocked on a full pipe, which is counted as a stall.
+func (m *Metrics) Reader(stream string, r io.Reader, stall time.Duration) io.Reader {
+	return &countReader{r: r, stream: stream, metrics: m, stall: stall}
+}
+
+type countReader struct {
+	r       io.Reader
+	stream  string
+	metrics *Metrics
+	stall   time.Duration
+	last    time.Time
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	stalled := c.stall > 0 && !c.last.IsZero() && time.Since(c.last) > c.stall
+	n, err := c.r.Read(p)
+	c.last = time.Now()
+
+	m := c.metrics
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.bytes[c.stream] += uint64(n)
+	m.lines[c.stream] += uint64(strings.Count(string(p[:n]), "\n"))
+	if stalled {
+		m.stalls[c.stream]++
+	}
+	return n, err
+}
+
+// Detected records an upgrade found in line at now, and how long after the daemon logged it, if the line has a time
+func (m *Metrics) Detected(line string, now time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.detected++
+	logged, ok := logTime(line)
+	if !ok {
+		return
+	}
+	latency := now.Sub(logged).Seconds()
+	// the daemon may print the time with less precision (or on another clock)
+	if latency < 0 {
+		latency = 0
+	}
+	i := sort.SearchFloat64s(latencyBuckets, latency)
+	m.latency[i]++
+	m.latencySum += latency
+}
+
+// OOMKilled counts the daemon being killed for running out of memory
+func (m *Metrics) OOMKilled() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.oomKills++
+}
+
+// SetNode labels all metrics with the label of this node
+func (m *Metrics) SetNode(label string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.node = label
+}
+
+// labels formats the node label and the given pairs (name, value, ...), as {node="a",stream="b"}
+func (m *Metrics) labels(pairs ...string) string {
+	if m.node != "" {
+		pairs = append([]string{"node", m.node}, pairs...)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, pairs[i]+`="`+labelEscaper.Replace(pairs[i+1])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// labelEscaper escapes a label value as the prometheus text format does, which (unlike %q) leaves everything
+// else as it is, eg. a node label in unicode
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// ServeHTTP writes all metrics
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+// WriteTo writes all metrics in the prometheus text format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var b strings.Builder
+	perStream := func(name, help string, values map[string]uint64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for _, stream := range []string{"stdout", "stderr"} {
+			fmt.Fprintf(&b, "%s%s %d\n", name, m.labels("stream", stream), values[stream])
+		}
+	}
+	perStream("cosmosd_scanner_lines_total", "Lines of daemon output scanned.", m.lines)
+	perStream("cosmosd_scanner_bytes_total", "Bytes of daemon output scanned.", m.bytes)
+	perStream("cosmosd_scanner_stalls_total", "Times the output was not read for longer than DAEMON_SCANNER_STALL.", m.stalls)
+
+	fmt.Fprintf(&b, "# HELP cosmosd_upgrades_detected_total Upgrade lines found in the output.\n")
+	fmt.Fprintf(&b, "# TYPE cosmosd_upgrades_detected_total counter\n")
+	fmt.Fprintf(&b, "cosmosd_upgrades_detected_total%s %d\n", m.labels(), m.detected)
+
+	fmt.Fprintf(&b, "# HELP cosmosd_daemon_oom_kills_total Times the daemon was killed for running out of memory.\n")
+	fmt.Fprintf(&b, "# TYPE cosmosd_daemon_oom_kills_total counter\n")
+	fmt.Fprintf(&b, "cosmosd_daemon_oom_kills_total%s %d\n", m.labels(), m.oomKills)
+
+	name := "cosmosd_upgrade_detection_latency_seconds"
+	fmt.Fprintf(&b, "# HELP %s Time from the log timestamp of an upgrade line to its detection.\n# TYPE %s histogram\n", name, name)
+	var count uint64
+	for i, n := range m.latency {
+		count += n
+		le := "+Inf"
+		if i < len(latencyBuckets) {
+			le = strconv.FormatFloat(latencyBuckets[i], 'g', -1, 64)
+		}
+		fmt.Fprintf(&b, "%s_bucket%s %d\n", name, m.labels("le", le), count)
+	}
+	fmt.Fprintf(&b, "%s_sum%s %s\n%s_count%s %d\n", name, m.labels(), strconv.FormatFloat(m.latencySum, 'g', -1, 64), name, m.labels(), count)
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// serveMetrics serves the metrics until we exit, a failure is only logged
+func serveMetrics(addr string) {
+	logger.Printf("serving metrics on %s", addr)
+	if err := http.ListenAndServe(addr, metrics); err != nil {
+		logger.Printf("cannot serve metrics: %v", err)
+	}
+}
+
+// tendermintTime is the time in front of plain text tendermint logs, eg. I[2020-06-01|10:02:11.123]
+var tendermintTime = regexp.MustCompile(`^[A-Z]\[(\d{4}-\d\d-\d\d\|\d\d:\d\d:\d\d\.\d{3})\]`)
+
+// timeKeys are where json loggers put the time
+var timeKeys = []string{"time", "ts", "timestamp", "@timestamp"}
+
+// logTime returns when the daemon logged line, if it says so
+func logTime(line string) (time.Time, bool) {
+	trimmed := strings.TrimSpace(line)
+	if m := tendermintTime.FindStringSubmatch(trimmed); m != nil {
+		// tendermint logs the local time, without a zone
+		t, err := time.ParseInLocation("2006-01-02|15:04:05.000", m[1], time.Local)
+		return t, err == nil
+	}
+	if !strings.HasPrefix(trimmed, "{") {
+		return time.Time{}, false
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(trimmed), &fields); err != nil {
+		return time.Time{}, false
+	}
+	for _, key := range timeKeys {
+		switch v := fields[key].(type) {
+		case string:
+			if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+				return t, true
+			}
+		case float64:
+			// unix seconds, as zap and zerolog with TimeFormatUnix write it
+			sec := int64(v)
+			return time.Unix(sec, int64((v-float64(sec))*1e9)), true
+		}
+	}
+	return time.Time{}, false
+}
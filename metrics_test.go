@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogTime(t *testing.T) {
+	cases := map[string]struct {
+		line   string
+		expect time.Time
+		ok     bool
+	}{
+		"tendermint": {
+			line:   `E[2020-06-01|10:02:11.123] UPGRADE "chain2" NEEDED at height 49: {} module=main`,
+			expect: time.Date(2020, 6, 1, 10, 2, 11, 123000000, time.Local),
+			ok:     true,
+		},
+		"zerolog": {
+			line:   `{"level":"error","time":"2020-06-01T10:02:11.5Z","message":"UPGRADE \"chain2\" NEEDED at height 49: {}"}`,
+			expect: time.Date(2020, 6, 1, 10, 2, 11, 500000000, time.UTC),
+			ok:     true,
+		},
+		"unix seconds": {
+			line:   `{"ts":1591005731.25,"msg":"UPGRADE \"chain2\" NEEDED at height 49: {}"}`,
+			expect: time.Unix(1591005731, 250000000),
+			ok:     true,
+		},
+		"no time":     {line: `UPGRADE "chain2" NEEDED at height 49: {}`},
+		"broken json": {line: `{"time":"2020-06-01T10:02:11Z"`},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			logged, ok := logTime(tc.line)
+			assert.Equal(t, tc.ok, ok)
+			if tc.ok {
+				assert.True(t, tc.expect.Equal(logged), "%s", logged)
+			}
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+
+	// a slow reader stalls once
+	r := m.Reader("stdout", strings.NewReader("first line\nsecond line\n"), 20*time.Millisecond)
+	buf := make([]byte, 11)
+	_, err := r.Read(buf)
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	_, err = ioutil.ReadAll(r)
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(m.Reader("stderr", strings.NewReader("oops\n"), 0))
+	require.NoError(t, err)
+
+	logged := time.Date(2020, 6, 1, 10, 2, 11, 0, time.UTC)
+	m.Detected(`{"time":"2020-06-01T10:02:11Z","message":"UPGRADE \"chain2\" NEEDED at height 49: {}"}`, logged.Add(200*time.Millisecond))
+	m.Detected(`UPGRADE "chain3" NEEDED at height 99: {}`, logged)
+	m.OOMKilled()
+
+	var out bytes.Buffer
+	_, err = m.WriteTo(&out)
+	require.NoError(t, err)
+	for _, line := range []string{
+		`cosmosd_scanner_lines_total{stream="stdout"} 2`,
+		`cosmosd_scanner_lines_total{stream="stderr"} 1`,
+		`cosmosd_scanner_bytes_total{stream="stdout"} 23`,
+		`cosmosd_scanner_stalls_total{stream="stdout"} 1`,
+		`cosmosd_scanner_stalls_total{stream="stderr"} 0`,
+		`cosmosd_upgrades_detected_total 2`,
+		`cosmosd_daemon_oom_kills_total 1`,
+		`cosmosd_upgrade_detection_latency_seconds_bucket{le="0.1"} 0`,
+		`cosmosd_upgrade_detection_latency_seconds_bucket{le="0.5"} 1`,
+		`cosmosd_upgrade_detection_latency_seconds_bucket{le="+Inf"} 1`,
+		`cosmosd_upgrade_detection_latency_seconds_sum 0.2`,
+		`cosmosd_upgrade_detection_latency_seconds_count 1`,
+	} {
+		assert.Contains(t, out.String(), line+"\n")
+	}
+}
+
+func TestMetricsNodeLabel(t *testing.T) {
+	m := NewMetrics()
+	m.SetNode("val-1")
+	m.Detected(`UPGRADE "chain2" NEEDED at height 49: {}`, time.Now())
+
+	var out bytes.Buffer
+	_, err := m.WriteTo(&out)
+	require.NoError(t, err)
+	for _, line := range []string{
+		`cosmosd_scanner_lines_total{node="val-1",stream="stdout"} 0`,
+		`cosmosd_upgrades_detected_total{node="val-1"} 1`,
+		`cosmosd_upgrade_detection_latency_seconds_bucket{node="val-1",le="+Inf"} 0`,
+		`cosmosd_upgrade_detection_latency_seconds_count{node="val-1"} 0`,
+	} {
+		assert.Contains(t, out.String(), line+"\n")
+	}
+
+	// only what the text format needs is escaped
+	m.SetNode("zürich \"a\"\\b")
+	out.Reset()
+	_, err = m.WriteTo(&out)
+	require.NoError(t, err)
+	assert.Contains(t, out.String(), `cosmosd_upgrades_detected_total{node="zürich \"a\"\\b"} 1`+"\n")
+}
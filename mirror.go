@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Mirror serves the downloads whose url starts with Prefix under Replacement as well
+type Mirror struct {
+	Prefix      string
+	Replacement string
+}
+
+// parseMirrors reads DAEMON_DOWNLOAD_MIRRORS, comma separated prefix=replacement pairs, in the order they are tried
+func parseMirrors(value string) ([]Mirror, error) {
+	var mirrors []Mirror
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, errors.Errorf("%s is not prefix=replacement", pair)
+		}
+		mirrors = append(mirrors, Mirror{Prefix: kv[0], Replacement: kv[1]})
+	}
+	return mirrors, nil
+}
+
+// MirrorURLs returns the other urls listed for the binary URL returns, if there are any
+func (c *UpgradeConfig) MirrorURLs() []string {
+	for _, platform := range []string{osArch(), anyPlatform} {
+		if c.Binaries[platform] != "" {
+			return c.Mirrors[platform]
+		}
+	}
+	return nil
+}
+
+// downloadURLs lists where the binary at artifact may be downloaded from, in order: artifact itself, the mirrors
+// the upgrade info lists, and then each of them on the mirrors of DAEMON_DOWNLOAD_MIRRORS. All of them are
+// verified with the checksum of artifact, so a mirror cannot serve anything else.
+func (cfg *Config) downloadURLs(artifact string, mirrors []string) ([]string, error) {
+	u, err := url.Parse(artifact)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing binary url")
+	}
+	checksum := u.Query().Get("checksum")
+
+	urls := []string{artifact}
+	for _, mirror := range mirrors {
+		if checksum != "" {
+			verified, err := withChecksum(mirror, checksum)
+			if err != nil {
+				return nil, errors.Wrapf(err, "mirror %s", mirror)
+			}
+			mirror = verified
+		}
+		urls = append(urls, mirror)
+	}
+	listed := len(urls)
+	for _, mirror := range cfg.DownloadMirrors {
+		for _, u := range urls[:listed] {
+			if strings.HasPrefix(u, mirror.Prefix) {
+				urls = append(urls, mirror.Replacement+strings.TrimPrefix(u, mirror.Prefix))
+			}
+		}
+	}
+	return urls, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMirrors(t *testing.T) {
+	mirrors, err := parseMirrors(" https://github.com/=https://mirror.example.com/gh/, s3://releases/=https://cdn.example.com/ ")
+	require.NoError(t, err)
+	assert.Equal(t, []Mirror{
+		{Prefix: "https://github.com/", Replacement: "https://mirror.example.com/gh/"},
+		{Prefix: "s3://releases/", Replacement: "https://cdn.example.com/"},
+	}, mirrors)
+
+	mirrors, err = parseMirrors("")
+	require.NoError(t, err)
+	assert.Empty(t, mirrors)
+
+	_, err = parseMirrors("https://github.com/")
+	assert.Error(t, err)
+	_, err = parseMirrors("https://github.com/=")
+	assert.Error(t, err)
+}
+
+func TestDownloadURLs(t *testing.T) {
+	cfg := &Config{DownloadMirrors: []Mirror{{Prefix: "https://github.com/", Replacement: "https://mirror.example.com/gh/"}}}
+	urls, err := cfg.downloadURLs("https://github.com/org/gaia/gaiad?checksum=sha256:abc", []string{"https://backup.example.com/gaiad", "https://github.com/other/gaiad"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"https://github.com/org/gaia/gaiad?checksum=sha256:abc",
+		"https://backup.example.com/gaiad?checksum=sha256%3Aabc",
+		"https://github.com/other/gaiad?checksum=sha256%3Aabc",
+		"https://mirror.example.com/gh/org/gaia/gaiad?checksum=sha256:abc",
+		"https://mirror.example.com/gh/other/gaiad?checksum=sha256%3Aabc",
+	}, urls)
+
+	// a mirror may not verify against another checksum
+	_, err = cfg.downloadURLs("https://github.com/gaiad?checksum=sha256:abc", []string{"https://backup.example.com/gaiad?checksum=sha256:def"})
+	assert.Error(t, err)
+}
+
+func TestDownloadFromMirror(t *testing.T) {
+	bin, err := ioutil.ReadFile("testdata/repo/raw_binary/autod")
+	require.NoError(t, err)
+	var mutex sync.Mutex
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			mutex.Lock()
+			requested = append(requested, r.URL.Path)
+			mutex.Unlock()
+		}
+		switch r.URL.Path {
+		case "/crushed/autod":
+			http.Error(w, "too many downloads", http.StatusServiceUnavailable)
+		case "/tampered/autod":
+			w.Write([]byte("#!/bin/sh\necho pwned\n"))
+		default:
+			w.Write(bin)
+		}
+	}))
+	defer server.Close()
+
+	home, err := copyTestData("download")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "autod", AllowDownloadBinaries: true,
+		DownloadMirrors: []Mirror{{Prefix: server.URL + "/tampered/", Replacement: server.URL + "/local/"}}}
+	info := &UpgradeInfo{Name: "amazonas", Info: fmt.Sprintf(`{"binaries":{"%s": "%s/crushed/autod?checksum=sha256:%s"}, "mirrors":{"%s": ["%s/tampered/autod"]}}`,
+		osArch(), server.URL, autodSHA256, osArch(), server.URL)}
+	require.NoError(t, DownloadBinary(cfg, info))
+	hash, err := sha256File(cfg.UpgradeBin("amazonas"))
+	require.NoError(t, err)
+	assert.Equal(t, autodSHA256, hash)
+	assert.Equal(t, []string{"/crushed/autod", "/tampered/autod", "/local/autod"}, requested)
+}
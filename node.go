@@ -0,0 +1,25 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// monikerLine is where the daemon is named in its config.toml
+var monikerLine = regexp.MustCompile(`(?m)^\s*moniker\s*=\s*"([^"]*)"`)
+
+// readNodeLabel returns DAEMON_NODE_LABEL, or else the moniker of the daemon, or else the hostname
+func (cfg *Config) readNodeLabel() string {
+	if label := cfg.getenv("DAEMON_NODE_LABEL"); label != "" {
+		return label
+	}
+	if bz, err := ioutil.ReadFile(filepath.Join(cfg.Home, "config", "config.toml")); err == nil {
+		if match := monikerLine.FindSubmatch(bz); match != nil && len(match[1]) > 0 {
+			return string(match[1])
+		}
+	}
+	host, _ := os.Hostname()
+	return host
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadNodeLabel(t *testing.T) {
+	home, err := ioutil.TempDir("", "node-label")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home}
+	defer setEnv(map[string]string{"DAEMON_NODE_LABEL": ""})()
+
+	host, err := os.Hostname()
+	require.NoError(t, err)
+	assert.Equal(t, host, cfg.readNodeLabel())
+
+	require.NoError(t, os.MkdirAll(filepath.Join(home, "config"), 0755))
+	toml := "# comment\nproxy_app = \"tcp://127.0.0.1:26658\"\n  moniker = \"val-eu-1\"\n\n[rpc]\n"
+	require.NoError(t, ioutil.WriteFile(filepath.Join(home, "config", "config.toml"), []byte(toml), 0644))
+	assert.Equal(t, "val-eu-1", cfg.readNodeLabel())
+
+	defer setEnv(map[string]string{"DAEMON_NODE_LABEL": "regen-validator-3"})()
+	assert.Equal(t, "regen-validator-3", cfg.readNodeLabel())
+}
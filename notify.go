@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// logger is used for all messages of the upgrade manager itself, so they are kept apart from
+// what the daemon writes to stdout
+var logger = log.New(console, "", 0)
+
+// Event is something that happened which the operator should know about
+type Event struct {
+	Type    string            `json:"type"`
+	Message string            `json:"message"`
+	Time    time.Time         `json:"time"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// Notify logs the event and runs the notification command, if one is configured.
+// Failing to notify never stops the upgrade manager, it is only logged.
+func (cfg *Config) Notify(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	console.Event(ev.Type, ev.Message)
+	if cfg.NotifyCommand == "" {
+		return
+	}
+	env := map[string]string{
+		"COSMOSD_EVENT":   ev.Type,
+		"COSMOSD_MESSAGE": ev.Message,
+		"COSMOSD_TIME":    ev.Time.Format(time.RFC3339),
+		"COSMOSD_NODE":    cfg.NodeLabel,
+		// the version of the COSMOSD_* variables and the template data
+		"COSMOSD_SCHEMA_VERSION": strconv.Itoa(SchemaVersion),
+	}
+	for k, v := range ev.Fields {
+		env["COSMOSD_"+k] = v
+	}
+	if payload, ok, err := cfg.renderEvent(ev); err != nil {
+		logger.Printf("cannot render notification: %v", err)
+	} else if ok {
+		env["COSMOSD_PAYLOAD"] = payload
+	}
+	if err := RunHook(cfg.NotifyCommand, env); err != nil {
+		logger.Printf("notification failed: %v", err)
+	}
+}
+
+// defaultTemplate is used for events without a template of their own
+const defaultTemplate = "default.tmpl"
+
+// templateFuncs help fitting events into rigid formats
+var templateFuncs = template.FuncMap{
+	// json quotes a value as a json string
+	"json": func(s string) (string, error) {
+		bz, err := json.Marshal(s)
+		return string(bz), err
+	},
+	// seconds turns a duration like 1m30s into 90
+	"seconds": func(s string) (string, error) {
+		d, err := time.ParseDuration(s)
+		return strconv.FormatFloat(d.Seconds(), 'f', -1, 64), err
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// loadNotifyTemplates parses <event type>.tmpl and default.tmpl in dir
+func loadNotifyTemplates(dir string) (*template.Template, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, errors.Errorf("no *.tmpl in %s", dir)
+	}
+	return template.New("").Funcs(templateFuncs).Option("missingkey=zero").ParseFiles(paths...)
+}
+
+// NotifyData is what notification templates are executed with
+type NotifyData struct {
+	Event
+	SchemaVersion int
+	// Chain and Node (its label) where it happened, Links are the urls the operator configured (eg. a runbook)
+	Chain string
+	Node  string
+	Links map[string]string
+	// Upgrade is the upgrade of the event, or the current one, Height is the height of the event
+	Upgrade string
+	Height  string
+}
+
+// renderEvent executes the template for the event, ok is false if there is none
+func (cfg *Config) renderEvent(ev Event) (payload string, ok bool, err error) {
+	if cfg.NotifyTemplates == nil {
+		return "", false, nil
+	}
+	tmpl := cfg.NotifyTemplates.Lookup(ev.Type + ".tmpl")
+	if tmpl == nil {
+		tmpl = cfg.NotifyTemplates.Lookup(defaultTemplate)
+	}
+	if tmpl == nil {
+		return "", false, nil
+	}
+	data := NotifyData{Event: ev, SchemaVersion: SchemaVersion, Chain: cfg.ChainID, Node: cfg.NodeLabel, Links: cfg.NotifyLinks, Upgrade: ev.Fields["UPGRADE"], Height: ev.Fields["HEIGHT"]}
+	if data.Upgrade == "" && cfg.Home != "" {
+		data.Upgrade = cfg.currentUpgradeName()
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", false, errors.Wrapf(err, "executing %s", tmpl.Name())
+	}
+	return b.String(), true, nil
+}
+
+// parseLinks reads name=url pairs, separated by commas
+func parseLinks(value string) (map[string]string, error) {
+	links := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, errors.Errorf("%s is not name=url", pair)
+		}
+		links[kv[0]] = kv[1]
+	}
+	return links, nil
+}
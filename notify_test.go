@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotifyCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notify-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the hook records what it was told
+	out := filepath.Join(dir, "out")
+	script := filepath.Join(dir, "hook.sh")
+	body := "#!/bin/sh\necho \"$COSMOSD_EVENT|$COSMOSD_MESSAGE|$COSMOSD_UPGRADE|$COSMOSD_SCHEMA_VERSION\" > " + out + "\n"
+	require.NoError(t, ioutil.WriteFile(script, []byte(body), 0755))
+
+	cfg := &Config{NotifyCommand: script}
+	cfg.Notify(Event{Type: "test", Message: "hello world", Fields: map[string]string{"UPGRADE": "chain2"}})
+
+	bz, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, "test|hello world|chain2|1\n", string(bz))
+
+	// a broken hook is only logged
+	cfg.NotifyCommand = filepath.Join(dir, "missing")
+	cfg.Notify(Event{Type: "test", Message: "nobody listens"})
+}
+
+func TestNotifyTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notify-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	templates := map[string]string{
+		"chain_stalled.tmpl": `{"summary":{{json .Message}},"node":"{{.Node}}","chain":"{{.Chain}}","seconds":{{seconds .Fields.DURATION}},"runbook":"{{.Links.runbook}}"}`,
+		"default.tmpl":       `{{upper .Type}} on {{.Node}}: {{.Upgrade}} at {{.Height}}{{.Fields.MISSING}}`,
+	}
+	for name, body := range templates {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(body), 0644))
+	}
+	tmpl, err := loadNotifyTemplates(dir)
+	require.NoError(t, err)
+	cfg := &Config{NotifyTemplates: tmpl, ChainID: "regen-1", NodeLabel: "val-1", NotifyLinks: map[string]string{"runbook": "https://wiki/stall"}}
+
+	cases := map[string]struct {
+		event    Event
+		expected string
+	}{
+		"own template": {
+			event:    Event{Type: "chain_stalled", Message: `ALERT: "no" new block`, Fields: map[string]string{"DURATION": "1m30s"}},
+			expected: `{"summary":"ALERT: \"no\" new block","node":"val-1","chain":"regen-1","seconds":90,"runbook":"https://wiki/stall"}`,
+		},
+		"default": {
+			event:    Event{Type: "upgrade_scheduled", Fields: map[string]string{"UPGRADE": "chain2", "HEIGHT": "49"}},
+			expected: `UPGRADE_SCHEDULED on val-1: chain2 at 49`,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			payload, ok, err := cfg.renderEvent(tc.event)
+			require.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, tc.expected, payload)
+		})
+	}
+
+	// without a default, other events have no payload
+	require.NoError(t, os.Remove(filepath.Join(dir, "default.tmpl")))
+	cfg.NotifyTemplates, err = loadNotifyTemplates(dir)
+	require.NoError(t, err)
+	_, ok, err := cfg.renderEvent(Event{Type: "halted"})
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// the payload is passed to the command
+	out := filepath.Join(dir, "out")
+	script := filepath.Join(dir, "hook.sh")
+	require.NoError(t, ioutil.WriteFile(script, []byte("#!/bin/sh\necho \"$COSMOSD_PAYLOAD\" > "+out+"\n"), 0755))
+	cfg.NotifyCommand = script
+	cfg.Notify(Event{Type: "chain_stalled", Message: "stalled", Fields: map[string]string{"DURATION": "10s"}})
+	bz, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, `{"summary":"stalled","node":"val-1","chain":"regen-1","seconds":10,"runbook":"https://wiki/stall"}`+"\n", string(bz))
+
+	_, err = loadNotifyTemplates(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestParseLinks(t *testing.T) {
+	links, err := parseLinks("runbook=https://wiki/upgrade?a=b, dashboard=https://grafana/d/1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"runbook": "https://wiki/upgrade?a=b", "dashboard": "https://grafana/d/1"}, links)
+	_, err = parseLinks("https://wiki")
+	assert.Error(t, err)
+}
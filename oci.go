@@ -0,0 +1,359 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	getter "github.com/hashicorp/go-getter"
+	"github.com/pkg/errors"
+)
+
+// the media types of manifests we read, an index lists one manifest per platform
+const (
+	ociManifestType        = "application/vnd.oci.image.manifest.v1+json"
+	ociIndexType           = "application/vnd.oci.image.index.v1+json"
+	dockerManifestType     = "application/vnd.docker.distribution.manifest.v2+json"
+	dockerManifestListType = "application/vnd.docker.distribution.manifest.list.v2+json"
+	// ociTitle names the file of a layer, as oras sets it
+	ociTitle = "org.opencontainers.image.title"
+	// manifests are small, anything larger is not one
+	maxManifestSize = 4 << 20
+)
+
+// ociRef is oci://<registry>/<repo>[:tag][@digest]
+type ociRef struct {
+	registry string
+	repo     string
+	tag      string
+	digest   string
+}
+
+// parseOCIRef reads an oci:// url, a missing tag is latest, as with docker
+func parseOCIRef(u *url.URL) (*ociRef, error) {
+	ref := &ociRef{registry: u.Host}
+	repo := strings.Trim(u.Path, "/")
+	if at := strings.LastIndex(repo, "@"); at >= 0 {
+		repo, ref.digest = repo[:at], repo[at+1:]
+		if _, err := parseSHA256(ref.digest); err != nil || !strings.HasPrefix(ref.digest, "sha256:") {
+			return nil, errors.Errorf("digest of %s must be sha256:<hex>", u)
+		}
+	}
+	if colon := strings.LastIndex(repo, ":"); colon > strings.LastIndex(repo, "/") {
+		repo, ref.tag = repo[:colon], repo[colon+1:]
+	}
+	if ref.registry == "" || repo == "" {
+		return nil, errors.Errorf("%s must be oci://<registry>/<repo>[:tag][@digest]", u)
+	}
+	if ref.tag == "" && ref.digest == "" {
+		ref.tag = "latest"
+	}
+	ref.repo = repo
+	return ref, nil
+}
+
+// ociPinned is whether artifact is an oci:// url with a digest, which verifies what is pulled like a checksum
+func ociPinned(artifact string) bool {
+	u, err := url.Parse(artifact)
+	if err != nil || u.Scheme != "oci" {
+		return false
+	}
+	ref, err := parseOCIRef(u)
+	return err == nil && ref.digest != ""
+}
+
+// ociStagedName is the name an oci artifact is staged with, the last part of its repository
+func ociStagedName(u *url.URL) string {
+	ref, err := parseOCIRef(u)
+	if err != nil {
+		return ""
+	}
+	return path.Base(ref.repo)
+}
+
+// ociGetter pulls an artifact from a registry with its api, as pushed eg. with `oras push`. The manifest (or the one
+// for this platform, of an index) must have a single layer, or one named after the daemon, which is fetched as a file.
+// The manifest is verified against the digest of the url, and the layer against the digest in the manifest.
+type ociGetter struct {
+	// name is the daemon, the layer named after it is taken from an artifact of several files
+	name   string
+	client *http.Client
+	// credentials are user:password for the registry, if it isn't public
+	credentials string
+	token       string
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+	} `json:"platform,omitempty"`
+}
+
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Layers    []ociDescriptor `json:"layers"`
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+func (g *ociGetter) ClientMode(*url.URL) (getter.ClientMode, error) {
+	return getter.ClientModeFile, nil
+}
+
+func (g *ociGetter) SetClient(*getter.Client) {}
+
+// Get only tells why the url cannot be fetched as a file, as fetching it as a directory is the fallback
+func (g *ociGetter) Get(dst string, u *url.URL) error {
+	return singleFileOnly(u, "push")
+}
+
+func (g *ociGetter) GetFile(dst string, u *url.URL) error {
+	ref, err := parseOCIRef(u)
+	if err != nil {
+		return err
+	}
+	reference := ref.digest
+	if reference == "" {
+		reference = ref.tag
+	}
+	manifest, err := g.manifest(ref, reference, ref.digest)
+	if err != nil {
+		return err
+	}
+	// an index lists the manifest of every platform
+	if len(manifest.Manifests) > 0 {
+		var platform *ociDescriptor
+		for i, m := range manifest.Manifests {
+			if m.Platform != nil && m.Platform.OS == runtime.GOOS && m.Platform.Architecture == runtime.GOARCH {
+				platform = &manifest.Manifests[i]
+				break
+			}
+		}
+		if platform == nil {
+			return errors.Errorf("%s has no manifest for %s", u, osArch())
+		}
+		if manifest, err = g.manifest(ref, platform.Digest, platform.Digest); err != nil {
+			return err
+		}
+	}
+	layer, err := g.pickLayer(manifest.Layers)
+	if err != nil {
+		return errors.Wrapf(err, "pulling %s", u)
+	}
+	return errors.Wrapf(g.blob(ref, layer, dst), "pulling %s", u)
+}
+
+// pickLayer takes the only layer, or the one named after the daemon
+func (g *ociGetter) pickLayer(layers []ociDescriptor) (ociDescriptor, error) {
+	if len(layers) == 1 {
+		return layers[0], nil
+	}
+	var titles []string
+	for _, l := range layers {
+		title := l.Annotations[ociTitle]
+		if title == g.name || title == g.name+".exe" {
+			return l, nil
+		}
+		titles = append(titles, title)
+	}
+	if len(layers) == 0 {
+		return ociDescriptor{}, errors.New("the artifact has no files")
+	}
+	return ociDescriptor{}, errors.Errorf("the artifact has no file named %s, only %s", g.name, strings.Join(titles, ", "))
+}
+
+// registryURL is the api of the registry, over plain http only on this host, as docker does
+func (ref *ociRef) registryURL(endpoint string) string {
+	host := ref.registry
+	if host == "docker.io" {
+		host = "registry-1.docker.io"
+	}
+	scheme := "https"
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	if ip := net.ParseIP(hostname); hostname == "localhost" || (ip != nil && ip.IsLoopback()) {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s/v2/%s/%s", scheme, host, ref.repo, endpoint)
+}
+
+// manifest fetches a manifest (or an index), and checks it against digest if we know it
+func (g *ociGetter) manifest(ref *ociRef, reference, digest string) (*ociManifest, error) {
+	accept := strings.Join([]string{ociManifestType, ociIndexType, dockerManifestType, dockerManifestListType}, ", ")
+	resp, err := g.get(ref, "manifests/"+reference, accept)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	bz, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetching manifest %s", reference)
+	}
+	if digest != "" {
+		sum := sha256.Sum256(bz)
+		if actual := "sha256:" + hex.EncodeToString(sum[:]); actual != digest {
+			return nil, errors.Errorf("manifest %s has digest %s", digest, actual)
+		}
+	}
+	var manifest ociManifest
+	if err := json.Unmarshal(bz, &manifest); err != nil {
+		return nil, errors.Wrapf(err, "parsing manifest %s", reference)
+	}
+	return &manifest, nil
+}
+
+// blob writes the layer to dst, verifying its size and digest
+func (g *ociGetter) blob(ref *ociRef, layer ociDescriptor, dst string) error {
+	resp, err := g.get(ref, "blobs/"+layer.Digest, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, hash), io.LimitReader(resp.Body, layer.Size+1))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "fetching %s", layer.Digest)
+	}
+	if n != layer.Size {
+		return errors.Errorf("layer %s has %d bytes, not %d", layer.Digest, n, layer.Size)
+	}
+	if actual := "sha256:" + hex.EncodeToString(hash.Sum(nil)); actual != layer.Digest {
+		return errors.Errorf("layer %s has digest %s", layer.Digest, actual)
+	}
+	return nil
+}
+
+// get requests endpoint of the repository, and authenticates as the registry asks for: with a bearer token from
+// its token service (anonymous, or with our credentials), or with our credentials
+func (g *ociGetter) get(ref *ociRef, endpoint, accept string) (*http.Response, error) {
+	do := func() (*http.Response, error) {
+		req, err := http.NewRequest("GET", ref.registryURL(endpoint), nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "creating request")
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if g.token != "" {
+			req.Header.Set("Authorization", "Bearer "+g.token)
+		} else if user, pass, ok := splitCredentials(g.credentials); ok {
+			req.SetBasicAuth(user, pass)
+		}
+		return g.client.Do(req)
+	}
+	resp, err := do()
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetching %s", endpoint)
+	}
+	if challenge := resp.Header.Get("WWW-Authenticate"); resp.StatusCode == http.StatusUnauthorized && g.token == "" &&
+		strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		resp.Body.Close()
+		if g.token, err = g.fetchToken(challenge); err != nil {
+			return nil, errors.Wrapf(err, "authenticating with %s", ref.registry)
+		}
+		if resp, err = do(); err != nil {
+			return nil, errors.Wrapf(err, "fetching %s", endpoint)
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, errors.Errorf("fetching %s: %s: %s", endpoint, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// fetchToken gets a token from the service of a challenge like
+// Bearer realm="https://ghcr.io/token",service="ghcr.io",scope="repository:org/repo:pull"
+func (g *ociGetter) fetchToken(challenge string) (string, error) {
+	params := map[string]string{}
+	for _, part := range splitChallenge(challenge[len("bearer "):]) {
+		if kv := strings.SplitN(part, "=", 2); len(kv) == 2 {
+			params[strings.ToLower(strings.TrimSpace(kv[0]))] = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+		}
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return "", errors.Errorf("no realm in %s", challenge)
+	}
+	query := realm.Query()
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			query.Set(key, params[key])
+		}
+	}
+	realm.RawQuery = query.Encode()
+	req, err := http.NewRequest("GET", realm.String(), nil)
+	if err != nil {
+		return "", errors.Wrap(err, "creating request")
+	}
+	if user, pass, ok := splitCredentials(g.credentials); ok {
+		req.SetBasicAuth(user, pass)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := getJSON(g.client, req, &token); err != nil {
+		return "", err
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return "", errors.New("no token in the response")
+	}
+	return token.Token, nil
+}
+
+// splitChallenge splits the parameters of a challenge on the commas outside of quotes
+func splitChallenge(s string) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i, c := range s {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// splitCredentials reads user:password
+func splitCredentials(credentials string) (user, pass string, ok bool) {
+	i := strings.Index(credentials, ":")
+	if i < 0 {
+		return "", "", false
+	}
+	return credentials[:i], credentials[i+1:], true
+}
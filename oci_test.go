@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadFromOCI(t *testing.T) {
+	bin, err := ioutil.ReadFile("testdata/repo/raw_binary/autod")
+	require.NoError(t, err)
+	digest := func(bz []byte) string {
+		sum := sha256.Sum256(bz)
+		return "sha256:" + hex.EncodeToString(sum[:])
+	}
+	blobs := map[string][]byte{digest(bin): bin}
+	manifests := map[string][]byte{}
+	push := func(v interface{}, tags ...string) string {
+		bz, err := json.Marshal(v)
+		require.NoError(t, err)
+		manifests[digest(bz)] = bz
+		for _, tag := range tags {
+			manifests[tag] = bz
+		}
+		return digest(bz)
+	}
+	layer := func(title string) ociDescriptor {
+		return ociDescriptor{MediaType: "application/octet-stream", Digest: digest(bin), Size: int64(len(bin)),
+			Annotations: map[string]string{ociTitle: title}}
+	}
+	single := push(ociManifest{MediaType: ociManifestType, Layers: []ociDescriptor{layer("autod")}}, "v2")
+	several := push(ociManifest{MediaType: ociManifestType, Layers: []ociDescriptor{layer("README.md"), layer("autod")}})
+	other := push(ociManifest{MediaType: ociManifestType, Layers: []ociDescriptor{layer("README.md"), layer("gaiad")}})
+	platform := ociDescriptor{MediaType: ociManifestType, Digest: single}
+	platform.Platform = &struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+	}{runtime.GOOS, runtime.GOARCH}
+	index := push(ociManifest{MediaType: ociIndexType, Manifests: []ociDescriptor{platform}})
+	tampered := "sha256:" + strings.Repeat("0", 64)
+	manifests[tampered] = manifests[single]
+
+	// the registry wants a token, which its token service hands out for our credentials only
+	var registry *httptest.Server
+	registry = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			if user, pass, _ := r.BasicAuth(); user != "ci" || pass != "s3cret" || r.URL.Query().Get("scope") != "repository:chain/autod:pull" {
+				http.Error(w, "denied", http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"token":"t0ken"}`)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer t0ken" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:chain/autod:pull"`, registry.URL))
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if ref := strings.TrimPrefix(r.URL.Path, "/v2/chain/autod/manifests/"); ref != r.URL.Path && manifests[ref] != nil {
+			w.Write(manifests[ref])
+			return
+		}
+		if ref := strings.TrimPrefix(r.URL.Path, "/v2/chain/autod/blobs/"); ref != r.URL.Path && blobs[ref] != nil {
+			w.Write(blobs[ref])
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer registry.Close()
+	repo := "oci://" + strings.TrimPrefix(registry.URL, "http://") + "/chain/autod"
+	info := func(url string) string {
+		return fmt.Sprintf(`{"binaries":{"%s":"%s"}}`, osArch(), url)
+	}
+
+	cases := map[string]struct {
+		cfg  Config
+		info string
+		err  string
+	}{
+		"index": {
+			cfg:  Config{RequireChecksum: true},
+			info: info(repo + ":v2@" + index),
+		},
+		"tag": {
+			info: info(repo + ":v2"),
+		},
+		"named layer": {
+			info: info(repo + "@" + several),
+		},
+		"no such layer": {
+			info: info(repo + "@" + other),
+			err:  "no file named autod",
+		},
+		"tampered": {
+			info: info(repo + "@" + tampered),
+			err:  "has digest " + single,
+		},
+		"not pinned": {
+			cfg:  Config{RequireChecksum: true},
+			info: info(repo + ":v2"),
+			err:  "no sha256 to verify",
+		},
+		"no credentials": {
+			cfg:  Config{OCICredentials: "-"},
+			info: info(repo + ":v2"),
+			err:  "authenticating with",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			home, err := copyTestData("download")
+			require.NoError(t, err)
+			defer os.RemoveAll(home)
+			cfg := tc.cfg
+			cfg.Home, cfg.Name, cfg.AllowDownloadBinaries = home, "autod", true
+			if cfg.OCICredentials == "" {
+				cfg.OCICredentials = "ci:s3cret"
+			}
+			err = DownloadBinary(&cfg, &UpgradeInfo{Name: "v2", Info: tc.info})
+			if tc.err != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+			hash, err := sha256File(cfg.UpgradeBin("v2"))
+			require.NoError(t, err)
+			assert.Equal(t, autodSHA256, hash)
+			// nothing stays staged
+			_, err = os.Stat(filepath.Join(cfg.Root(), downloadsDir))
+			if err == nil {
+				entries, err := ioutil.ReadDir(filepath.Join(cfg.Root(), downloadsDir))
+				require.NoError(t, err)
+				assert.Empty(t, entries)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the files the cgroup of the upgrade manager (which the daemon shares) is found and read in
+var (
+	procCgroup = "/proc/self/cgroup"
+	cgroupRoot = "/sys/fs/cgroup"
+)
+
+// OOMError is returned when the kernel killed the daemon for running out of memory, rather than
+// a plain "signal: killed"
+type OOMError struct {
+	// Evidence tells how we know, eg. memory.events of the cgroup
+	Evidence string
+	Err      error
+}
+
+func (e *OOMError) Error() string {
+	return fmt.Sprintf("OOM-killed (%s): %v", e.Evidence, e.Err)
+}
+
+// OOMWatch remembers how often the cgroup of the daemon saw the OOM killer before it started, and when
+type OOMWatch struct {
+	cgroup string
+	kills  uint64
+	ok     bool
+	// since is the time since boot in microseconds, as the kernel log has it
+	since uint64
+
+	mutex sync.Mutex
+	// pids are the processes the daemon ran as, which the kernel log names
+	pids map[int]bool
+}
+
+// WatchOOM is called before the daemon starts
+func WatchOOM() *OOMWatch {
+	kills, cgroup, err := cgroupOOMKills(procCgroup, cgroupRoot)
+	return &OOMWatch{cgroup: cgroup, kills: kills, ok: err == nil, since: uptime(), pids: map[int]bool{}}
+}
+
+// oomTrackInterval is how often the processes of a jailed daemon are looked up, as the daemon starts after its jailer
+const oomTrackInterval = time.Second
+
+// Track remembers the pids of the daemon until done, its own or, in a jailer, those in the process group of the jailer
+func (w *OOMWatch) Track(cmd *exec.Cmd, done <-chan struct{}) {
+	ticker := time.NewTicker(oomTrackInterval)
+	defer ticker.Stop()
+	for {
+		pids := daemonPIDs(cmd)
+		w.mutex.Lock()
+		for _, pid := range pids {
+			w.pids[pid] = true
+		}
+		w.mutex.Unlock()
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check returns an OOMError if the daemon exited with err as it was killed by the OOM killer: it died of SIGKILL,
+// and the OOM kills of its cgroup went up, or the kernel log tells the OOM killer took one of its pids since
+func (w *OOMWatch) Check(cmd *exec.Cmd, err error) *OOMError {
+	if err == nil || cmd.ProcessState == nil || !killedHard(cmd) {
+		return nil
+	}
+	if w.ok {
+		if kills, _, cgErr := cgroupOOMKills(procCgroup, cgroupRoot); cgErr == nil && kills > w.kills {
+			return &OOMError{Evidence: "oom_kill in the memory events of cgroup " + w.cgroup, Err: err}
+		}
+	}
+	w.mutex.Lock()
+	pids := map[int]bool{cmd.Process.Pid: true}
+	for pid := range w.pids {
+		pids[pid] = true
+	}
+	w.mutex.Unlock()
+	if kernelLogOOM(w.since, pids) {
+		return &OOMError{Evidence: "the kernel log", Err: err}
+	}
+	return nil
+}
+
+// reportOOM tells the operator, the metrics and the history that the daemon ran out of memory
+func (cfg *Config) reportOOM(oom *OOMError) {
+	metrics.OOMKilled()
+	cfg.Notify(Event{
+		Type:    "oom_killed",
+		Message: fmt.Sprintf("the daemon was killed for running out of memory, as %s tells", oom.Evidence),
+		Fields:  map[string]string{"EVIDENCE": oom.Evidence},
+	})
+	entry := HistoryEntry{Type: "oom_killed", Upgrade: cfg.currentUpgradeName(), Fields: map[string]string{"evidence": oom.Evidence}}
+	if err := cfg.RecordHistory(entry); err != nil {
+		logger.Printf("cannot record history: %v", err)
+	}
+}
+
+// cgroupOOMKills reads the oom_kill counter of the memory cgroup we are in, from memory.events on cgroup v2
+// or memory.oom_control on v1
+func cgroupOOMKills(procFile, root string) (uint64, string, error) {
+	bz, err := ioutil.ReadFile(procFile)
+	if err != nil {
+		return 0, "", err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(bz)), "\n") {
+		// hierarchy-ID:controllers:path
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		var file string
+		switch {
+		case parts[0] == "0" && parts[1] == "":
+			file = filepath.Join(root, parts[2], "memory.events")
+		case hasController(parts[1], "memory"):
+			file = filepath.Join(root, "memory", parts[2], "memory.oom_control")
+		default:
+			continue
+		}
+		kills, err := readOOMKills(file)
+		return kills, parts[2], err
+	}
+	return 0, "", os.ErrNotExist
+}
+
+func hasController(controllers, name string) bool {
+	for _, c := range strings.Split(controllers, ",") {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// readOOMKills finds the "oom_kill <n>" line of a memory cgroup file
+func readOOMKills(file string) (uint64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		fields := strings.Fields(scan.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			return strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	if err := scan.Err(); err != nil {
+		return 0, err
+	}
+	// kernels before 4.13 don't count the kills
+	return 0, os.ErrNotExist
+}
+
+// oomKilled is how the kernel logs an OOM kill, "Out of memory: Killed process 1234 (gaiad) total-vm:..."
+// (or "Memory cgroup out of memory: ...")
+var oomKilled = regexp.MustCompile(`Killed process (\d+) \(`)
+
+// scanKernelLog is whether the records of /dev/kmsg in r ("priority,sequence,microseconds,flags;message") tell
+// the OOM killer took one of pids since. A process of the same name may be anyone's.
+func scanKernelLog(r io.Reader, since uint64, pids map[int]bool) bool {
+	scan := bufio.NewScanner(r)
+	for scan.Scan() {
+		semi := strings.Index(scan.Text(), ";")
+		if semi < 0 {
+			continue
+		}
+		prefix := strings.Split(scan.Text()[:semi], ",")
+		if len(prefix) < 3 {
+			continue
+		}
+		if at, err := strconv.ParseUint(prefix[2], 10, 64); err != nil || at < since {
+			continue
+		}
+		match := oomKilled.FindStringSubmatch(scan.Text()[semi+1:])
+		if match == nil {
+			continue
+		}
+		if pid, err := strconv.Atoi(match[1]); err == nil && pids[pid] {
+			return true
+		}
+	}
+	return false
+}
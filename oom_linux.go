@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// killedHard is whether the daemon died of SIGKILL, as the OOM killer sends it. A jailer which outlived the
+// daemon exits with 128+9, as a shell does.
+func killedHard(cmd *exec.Cmd) bool {
+	status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if !ok {
+		return false
+	}
+	if status.Signaled() {
+		return status.Signal() == syscall.SIGKILL
+	}
+	return jailed(cmd) && status.ExitStatus() == 128+int(syscall.SIGKILL)
+}
+
+// uptime is the time since boot in microseconds
+func uptime() uint64 {
+	bz, err := ioutil.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(bz))
+	if len(fields) == 0 {
+		return 0
+	}
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0
+	}
+	return uint64(seconds * 1e6)
+}
+
+// kernelLogOOM reads /dev/kmsg up to its end, which is only allowed to root (or with CAP_SYSLOG) on most systems
+func kernelLogOOM(since uint64, pids map[int]bool) bool {
+	// an os.File would wait for more records rather than return at the end
+	fd, err := syscall.Open("/dev/kmsg", syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return false
+	}
+	defer syscall.Close(fd)
+	return scanKernelLog(kmsgReader(fd), since, pids)
+}
+
+// daemonPIDs are the pid of the daemon, or of a jailer and the processes in its group (/proc/<pid>/stat has the
+// group fifth, after a name in parentheses which may hold spaces)
+func daemonPIDs(cmd *exec.Cmd) []int {
+	pids := []int{cmd.Process.Pid}
+	if !jailed(cmd) {
+		return pids
+	}
+	dirs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return pids
+	}
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(dir.Name())
+		if err != nil || pid == cmd.Process.Pid {
+			continue
+		}
+		bz, err := ioutil.ReadFile("/proc/" + dir.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+		stat := string(bz)
+		fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+		if len(fields) > 2 && fields[2] == strconv.Itoa(cmd.Process.Pid) {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// kmsgReader reads one record of the kernel log per call, and ends where reading would block
+type kmsgReader int
+
+func (fd kmsgReader) Read(p []byte) (int, error) {
+	for {
+		n, err := syscall.Read(int(fd), p)
+		switch {
+		// a record was overwritten while we read, the next read goes on with the oldest left
+		case err == syscall.EPIPE:
+			continue
+		case err == syscall.EAGAIN:
+			return 0, io.EOF
+		case err != nil:
+			return 0, err
+		}
+		return n, nil
+	}
+}
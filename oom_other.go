@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "os/exec"
+
+// only linux has an OOM killer we can tell apart from any other SIGKILL
+
+func killedHard(cmd *exec.Cmd) bool {
+	return false
+}
+
+func uptime() uint64 {
+	return 0
+}
+
+func daemonPIDs(cmd *exec.Cmd) []int {
+	return []int{cmd.Process.Pid}
+}
+
+func kernelLogOOM(since uint64, pids map[int]bool) bool {
+	return false
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCgroupOOMKills(t *testing.T) {
+	root, err := ioutil.TempDir("", "cgroup")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	write := func(name, content string) string {
+		path := filepath.Join(root, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+		return path
+	}
+	write("system.slice/gaiad.service/memory.events", "low 0\nhigh 0\nmax 12\noom 2\noom_kill 2\n")
+	write("memory/system.slice/gaiad.service/memory.oom_control", "oom_kill_disable 0\nunder_oom 0\noom_kill 5\n")
+
+	kills, cgroup, err := cgroupOOMKills(write("v2", "0::/system.slice/gaiad.service\n"), root)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), kills)
+	assert.Equal(t, "/system.slice/gaiad.service", cgroup)
+
+	kills, _, err = cgroupOOMKills(write("v1", "12:pids:/system.slice/gaiad.service\n4:memory:/system.slice/gaiad.service\n"), root)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), kills)
+
+	_, _, err = cgroupOOMKills(write("none", "12:pids:/system.slice/gaiad.service\n"), root)
+	assert.Error(t, err)
+	_, _, err = cgroupOOMKills(write("missing", "0::/user.slice\n"), root)
+	assert.Error(t, err)
+}
+
+func TestScanKernelLog(t *testing.T) {
+	log := strings.Join([]string{
+		"6,1001,1000000,-;Out of memory: Killed process 4242 (gaiad) total-vm:9000000kB, anon-rss:8000000kB",
+		"3,1002,5000000,-;Memory cgroup out of memory: Killed process 5151 (osmosisd-long-n) total-vm:100kB",
+		"6,1003,6000000,-;usb 1-1: new high-speed USB device",
+	}, "\n")
+	assert.True(t, scanKernelLog(strings.NewReader(log), 0, map[int]bool{4242: true}))
+	// an earlier kill of the same pid is not ours
+	assert.False(t, scanKernelLog(strings.NewReader(log), 2000000, map[int]bool{4242: true}))
+	assert.True(t, scanKernelLog(strings.NewReader(log), 2000000, map[int]bool{1: true, 5151: true}))
+	// nor is a process of the same name
+	assert.False(t, scanKernelLog(strings.NewReader(log), 0, map[int]bool{1: true}))
+}
+
+// TestLaunchProcessOOM reports a daemon killed while its cgroup counted an OOM kill
+func TestLaunchProcessOOM(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("cgroups are linux only")
+	}
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	events := filepath.Join(home, "cgroup", "node", "memory.events")
+	require.NoError(t, os.MkdirAll(filepath.Dir(events), 0755))
+	require.NoError(t, ioutil.WriteFile(events, []byte("oom 0\noom_kill 0\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(home, "cgroup.proc"), []byte("0::/node\n"), 0644))
+	defer func(file, root string) { procCgroup, cgroupRoot = file, root }(procCgroup, cgroupRoot)
+	procCgroup, cgroupRoot = filepath.Join(home, "cgroup.proc"), filepath.Join(home, "cgroup")
+
+	cfg := &Config{Home: home, Name: "dummyd"}
+	script := "#!/bin/sh\necho 'oom 1\noom_kill 1' > " + events + "\nkill -9 $$\n"
+	require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+
+	var stdout, stderr bytes.Buffer
+	err = LaunchProcess(cfg, []string{"start"}, &stdout, &stderr)
+	require.Error(t, err)
+	oom, ok := err.(*OOMError)
+	require.True(t, ok, err.Error())
+	assert.Equal(t, "oom_kill in the memory events of cgroup /node", oom.Evidence)
+	entries, err := cfg.History()
+	require.NoError(t, err)
+	assert.Equal(t, "oom_killed", entries[len(entries)-1].Type)
+
+	// any other SIGKILL is not
+	require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte("#!/bin/sh\nkill -9 $$\n"), 0755))
+	err = LaunchProcess(cfg, []string{"start"}, &stdout, &stderr)
+	require.Error(t, err)
+	_, ok = err.(*OOMError)
+	assert.False(t, ok)
+}
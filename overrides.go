@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+const overridesDir = "overrides"
+
+// Overrides are extra settings applied only while running the binary of one upgrade.
+// They live in the optional overrides/ folder of the upgrade directory:
+//
+//	overrides/env   KEY=value lines, added to the environment of the daemon (and of every other run of the
+//	                binary), where {{.Dir}} is the upgrade directory, eg. LD_LIBRARY_PATH={{.Dir}}/lib
+//	overrides/args     one argument per line, appended to the arguments of the daemon
+//	overrides/rewrite  rules changing the arguments of the daemon, for flags renamed or removed by the upgrade:
+//	                   remove FLAG, remove-with-value FLAG or replace OLD NEW (see Rewrite)
+type Overrides struct {
+	Env      []string
+	Args     []string
+	Rewrites []Rewrite
+}
+
+// Rewrite is a rule of overrides/rewrite
+type Rewrite struct {
+	// Op is remove (FLAG and FLAG=value), remove-with-value (also FLAG value) or replace
+	Op string
+	// Flag is the argument the rule applies to
+	Flag string
+	// To is the new name of Flag for replace. If Flag is an exact FLAG=value, To replaces it as a whole.
+	To string
+}
+
+const (
+	rewriteRemove          = "remove"
+	rewriteRemoveWithValue = "remove-with-value"
+	rewriteReplace         = "replace"
+)
+
+// OverrideData is what the values of overrides/env may use
+type OverrideData struct {
+	// Dir is the upgrade directory holding the binary (current itself in copy mode)
+	Dir string
+}
+
+// LoadOverrides reads the overrides of the upgrade directory holding bin.
+// Missing files are fine, and lead to empty overrides.
+func LoadOverrides(bin string) (*Overrides, error) {
+	upgradeDir, err := filepath.Abs(filepath.Dir(filepath.Dir(bin)))
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(upgradeDir, overridesDir)
+	env, err := readLines(filepath.Join(dir, "env"))
+	if err != nil {
+		return nil, err
+	}
+	for i, line := range env {
+		if !strings.Contains(line, "=") || strings.HasPrefix(line, "=") {
+			return nil, errors.Errorf("invalid line in %s: %s", filepath.Join(dir, "env"), line)
+		}
+		if env[i], err = expandOverride(line, OverrideData{Dir: upgradeDir}); err != nil {
+			return nil, errors.Wrapf(err, "invalid line in %s", filepath.Join(dir, "env"))
+		}
+	}
+	args, err := readLines(filepath.Join(dir, "args"))
+	if err != nil {
+		return nil, err
+	}
+	rules, err := readLines(filepath.Join(dir, "rewrite"))
+	if err != nil {
+		return nil, err
+	}
+	var rewrites []Rewrite
+	for _, line := range rules {
+		rewrite, err := parseRewrite(line)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid line in %s", filepath.Join(dir, "rewrite"))
+		}
+		rewrites = append(rewrites, rewrite)
+	}
+	return &Overrides{Env: env, Args: args, Rewrites: rewrites}, nil
+}
+
+// parseRewrite parses a line of overrides/rewrite
+func parseRewrite(line string) (Rewrite, error) {
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 2 && (fields[0] == rewriteRemove || fields[0] == rewriteRemoveWithValue):
+		return Rewrite{Op: fields[0], Flag: fields[1]}, nil
+	case len(fields) == 3 && fields[0] == rewriteReplace:
+		return Rewrite{Op: fields[0], Flag: fields[1], To: fields[2]}, nil
+	}
+	return Rewrite{}, errors.Errorf("expected remove FLAG, remove-with-value FLAG or replace OLD NEW: %s", line)
+}
+
+// Apply returns args changed by the rewrites, in order. A flag matches both as FLAG and FLAG=value, so
+// replace --old --new turns --old=1 into --new=1 and keeps the value following --old as it is.
+func (o *Overrides) Apply(args []string) []string {
+	for _, rewrite := range o.Rewrites {
+		var rewritten []string
+		for i := 0; i < len(args); i++ {
+			arg := args[i]
+			exact := arg == rewrite.Flag
+			withValue := !strings.Contains(rewrite.Flag, "=") && strings.HasPrefix(arg, rewrite.Flag+"=")
+			switch {
+			case !exact && !withValue:
+				rewritten = append(rewritten, arg)
+			case rewrite.Op == rewriteReplace:
+				rewritten = append(rewritten, rewrite.To+strings.TrimPrefix(arg, rewrite.Flag))
+			case rewrite.Op == rewriteRemoveWithValue && exact && i+1 < len(args):
+				i++
+			}
+		}
+		args = rewritten
+	}
+	return args
+}
+
+// expandOverride fills in a line of overrides/env, which is taken as is if it has no {{
+func expandOverride(line string, data OverrideData) (string, error) {
+	if !strings.Contains(line, "{{") {
+		return line, nil
+	}
+	tmpl, err := template.New("env").Option("missingkey=error").Parse(line)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// withOverrideEnv adds the env overrides of the upgrade holding bin to cmd, which runs bin (directly, or in the
+// jailer), so the binary runs with them whatever it is run for, eg. its smoke test or pre-upgrade. They go on top of
+// the env cmd already has, or ours.
+func withOverrideEnv(cmd *exec.Cmd, bin string) error {
+	overrides, err := LoadOverrides(bin)
+	if err != nil {
+		return errors.Wrap(err, "loading overrides")
+	}
+	if len(overrides.Env) > 0 {
+		env := cmd.Env
+		if env == nil {
+			env = os.Environ()
+		}
+		cmd.Env = append(env, overrides.Env...)
+	}
+	return nil
+}
+
+// Empty returns true if there is nothing to override
+func (o *Overrides) Empty() bool {
+	return len(o.Env) == 0 && len(o.Args) == 0 && len(o.Rewrites) == 0
+}
+
+// readLines returns all lines of the file which are neither blank nor a # comment.
+// Lines are trimmed of surrounding whitespace. A missing file has no lines.
+func readLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "opening overrides")
+	}
+	defer f.Close()
+
+	var lines []string
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		line := strings.TrimSpace(scan.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, errors.Wrapf(scan.Err(), "reading %s", path)
+}
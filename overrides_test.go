@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadOverrides(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+
+	// nothing configured
+	ov, err := LoadOverrides(cfg.UpgradeBin("chain2"))
+	require.NoError(t, err)
+	assert.True(t, ov.Empty())
+
+	dir := filepath.Join(cfg.UpgradeDir("chain2"), overridesDir)
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	env := "# new in chain2\nFEATURE_X=on\n\n  LD_LIBRARY_PATH=/opt/chain2/lib  \n"
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "env"), []byte(env), 0644))
+	args := "--x-crisis-skip-assert-invariants\n--pruning=custom\n# --no-such-flag\n"
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "args"), []byte(args), 0644))
+
+	ov, err = LoadOverrides(cfg.UpgradeBin("chain2"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"FEATURE_X=on", "LD_LIBRARY_PATH=/opt/chain2/lib"}, ov.Env)
+	assert.Equal(t, []string{"--x-crisis-skip-assert-invariants", "--pruning=custom"}, ov.Args)
+
+	// they are only used with that binary
+	ov, err = LoadOverrides(cfg.GenesisBin())
+	require.NoError(t, err)
+	assert.True(t, ov.Empty())
+
+	// values may point into the upgrade directory
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "env"), []byte("LD_LIBRARY_PATH={{.Dir}}/lib\n"), 0644))
+	ov, err = LoadOverrides(cfg.UpgradeBin("chain2"))
+	require.NoError(t, err)
+	upgradeDir, err := filepath.Abs(cfg.UpgradeDir("chain2"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"LD_LIBRARY_PATH=" + upgradeDir + "/lib"}, ov.Env)
+
+	// garbage is refused
+	for _, env := range []string{"just a line\n", "LIB={{.Nope}}\n", "LIB={{.Dir\n"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "env"), []byte(env), 0644))
+		_, err = LoadOverrides(cfg.UpgradeBin("chain2"))
+		assert.Error(t, err, env)
+	}
+}
+
+func TestOverridesApply(t *testing.T) {
+	args := []string{"start", "--home", "/node", "--x-crisis-skip-assert-invariants", "--pruning", "custom",
+		"--minimum-gas-prices=0.01stake", "--db_backend=goleveldb", "--trace"}
+	cases := map[string]struct {
+		rewrite  string
+		expected []string
+	}{
+		"remove a switch": {
+			rewrite:  "remove --x-crisis-skip-assert-invariants",
+			expected: []string{"start", "--home", "/node", "--pruning", "custom", "--minimum-gas-prices=0.01stake", "--db_backend=goleveldb", "--trace"},
+		},
+		"remove with value": {
+			rewrite:  "remove-with-value --pruning\nremove-with-value --db_backend",
+			expected: []string{"start", "--home", "/node", "--x-crisis-skip-assert-invariants", "--minimum-gas-prices=0.01stake", "--trace"},
+		},
+		"rename": {
+			rewrite:  "replace --pruning --state-pruning\nreplace --minimum-gas-prices --min-gas-prices",
+			expected: []string{"start", "--home", "/node", "--x-crisis-skip-assert-invariants", "--state-pruning", "custom", "--min-gas-prices=0.01stake", "--db_backend=goleveldb", "--trace"},
+		},
+		"replace a value": {
+			rewrite:  "replace --db_backend=goleveldb --db_backend=pebbledb\nreplace --db_backend=rocksdb --db_backend=pebbledb",
+			expected: []string{"start", "--home", "/node", "--x-crisis-skip-assert-invariants", "--pruning", "custom", "--minimum-gas-prices=0.01stake", "--db_backend=pebbledb", "--trace"},
+		},
+		"in order": {
+			rewrite:  "replace --trace --verbose\nremove --verbose\n# remove --home",
+			expected: []string{"start", "--home", "/node", "--x-crisis-skip-assert-invariants", "--pruning", "custom", "--minimum-gas-prices=0.01stake", "--db_backend=goleveldb"},
+		},
+		"not given": {
+			rewrite:  "remove --inv-check-period\nremove-with-value --trace",
+			expected: []string{"start", "--home", "/node", "--x-crisis-skip-assert-invariants", "--pruning", "custom", "--minimum-gas-prices=0.01stake", "--db_backend=goleveldb"},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			home, err := copyTestData("validate")
+			require.NoError(t, err)
+			defer os.RemoveAll(home)
+			cfg := &Config{Home: home, Name: "dummyd"}
+			dir := filepath.Join(cfg.UpgradeDir("chain2"), overridesDir)
+			require.NoError(t, os.MkdirAll(dir, 0755))
+			require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "rewrite"), []byte(tc.rewrite), 0644))
+
+			ov, err := LoadOverrides(cfg.UpgradeBin("chain2"))
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, ov.Apply(append([]string{}, args...)))
+		})
+	}
+}
+
+func TestParseRewrite(t *testing.T) {
+	rewrite, err := parseRewrite("replace  --old\t--new")
+	require.NoError(t, err)
+	assert.Equal(t, Rewrite{Op: "replace", Flag: "--old", To: "--new"}, rewrite)
+	for _, line := range []string{"remove", "remove --a --b", "replace --old", "rename --old --new"} {
+		_, err := parseRewrite(line)
+		assert.Error(t, err, line)
+	}
+}
+
+func TestLaunchProcessWithOverrides(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+
+	script := "#!/bin/sh\necho Args: $@\necho Feature: $FEATURE_X\n"
+	require.NoError(t, ioutil.WriteFile(cfg.UpgradeBin("chain3"), []byte(script), 0755))
+	dir := filepath.Join(cfg.UpgradeDir("chain3"), overridesDir)
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "env"), []byte("FEATURE_X=enabled\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "args"), []byte("--new-flag\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "rewrite"), []byte("remove --old-flag\n"), 0644))
+	require.NoError(t, cfg.SetCurrentUpgrade("chain3"))
+
+	var stdout, stderr bytes.Buffer
+	args := []string{"start", "--home", home, "--old-flag"}
+	require.NoError(t, LaunchProcess(cfg, args, &stdout, &stderr))
+	assert.Equal(t, "Args: start --home "+home+" --new-flag\nFeature: enabled\n", stdout.String())
+	// the caller's args are left alone
+	assert.Equal(t, []string{"start", "--home", home, "--old-flag"}, args)
+}
+
+func TestWithOverrideEnv(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+	dir := filepath.Join(cfg.UpgradeDir("chain2"), overridesDir)
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "env"), []byte("FEATURE_X=on\n"), 0644))
+
+	// the env the command was given is kept
+	cmd := exec.Command(cfg.UpgradeBin("chain2"))
+	cmd.Env = []string{"JAILER_ONLY=1"}
+	require.NoError(t, withOverrideEnv(cmd, cfg.UpgradeBin("chain2")))
+	assert.Equal(t, []string{"JAILER_ONLY=1", "FEATURE_X=on"}, cmd.Env)
+
+	// or ours
+	cmd = exec.Command(cfg.UpgradeBin("chain2"))
+	require.NoError(t, withOverrideEnv(cmd, cfg.UpgradeBin("chain2")))
+	assert.Equal(t, append(os.Environ(), "FEATURE_X=on"), cmd.Env)
+
+	// no overrides leave it alone
+	cmd = exec.Command(cfg.GenesisBin())
+	require.NoError(t, withOverrideEnv(cmd, cfg.GenesisBin()))
+	assert.Nil(t, cmd.Env)
+}
+
+// TestSmokeTestWithOverrides runs the staged binary with its env overrides before it is switched to
+func TestSmokeTestWithOverrides(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd", UnsafeSkipBackup: true, SmokeTest: defaultSmokeTest}
+
+	script := "#!/bin/sh\n[ \"$FEATURE_X\" = enabled ] || exit 1\necho v3.0.0\n"
+	require.NoError(t, ioutil.WriteFile(cfg.UpgradeBin("chain3"), []byte(script), 0755))
+	err = DoUpgrade(cfg, &UpgradeInfo{Name: "chain3"})
+	require.Error(t, err)
+	assert.Equal(t, cfg.GenesisBin(), cfg.CurrentBin())
+
+	dir := filepath.Join(cfg.UpgradeDir("chain3"), overridesDir)
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "env"), []byte("FEATURE_X=enabled\n"), 0644))
+	require.NoError(t, DoUpgrade(cfg, &UpgradeInfo{Name: "chain3"}))
+	assert.Equal(t, cfg.UpgradeBin("chain3"), cfg.CurrentBin())
+}
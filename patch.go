@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	getter "github.com/hashicorp/go-getter"
+	"github.com/pkg/errors"
+)
+
+// Patch turns the binary with sha256 From into the binary of an upgrade, which is a small download when a
+// release changed little. Its format is told by the extension of URL, .zst (zstd --patch-from) or .bsdiff.
+type Patch struct {
+	From string `json:"from"`
+	URL  string `json:"url"`
+	// To optionally is the sha256 of the patched binary, if the binary of the upgrade is an archive
+	To string `json:"to,omitempty"`
+}
+
+// patchCommands apply a patch in each format, to the old binary, writing the new one
+var patchCommands = map[string]func(old, patch, new string) []string{
+	"zstd": func(old, patch, new string) []string {
+		return []string{"zstd", "-d", "-q", "-f", "--long=31", "--patch-from=" + old, patch, "-o", new}
+	},
+	"bsdiff": func(old, patch, new string) []string {
+		return []string{"bspatch", old, new, patch}
+	},
+}
+
+// patchFormat is the format of a patch, by the extension of its url
+func patchFormat(patchURL string) string {
+	u, err := url.Parse(patchURL)
+	if err != nil {
+		return ""
+	}
+	switch path.Ext(u.Path) {
+	case ".zst", ".zstd":
+		return "zstd"
+	case ".bsdiff", ".bspatch":
+		return "bsdiff"
+	}
+	return ""
+}
+
+// BinaryPatches returns the patches listed for the binary URL returns
+func (c *UpgradeConfig) BinaryPatches() []Patch {
+	for _, platform := range []string{osArch(), anyPlatform} {
+		if c.Binaries[platform] != "" {
+			return c.Patches[platform]
+		}
+	}
+	return nil
+}
+
+// patchBinary installs the binary of upgradeName by patching the current one, if a patch starts from it and we
+// know the sha256 to verify the result with. It fails if it cannot, and the binary is downloaded in full.
+func (cfg *Config) patchBinary(upgradeName, artifact string, patches []Patch, opts []getter.ClientOption) error {
+	if len(patches) == 0 {
+		return errors.New("no patches")
+	}
+	// a patched binary cannot be checked against the signature of the release
+	if cfg.verifiesArtifacts() {
+		return errors.New("artifacts must be signed")
+	}
+	current := cfg.CurrentBin()
+	sum, err := sha256File(current)
+	if err != nil {
+		return err
+	}
+	var patch *Patch
+	for i, p := range patches {
+		if from, err := parseSHA256(p.From); err == nil && from == "sha256:"+sum {
+			patch = &patches[i]
+			break
+		}
+	}
+	if patch == nil {
+		return errors.Errorf("no patch from sha256:%s", sum)
+	}
+	to := patch.To
+	if to == "" {
+		if u, err := url.Parse(artifact); err == nil {
+			to = u.Query().Get("checksum")
+		}
+	}
+	if to, err = parseSHA256(to); err != nil {
+		return errors.Wrap(err, "no sha256 to verify the patched binary with")
+	}
+	format := patchFormat(patch.URL)
+	if format == "" {
+		return errors.Errorf("unknown format of patch %s", redactURL(patch.URL))
+	}
+
+	bin := cfg.UpgradeBin(upgradeName)
+	if err := os.MkdirAll(filepath.Dir(bin), 0755); err != nil {
+		return errors.Wrap(err, "creating bin dir")
+	}
+	tmpDir, err := ioutil.TempDir(filepath.Dir(bin), ".patch")
+	if err != nil {
+		return errors.Wrap(err, "creating patch dir")
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := cfg.requireHTTPS(patch.URL); err != nil {
+		return err
+	}
+	// the patch is taken as it comes, not unpacked as an archive
+	source, err := url.Parse(patch.URL)
+	if err != nil {
+		return errors.Wrap(err, "parsing patch url")
+	}
+	query := source.Query()
+	query.Set("archive", "false")
+	source.RawQuery = query.Encode()
+	patchFile := filepath.Join(tmpDir, "patch")
+	if err := getter.GetFile(patchFile, source.String(), opts...); err != nil {
+		return errors.Wrapf(err, "downloading patch %s", redactURL(patch.URL))
+	}
+	patched := filepath.Join(tmpDir, "patched")
+	args := patchCommands[format](current, patchFile, patched)
+	var output bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "running %s: %s", quoteArgs(cmd.Args), strings.TrimSpace(output.String()))
+	}
+	if actual, err := sha256File(patched); err != nil {
+		return err
+	} else if "sha256:"+actual != to {
+		return errors.Errorf("patched binary has sha256:%s, not %s", actual, to)
+	}
+	if err := os.Rename(patched, bin); err != nil {
+		return errors.Wrap(err, "installing patched binary")
+	}
+	logger.Printf("patched the binary of upgrade %s from %s with %s", upgradeName, current, redactURL(patch.URL))
+	return nil
+}
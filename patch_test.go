@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPatchBinary(t *testing.T) {
+	bin, err := ioutil.ReadFile("testdata/repo/raw_binary/autod")
+	require.NoError(t, err)
+	var downloads int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			atomic.AddInt32(&downloads, 1)
+		}
+		w.Write(bin)
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "patch-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	genesis, err := filepath.Abs("testdata/download/upgrade_manager/genesis/bin/autod")
+	require.NoError(t, err)
+	from, err := sha256File(genesis)
+	require.NoError(t, err)
+	broken := filepath.Join(dir, "broken.zst")
+	require.NoError(t, ioutil.WriteFile(broken, []byte("not a patch"), 0644))
+	patch := filepath.Join(dir, "autod.zst")
+	_, zstd := exec.LookPath("zstd")
+	if zstd == nil {
+		out, err := exec.Command("zstd", "-q", "--patch-from="+genesis, "testdata/repo/raw_binary/autod", "-o", patch).CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+
+	cases := map[string]struct {
+		disabled bool
+		patches  []Patch
+		// whether the binary is downloaded in full
+		download bool
+	}{
+		"patched": {
+			patches: []Patch{{From: "sha256:" + autodSHA256, URL: broken}, {From: from, URL: patch}},
+		},
+		"disabled": {
+			disabled: true,
+			patches:  []Patch{{From: from, URL: patch}},
+			download: true,
+		},
+		"no patch from the current binary": {
+			patches:  []Patch{{From: "sha256:" + autodSHA256, URL: patch}},
+			download: true,
+		},
+		"broken patch": {
+			patches:  []Patch{{From: from, URL: broken}},
+			download: true,
+		},
+		"unknown format": {
+			patches:  []Patch{{From: from, URL: filepath.Join(dir, "autod.patch")}},
+			download: true,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if zstd != nil && !tc.download {
+				t.Skip("zstd is not installed")
+			}
+			home, err := copyTestData("download")
+			require.NoError(t, err)
+			defer os.RemoveAll(home)
+			cfg := &Config{Home: home, Name: "autod", AllowDownloadBinaries: true, DownloadPatches: !tc.disabled}
+			config := UpgradeConfig{
+				Binaries: map[string]string{osArch(): server.URL + "/autod?checksum=sha256:" + autodSHA256},
+				Patches:  map[string][]Patch{osArch(): tc.patches},
+			}
+			bz, err := json.Marshal(config)
+			require.NoError(t, err)
+			atomic.StoreInt32(&downloads, 0)
+			require.NoError(t, DownloadBinary(cfg, &UpgradeInfo{Name: "v2", Info: string(bz)}))
+			hash, err := sha256File(cfg.UpgradeBin("v2"))
+			require.NoError(t, err)
+			assert.Equal(t, autodSHA256, hash)
+			assert.Equal(t, tc.download, atomic.LoadInt32(&downloads) > 0, fmt.Sprintf("%d downloads", downloads))
+			// nothing is left of the patch
+			files, err := ioutil.ReadDir(filepath.Dir(cfg.UpgradeBin("v2")))
+			require.NoError(t, err)
+			assert.Len(t, files, 1)
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// writePIDFile writes pid to path, renaming it into place so a reader never sees half a pid
+func writePIDFile(path string, pid int) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.Itoa(pid)+"\n"), 0644); err != nil {
+		return errors.Wrap(err, "writing pid file")
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "writing pid file")
+	}
+	return nil
+}
+
+// removePIDFile removes path once pid is gone, unless another process took the file over since
+func removePIDFile(path string, pid int) {
+	bz, err := ioutil.ReadFile(path)
+	if err != nil || strings.TrimSpace(string(bz)) != strconv.Itoa(pid) {
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		logger.Printf("cannot remove pid file: %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChildPIDFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as daemon")
+	}
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	pidFile := filepath.Join(home, "dummyd.pid")
+	cfg := &Config{Home: home, Name: "dummyd", ChildPIDFile: pidFile}
+	// the daemon finds its own pid in the file, which is written right after it started
+	script := "#!/bin/sh\nfor i in $(seq 50); do\n  [ \"$(cat " + pidFile + " 2>/dev/null)\" = \"$$\" ] && echo found && exit 0\n  sleep 0.1\ndone\nexit 1\n"
+	require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+
+	var stdout, stderr bytes.Buffer
+	require.NoError(t, LaunchProcess(cfg, []string{"start"}, &stdout, &stderr))
+	assert.Equal(t, "found\n", stdout.String())
+	// and it is gone with the daemon
+	_, err = os.Stat(pidFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRemovePIDFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pidfile-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cosmosd.pid")
+
+	require.NoError(t, writePIDFile(path, 1234))
+	bz, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "1234\n", string(bz))
+
+	// another process took it over
+	removePIDFile(path, 42)
+	_, err = os.Stat(path)
+	assert.NoError(t, err)
+
+	removePIDFile(path, 1234)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
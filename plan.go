@@ -0,0 +1,282 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	planFile      = "plan.json"
+	bundlePlan    = "plan.json"
+	bundleUpgrade = "upgrade"
+)
+
+// Plan is an upgrade we detected (or imported), but could not apply yet
+type Plan struct {
+	Name   string `json:"name"`
+	Height int64  `json:"height"`
+	Info   string `json:"info,omitempty"`
+	// SHA256 is the hash of the binary, once we have one
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// PlanFile is where the held plan is stored
+func (cfg *Config) PlanFile() string {
+	return filepath.Join(cfg.Root(), planFile)
+}
+
+// HoldPlan records an upgrade we could not apply, so it can be exported to another node
+func (cfg *Config) HoldPlan(info *UpgradeInfo) error {
+	return cfg.writePlan(Plan{Name: info.Name, Height: info.Height, Info: info.Info})
+}
+
+func (cfg *Config) writePlan(plan Plan) error {
+	bz, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "encode plan")
+	}
+	return errors.Wrap(ioutil.WriteFile(cfg.PlanFile(), bz, 0644), "writing plan")
+}
+
+// HeldPlan returns the plan we hold, or nil if there is none
+func (cfg *Config) HeldPlan() (*Plan, error) {
+	bz, err := ioutil.ReadFile(cfg.PlanFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "reading plan")
+	}
+	var plan Plan
+	if err := json.Unmarshal(bz, &plan); err != nil {
+		return nil, errors.Wrap(err, "parsing plan")
+	}
+	return &plan, nil
+}
+
+// releasePlan removes the held plan once the named upgrade was applied
+func (cfg *Config) releasePlan(upgradeName string) {
+	plan, err := cfg.HeldPlan()
+	if err == nil && plan != nil && plan.Name == upgradeName {
+		os.Remove(cfg.PlanFile())
+	}
+}
+
+// ExportPlan writes a tar.gz with the plan and the staged upgrade directory to w.
+// If name is empty, the held plan is exported.
+func (cfg *Config) ExportPlan(name string, w io.Writer) error {
+	plan, err := cfg.HeldPlan()
+	if err != nil {
+		return err
+	}
+	if plan == nil || (name != "" && plan.Name != name) {
+		if name == "" {
+			return errors.New("no held plan, please name the upgrade to export")
+		}
+		plan = &Plan{Name: name}
+	}
+	if err := EnsureBinary(cfg.UpgradeBin(plan.Name)); err != nil {
+		return errors.Wrap(err, "upgrade must be staged before export")
+	}
+	if plan.SHA256, err = sha256File(cfg.UpgradeBin(plan.Name)); err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	bz, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "encode plan")
+	}
+	hdr := &tar.Header{Name: bundlePlan, Mode: 0644, Size: int64(len(bz)), Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return errors.Wrap(err, "writing bundle")
+	}
+	if _, err := tw.Write(bz); err != nil {
+		return errors.Wrap(err, "writing bundle")
+	}
+	if err := tarDir(tw, cfg.UpgradeDir(plan.Name), bundleUpgrade); err != nil {
+		return errors.Wrap(err, "writing bundle")
+	}
+	if err := tw.Close(); err != nil {
+		return errors.Wrap(err, "writing bundle")
+	}
+	return errors.Wrap(zw.Close(), "writing bundle")
+}
+
+// tarDir adds all dirs and regular files under dir to the archive, under prefix
+func tarDir(tw *tar.Writer, dir, prefix string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(filepath.Join(prefix, rel))
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
+
+// ImportPlan reads a bundle written by ExportPlan, installs the upgrade directory after verifying
+// the binary hash, and holds the plan. It refuses to overwrite an existing upgrade directory.
+func (cfg *Config) ImportPlan(r io.Reader) (*Plan, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading bundle")
+	}
+	tr := tar.NewReader(zr)
+
+	// the plan is always the first entry
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != bundlePlan {
+		return nil, errors.New("invalid bundle, no plan")
+	}
+	var plan Plan
+	if err := json.NewDecoder(tr).Decode(&plan); err != nil {
+		return nil, errors.Wrap(err, "parsing plan")
+	}
+	if plan.Name == "" || plan.SHA256 == "" {
+		return nil, errors.New("invalid plan, name and sha256 are required")
+	}
+
+	dir := cfg.UpgradeDir(plan.Name)
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		return nil, errors.Errorf("upgrade dir %s already exists, won't overwrite", dir)
+	}
+	if err := untar(tr, dir, bundleUpgrade+"/"); err != nil {
+		os.RemoveAll(dir)
+		return nil, errors.Wrap(err, "extracting bundle")
+	}
+
+	hash, err := sha256File(cfg.UpgradeBin(plan.Name))
+	if err == nil && hash != plan.SHA256 {
+		err = errors.Errorf("binary hash %s doesn't match plan %s", hash, plan.SHA256)
+	}
+	if err == nil {
+		err = MarkExecutable(cfg.UpgradeBin(plan.Name))
+	}
+	if err == nil {
+		err = cfg.prepareBinary(dir, cfg.UpgradeBin(plan.Name))
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	if err := cfg.AddToCache(dir); err != nil {
+		return nil, err
+	}
+	return &plan, cfg.writePlan(plan)
+}
+
+// untar extracts all entries below prefix into dest, refusing anything that would end up outside of it
+func untar(tr *tar.Reader, dest, prefix string) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(hdr.Name, prefix) {
+			return errors.Errorf("unexpected entry %s", hdr.Name)
+		}
+		rel := filepath.FromSlash(strings.TrimPrefix(hdr.Name, prefix))
+		if rel == "" || strings.HasPrefix(filepath.Clean(rel), "..") || filepath.IsAbs(rel) {
+			return errors.Errorf("invalid entry %s", hdr.Name)
+		}
+		target := filepath.Join(dest, rel)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.FileMode(hdr.Mode).Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		default:
+			return errors.Errorf("unsupported entry %s", hdr.Name)
+		}
+	}
+}
+
+// cmdPlan handles `plan export <file> [name]` and `plan import <file>`
+func cmdPlan(cfg *Config, args []string, out io.Writer) error {
+	if len(args) < 2 {
+		return errors.New("usage: plan export <file> [upgrade name] | plan import <file>")
+	}
+	switch args[0] {
+	case "export":
+		name := ""
+		if len(args) > 2 {
+			name = args[2]
+		}
+		f, err := os.OpenFile(args[1], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return errors.Wrap(err, "creating bundle")
+		}
+		if err := cfg.ExportPlan(name, f); err != nil {
+			f.Close()
+			os.Remove(args[1])
+			return err
+		}
+		return f.Close()
+	case "import":
+		f, err := os.Open(args[1])
+		if err != nil {
+			return errors.Wrap(err, "opening bundle")
+		}
+		defer f.Close()
+		plan, err := cfg.ImportPlan(f)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "imported upgrade %s (height %d, sha256 %s)\n", plan.Name, plan.Height, plan.SHA256)
+		return nil
+	default:
+		return errors.Errorf("unknown plan command: %s", args[0])
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/homedepot/flop"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImportPlan(t *testing.T) {
+	// the internet connected staging host sees an upgrade it has no binary for
+	staging, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(staging)
+	stagingCfg := &Config{Home: staging, Name: "dummyd"}
+
+	info := &UpgradeInfo{Name: "chain4", Height: 1234, Info: "{}"}
+	require.Error(t, DoUpgrade(stagingCfg, info))
+	plan, err := stagingCfg.HeldPlan()
+	require.NoError(t, err)
+	require.Equal(t, &Plan{Name: "chain4", Height: 1234, Info: "{}"}, plan)
+
+	// can't export before the binary is there
+	var bundle bytes.Buffer
+	require.Error(t, stagingCfg.ExportPlan("", &bundle))
+	require.NoError(t, flop.Copy(stagingCfg.UpgradeDir("chain2"), stagingCfg.UpgradeDir("chain4"), flop.Options{Recursive: true}))
+	bundle.Reset()
+	require.NoError(t, stagingCfg.ExportPlan("", &bundle))
+
+	// which is imported on the air-gapped signer
+	signer, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(signer)
+	signerCfg := &Config{Home: signer, Name: "dummyd"}
+
+	imported, err := signerCfg.ImportPlan(bytes.NewReader(bundle.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, "chain4", imported.Name)
+	assert.Equal(t, int64(1234), imported.Height)
+	hash, err := sha256File(stagingCfg.UpgradeBin("chain2"))
+	require.NoError(t, err)
+	assert.Equal(t, hash, imported.SHA256)
+	require.NoError(t, EnsureBinary(signerCfg.UpgradeBin("chain4")))
+	held, err := signerCfg.HeldPlan()
+	require.NoError(t, err)
+	assert.Equal(t, imported, held)
+
+	// importing twice won't overwrite anything
+	_, err = signerCfg.ImportPlan(bytes.NewReader(bundle.Bytes()))
+	require.Error(t, err)
+
+	// once the signer halts, the upgrade is applied and the plan released
+	require.NoError(t, DoUpgrade(signerCfg, info))
+	assert.Equal(t, signerCfg.UpgradeBin("chain4"), signerCfg.CurrentBin())
+	held, err = signerCfg.HeldPlan()
+	require.NoError(t, err)
+	assert.Nil(t, held)
+}
+
+func TestImportPlanInvalid(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+
+	goodPlan := Plan{Name: "chain4", SHA256: "e6bc7851600a2a9917f7bf88eb7bdee1ec162c671101485690b4deb089077b0d"}
+	binary := []byte("#!/bin/sh\necho hi\n")
+	cases := map[string]struct {
+		plan    Plan
+		entries map[string][]byte
+	}{
+		"no sha": {
+			plan:    Plan{Name: "chain4"},
+			entries: map[string][]byte{"upgrade/bin/dummyd": binary},
+		},
+		"wrong hash": {
+			plan:    goodPlan,
+			entries: map[string][]byte{"upgrade/bin/dummyd": binary},
+		},
+		"escape dir": {
+			plan:    goodPlan,
+			entries: map[string][]byte{"upgrade/../../evil": binary},
+		},
+		"other entry": {
+			plan:    goodPlan,
+			entries: map[string][]byte{"etc/passwd": binary},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			tw := tar.NewWriter(zw)
+			bz, err := json.Marshal(tc.plan)
+			require.NoError(t, err)
+			writeEntry(t, tw, bundlePlan, bz)
+			for name, bz := range tc.entries {
+				writeEntry(t, tw, name, bz)
+			}
+			require.NoError(t, tw.Close())
+			require.NoError(t, zw.Close())
+
+			_, err = cfg.ImportPlan(&buf)
+			require.Error(t, err)
+			_, err = os.Stat(cfg.UpgradeDir("chain4"))
+			assert.True(t, os.IsNotExist(err))
+			_, err = os.Stat(filepath.Join(home, "evil"))
+			assert.True(t, os.IsNotExist(err))
+		})
+	}
+}
+
+func writeEntry(t *testing.T, tw *tar.Writer, name string, bz []byte) {
+	hdr := &tar.Header{Name: name, Mode: 0755, Size: int64(len(bz)), Typeflag: tar.TypeReg}
+	require.NoError(t, tw.WriteHeader(hdr))
+	_, err := tw.Write(bz)
+	require.NoError(t, err)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const plannedFile = "upgrades.json"
+
+// PlannedUpgrade is an upgrade the operator lists ahead of time in upgrades.json, for nodes which cannot rely
+// on the chain telling them (eg. air-gapped validators). URL is where the binary is downloaded from if it isn't
+// staged in upgrades/<name> already, verified with Checksum (sha256:<hex>, or just the hex).
+type PlannedUpgrade struct {
+	Name     string `json:"name"`
+	Height   int64  `json:"height"`
+	URL      string `json:"url,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// PlannedFile lists the upgrades planned ahead
+func (cfg *Config) PlannedFile() string {
+	return filepath.Join(cfg.Root(), plannedFile)
+}
+
+// PlannedUpgrades reads upgrades.json ordered by height, or nil if there is none
+func (cfg *Config) PlannedUpgrades() ([]PlannedUpgrade, error) {
+	bz, err := ioutil.ReadFile(cfg.PlannedFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s", plannedFile)
+	}
+	var planned []PlannedUpgrade
+	if err := json.Unmarshal(bz, &planned); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", plannedFile)
+	}
+	names := make(map[string]bool)
+	for _, p := range planned {
+		if p.Name == "" || p.Height <= 0 {
+			return nil, errors.Errorf("%s: every upgrade needs a name and a positive height", plannedFile)
+		}
+		if names[p.Name] {
+			return nil, errors.Errorf("%s: upgrade %s is listed twice", plannedFile, p.Name)
+		}
+		names[p.Name] = true
+		if _, err := p.UpgradeInfo(); err != nil {
+			return nil, errors.Wrapf(err, "%s: upgrade %s", plannedFile, p.Name)
+		}
+	}
+	sort.SliceStable(planned, func(i, j int) bool { return planned[i].Height < planned[j].Height })
+	return planned, nil
+}
+
+// UpgradeInfo returns the upgrade to apply, with the url of the binary for this platform if one is given
+func (p PlannedUpgrade) UpgradeInfo() (*UpgradeInfo, error) {
+	req := RemoteUpgrade{Name: p.Name, Height: p.Height, Binary: p.URL}
+	if p.Checksum != "" {
+		if p.URL == "" {
+			return nil, errors.New("a checksum needs a url")
+		}
+		sum, err := parseSHA256(p.Checksum)
+		if err != nil {
+			return nil, err
+		}
+		binary, err := withChecksum(p.URL, sum)
+		if err != nil {
+			return nil, err
+		}
+		req.Binary = binary
+	}
+	return req.UpgradeInfo()
+}
+
+// UpcomingUpgrades returns the planned upgrades above the height of the node, but the skipped ones
+func (cfg *Config) UpcomingUpgrades() ([]*UpgradeInfo, error) {
+	return cfg.upcomingUpgrades(0)
+}
+
+// upcomingUpgrades returns the planned upgrades above pastHeight, given the last block the node committed (0 if unknown)
+func (cfg *Config) upcomingUpgrades(committed int64) ([]*UpgradeInfo, error) {
+	planned, err := cfg.PlannedUpgrades()
+	if err != nil {
+		return nil, err
+	}
+	past := cfg.pastHeight(planned, committed)
+	var upcoming []*UpgradeInfo
+	for _, p := range planned {
+		if p.Height <= past {
+			continue
+		}
+		info, err := p.UpgradeInfo()
+		if err != nil {
+			return nil, err
+		}
+		if !cfg.skipsUpgrade(info) {
+			upcoming = append(upcoming, info)
+		}
+	}
+	return upcoming, nil
+}
+
+// pastHeight returns the height up to which planned upgrades are past: the height of the upgrade we run, from
+// upgrades.json or the upgrade-info.json x/upgrade wrote for it, and the heights below the last block the node
+// committed. Without committed, the validator state tells it if there is one. On genesis with neither, none is past.
+func (cfg *Config) pastHeight(planned []PlannedUpgrade, committed int64) int64 {
+	var past int64
+	current := cfg.currentUpgradeName()
+	for _, p := range planned {
+		if p.Name == current {
+			past = p.Height
+		}
+	}
+	if info, err := readUpgradeFile(cfg.UpgradeInfoFile()); err == nil && info != nil && info.Name == current && info.Height > past {
+		past = info.Height
+	}
+	if committed == 0 {
+		committed, _ = validatorState{path: cfg.ValidatorStateFile()}.Height()
+	}
+	// an upgrade at the height committed last is still to apply, if the node halted there
+	if committed-1 > past {
+		past = committed - 1
+	}
+	return past
+}
+
+// NextPlannedUpgrade returns the first upcoming planned upgrade, or nil if there is none
+func (cfg *Config) NextPlannedUpgrade() (*UpgradeInfo, error) {
+	return cfg.nextPlannedUpgrade(0)
+}
+
+func (cfg *Config) nextPlannedUpgrade(committed int64) (*UpgradeInfo, error) {
+	upcoming, err := cfg.upcomingUpgrades(committed)
+	if err != nil || len(upcoming) == 0 {
+		return nil, err
+	}
+	return upcoming[0], nil
+}
+
+// checkPlanned returns the next planned upgrade once the node reached its height, if one of the heights knows it.
+// Otherwise the daemon halts at it (see withHaltHeight), and it is applied once the daemon exited there.
+func (cfg *Config) checkPlanned(heights *Heights) (*UpgradeInfo, error) {
+	height, err := heights.Height("planned")
+	if err != nil {
+		return nil, nil
+	}
+	next, err := cfg.nextPlannedUpgrade(height)
+	if err != nil || next == nil || height < next.Height {
+		return nil, err
+	}
+	return next, nil
+}
+
+// StagePlannedUpgrades downloads the binaries of the upcoming planned upgrades which aren't staged yet, so
+// nothing is left to fetch at the upgrade height
+func (cfg *Config) StagePlannedUpgrades() {
+	upcoming, err := cfg.UpcomingUpgrades()
+	if err != nil {
+		logger.Printf("cannot stage planned upgrades: %v", err)
+		return
+	}
+	for _, info := range upcoming {
+		if EnsureBinary(cfg.UpgradeBin(info.Name)) == nil {
+			continue
+		}
+		if info.Info == "" || !cfg.AllowDownloadBinaries {
+			logger.Printf("upgrade %s planned at height %d has no binary at %s yet", info.Name, info.Height, cfg.UpgradeBin(info.Name))
+			continue
+		}
+		cfg.PreDownloadUpgrade(info)
+	}
+}
+
+// haltHeight returns the --halt-height in args, or 0 if there is none
+func haltHeight(args []string) int64 {
+	for i, arg := range args {
+		value := ""
+		switch {
+		case arg == "--halt-height" && i+1 < len(args):
+			value = args[i+1]
+		case strings.HasPrefix(arg, "--halt-height="):
+			value = strings.TrimPrefix(arg, "--halt-height=")
+		default:
+			continue
+		}
+		height, _ := strconv.ParseInt(value, 10, 64)
+		return height
+	}
+	return 0
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testSum = "b5bb9d8014a0f9b1d61e21e796d78dccdf1352f23cd32812f4850b878ae4944c"
+
+func TestPlannedUpgrades(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+
+	cases := map[string]struct {
+		file     string
+		expected []PlannedUpgrade
+		isErr    bool
+	}{
+		"no file": {},
+		"by height": {
+			file:     `[{"name":"chain3","height":200},{"name":"chain2","height":100,"url":"https://example.com/gaiad","checksum":"` + testSum + `"}]`,
+			expected: []PlannedUpgrade{{Name: "chain2", Height: 100, URL: "https://example.com/gaiad", Checksum: testSum}, {Name: "chain3", Height: 200}},
+		},
+		"no height":        {file: `[{"name":"chain2"}]`, isErr: true},
+		"twice":            {file: `[{"name":"chain2","height":100},{"name":"chain2","height":200}]`, isErr: true},
+		"checksum, no url": {file: `[{"name":"chain2","height":100,"checksum":"` + testSum + `"}]`, isErr: true},
+		"short checksum":   {file: `[{"name":"chain2","height":100,"url":"https://example.com/gaiad","checksum":"sha256:abc"}]`, isErr: true},
+		"not a list":       {file: `{"name":"chain2","height":100}`, isErr: true},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			os.Remove(cfg.PlannedFile())
+			if tc.file != "" {
+				require.NoError(t, ioutil.WriteFile(cfg.PlannedFile(), []byte(tc.file), 0644))
+			}
+			planned, err := cfg.PlannedUpgrades()
+			if tc.isErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, planned)
+		})
+	}
+}
+
+func TestPlannedUpgradeInfo(t *testing.T) {
+	info, err := PlannedUpgrade{Name: "chain2", Height: 100, URL: "https://example.com/gaiad", Checksum: "sha256:" + testSum}.UpgradeInfo()
+	require.NoError(t, err)
+	assert.Equal(t, &UpgradeInfo{Name: "chain2", Height: 100, Info: `{"binaries":{"` + osArch() + `":"https://example.com/gaiad?checksum=sha256%3A` + testSum + `"}}`}, info)
+
+	// staged binaries need no url
+	info, err = PlannedUpgrade{Name: "chain2", Height: 100}.UpgradeInfo()
+	require.NoError(t, err)
+	assert.Equal(t, &UpgradeInfo{Name: "chain2", Height: 100}, info)
+
+	_, err = PlannedUpgrade{Name: "chain2", Height: 100, URL: "https://example.com/gaiad?checksum=sha256:" + testSum[1:] + "0", Checksum: testSum}.UpgradeInfo()
+	assert.Error(t, err)
+}
+
+func TestUpcomingUpgrades(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd", UnsafeSkipUpgrades: []int64{150}}
+	plan := `[{"name":"chain2","height":100},{"name":"skipped","height":150},{"name":"chain3","height":200}]`
+	require.NoError(t, ioutil.WriteFile(cfg.PlannedFile(), []byte(plan), 0644))
+
+	// all of them on genesis
+	next, err := cfg.NextPlannedUpgrade()
+	require.NoError(t, err)
+	assert.Equal(t, &UpgradeInfo{Name: "chain2", Height: 100}, next)
+	assert.Equal(t, []string{"start", "--halt-height", "100"}, cfg.withHaltHeight([]string{"start"}))
+
+	require.NoError(t, cfg.SetCurrentUpgrade("chain2"))
+	upcoming, err := cfg.UpcomingUpgrades()
+	require.NoError(t, err)
+	assert.Equal(t, []*UpgradeInfo{{Name: "chain3", Height: 200}}, upcoming)
+
+	require.NoError(t, cfg.SetCurrentUpgrade("chain3"))
+	next, err = cfg.NextPlannedUpgrade()
+	require.NoError(t, err)
+	assert.Nil(t, next)
+
+	// an upgrade which is not listed tells nothing, the heights the node is past do
+	require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte("#!/bin/sh\n"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(cfg.Root(), "upgrades", "unlisted", "bin"), 0755))
+	require.NoError(t, ioutil.WriteFile(cfg.UpgradeBin("unlisted"), []byte("#!/bin/sh\n"), 0755))
+	require.NoError(t, cfg.SetCurrentUpgrade("unlisted"))
+	require.NoError(t, os.MkdirAll(cfg.DataDir(), 0755))
+	require.NoError(t, ioutil.WriteFile(cfg.UpgradeInfoFile(), []byte(`{"name":"unlisted","height":120}`), 0644))
+	upcoming, err = cfg.UpcomingUpgrades()
+	require.NoError(t, err)
+	assert.Equal(t, []*UpgradeInfo{{Name: "chain3", Height: 200}}, upcoming)
+
+	require.NoError(t, os.Remove(cfg.UpgradeInfoFile()))
+	require.NoError(t, ioutil.WriteFile(cfg.ValidatorStateFile(), []byte(`{"height":"102","round":0,"step":3}`), 0644))
+	upcoming, err = cfg.UpcomingUpgrades()
+	require.NoError(t, err)
+	assert.Equal(t, []*UpgradeInfo{{Name: "chain3", Height: 200}}, upcoming)
+
+	// at a halt at the height of an upgrade, it is still to apply
+	next, err = cfg.nextPlannedUpgrade(200)
+	require.NoError(t, err)
+	assert.Equal(t, &UpgradeInfo{Name: "chain3", Height: 200}, next)
+	next, err = cfg.nextPlannedUpgrade(201)
+	require.NoError(t, err)
+	assert.Nil(t, next)
+}
+
+func TestCheckPlanned(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd", HeightSources: []string{"output"}}
+	require.NoError(t, ioutil.WriteFile(cfg.PlannedFile(), []byte(`[{"name":"chain2","height":100}]`), 0644))
+	heights := cfg.NewHeights()
+
+	for _, c := range []struct {
+		line     string
+		expected *UpgradeInfo
+	}{
+		{"", nil},
+		{`INF committed state app_hash=AB height=99 module=state`, nil},
+		{`INF committed state app_hash=AB height=100 module=state`, &UpgradeInfo{Name: "chain2", Height: 100}},
+		// when it overshot, the upgrade is past
+		{`INF committed state app_hash=AB height=101 module=state`, nil},
+	} {
+		heights.Observe(c.line)
+		info, err := cfg.checkPlanned(heights)
+		require.NoError(t, err)
+		assert.Equal(t, c.expected, info, c.line)
+	}
+}
+
+func TestHaltHeight(t *testing.T) {
+	assert.Equal(t, int64(0), haltHeight([]string{"start"}))
+	assert.Equal(t, int64(99), haltHeight([]string{"start", "--halt-height", "99"}))
+	assert.Equal(t, int64(80), haltHeight([]string{"start", "--halt-height=80", "--trace"}))
+	assert.Equal(t, int64(0), haltHeight([]string{"start", "--halt-height"}))
+}
+
+// TestLaunchProcessPlannedUpgrade switches at the planned height, though the daemon never logs the upgrade
+func TestLaunchProcessPlannedUpgrade(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd", UnsafeSkipBackup: true}
+	require.NoError(t, ioutil.WriteFile(cfg.PlannedFile(), []byte(`[{"name":"chain2","height":49}]`), 0644))
+
+	// not when the daemon stops at another height
+	script := "#!/bin/sh\necho Genesis $@\necho 'INF committed state app_hash=AB height=30 module=state'\n"
+	require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+	var stdout, stderr bytes.Buffer
+	require.NoError(t, LaunchProcess(cfg, []string{"start", "--halt-height", "30"}, &stdout, &stderr))
+	assert.Equal(t, cfg.GenesisBin(), cfg.CurrentBin())
+
+	// nor when it exits at the --halt-height without reaching it
+	stdout.Reset()
+	require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte("#!/bin/sh\necho Genesis $@\n"), 0755))
+	require.NoError(t, LaunchProcess(cfg, []string{"start"}, &stdout, &stderr))
+	assert.Equal(t, "Genesis start --halt-height 49\n", stdout.String())
+	assert.Equal(t, cfg.GenesisBin(), cfg.CurrentBin())
+
+	stdout.Reset()
+	script = "#!/bin/sh\necho Genesis $@\necho 'INF committed state app_hash=AB height=49 module=state'\n"
+	require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+	require.NoError(t, LaunchProcess(cfg, []string{"start"}, &stdout, &stderr))
+	assert.Equal(t, "Genesis start --halt-height 49\nINF committed state app_hash=AB height=49 module=state\n", stdout.String())
+	assert.Equal(t, cfg.UpgradeBin("chain2"), cfg.CurrentBin())
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// postUpgradeFile remembers an upgrade we switched to, until the config check and post-upgrade hook ran for it. It outlives us, as
+// without DAEMON_RESTART_AFTER_UPGRADE it is the next upgrade manager that starts the upgrade.
+const postUpgradeFile = "post-upgrade.json"
+
+// PostUpgradeFile is where an upgrade waits for its post-upgrade hook
+func (cfg *Config) PostUpgradeFile() string {
+	return filepath.Join(cfg.Root(), postUpgradeFile)
+}
+
+// awaitPostUpgrade marks the upgrade we just switched to, so the hook runs once it is up
+func (cfg *Config) awaitPostUpgrade(info *UpgradeInfo) error {
+	if cfg.PostUpgradeCommand == "" && !cfg.checksConfig() {
+		return nil
+	}
+	bz, err := json.Marshal(UpgradeInfo{Name: info.Name, Height: info.Height})
+	if err != nil {
+		return errors.Wrap(err, "encode post-upgrade")
+	}
+	return errors.Wrap(ioutil.WriteFile(cfg.PostUpgradeFile(), bz, 0644), "writing post-upgrade")
+}
+
+// runPostUpgrade checks the config (see checkConfig) and runs DAEMON_POST_UPGRADE_COMMAND once the daemon started
+// with bin is up, ie. the heights know a block it committed, if we switched to an upgrade since. It gives up once done is closed, to run at the next start. It
+// runs once, a failure is only reported.
+func (cfg *Config) runPostUpgrade(bin string, heights *Heights, done <-chan struct{}) {
+	if _, err := os.Stat(cfg.PostUpgradeFile()); os.IsNotExist(err) {
+		return
+	}
+	ticker := time.NewTicker(orDefault(cfg.PollInterval, defaultPollInterval))
+	defer ticker.Stop()
+	for {
+		if _, err := heights.Height("post-upgrade"); err == nil {
+			break
+		}
+		select {
+		case <-ticker.C:
+			continue
+		case <-done:
+		}
+		// it may have committed one since we asked
+		if _, err := heights.Height("post-upgrade"); err != nil {
+			logger.Printf("the daemon exited before it committed a block, the post-upgrade hook waits for the next start")
+			return
+		}
+		break
+	}
+
+	bz, err := ioutil.ReadFile(cfg.PostUpgradeFile())
+	if os.IsNotExist(err) {
+		return
+	}
+	os.Remove(cfg.PostUpgradeFile())
+	var info UpgradeInfo
+	if err == nil {
+		err = json.Unmarshal(bz, &info)
+	}
+	if err != nil {
+		logger.Printf("cannot read %s: %v", cfg.PostUpgradeFile(), err)
+		return
+	}
+	// the operator may have switched to another upgrade by hand since
+	if info.Name != cfg.currentUpgradeName() {
+		return
+	}
+	if cfg.checksConfig() {
+		cfg.notifyConfigChanges(info.Name)
+	}
+	if cfg.PostUpgradeCommand == "" {
+		return
+	}
+	env := map[string]string{
+		"COSMOSD_UPGRADE_NAME":   info.Name,
+		"COSMOSD_UPGRADE_HEIGHT": strconv.FormatInt(info.Height, 10),
+		"COSMOSD_BINARY":         bin,
+	}
+	if err := RunHook(cfg.PostUpgradeCommand, env); err != nil {
+		cfg.Notify(Event{
+			Type:    "post_upgrade_failed",
+			Message: fmt.Sprintf("the post-upgrade hook of upgrade %s failed: %v", info.Name, err),
+			Fields:  map[string]string{"UPGRADE": info.Name, "ERROR": err.Error()},
+		})
+		return
+	}
+	logger.Printf("post-upgrade hook of %s succeeded", info.Name)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostUpgradeHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as hook")
+	}
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	calls := filepath.Join(home, "calls")
+	hook := filepath.Join(home, "post-upgrade")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$COSMOSD_UPGRADE_NAME $COSMOSD_UPGRADE_HEIGHT $COSMOSD_BINARY\" >> %s\n", calls)
+	require.NoError(t, ioutil.WriteFile(hook, []byte(script), 0755))
+	cfg := &Config{Home: home, Name: "dummyd", PostUpgradeCommand: hook}
+
+	// nothing to do before an upgrade
+	var stdout, stderr bytes.Buffer
+	require.NoError(t, DoUpgrade(cfg, &UpgradeInfo{Name: "chain2", Height: 49}))
+	_, err = os.Stat(calls)
+	assert.True(t, os.IsNotExist(err), "ran before the daemon started")
+
+	// not while the daemon didn't commit a block, nor for another command than start
+	bin := cfg.UpgradeBin("chain2")
+	require.NoError(t, ioutil.WriteFile(bin, []byte("#!/bin/sh\necho 'INF committed state height=50 module=state'\n"), 0755))
+	require.NoError(t, LaunchProcess(cfg, []string{"export"}, &stdout, &stderr))
+	require.NoError(t, ioutil.WriteFile(bin, []byte("#!/bin/sh\n"), 0755))
+	require.NoError(t, LaunchProcess(cfg, []string{"start"}, &stdout, &stderr))
+	_, err = os.Stat(cfg.PostUpgradeFile())
+	require.NoError(t, err)
+
+	// the hook runs once the upgrade is up, before the launch returns, and only then
+	script = "#!/bin/sh\necho 'INF committed state height=50 module=state'\nsleep 0.2\n"
+	require.NoError(t, ioutil.WriteFile(bin, []byte(script), 0755))
+	cfg.PollInterval = 20 * time.Millisecond
+	for i := 0; i < 2; i++ {
+		require.NoError(t, LaunchProcess(cfg, []string{"start"}, &stdout, &stderr))
+		_, err = os.Stat(cfg.PostUpgradeFile())
+		assert.True(t, os.IsNotExist(err))
+	}
+	_, err = os.Stat(calls)
+	require.NoError(t, err)
+	bz, err := ioutil.ReadFile(calls)
+	require.NoError(t, err)
+	assert.Equal(t, "chain2 49 "+bin+"\n", string(bz))
+
+	// without a hook, nothing waits for it
+	cfg.PostUpgradeCommand = ""
+	require.NoError(t, DoUpgrade(cfg, &UpgradeInfo{Name: "chain3"}))
+	_, err = os.Stat(cfg.PostUpgradeFile())
+	assert.True(t, os.IsNotExist(err))
+}
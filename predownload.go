@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// downloading serializes the downloads of upgrades, so one started ahead of time and one at the
+// upgrade height never write to the same directory
+var downloading sync.Mutex
+
+// PreDownloadUpgrade stages the binary of an upgrade as soon as it is scheduled, days before the height,
+// rather than when everyone halts and hammers the release servers. A failure is notified, as there is
+// still time to stage the binary by hand.
+func (cfg *Config) PreDownloadUpgrade(info *UpgradeInfo) {
+	downloading.Lock()
+	defer downloading.Unlock()
+	if EnsureBinary(cfg.UpgradeBin(info.Name)) == nil {
+		return
+	}
+	lock, err := cfg.LockDownload(context.Background(), info.Name)
+	if err != nil {
+		logger.Printf("not downloading upgrade %s ahead of time: %v", info.Name, err)
+		return
+	}
+	defer lock.Unlock()
+	// another upgrade manager sharing the upgrades dir may just have downloaded it
+	if EnsureBinary(cfg.UpgradeBin(info.Name)) == nil {
+		return
+	}
+	dir := cfg.UpgradeDir(info.Name)
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		logger.Printf("not downloading upgrade %s ahead of time, %s already exists", info.Name, dir)
+		return
+	}
+
+	fields := map[string]string{"UPGRADE": info.Name, "HEIGHT": strconv.FormatInt(info.Height, 10)}
+	err = DownloadBinary(cfg, info)
+	if err == nil {
+		err = EnsureBinary(cfg.UpgradeBin(info.Name))
+	}
+	if err != nil {
+		// leave nothing behind, so we try again at the upgrade height
+		os.RemoveAll(dir)
+		cfg.Notify(Event{
+			Type:    "predownload_failed",
+			Message: fmt.Sprintf("cannot download upgrade %s ahead of time: %v", info.Name, err),
+			Fields:  fields,
+		})
+		return
+	}
+	cfg.Notify(Event{
+		Type:    "upgrade_downloaded",
+		Message: fmt.Sprintf("downloaded and verified upgrade %s for height %d", info.Name, info.Height),
+		Fields:  fields,
+	})
+}
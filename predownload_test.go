@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreDownloadUpgrade(t *testing.T) {
+	binary, err := filepath.Abs(filepath.FromSlash("./testdata/repo/raw_binary/autod"))
+	require.NoError(t, err)
+
+	cases := map[string]struct {
+		url    string
+		staged bool
+	}{
+		"downloaded": {url: binary, staged: true},
+		"bad url":    {url: binary + ".missing"},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			home, err := copyTestData("download")
+			require.NoError(t, err)
+			defer os.RemoveAll(home)
+
+			cfg := &Config{Home: home, Name: "autod", AllowDownloadBinaries: true}
+			info := &UpgradeInfo{Name: "amazonas", Height: 789, Info: fmt.Sprintf(`{"binaries":{"%s": "%s"}}`, osArch(), tc.url)}
+			cfg.PreDownloadUpgrade(info)
+			if !tc.staged {
+				// nothing is left behind for the download at the upgrade height
+				_, err := os.Stat(cfg.UpgradeDir("amazonas"))
+				assert.True(t, os.IsNotExist(err))
+				return
+			}
+			require.NoError(t, EnsureBinary(cfg.UpgradeBin("amazonas")))
+			// at the height, the staged binary is used
+			require.NoError(t, DoUpgrade(&Config{Home: home, Name: "autod", UnsafeSkipBackup: true}, info))
+			assert.Equal(t, cfg.UpgradeBin("amazonas"), cfg.CurrentBin())
+		})
+	}
+}
+
+func TestPlanDetectorPreDownloads(t *testing.T) {
+	home, err := copyTestData("download")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	binary, err := filepath.Abs(filepath.FromSlash("./testdata/repo/raw_binary/autod"))
+	require.NoError(t, err)
+
+	info := fmt.Sprintf(`{"binaries":{"%s": "%s"}}`, osArch(), binary)
+	srv := httptest.NewServer(&planNode{height: 10, plan: encodeCurrentPlan("amazonas", 1000, info)})
+	defer srv.Close()
+
+	cfg := &Config{Home: home, Name: "autod", RPCAddress: srv.URL, AllowDownloadBinaries: true, PreDownload: true}
+	upgrade, err := cfg.NewPlanDetector().Check()
+	require.NoError(t, err)
+	assert.Nil(t, upgrade)
+	assert.Eventually(t, func() bool {
+		downloading.Lock()
+		defer downloading.Unlock()
+		return EnsureBinary(cfg.UpgradeBin("amazonas")) == nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// preSwitch runs DAEMON_PRE_SWITCH_COMMAND once the daemon stopped for an upgrade, before current is switched to
+// it, eg. to snapshot the data volume or stop a relayer running along. The upgrade is aborted if it fails.
+func (cfg *Config) preSwitch(info *UpgradeInfo) error {
+	if cfg.PreSwitchCommand == "" {
+		return nil
+	}
+	env := map[string]string{
+		"COSMOSD_UPGRADE_NAME":    info.Name,
+		"COSMOSD_UPGRADE_HEIGHT":  strconv.FormatInt(info.Height, 10),
+		"COSMOSD_BINARY":          cfg.UpgradeBin(info.Name),
+		"COSMOSD_CURRENT_BINARY":  cfg.CurrentBin(),
+		"COSMOSD_CURRENT_UPGRADE": cfg.currentUpgradeName(),
+	}
+	if err := RunHook(cfg.PreSwitchCommand, env); err != nil {
+		cfg.Notify(Event{
+			Type:    "pre_switch_failed",
+			Message: fmt.Sprintf("the pre-switch hook of upgrade %s failed, not switching to it: %v", info.Name, err),
+			Fields:  map[string]string{"UPGRADE": info.Name, "ERROR": err.Error()},
+		})
+		return errors.Wrapf(err, "pre-switch hook of %s failed, not switching", info.Name)
+	}
+	return nil
+}
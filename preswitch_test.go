@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreSwitchHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as hook")
+	}
+	cases := map[string]struct {
+		exit int
+		err  bool
+	}{
+		"switched": {},
+		"aborted":  {exit: 1, err: true},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			home, err := copyTestData("validate")
+			require.NoError(t, err)
+			defer os.RemoveAll(home)
+			calls := filepath.Join(home, "calls")
+			hook := filepath.Join(home, "pre-switch")
+			script := fmt.Sprintf("#!/bin/sh\necho \"$COSMOSD_UPGRADE_NAME $COSMOSD_UPGRADE_HEIGHT $COSMOSD_BINARY $COSMOSD_CURRENT_UPGRADE $COSMOSD_CURRENT_BINARY\" > %s\nexit %d\n", calls, tc.exit)
+			require.NoError(t, ioutil.WriteFile(hook, []byte(script), 0755))
+			cfg := &Config{Home: home, Name: "dummyd", PreSwitchCommand: hook}
+
+			err = DoUpgrade(cfg, &UpgradeInfo{Name: "chain2", Height: 49})
+			bz, readErr := ioutil.ReadFile(calls)
+			require.NoError(t, readErr)
+			// the hook sees current before the switch
+			assert.Equal(t, fmt.Sprintf("chain2 49 %s genesis %s\n", cfg.UpgradeBin("chain2"), cfg.GenesisBin()), string(bz))
+			if tc.err {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), "pre-switch hook of chain2 failed")
+				assert.Equal(t, cfg.GenesisBin(), cfg.CurrentBin())
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, cfg.UpgradeBin("chain2"), cfg.CurrentBin())
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// the exit codes of `pre-upgrade`, as the sdk documents them
+const (
+	// preUpgradeNotImplemented is what a binary without the command exits with
+	preUpgradeNotImplemented = 1
+	// preUpgradeFailed may not be retried, the node must not start
+	preUpgradeFailed = 30
+	// preUpgradeRetry may be retried, up to DAEMON_PREUPGRADE_MAX_RETRIES times
+	preUpgradeRetry = 31
+)
+
+// preUpgrade runs `pre-upgrade` of the binary current was just switched to, so it migrates the config or state before
+// it starts. If it fails for good, we halt: the daemon would start without the migration otherwise.
+func (cfg *Config) preUpgrade(upgradeName string) error {
+	if !cfg.PreUpgrade {
+		return nil
+	}
+	for attempt := 0; ; attempt++ {
+		code, output, err := cfg.runPreUpgrade()
+		switch {
+		case err != nil:
+			return errors.Wrap(err, "running pre-upgrade")
+		case code == 0:
+			logger.Printf("pre-upgrade of %s succeeded", upgradeName)
+			return nil
+		case code == preUpgradeNotImplemented:
+			logger.Printf("%s has no pre-upgrade, starting it right away", upgradeName)
+			return nil
+		case code == preUpgradeRetry && attempt < cfg.PreUpgradeRetries:
+			logger.Printf("pre-upgrade of %s failed, retrying (%d/%d)", upgradeName, attempt+1, cfg.PreUpgradeRetries)
+			continue
+		}
+		fatal := &FatalError{
+			Pattern: "pre-upgrade",
+			Line:    fmt.Sprintf("pre-upgrade of %s exited with %d on attempt %d: %s", upgradeName, code, attempt+1, output),
+			Time:    time.Now(),
+		}
+		if err := cfg.Halt(fatal); err != nil {
+			logger.Printf("cannot record halt: %v", err)
+		}
+		return fatal
+	}
+}
+
+// runPreUpgrade runs `pre-upgrade` of the current binary (in the jailer, if any) and returns its exit code, and the end
+// of its output. err is only set if it could not run at all.
+func (cfg *Config) runPreUpgrade() (int, string, error) {
+	cmd, _, err := cfg.Command(cfg.CurrentBin(), []string{"pre-upgrade"})
+	if err != nil {
+		return 0, "", err
+	}
+	if err := withOverrideEnv(cmd, cfg.CurrentBin()); err != nil {
+		return 0, "", err
+	}
+	var out bytes.Buffer
+	cmd.Stdout = io.MultiWriter(os.Stdout, &out)
+	cmd.Stderr = io.MultiWriter(os.Stderr, &out)
+	err = cmd.Run()
+	output := strings.TrimSpace(out.String())
+	if len(output) > smokeTestTail {
+		output = "..." + output[len(output)-smokeTestTail:]
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode(), output, nil
+	}
+	return 0, output, err
+}
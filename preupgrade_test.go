@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreUpgrade(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as daemon")
+	}
+	cases := map[string]struct {
+		disabled bool
+		// the exit codes of the attempts, the last one repeats
+		codes   []int
+		retries int
+		runs    int
+		halted  bool
+	}{
+		"disabled":            {disabled: true, codes: []int{30}},
+		"succeeded":           {codes: []int{0}, runs: 1},
+		"not implemented":     {codes: []int{1}, runs: 1},
+		"failed":              {codes: []int{30}, retries: 3, runs: 1, halted: true},
+		"retried":             {codes: []int{31, 31, 0}, retries: 2, runs: 3},
+		"out of retries":      {codes: []int{31}, retries: 2, runs: 3, halted: true},
+		"retry not permitted": {codes: []int{31, 0}, runs: 1, halted: true},
+		"unknown exit code":   {codes: []int{2}, retries: 2, runs: 1, halted: true},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			home, err := copyTestData("validate")
+			require.NoError(t, err)
+			defer os.RemoveAll(home)
+			cfg := &Config{Home: home, Name: "dummyd", PreUpgrade: !tc.disabled, PreUpgradeRetries: tc.retries}
+			runs := filepath.Join(home, "runs")
+			codes := fmt.Sprint(tc.codes)
+			script := fmt.Sprintf(`#!/bin/sh
+[ "$1" = pre-upgrade ] || exit 0
+echo run >> %s
+n=$(wc -l < %s)
+i=1
+for code in %s; do
+	[ $i -eq $n ] && break
+	i=$((i+1))
+done
+exit $code
+`, runs, runs, codes[1:len(codes)-1])
+			require.NoError(t, ioutil.WriteFile(cfg.UpgradeBin("chain2"), []byte(script), 0755))
+
+			err = DoUpgrade(cfg, &UpgradeInfo{Name: "chain2"})
+			bz, _ := ioutil.ReadFile(runs)
+			assert.Equal(t, tc.runs, len(bz)/len("run\n"))
+			// current is switched either way, but doesn't start after a failed pre-upgrade
+			assert.Equal(t, cfg.UpgradeBin("chain2"), cfg.CurrentBin())
+			halted, haltErr := cfg.Halted()
+			require.NoError(t, haltErr)
+			if tc.halted {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), "pre-upgrade of chain2 exited")
+				require.NotNil(t, halted)
+				assert.Equal(t, "pre-upgrade", halted.Pattern)
+			} else {
+				require.NoError(t, err)
+				assert.Nil(t, halted)
+			}
+		})
+	}
+}
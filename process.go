@@ -3,23 +3,87 @@ package main
 import (
 	"bufio"
 	"io"
+	"os"
 	"os/exec"
+	"regexp"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
+// errStopped is returned by LaunchProcess if the daemon stopped for SIGINT or SIGTERM, which we exit with
+var errStopped = errors.New("stopped by signal")
+
+// errRestarted is returned by LaunchProcess if the daemon was stopped to be restarted at once, eg. from top
+var errRestarted = errors.New("restart requested")
+
 // LaunchProcess runs a subprocess and returns when the subprocess exits,
 // either when it dies, or *after* a successful upgrade.
 func LaunchProcess(cfg *Config, args []string, stdout, stderr io.Writer) error {
+	// never restart a node that we halted, until the operator looked at it
+	halted, err := cfg.Halted()
+	if err != nil {
+		return err
+	}
+	if halted != nil {
+		return errors.Errorf("halted at %s after %s, remove %s to start again",
+			halted.Time.Format(time.RFC3339), halted.Error(), cfg.HaltFile())
+	}
+
 	bin := cfg.CurrentBin()
-	err := EnsureBinary(bin)
+	err = EnsureBinary(bin)
 	if err != nil {
 		return errors.Wrap(err, "current binary invalid")
 	}
 
-	cmd := exec.Command(bin, args...)
+	// a validator may only start if it holds the lease
+	if cfg.HasLease() {
+		if err := cfg.AcquireLease(); err != nil {
+			return errors.Wrap(err, "cannot acquire lease")
+		}
+	}
+
+	// settings which only apply to this upgrade
+	overrides, err := LoadOverrides(bin)
+	if err != nil {
+		return errors.Wrap(err, "loading overrides")
+	}
+	if !overrides.Empty() {
+		logger.Printf("applying overrides of %s: %d env vars, args %v, %d rewrites", bin, len(overrides.Env), overrides.Args,
+			len(overrides.Rewrites))
+		args = append(append([]string{}, overrides.Apply(args)...), overrides.Args...)
+	}
+
+	// stop exactly at the next upgrade we know of, rather than relying on the daemon to panic
+	args = cfg.withHaltHeight(args)
+	// and let x/upgrade skip the plans the operator gave up on, as we do
+	args = cfg.withSkipUpgrades(args)
+
+	// nothing should be left to download at the height of a planned upgrade
+	go cfg.StagePlannedUpgrades()
+
+	// what the chain must look like after the upgrade we run
+	expectation, err := LoadExpectation(bin)
+	if err != nil {
+		return errors.Wrap(err, "loading expectation")
+	}
+	if expectation != nil && !cfg.usesRPC("expect") {
+		logger.Printf("%s of %s is only checked if %s is set (and expect not in %s)", expectFile, bin,
+			cfg.envName("DAEMON_RPC_ADDRESS"), cfg.envName("DAEMON_RPC_DISABLE"))
+	}
+
+	cmd, jail, err := cfg.Command(bin, args)
+	if err != nil {
+		return err
+	}
+	if err := withOverrideEnv(cmd, bin); err != nil {
+		return err
+	}
+	// our input is the input of the daemon, for its prompts (eg. the passphrase of the os keyring)
+	cmd.Stdin = os.Stdin
 	outpipe, err := cmd.StdoutPipe()
 	if err != nil {
 		return err
@@ -28,16 +92,182 @@ func LaunchProcess(cfg *Config, args []string, stdout, stderr io.Writer) error {
 	if err != nil {
 		return err
 	}
-	scanOut := bufio.NewScanner(io.TeeReader(outpipe, stdout))
-	scanErr := bufio.NewScanner(io.TeeReader(errpipe, stderr))
+	scanOut := NewLineScanner(io.TeeReader(metrics.Reader("stdout", outpipe, cfg.ScannerStall), io.MultiWriter(stdout, outputLog.Writer("stdout"))), cfg.MaxLineLength)
+	scanErr := NewLineScanner(io.TeeReader(metrics.Reader("stderr", errpipe, cfg.ScannerStall), io.MultiWriter(stderr, outputLog.Writer("stderr"))), cfg.MaxLineLength)
 
+	// the file may remain from the last upgrade, so we remember it before the daemon can touch it
+	upgradeFile := NewUpgradeInfoWatcher(cfg.UpgradeInfoFile())
+	heights := cfg.NewHeights()
+	trigger := cfg.NewTrigger(heights)
+	defer trigger.Stop()
+	oom := WatchOOM()
 	err = cmd.Start()
 	if err != nil {
-		return errors.Wrapf(err, "launching process %s %s", bin, strings.Join(args, " "))
+		return errors.Wrapf(err, "launching process %s", quoteArgs(append([]string{bin}, args...)))
+	}
+
+	daemonStarted(cmd.Process.Pid)
+	reportDetached(cmd.Process.Pid)
+	if cfg.ChildPIDFile != "" {
+		if err := writePIDFile(cfg.ChildPIDFile, cmd.Process.Pid); err != nil {
+			logger.Printf("cannot write pid of the daemon: %v", err)
+		}
+	}
+
+	// what the daemon runs with, for when something goes wrong
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	launch := &Launch{Binary: bin, Args: args, Jailer: jail, Env: redactEnv(env)}
+	if err := cfg.RecordHistory(HistoryEntry{Type: "launched", Upgrade: cfg.currentUpgradeName(), Launch: launch}); err != nil {
+		logger.Printf("cannot record history: %v", err)
+	}
+
+	// a signal to stop is the daemon's to handle, we exit once it did
+	var stopMutex sync.Mutex
+	var stopSignal os.Signal
+	stopForwarding := forwardSignals(cmd, func(sig os.Signal) {
+		stopMutex.Lock()
+		defer stopMutex.Unlock()
+		if stopSignal == nil {
+			logger.Printf("received %s, waiting for the daemon to stop", sig)
+			stopSignal = sig
+		}
+	})
+	defer stopForwarding()
+
+	done := make(chan struct{})
+	go oom.Track(cmd, done)
+	// the hook of an upgrade is for the node it runs, not for a command like export
+	var postUpgrade sync.WaitGroup
+	if len(args) > 0 && args[0] == "start" {
+		postUpgrade.Add(1)
+		go func() {
+			defer postUpgrade.Done()
+			cfg.runPostUpgrade(bin, heights, done)
+		}()
+	}
+	lost := make(chan error, 1)
+	if cfg.HasLease() {
+		go cfg.RenewLease(cmd, done, lost)
+	}
+	if expectation != nil && cfg.usesRPC("expect") {
+		go cfg.WatchExpectation(expectation, cfg.currentUpgradeName(), done)
+	}
+	watch := func(line string) error {
+		heights.Observe(line)
+		return cfg.watchLine(line)
+	}
+	stalled := make(chan error, 1)
+	if watchdog := cfg.NewWatchdog(heights); watchdog != nil {
+		watch = func(line string) error {
+			heights.Observe(line)
+			watchdog.Observe(line)
+			return cfg.watchLine(line)
+		}
+		go watchdog.Run(cmd, done, stalled)
 	}
 
+	// a line in the output may be anyone's, eg. the memo of a tx
+	detectors := cfg.NewDetectors(upgradeFile, trigger, heights, cfg.NewPlanDetector())
+	confirm := func(info *UpgradeInfo) error {
+		if cfg.ConfirmHeight {
+			if err := cfg.confirmHeight(heights, info); err != nil {
+				return err
+			}
+		}
+		return detectors.Accept("log", info)
+	}
+	var inject <-chan string
+	if cfg.detects("inject") {
+		inject = injections
+	}
+	restarted := make(chan error, 1)
+	go func() {
+		select {
+		case <-restarts:
+			restarted <- errRestarted
+			StopProcess(cmd, cfg.ShutdownSignal, cfg.ShutdownGrace, done, NewStopMarkers(nil))
+		case <-done:
+		}
+	}()
+
 	// three ways to exit - command ends, find regexp in scanOut, find regexp in scanErr
-	upgradeInfo, err := WaitForUpgradeOrExit(cmd, scanOut, scanErr)
+	upgradeInfo, err := WaitForUpgradeOrExit(cmd, scanOut, scanErr, WaitOptions{
+		Grace:        cfg.ShutdownGrace,
+		Signal:       cfg.ShutdownSignal,
+		Watch:        watch,
+		Poll:         detectors.Poll,
+		PollInterval: cfg.PollInterval,
+		StopMarkers:  cfg.StopMarkers,
+		Skip:         cfg.skipsUpgrade,
+		Inject:       inject,
+		Accept:       detectors.Accept,
+		Confirm:      confirm,
+	})
+	close(done)
+	postUpgrade.Wait()
+	stopForwarding()
+	// the daemon is gone, even if we upgrade before launching it again
+	daemonExited()
+	if cfg.ChildPIDFile != "" {
+		removePIDFile(cfg.ChildPIDFile, cmd.Process.Pid)
+	}
+	stopMutex.Lock()
+	stopped := stopSignal
+	stopMutex.Unlock()
+	if stopped != nil {
+		logger.Printf("daemon stopped after %s (%v)", stopped, err)
+		return errStopped
+	}
+	select {
+	case leaseErr := <-lost:
+		return errors.Wrap(leaseErr, "lost lease, stopped process")
+	case stallErr := <-stalled:
+		return stallErr
+	case restartErr := <-restarted:
+		return restartErr
+	default:
+	}
+	if oomErr := oom.Check(cmd, err); oomErr != nil {
+		cfg.reportOOM(oomErr)
+		return oomErr
+	}
+	if fatal, ok := err.(*FatalError); ok {
+		if haltErr := cfg.Halt(fatal); haltErr != nil {
+			logger.Printf("cannot record halt: %v", haltErr)
+		}
+		return err
+	}
+	// a trigger waiting for its height applies once the daemon cleanly stopped there, eg. at its --halt-height
+	if upgradeInfo == nil && err == nil && cfg.detects("trigger") {
+		if pending, triggerErr := cfg.PendingTrigger(); triggerErr != nil {
+			logger.Printf("cannot read trigger: %v", triggerErr)
+		} else if pending != nil && (pending.Height <= 0 || heights.stoppedAt("trigger", pending)) && detectors.Accept("trigger", pending) == nil {
+			logger.Printf("daemon exited, applying triggered upgrade %s", pending.Name)
+			upgradeInfo = pending
+		}
+	}
+	// as does the schedule, if the daemon cleanly stopped at the --halt-height we gave it
+	if upgradeInfo == nil && err == nil && cfg.HaltAtUpgrade && cfg.detects("rpc") {
+		if scheduled, scheduleErr := cfg.ScheduledPlan(); scheduleErr != nil {
+			logger.Printf("cannot read schedule: %v", scheduleErr)
+		} else if scheduled != nil && heights.stoppedAt("plan", scheduled) && detectors.Accept("rpc", scheduled) == nil {
+			logger.Printf("daemon halted, applying scheduled upgrade %s", scheduled.Name)
+			upgradeInfo = scheduled
+		}
+	}
+	// and the planned upgrade, if the daemon cleanly stopped at the --halt-height for it
+	if upgradeInfo == nil && err == nil && cfg.detects("planned") {
+		if planned, plannedErr := cfg.NextPlannedUpgrade(); plannedErr != nil {
+			logger.Printf("cannot read planned upgrades: %v", plannedErr)
+		} else if planned != nil && haltHeight(args) == planned.Height && heights.stoppedAt("planned", planned) &&
+			detectors.Accept("planned", planned) == nil {
+			logger.Printf("daemon halted, applying planned upgrade %s", planned.Name)
+			upgradeInfo = planned
+		}
+	}
 	if err != nil {
 		return err
 	}
@@ -56,16 +286,37 @@ type WaitResult struct {
 	// access is wrapped by mutex and should only be done through methods
 	err   error
 	info  *UpgradeInfo
+	fatal error
 	mutex sync.Mutex
 }
 
 // AsResult reads the data protected by mutex to avoid race conditions
+// A fatal error wins over anything else
 func (u *WaitResult) AsResult() (*UpgradeInfo, error) {
 	u.mutex.Lock()
 	defer u.mutex.Unlock()
+	if u.fatal != nil {
+		return nil, u.fatal
+	}
 	return u.info, u.err
 }
 
+// Fatal returns the error of the line watcher, if it made us stop the process
+func (u *WaitResult) Fatal() error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.fatal
+}
+
+// SetFatal records the first error returned by the line watcher, which made us stop the process
+func (u *WaitResult) SetFatal(err error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.fatal == nil {
+		u.fatal = err
+	}
+}
+
 // SetError will set with the first error using a mutex
 // don't set it once info is set, that means we chose to kill the process
 func (u *WaitResult) SetError(myErr error) {
@@ -87,39 +338,230 @@ func (u *WaitResult) SetUpgrade(up *UpgradeInfo) {
 	}
 }
 
+// WaitOptions control how WaitForUpgradeOrExit treats the process
+type WaitOptions struct {
+	// Grace is the time the process gets to shut down cleanly after Signal (SIGTERM unless set) before it is killed
+	Grace  time.Duration
+	Signal syscall.Signal
+	// Watch is passed every line of output, if it returns an error, the process is stopped
+	// and that error returned
+	Watch func(line string) error
+	// Poll is called every PollInterval while the process runs, and once after it exited.
+	// If it returns upgrade info, we stop the process just like for a matching line.
+	Poll         func() (*UpgradeInfo, error)
+	PollInterval time.Duration
+	// StopMarkers are the lines the process prints once it is safe to kill, after we asked it to stop.
+	// Grace remains the longest we wait for them.
+	StopMarkers []*regexp.Regexp
+	// Skip is true for upgrades we ignore, both in the output and from Poll
+	Skip func(info *UpgradeInfo) bool
+	// Confirm checks an upgrade found in the output, if it returns an error, the upgrade is ignored
+	Confirm func(info *UpgradeInfo) error
+	// Inject receives lines which are matched as if the process printed them, but not watched
+	Inject <-chan string
+	// Accept checks an injected upgrade against the other detectors, if it returns an error, the upgrade is ignored
+	Accept func(detector string, info *UpgradeInfo) error
+}
+
 // WaitForUpgradeOrExit listens to both output streams of the process, as well as the process state itself
 // When it returns, the process is finished and all streams have closed.
 //
-// It returns (info, nil) if an upgrade should be initiated (and we killed the process)
+// It returns (info, nil) if an upgrade should be initiated (and we stopped the process)
 // It returns (nil, err) if the process died by itself, or there was an issue reading the pipes
 // It returns (nil, nil) if the process exited normally without triggering an upgrade. This is very unlikely
 // to happend with "start" but may happend with short-lived commands like `gaiad export ...`
-func WaitForUpgradeOrExit(cmd *exec.Cmd, scanOut, scanErr *bufio.Scanner) (*UpgradeInfo, error) {
+// It returns (nil, err) with the error of opts.Watch, if that made us stop the process
+func WaitForUpgradeOrExit(cmd *exec.Cmd, scanOut, scanErr *bufio.Scanner, opts WaitOptions) (*UpgradeInfo, error) {
 	var res WaitResult
+	exited := make(chan struct{})
+	var scanning sync.WaitGroup
+	markers := NewStopMarkers(opts.StopMarkers)
+	stopProcess := func() {
+		StopProcess(cmd, opts.Signal, opts.Grace, exited, markers)
+	}
+	// keep passing on the output while the process shuts down, looking for the markers
+	skip := func(info *UpgradeInfo) bool {
+		if opts.Skip == nil || !opts.Skip(info) {
+			return false
+		}
+		logger.Printf("ignoring upgrade %s at height %d, it is skipped", info.Name, info.Height)
+		return true
+	}
+	confirm := func(info *UpgradeInfo) bool {
+		if opts.Confirm == nil {
+			return true
+		}
+		if err := opts.Confirm(info); err != nil {
+			logger.Printf("ignoring upgrade %s at height %d: %v", info.Name, info.Height, err)
+			return false
+		}
+		return true
+	}
+	drain := func(scan *bufio.Scanner) {
+		for scan.Scan() {
+			markers.Check(ansiEscape.ReplaceAllString(scan.Text(), ""))
+		}
+	}
 
 	waitScan := func(scan *bufio.Scanner) {
-		upgrade, err := WaitForUpdate(scanOut)
-		if err != nil {
+		defer scanning.Done()
+		var stop error
+		watch := func(line string) error {
+			markers.Check(line)
+			if opts.Watch != nil {
+				stop = opts.Watch(line)
+			}
+			return stop
+		}
+		upgrade, err := WatchOutput(scan, watch)
+		for upgrade != nil && (skip(upgrade) || !confirm(upgrade)) {
+			upgrade, err = WatchOutput(scan, watch)
+		}
+		switch {
+		case stop != nil:
+			res.SetFatal(stop)
+			go stopProcess()
+			drain(scan)
+		case err != nil:
 			res.SetError(err)
-		} else if upgrade != nil {
+		case upgrade != nil:
 			res.SetUpgrade(upgrade)
-			// now we need to kill the process
-			_ = cmd.Process.Kill()
+			// now we need to stop the process
+			go stopProcess()
+			drain(scan)
 		}
 	}
 
-	// wait for the scanners, which can trigger upgrade and kill cmd
+	poll := func() bool {
+		upgrade, err := opts.Poll()
+		if err != nil {
+			logger.Printf("polling for upgrade: %v", err)
+			return false
+		}
+		if upgrade == nil || skip(upgrade) {
+			return false
+		}
+		res.SetUpgrade(upgrade)
+		return true
+	}
+	if opts.Poll != nil {
+		interval := opts.PollInterval
+		if interval <= 0 {
+			interval = defaultPollInterval
+		}
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-exited:
+					return
+				case <-ticker.C:
+					if poll() {
+						stopProcess()
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	if opts.Inject != nil {
+		go func() {
+			for {
+				select {
+				case <-exited:
+					return
+				case line := <-opts.Inject:
+					upgrade, err := matchUpgrade(line)
+					if err != nil || upgrade == nil || skip(upgrade) {
+						logger.Printf("injected line %q is no upgrade (%v)", line, err)
+						continue
+					}
+					if opts.Accept != nil {
+						if err := opts.Accept("inject", upgrade); err != nil {
+							logger.Printf("ignoring injected upgrade %s at height %d: %v", upgrade.Name, upgrade.Height, err)
+							continue
+						}
+					}
+					logger.Printf("upgrade %s at height %d was injected", upgrade.Name, upgrade.Height)
+					res.SetUpgrade(upgrade)
+					stopProcess()
+					return
+				}
+			}
+		}()
+	}
+
+	// wait for the scanners, which can trigger upgrade and stop cmd
+	scanning.Add(2)
 	go waitScan(scanOut)
 	go waitScan(scanErr)
 
+	// all output must be read before waiting on the command, as Wait closes the pipes.
 	// if the command exits normally (eg. short command like `gaiad version`), just return (nil, nil)
-	// we often get broken read pipes if it runs too fast.
-	// if we had upgrade info, we would have killed it, and thus got a non-nil error code
+	// if we had upgrade info, we would have stopped it, and usually got a non-nil error code
+	scanning.Wait()
 	err := cmd.Wait()
+	close(exited)
+	if missing := markers.Missing(); len(missing) > 0 {
+		logger.Printf("process stopped without printing stop markers %s", strings.Join(missing, ", "))
+	}
+	// the daemon may have halted right after writing the file we poll
+	if opts.Poll != nil {
+		if info, _ := res.AsResult(); info == nil {
+			poll()
+		}
+	}
 	if err == nil {
-		return nil, nil
+		// a process that shut down cleanly after an upgrade also exits normally
+		if fatal := res.Fatal(); fatal != nil {
+			return nil, fatal
+		}
+		info, _ := res.AsResult()
+		return info, nil
 	}
 	// this will set the error code if it wasn't killed due to upgrade
 	res.SetError(err)
 	return res.AsResult()
 }
+
+// StopProcess asks the process to shut down with sig (SIGTERM if 0), and kills it if it didn't exit within grace,
+// or as soon as it printed all stop markers. With no grace period, or if it cannot be signaled,
+// it is killed right away.
+func StopProcess(cmd *exec.Cmd, sig syscall.Signal, grace time.Duration, exited <-chan struct{}, markers *StopMarkers) {
+	markers.Arm()
+	if sig == 0 {
+		sig = syscall.SIGTERM
+	}
+	if grace <= 0 || signalProcess(cmd, sig) != nil {
+		_ = signalProcess(cmd, syscall.SIGKILL)
+		return
+	}
+	select {
+	case <-exited:
+	case <-markers.Seen():
+		logger.Printf("process printed all stop markers, killing it")
+		_ = signalProcess(cmd, syscall.SIGKILL)
+	case <-time.After(grace):
+		logger.Printf("process did not stop within %s, killing it", grace)
+		_ = signalProcess(cmd, syscall.SIGKILL)
+	}
+}
+
+// shutdownSignals may stop the daemon on upgrade, by the names kill takes
+var shutdownSignals = map[string]syscall.Signal{
+	"TERM": syscall.SIGTERM,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"HUP":  syscall.SIGHUP,
+}
+
+// parseSignal reads a signal name like TERM or SIGINT
+func parseSignal(name string) (syscall.Signal, error) {
+	sig, ok := shutdownSignals[strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(name)), "SIG")]
+	if !ok {
+		return 0, errors.Errorf("%s is not one of TERM, INT, QUIT or HUP", name)
+	}
+	return sig, nil
+}
@@ -2,8 +2,12 @@ package main
 
 import (
 	"bytes"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -86,3 +90,83 @@ func TestLaunchProcessWithDownloads(t *testing.T) {
 	// and this doesn't upgrade
 	require.Equal(t, cfg.UpgradeBin("chain3"), cfg.CurrentBin())
 }
+
+// TestLaunchProcessGracefulShutdown ensures the daemon gets a chance to stop cleanly on upgrade
+func TestLaunchProcessGracefulShutdown(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+
+	script := `#!/bin/sh
+trap 'echo "Stopping cleanly"; exit 0' TERM
+trap 'echo "Interrupted cleanly"; exit 0' INT
+echo 'UPGRADE "chain2" NEEDED at height 49: {}'
+while true; do sleep 0.1; done
+`
+	cases := map[string]struct {
+		grace  time.Duration
+		signal syscall.Signal
+		output string
+	}{
+		"kill at once": {
+			output: "UPGRADE \"chain2\" NEEDED at height 49: {}\n",
+		},
+		"with grace": {
+			grace:  5 * time.Second,
+			output: "UPGRADE \"chain2\" NEEDED at height 49: {}\nStopping cleanly\n",
+		},
+		"with signal": {
+			grace:  5 * time.Second,
+			signal: syscall.SIGINT,
+			output: "UPGRADE \"chain2\" NEEDED at height 49: {}\nInterrupted cleanly\n",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cfg := &Config{Home: home, Name: "dummyd", ShutdownGrace: tc.grace, ShutdownSignal: tc.signal}
+			require.NoError(t, os.RemoveAll(filepath.Join(cfg.Root(), currentLink)))
+			require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+
+			var stdout, stderr bytes.Buffer
+			err := LaunchProcess(cfg, []string{"start"}, &stdout, &stderr)
+			require.NoError(t, err)
+			assert.Equal(t, tc.output, stdout.String())
+			assert.Equal(t, cfg.UpgradeBin("chain2"), cfg.CurrentBin())
+		})
+	}
+}
+
+// TestLaunchProcessStdin answers a prompt of the daemon on our input
+func TestLaunchProcessStdin(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+	script := "#!/bin/sh\necho 'Enter keyring passphrase:'\nread passphrase\necho \"unlocked with $passphrase\"\n"
+	require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+	_, err = w.WriteString("secret\n")
+	require.NoError(t, err)
+	w.Close()
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+
+	var stdout, stderr bytes.Buffer
+	require.NoError(t, LaunchProcess(cfg, []string{"keys", "add", "mykey"}, &stdout, &stderr))
+	assert.Equal(t, "Enter keyring passphrase:\nunlocked with secret\n", stdout.String())
+}
+
+func TestParseSignal(t *testing.T) {
+	for name, sig := range map[string]syscall.Signal{"TERM": syscall.SIGTERM, "sigint": syscall.SIGINT, " SIGQUIT": syscall.SIGQUIT} {
+		parsed, err := parseSignal(name)
+		require.NoError(t, err)
+		assert.Equal(t, sig, parsed)
+	}
+	_, err := parseSignal("KILL")
+	assert.Error(t, err)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PruneIfLowOnSpace removes the oldest backups and upgrade directories which are not in use, until at least
+// PruneMinFree bytes are available on the filesystem holding the upgrade_manager dir.
+// Only upgrades older than the current link are considered, anything staged after the last switch
+// may be a pending upgrade and is never removed. Genesis is never removed either.
+func (cfg *Config) PruneIfLowOnSpace() error {
+	if cfg.PruneMinFree == 0 {
+		return nil
+	}
+	free, err := freeSpace(cfg.Root())
+	if err != nil {
+		return err
+	}
+	if free >= cfg.PruneMinFree {
+		return nil
+	}
+
+	candidates, err := cfg.pruneCandidates()
+	if err != nil {
+		return err
+	}
+	var removed []string
+	for _, name := range candidates {
+		if free >= cfg.PruneMinFree {
+			break
+		}
+		if err := os.RemoveAll(filepath.Join(cfg.Root(), name)); err != nil {
+			return errors.Wrapf(err, "pruning %s", name)
+		}
+		removed = append(removed, name)
+		// downloaded files are only freed once no upgrade links to them
+		if err := cfg.CleanCache(); err != nil {
+			return err
+		}
+		if free, err = freeSpace(cfg.Root()); err != nil {
+			return err
+		}
+	}
+
+	if len(removed) > 0 {
+		cfg.Notify(Event{
+			Type:    "pruned",
+			Message: fmt.Sprintf("low disk space, removed: %s", strings.Join(removed, ", ")),
+			Fields:  map[string]string{"REMOVED": strings.Join(removed, ",")},
+		})
+	}
+	if free < cfg.PruneMinFree {
+		cfg.Notify(Event{
+			Type:    "low_disk",
+			Message: fmt.Sprintf("only %d bytes free in %s, nothing left to prune", free, cfg.Root()),
+		})
+	}
+	return nil
+}
+
+// pruneCandidates returns the paths (relative to Root) of all backups and upgrade directories
+// which may be removed, oldest first
+func (cfg *Config) pruneCandidates() ([]string, error) {
+	var old []string
+	modTime := make(map[string]time.Time)
+	add := func(sub string, keep func(dir os.FileInfo) bool) error {
+		dirs, err := ioutil.ReadDir(filepath.Join(cfg.Root(), sub))
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "listing %s", sub)
+		}
+		for _, dir := range dirs {
+			if dir.IsDir() && !keep(dir) {
+				rel := filepath.Join(sub, dir.Name())
+				old = append(old, rel)
+				modTime[rel] = dir.ModTime()
+			}
+		}
+		return nil
+	}
+
+	// backups are only there for a rollback, and can always go
+	if err := add(backupsDir, func(os.FileInfo) bool { return false }); err != nil {
+		return nil, err
+	}
+
+	// if we still run genesis, everything staged is still to come
+	current, since, ok := cfg.CurrentUpgradeDir()
+	if ok {
+		err := add(upgradesDir, func(dir os.FileInfo) bool {
+			path := filepath.Join(cfg.Root(), upgradesDir, dir.Name())
+			return path == current || !dir.ModTime().Before(since)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(old, func(i, j int) bool { return modTime[old[i]].Before(modTime[old[j]]) })
+	return old, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPruneIfLowOnSpace(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+
+	cfg := &Config{Home: home, Name: "dummyd"}
+	// nothing is pruned while we run genesis
+	cands, err := cfg.pruneCandidates()
+	require.NoError(t, err)
+	assert.Empty(t, cands)
+
+	require.NoError(t, cfg.SetCurrentUpgrade("chain2"))
+	age := func(name string, d time.Duration) {
+		when := time.Now().Add(d)
+		require.NoError(t, os.Chtimes(cfg.UpgradeDir(name), when, when))
+	}
+	age("chain2", -3*time.Hour)
+	age("nobin", -2*time.Hour)
+	age("chain3", -time.Hour)
+	// staged after the switch, so this is pending
+	age("noexec", time.Hour)
+
+	cands, err = cfg.pruneCandidates()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"upgrades/nobin", "upgrades/chain3"}, cands)
+
+	// backups are always fair game
+	backup := filepath.Join(cfg.Root(), backupsDir, "chain2-20200101T000000Z")
+	require.NoError(t, os.MkdirAll(backup, 0755))
+	when := time.Now().Add(-90 * time.Minute)
+	require.NoError(t, os.Chtimes(backup, when, when))
+	cands, err = cfg.pruneCandidates()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"upgrades/nobin", "backups/chain2-20200101T000000Z", "upgrades/chain3"}, cands)
+
+	// plenty of space, nothing happens
+	require.NoError(t, cfg.PruneIfLowOnSpace())
+	cfg.PruneMinFree = 1
+	require.NoError(t, cfg.PruneIfLowOnSpace())
+	assertUpgrades(t, cfg, "chain2", "chain3", "nobin", "noexec")
+
+	// we can never get that much space, so all candidates go
+	cfg.PruneMinFree = math.MaxUint64
+	require.NoError(t, cfg.PruneIfLowOnSpace())
+	assertUpgrades(t, cfg, "chain2", "noexec")
+	_, err = os.Stat(backup)
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, cfg.UpgradeBin("chain2"), cfg.CurrentBin())
+	assert.NoError(t, EnsureBinary(cfg.GenesisBin()))
+}
+
+func assertUpgrades(t *testing.T, cfg *Config, expected ...string) {
+	dirs, err := ioutil.ReadDir(filepath.Join(cfg.Root(), upgradesDir))
+	require.NoError(t, err)
+	var names []string
+	for _, dir := range dirs {
+		names = append(names, dir.Name())
+	}
+	assert.Equal(t, expected, names)
+}
+
+func TestParseByteSize(t *testing.T) {
+	cases := map[string]struct {
+		input  string
+		expect uint64
+		isErr  bool
+	}{
+		"plain":    {input: "1024", expect: 1024},
+		"bytes":    {input: "17B", expect: 17},
+		"kilo":     {input: "4k", expect: 4096},
+		"mega":     {input: "10 MB", expect: 10 << 20},
+		"giga":     {input: "1.5GB", expect: 3 << 29},
+		"tera":     {input: "2T", expect: 2 << 40},
+		"negative": {input: "-5MB", isErr: true},
+		"garbage":  {input: "lots", isErr: true},
+		"empty":    {input: "", isErr: true},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			size, err := parseByteSize(tc.input)
+			if tc.isErr {
+				assert.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tc.expect, size)
+			}
+		})
+	}
+}
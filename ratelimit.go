@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// parseRate reads a byte rate like 10MB/s (or just 10MB)
+func parseRate(s string) (uint64, error) {
+	val := strings.TrimSpace(s)
+	for _, suffix := range []string{"/s", "/S", "ps"} {
+		val = strings.TrimSuffix(val, suffix)
+	}
+	rate, err := parseByteSize(val)
+	if err != nil || rate == 0 {
+		return 0, errors.Errorf("invalid rate: %s", s)
+	}
+	return rate, nil
+}
+
+// rateLimiter spreads reads so they add up to at most rate bytes per second
+type rateLimiter struct {
+	rate  float64
+	mutex sync.Mutex
+	// next is when the bytes read so far are due at the rate
+	next time.Time
+}
+
+// rateLimiters are shared by all downloads with the same limit, so downloading at once doesn't add up past it
+var rateLimiters = struct {
+	sync.Mutex
+	byRate map[uint64]*rateLimiter
+}{byRate: map[uint64]*rateLimiter{}}
+
+func sharedRateLimiter(rate uint64) *rateLimiter {
+	rateLimiters.Lock()
+	defer rateLimiters.Unlock()
+	l, ok := rateLimiters.byRate[rate]
+	if !ok {
+		l = &rateLimiter{rate: float64(rate)}
+		rateLimiters.byRate[rate] = l
+	}
+	return l
+}
+
+// chunk is how much to read at once, about a tenth of a second, so the rate stays even
+func (l *rateLimiter) chunk() int {
+	chunk := int(l.rate / 10)
+	if chunk < 512 {
+		chunk = 512
+	}
+	if chunk > 64*1024 {
+		chunk = 64 * 1024
+	}
+	return chunk
+}
+
+// wait blocks until n bytes just read are due at the rate, or ctx is done
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mutex.Lock()
+	now := time.Now()
+	// an idle limiter saves up nothing
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	delay := l.next.Sub(now)
+	l.mutex.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttledTransport reads the bodies of all responses at the rate of limiter
+type throttledTransport struct {
+	base    http.RoundTripper
+	limiter *rateLimiter
+}
+
+func (t *throttledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &throttledBody{ReadCloser: resp.Body, ctx: req.Context(), limiter: t.limiter}
+	return resp, nil
+}
+
+type throttledBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	limiter *rateLimiter
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+	if chunk := b.limiter.chunk(); len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if werr := b.limiter.wait(b.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
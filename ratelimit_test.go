@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	getter "github.com/hashicorp/go-getter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRate(t *testing.T) {
+	for input, want := range map[string]uint64{"10MB/s": 10 << 20, "512K": 512 << 10, " 1.5mb/s ": 3 << 19, "2MBps": 2 << 20} {
+		rate, err := parseRate(input)
+		require.NoError(t, err, input)
+		assert.Equal(t, want, rate, input)
+	}
+	for _, input := range []string{"", "0", "fast", "-1MB/s"} {
+		_, err := parseRate(input)
+		assert.Error(t, err, input)
+	}
+}
+
+func TestDownloadRateLimit(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 64<<10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "ratelimit-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	download := func(cfg *Config) time.Duration {
+		start := time.Now()
+		dest := filepath.Join(dir, "file")
+		require.NoError(t, getter.GetFile(dest, server.URL+"/file", cfg.getterOptions()...))
+		bz, err := ioutil.ReadFile(dest)
+		require.NoError(t, err)
+		assert.Equal(t, len(body), len(bz))
+		require.NoError(t, os.Remove(dest))
+		return time.Since(start)
+	}
+	assert.True(t, download(&Config{}) < 300*time.Millisecond)
+	// 64KiB at 128KiB/s take half a second, less the first chunk
+	took := download(&Config{DownloadRateLimit: 128 << 10})
+	assert.True(t, took >= 400*time.Millisecond, took.String())
+	assert.True(t, took < 2*time.Second, took.String())
+}
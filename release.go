@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const releaseNotesFile = "release-notes.md"
+
+// ReleaseRef points to a tagged release on a code hosting site, eg. github://owner/repo@tag
+type ReleaseRef struct {
+	Scheme string
+	// Host is the instance of self-hosted sites (gitlab, gitea), github references have none
+	Host string
+	// Repo is the path of the repository, eg. owner/repo
+	Repo string
+	Tag  string
+}
+
+// Release lists what was published under a tag
+type Release struct {
+	Assets []Asset
+	Notes  string
+}
+
+// Asset is a downloadable file of a release
+type Asset struct {
+	Name string
+	URL  string
+	// Digest is "sha256:<hex>", if known
+	Digest string
+}
+
+// Artifact is the asset of a release we picked for this platform
+type Artifact struct {
+	// URL downloads the asset, with the checksum set if the release lists one
+	URL string
+	// SHA256Sums is the url of a checksum manifest of the release, if it has no digest for the asset
+	SHA256Sums string
+	Notes      string
+}
+
+// Fetcher looks up the release a reference points to, using the API of the hosting site
+type Fetcher interface {
+	Fetch(ref *ReleaseRef) (*Release, error)
+}
+
+// fetcher returns the Fetcher for the scheme of a release reference, or nil if it is no such reference
+func (cfg *Config) fetcher(scheme string) Fetcher {
+	switch scheme {
+	case "github":
+		return &githubFetcher{api: cfg.GitHubAPI, token: cfg.GitHubToken, client: cfg.downloadClient()}
+	case "gitlab":
+		return &gitlabFetcher{token: cfg.GitLabToken, client: cfg.downloadClient()}
+	case "gitea":
+		return &giteaFetcher{token: cfg.GiteaToken, client: cfg.downloadClient()}
+	default:
+		return nil
+	}
+}
+
+// releaseSchemes are the schemes of release references we have a Fetcher for
+var releaseSchemes = map[string]bool{"github": true, "gitlab": true, "gitea": true}
+
+// isReleaseRef returns true if raw is a reference one of our fetchers resolves
+func isReleaseRef(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && releaseSchemes[u.Scheme]
+}
+
+// ParseReleaseRef reads github://owner/repo@tag, or gitlab://host/group/repo@tag and gitea://host/owner/repo@tag
+// for the self-hosted sites
+func ParseReleaseRef(raw string) (*ReleaseRef, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing release reference")
+	}
+	expected := "owner/repo@tag"
+	if u.Scheme != "github" {
+		expected = "host/" + expected
+	}
+	at := strings.LastIndex(u.Path, "@")
+	if u.Host == "" || at < 0 {
+		return nil, errors.Errorf("invalid release reference %s, expected %s://%s", raw, u.Scheme, expected)
+	}
+	ref := &ReleaseRef{Scheme: u.Scheme, Repo: u.Host + strings.TrimSuffix(u.Path[:at], "/"), Tag: u.Path[at+1:]}
+	if u.Scheme != "github" {
+		ref.Host, ref.Repo = u.Host, strings.Trim(u.Path[:at], "/")
+	}
+	if strings.Count(ref.Repo, "/") < 1 || ref.Tag == "" {
+		return nil, errors.Errorf("invalid release reference %s, expected %s://%s", raw, u.Scheme, expected)
+	}
+	return ref, nil
+}
+
+// ResolveRelease fetches the referenced release and picks the asset for this platform
+func (cfg *Config) ResolveRelease(raw string) (*Artifact, error) {
+	ref, err := ParseReleaseRef(raw)
+	if err != nil {
+		return nil, err
+	}
+	fetcher := cfg.fetcher(ref.Scheme)
+	if fetcher == nil {
+		return nil, errors.Errorf("unknown release reference %s", raw)
+	}
+	release, err := fetcher.Fetch(ref)
+	if err != nil {
+		return nil, errors.Wrapf(err, "resolving %s", raw)
+	}
+	asset, err := cfg.MatchAsset(release.Assets)
+	if err != nil {
+		return nil, errors.Wrapf(err, "resolving %s", raw)
+	}
+
+	artifact := &Artifact{URL: asset.URL, Notes: release.Notes}
+	if strings.HasPrefix(asset.Digest, "sha256:") {
+		if artifact.URL, err = withChecksum(asset.URL, strings.ToLower(asset.Digest)); err != nil {
+			return nil, err
+		}
+	} else {
+		artifact.SHA256Sums = manifestAsset(release.Assets)
+	}
+	return artifact, nil
+}
+
+// writeReleaseNotes keeps the notes of the release next to the binary, for the operator to read
+func (cfg *Config) writeReleaseNotes(upgradeName string, artifact *Artifact) error {
+	if artifact.Notes == "" {
+		return nil
+	}
+	path := filepath.Join(cfg.UpgradeDir(upgradeName), releaseNotesFile)
+	return errors.Wrap(ioutil.WriteFile(path, []byte(artifact.Notes), 0644), "writing release notes")
+}
+
+var (
+	osNames = map[string][]string{
+		"linux":   {"linux"},
+		"darwin":  {"darwin", "macos", "osx", "apple"},
+		"windows": {"windows", "win64", "win"},
+	}
+	archNames = map[string][]string{
+		"amd64": {"amd64", "x64"},
+		"arm64": {"arm64", "aarch64"},
+		"386":   {"386", "i386", "x86"},
+		"arm":   {"arm", "armv7", "armhf"},
+	}
+	// x86_64 would otherwise split into x86 and 64
+	x8664 = regexp.MustCompile(`x86[_-]64`)
+	// files published next to the binaries, which are never the binary
+	notBinary = regexp.MustCompile(`(sha256sums|checksums|\.sha256|\.sha256sum|\.asc|\.sig|\.pem|\.txt|\.json|\.jsonl|\.sbom|\.spdx)$`)
+)
+
+// MatchAsset picks the one asset built for this platform, preferring those named after the daemon
+func (cfg *Config) MatchAsset(assets []Asset) (*Asset, error) {
+	return matchAsset(assets, runtime.GOOS, runtime.GOARCH, cfg.Name)
+}
+
+func matchAsset(assets []Asset, goos, goarch, name string) (*Asset, error) {
+	var matches, named []int
+	for i, asset := range assets {
+		lower := strings.ToLower(asset.Name)
+		if notBinary.MatchString(lower) {
+			continue
+		}
+		tokens := strings.FieldsFunc(x8664.ReplaceAllString(lower, "amd64"), func(r rune) bool {
+			return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9')
+		})
+		if !hasToken(tokens, osNames[goos]) || !hasToken(tokens, archNames[goarch]) {
+			continue
+		}
+		matches = append(matches, i)
+		if name != "" && strings.Contains(lower, strings.ToLower(name)) {
+			named = append(named, i)
+		}
+	}
+	if len(named) > 0 {
+		matches = named
+	}
+	switch len(matches) {
+	case 0:
+		return nil, errors.Wrapf(errNoArtifact, "no asset for %s/%s in release", goos, goarch)
+	case 1:
+		return &assets[matches[0]], nil
+	default:
+		names := make([]string, len(matches))
+		for i, m := range matches {
+			names[i] = assets[m].Name
+		}
+		return nil, errors.Errorf("several assets for %s/%s in release: %s", goos, goarch, strings.Join(names, ", "))
+	}
+}
+
+func hasToken(tokens, want []string) bool {
+	for _, t := range tokens {
+		for _, w := range want {
+			if t == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// manifestAsset returns the url of the checksum manifest in assets, if there is one
+func manifestAsset(assets []Asset) string {
+	for _, asset := range assets {
+		lower := strings.ToLower(asset.Name)
+		if strings.HasSuffix(lower, "sha256sums") || strings.HasSuffix(lower, "sha256sums.txt") || strings.HasSuffix(lower, "checksums.txt") {
+			return asset.URL
+		}
+	}
+	return ""
+}
+
+// getJSON sends the request and decodes a successful json response into v
+func getJSON(client *http.Client, req *http.Request, v interface{}) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "requesting %s", req.URL)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return &statusError{url: req.URL.String(), status: resp.Status, msg: strings.TrimSpace(string(msg))}
+	}
+	return errors.Wrapf(json.NewDecoder(resp.Body).Decode(v), "parsing response of %s", req.URL)
+}
+
+// statusError is a server answering, but not with what we asked for
+type statusError struct {
+	url, status, msg string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s returned %s: %s", e.url, e.status, e.msg)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseReleaseRef(t *testing.T) {
+	cases := map[string]struct {
+		input  string
+		expect ReleaseRef
+		isErr  bool
+	}{
+		"github":        {input: "github://cosmos/gaia@v4.2.1", expect: ReleaseRef{Scheme: "github", Repo: "cosmos/gaia", Tag: "v4.2.1"}},
+		"nested repo":   {input: "github://org/group/repo@v1", expect: ReleaseRef{Scheme: "github", Repo: "org/group/repo", Tag: "v1"}},
+		"no tag":        {input: "github://cosmos/gaia", isErr: true},
+		"empty tag":     {input: "github://cosmos/gaia@", isErr: true},
+		"no repo":       {input: "github://cosmos@v1", isErr: true},
+		"missing host":  {input: "github:///gaia@v1", isErr: true},
+		"gitlab":        {input: "gitlab://gitlab.com/group/sub/chain@v2.0.0", expect: ReleaseRef{Scheme: "gitlab", Host: "gitlab.com", Repo: "group/sub/chain", Tag: "v2.0.0"}},
+		"gitea":         {input: "gitea://codeberg.org/team/chain@v2", expect: ReleaseRef{Scheme: "gitea", Host: "codeberg.org", Repo: "team/chain", Tag: "v2"}},
+		"gitea no host": {input: "gitea://team/chain@v2", isErr: true},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			ref, err := ParseReleaseRef(tc.input)
+			if tc.isErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expect, *ref)
+		})
+	}
+}
+
+func TestMatchAsset(t *testing.T) {
+	assets := func(names ...string) []Asset {
+		res := make([]Asset, len(names))
+		for i, n := range names {
+			res[i] = Asset{Name: n, URL: "https://example.com/" + n}
+		}
+		return res
+	}
+
+	cases := map[string]struct {
+		assets []Asset
+		goos   string
+		goarch string
+		expect string
+		isErr  bool
+	}{
+		"goreleaser": {
+			assets: assets("gaiad_4.2.1_Linux_x86_64.tar.gz", "gaiad_4.2.1_Darwin_x86_64.tar.gz", "gaiad_4.2.1_Linux_arm64.tar.gz", "checksums.txt"),
+			goos:   "linux", goarch: "amd64",
+			expect: "gaiad_4.2.1_Linux_x86_64.tar.gz",
+		},
+		"arm64 alias": {
+			assets: assets("gaiad-v4.2.1-linux-amd64", "gaiad-v4.2.1-linux-aarch64"),
+			goos:   "linux", goarch: "arm64",
+			expect: "gaiad-v4.2.1-linux-aarch64",
+		},
+		"macos": {
+			assets: assets("gaiad-linux-amd64", "gaiad-macos-amd64.zip"),
+			goos:   "darwin", goarch: "amd64",
+			expect: "gaiad-macos-amd64.zip",
+		},
+		"x86_64 is not 386": {
+			assets: assets("gaiad-linux-x86_64"),
+			goos:   "linux", goarch: "386",
+			isErr: true,
+		},
+		"skips checksums and signatures": {
+			assets: assets("gaiad-linux-amd64.sha256", "gaiad-linux-amd64.asc", "gaiad-linux-amd64"),
+			goos:   "linux", goarch: "amd64",
+			expect: "gaiad-linux-amd64",
+		},
+		"prefers daemon name": {
+			assets: assets("gaiacli-linux-amd64", "gaiad-linux-amd64"),
+			goos:   "linux", goarch: "amd64",
+			expect: "gaiad-linux-amd64",
+		},
+		"ambiguous": {
+			assets: assets("gaiad-linux-amd64", "gaiad-linux-amd64.tar.gz"),
+			goos:   "linux", goarch: "amd64",
+			isErr: true,
+		},
+		"no match": {
+			assets: assets("gaiad-windows-amd64.exe"),
+			goos:   "linux", goarch: "amd64",
+			isErr: true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			asset, err := matchAsset(tc.assets, tc.goos, tc.goarch, "gaiad")
+			if tc.isErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expect, asset.Name)
+		})
+	}
+}
+
+func TestSelfHostedFetchers(t *testing.T) {
+	cases := map[string]struct {
+		path     string
+		header   string
+		token    string
+		response string
+		fetcher  func(srv *httptest.Server) Fetcher
+	}{
+		"gitlab": {
+			path:     "/api/v4/projects/group%2Fchain/releases/v2.0.0",
+			header:   "PRIVATE-TOKEN",
+			token:    "s3cret",
+			response: `{"description":"notes","assets":{"links":[{"name":"chaind-linux-amd64","url":"https://gitlab.example.com/-/releases/1","direct_asset_url":"https://gitlab.example.com/bin"},{"name":"SHA256SUMS","url":"https://gitlab.example.com/sums"}]}}`,
+			fetcher: func(srv *httptest.Server) Fetcher {
+				return &gitlabFetcher{token: "s3cret", client: srv.Client()}
+			},
+		},
+		"gitea": {
+			path:     "/api/v1/repos/group/chain/releases/tags/v2.0.0",
+			header:   "Authorization",
+			token:    "token s3cret",
+			response: `{"body":"notes","assets":[{"name":"chaind-linux-amd64","browser_download_url":"https://gitlab.example.com/bin"},{"name":"SHA256SUMS","browser_download_url":"https://gitlab.example.com/sums"}]}`,
+			fetcher: func(srv *httptest.Server) Fetcher {
+				return &giteaFetcher{token: "s3cret", client: srv.Client()}
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.EscapedPath() != tc.path || r.Header.Get(tc.header) != tc.token {
+					http.NotFound(w, r)
+					return
+				}
+				fmt.Fprint(w, tc.response)
+			}))
+			defer srv.Close()
+
+			ref := &ReleaseRef{Scheme: name, Host: srv.Listener.Addr().String(), Repo: "group/chain", Tag: "v2.0.0"}
+			release, err := tc.fetcher(srv).Fetch(ref)
+			require.NoError(t, err)
+			assert.Equal(t, "notes", release.Notes)
+			assert.Equal(t, []Asset{
+				{Name: "chaind-linux-amd64", URL: "https://gitlab.example.com/bin"},
+				{Name: "SHA256SUMS", URL: "https://gitlab.example.com/sums"},
+			}, release.Assets)
+			assert.Equal(t, "https://gitlab.example.com/sums", manifestAsset(release.Assets))
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// historyLaunches is how many launched entries the history keeps at most, a daemon restarted in a loop
+// would fill it up otherwise
+const historyLaunches = 20
+
+// retainHistory drops the entries older than HistoryMaxAge, the launches past the newest historyLaunches, and then
+// the oldest past HistoryMaxEntries. Upgrades are always kept, they are few and fleet-compare compares them.
+func (cfg *Config) retainHistory(entries []HistoryEntry, now time.Time) ([]HistoryEntry, int) {
+	launches := 0
+	for _, entry := range entries {
+		if entry.Type == "launched" {
+			launches++
+		}
+	}
+	expired := func(i int) bool {
+		if entries[i].Type == "launched" && launches > historyLaunches {
+			launches--
+			return true
+		}
+		return entries[i].Type != "upgraded" && cfg.HistoryMaxAge > 0 && now.Sub(entries[i].Time) > cfg.HistoryMaxAge
+	}
+	var kept []HistoryEntry
+	others := 0
+	for i := range entries {
+		if !expired(i) {
+			kept = append(kept, entries[i])
+			if entries[i].Type != "upgraded" {
+				others++
+			}
+		}
+	}
+	// drop oldest first, until few enough are left
+	excess := others - cfg.HistoryMaxEntries
+	if cfg.HistoryMaxEntries > 0 && excess > 0 {
+		trimmed := kept[:0]
+		for _, entry := range kept {
+			if excess > 0 && entry.Type != "upgraded" {
+				excess--
+				continue
+			}
+			trimmed = append(trimmed, entry)
+		}
+		kept = trimmed
+	}
+	return kept, len(entries) - len(kept)
+}
+
+// expiredBackups returns the backups (relative to Root) older than BackupsMaxAge, or past the newest BackupsKeep
+func (cfg *Config) expiredBackups(now time.Time) ([]string, error) {
+	dirs, err := ioutil.ReadDir(filepath.Join(cfg.Root(), backupsDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing %s", backupsDir)
+	}
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].ModTime().After(dirs[j].ModTime()) })
+	var expired []string
+	kept := 0
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		if (cfg.BackupsKeep > 0 && kept >= cfg.BackupsKeep) || (cfg.BackupsMaxAge > 0 && now.Sub(dir.ModTime()) > cfg.BackupsMaxAge) {
+			expired = append(expired, filepath.Join(backupsDir, dir.Name()))
+			continue
+		}
+		kept++
+	}
+	return expired, nil
+}
+
+// Compaction is what a compaction removed, or would remove
+type Compaction struct {
+	History int
+	Backups []string
+}
+
+// Compact applies the retention of the history and the backups. With dryRun, nothing is removed.
+func (cfg *Config) Compact(now time.Time, dryRun bool) (*Compaction, error) {
+	var res Compaction
+	entries, err := cfg.History()
+	if err != nil {
+		return nil, err
+	}
+	kept, dropped := cfg.retainHistory(entries, now)
+	res.History = dropped
+	if dropped > 0 && !dryRun {
+		if err := cfg.writeHistory(kept); err != nil {
+			return nil, err
+		}
+	}
+
+	if res.Backups, err = cfg.expiredBackups(now); err != nil {
+		return nil, err
+	}
+	if dryRun {
+		return &res, nil
+	}
+	for _, backup := range res.Backups {
+		if err := os.RemoveAll(filepath.Join(cfg.Root(), backup)); err != nil {
+			return nil, errors.Wrapf(err, "removing %s", backup)
+		}
+	}
+	return &res, nil
+}
+
+// compactBackups removes the expired backups after an upgrade made a new one, a failure is only logged
+func (cfg *Config) compactBackups() {
+	expired, err := cfg.expiredBackups(time.Now())
+	if err != nil {
+		logger.Printf("cannot apply backup retention: %v", err)
+		return
+	}
+	for _, backup := range expired {
+		logger.Printf("removing %s, past its retention", backup)
+		if err := os.RemoveAll(filepath.Join(cfg.Root(), backup)); err != nil {
+			logger.Printf("cannot remove %s: %v", backup, err)
+		}
+	}
+}
+
+// cmdMaintenance applies the retention of history and backups right away, -dry-run only lists what would go
+func cmdMaintenance(cfg *Config, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("maintenance", flag.ContinueOnError)
+	flags.SetOutput(out)
+	dryRun := flags.Bool("dry-run", false, "only list what would be removed")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	res, err := cfg.Compact(time.Now(), *dryRun)
+	if err != nil {
+		return err
+	}
+	verb := "removed"
+	if *dryRun {
+		verb = "would remove"
+	}
+	fmt.Fprintf(out, "history: %s %d entries\n", verb, res.History)
+	for _, backup := range res.Backups {
+		fmt.Fprintf(out, "backups: %s %s\n", verb, backup)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetainHistory(t *testing.T) {
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	entries := []HistoryEntry{
+		{Time: now.Add(-10 * day), Type: "upgraded", Upgrade: "chain2"},
+		{Time: now.Add(-9 * day), Type: "launched", Upgrade: "chain2"},
+		{Time: now.Add(-3 * day), Type: "launched", Upgrade: "chain2"},
+		{Time: now.Add(-2 * day), Type: "upgraded", Upgrade: "chain3"},
+		{Time: now.Add(-1 * day), Type: "launched", Upgrade: "chain3"},
+	}
+	types := func(entries []HistoryEntry) []string {
+		var res []string
+		for _, e := range entries {
+			res = append(res, e.Type+" "+e.Upgrade+" "+now.Sub(e.Time).String())
+		}
+		return res
+	}
+
+	cases := map[string]struct {
+		maxAge     time.Duration
+		maxEntries int
+		expected   []string
+	}{
+		"no limits": {
+			expected: types(entries),
+		},
+		"by age": {
+			maxAge:   5 * day,
+			expected: []string{"upgraded chain2 240h0m0s", "launched chain2 72h0m0s", "upgraded chain3 48h0m0s", "launched chain3 24h0m0s"},
+		},
+		"by count": {
+			maxEntries: 1,
+			expected:   []string{"upgraded chain2 240h0m0s", "upgraded chain3 48h0m0s", "launched chain3 24h0m0s"},
+		},
+		"both": {
+			maxAge:     2 * day,
+			maxEntries: 5,
+			expected:   []string{"upgraded chain2 240h0m0s", "upgraded chain3 48h0m0s", "launched chain3 24h0m0s"},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cfg := &Config{HistoryMaxAge: tc.maxAge, HistoryMaxEntries: tc.maxEntries}
+			kept, dropped := cfg.retainHistory(append([]HistoryEntry{}, entries...), now)
+			assert.Equal(t, tc.expected, types(kept))
+			assert.Equal(t, len(entries)-len(tc.expected), dropped)
+		})
+	}
+}
+
+func TestRetainLaunches(t *testing.T) {
+	now := time.Now()
+	var entries []HistoryEntry
+	for i := 0; i < historyLaunches+5; i++ {
+		entries = append(entries, HistoryEntry{Time: now.Add(time.Duration(i) * time.Minute), Type: "launched"})
+	}
+	entries = append(entries, HistoryEntry{Time: now, Type: "upgraded", Upgrade: "chain2"})
+
+	// even without any retention configured, only the newest launches are kept
+	kept, dropped := (&Config{}).retainHistory(entries, now)
+	assert.Equal(t, 5, dropped)
+	require.Len(t, kept, historyLaunches+1)
+	assert.Equal(t, entries[5], kept[0])
+	assert.Equal(t, "upgraded", kept[historyLaunches].Type)
+}
+
+func TestMaintenance(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd", HistoryMaxEntries: 1, BackupsKeep: 1, BackupsMaxAge: 30 * 24 * time.Hour}
+
+	now := time.Now()
+	for i, age := range []time.Duration{0, time.Hour, 2 * time.Hour} {
+		dir := filepath.Join(cfg.Root(), backupsDir, "chain"+string(rune('2'+i)))
+		require.NoError(t, os.MkdirAll(dir, 0755))
+		require.NoError(t, os.Chtimes(dir, now.Add(-age), now.Add(-age)))
+	}
+	// written without retention, as by an older version
+	require.NoError(t, cfg.writeHistory([]HistoryEntry{
+		{Time: now.Add(-time.Hour), Type: "launched"},
+		{Time: now, Type: "launched"},
+		{Time: now, Type: "upgraded", Upgrade: "chain2"},
+	}))
+
+	var out bytes.Buffer
+	require.NoError(t, cmdMaintenance(cfg, []string{"-dry-run"}, &out))
+	assert.Equal(t, "history: would remove 1 entries\nbackups: would remove backups/chain3\nbackups: would remove backups/chain4\n", out.String())
+	entries, err := cfg.History()
+	require.NoError(t, err)
+	assert.Len(t, entries, 3)
+
+	out.Reset()
+	require.NoError(t, cmdMaintenance(cfg, nil, &out))
+	assert.Equal(t, "history: removed 1 entries\nbackups: removed backups/chain3\nbackups: removed backups/chain4\n", out.String())
+	entries, err = cfg.History()
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.DirExists(t, filepath.Join(cfg.Root(), backupsDir, "chain2"))
+	_, err = os.Stat(filepath.Join(cfg.Root(), backupsDir, "chain3"))
+	assert.True(t, os.IsNotExist(err))
+
+	// and it is applied to every new entry
+	require.NoError(t, cfg.RecordHistory(HistoryEntry{Type: "launched"}))
+	entries, err = cfg.History()
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const currentPlanPath = "/cosmos.upgrade.v1beta1.Query/CurrentPlan"
+
+// PlanDetector polls the node for the upgrade plan x/upgrade has scheduled. It reports the upgrade once x/upgrade
+// stopped the node in BeginBlock of the upgrade height, which leaves it at the block before (and with tendermint
+// catching the panic, still serving its rpc). Stopping it any earlier would keep x/upgrade from writing
+// upgrade-info.json, which the new binary loads its store upgrades from.
+type PlanDetector struct {
+	cfg    *Config
+	client *http.Client
+	// plan is the last plan we saw, and height the last height the node reported
+	mutex  sync.Mutex
+	plan   *UpgradeInfo
+	height int64
+}
+
+// NewPlanDetector returns a detector querying cfg.RPCAddress, or nil if none is configured (or it is disabled)
+func (cfg *Config) NewPlanDetector() *PlanDetector {
+	if !cfg.usesRPC("plan") {
+		return nil
+	}
+	return &PlanDetector{cfg: cfg, client: cfg.rpcClient()}
+}
+
+// Check queries the current plan, and returns it once the upgrade height is (about to be) reached
+func (d *PlanDetector) Check() (*UpgradeInfo, error) {
+	plan, height, err := d.query()
+	// the node isn't up yet, just halted, or doesn't serve its rpc to us
+	d.cfg.rpcResult(err)
+	if err != nil {
+		return nil, nil
+	}
+	d.height = height
+
+	// skipped plans are announced once, but never prepared for nor applied
+	skipped := d.cfg.skipsUpgrade(plan)
+	if plan != nil && (d.plan == nil || *d.plan != *plan) {
+		d.cfg.Notify(Event{
+			Type:    "upgrade_scheduled",
+			Message: fmt.Sprintf("upgrade %s scheduled at height %d, now at %d", plan.Name, plan.Height, height),
+			Fields:  map[string]string{"UPGRADE": plan.Name, "HEIGHT": strconv.FormatInt(plan.Height, 10)},
+		})
+		if skipped {
+			logger.Printf("upgrade %s at height %d is skipped", plan.Name, plan.Height)
+		} else if d.cfg.PreDownload && d.cfg.AllowDownloadBinaries && !d.cfg.isCurrentUpgrade(plan.Name) {
+			go d.cfg.PreDownloadUpgrade(plan)
+		}
+		// the next launch of the daemon halts at this plan
+		if d.cfg.HaltAtUpgrade && !skipped && !d.cfg.isCurrentUpgrade(plan.Name) {
+			if err := d.cfg.Schedule(plan); err != nil {
+				logger.Printf("cannot record schedule: %v", err)
+			}
+		}
+	}
+	// a plan which is gone was cancelled (or applied), so the next launch must not halt for it
+	if plan == nil {
+		d.cfg.cancelSchedule()
+	}
+	d.mutex.Lock()
+	d.plan = plan
+	d.mutex.Unlock()
+	// the new binary still reports the plan, until it applied it
+	if plan != nil && !skipped && !d.cfg.isCurrentUpgrade(plan.Name) && (height >= plan.Height || (height == plan.Height-1 && d.reachedPlan(plan))) {
+		return plan, nil
+	}
+	return nil, nil
+}
+
+// reachedPlan returns whether x/upgrade ran BeginBlock of the plan height, as it wrote upgrade-info.json for the plan
+func (d *PlanDetector) reachedPlan(plan *UpgradeInfo) bool {
+	info, err := readUpgradeFile(d.cfg.UpgradeInfoFile())
+	return err == nil && info != nil && info.Name == plan.Name && info.Height == plan.Height
+}
+
+// Plan returns the last plan the node reported, whether or not it is due
+func (d *PlanDetector) Plan() *UpgradeInfo {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.plan
+}
+
+// abciQueryResponse is the part of the tendermint rpc response we need
+type abciQueryResponse struct {
+	Result struct {
+		Response struct {
+			Code   int    `json:"code"`
+			Log    string `json:"log"`
+			Value  string `json:"value"`
+			Height string `json:"height"`
+		} `json:"response"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+		Data    string `json:"data"`
+	} `json:"error"`
+}
+
+// query returns the scheduled plan (nil if there is none), and the height it was queried at
+func (d *PlanDetector) query() (*UpgradeInfo, int64, error) {
+	endpoint := strings.TrimSuffix(d.cfg.RPCAddress, "/") + "/abci_query?path=" + url.QueryEscape(`"`+currentPlanPath+`"`)
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "creating request")
+	}
+	var res abciQueryResponse
+	if err := getJSON(d.client, req, &res); err != nil {
+		return nil, 0, err
+	}
+	if res.Error != nil {
+		return nil, 0, errors.Errorf("abci_query failed: %s %s", res.Error.Message, res.Error.Data)
+	}
+	resp := res.Result.Response
+	if resp.Code != 0 {
+		return nil, 0, errors.Errorf("abci_query failed with code %d: %s", resp.Code, resp.Log)
+	}
+	height, err := parseHeight(resp.Height)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "parsing query height")
+	}
+	bz, err := base64.StdEncoding.DecodeString(resp.Value)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "decoding query value")
+	}
+	plan, err := decodeCurrentPlan(bz)
+	return plan, height, err
+}
+
+// decodeCurrentPlan reads the protobuf encoded QueryCurrentPlanResponse:
+//
+//	message QueryCurrentPlanResponse { Plan plan = 1; }
+//	message Plan { string name = 1; google.protobuf.Timestamp time = 2; int64 height = 3; string info = 4; ... }
+func decodeCurrentPlan(bz []byte) (*UpgradeInfo, error) {
+	var planBz []byte
+	err := protoFields(bz, func(field int, varint uint64, data []byte) {
+		if field == 1 {
+			planBz = data
+		}
+	})
+	if err != nil || planBz == nil {
+		return nil, errors.Wrap(err, "decoding current plan")
+	}
+	var plan UpgradeInfo
+	var height uint64
+	err = protoFields(planBz, func(field int, varint uint64, data []byte) {
+		switch field {
+		case 1:
+			plan.Name = string(data)
+		case 3:
+			height = varint
+		case 4:
+			plan.Info = string(data)
+		}
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding plan")
+	}
+	if plan.Name == "" {
+		return nil, errors.New("plan without name")
+	}
+	// int64 on the chain, so anything larger is a negative height
+	if height > math.MaxInt64 {
+		return nil, errors.Errorf("plan %s has invalid height %d", plan.Name, int64(height))
+	}
+	plan.Height = int64(height)
+	return &plan, nil
+}
+
+// protoFields calls fn for every field of the protobuf message, with the value of varints,
+// or the content of length delimited fields. Fixed size fields are skipped.
+func protoFields(bz []byte, fn func(field int, varint uint64, data []byte)) error {
+	for len(bz) > 0 {
+		key, n := protoVarint(bz)
+		if n == 0 {
+			return errors.New("invalid field key")
+		}
+		bz = bz[n:]
+		field, wireType := int(key>>3), key&7
+		switch wireType {
+		case 0:
+			v, n := protoVarint(bz)
+			if n == 0 {
+				return errors.New("invalid varint")
+			}
+			fn(field, v, nil)
+			bz = bz[n:]
+		case 1, 5:
+			size := 8
+			if wireType == 5 {
+				size = 4
+			}
+			if len(bz) < size {
+				return errors.New("truncated message")
+			}
+			bz = bz[size:]
+		case 2:
+			l, n := protoVarint(bz)
+			if n == 0 || uint64(len(bz)-n) < l {
+				return errors.New("truncated message")
+			}
+			fn(field, 0, bz[n:n+int(l)])
+			bz = bz[n+int(l):]
+		default:
+			return errors.Errorf("unsupported wire type %d", wireType)
+		}
+	}
+	return nil
+}
+
+// protoVarint returns the varint at the start of bz and its length, or a length of 0 if it is invalid
+func protoVarint(bz []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < len(bz) && i < 10; i++ {
+		v |= uint64(bz[i]&0x7f) << (7 * uint(i))
+		if bz[i] < 0x80 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
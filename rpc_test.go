@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// protoField encodes a length delimited field, or a varint if data is nil
+func protoField(field int, varint uint64, data []byte) []byte {
+	appendVarint := func(bz []byte, v uint64) []byte {
+		for v >= 0x80 {
+			bz = append(bz, byte(v)|0x80)
+			v >>= 7
+		}
+		return append(bz, byte(v))
+	}
+	if data == nil {
+		return appendVarint(appendVarint(nil, uint64(field)<<3), varint)
+	}
+	bz := appendVarint(appendVarint(nil, uint64(field)<<3|2), uint64(len(data)))
+	return append(bz, data...)
+}
+
+func encodeCurrentPlan(name string, height int, info string) []byte {
+	var plan []byte
+	plan = append(plan, protoField(1, 0, []byte(name))...)
+	// the deprecated time, which we skip
+	plan = append(plan, protoField(2, 0, protoField(1, 1600000000, nil))...)
+	plan = append(plan, protoField(3, uint64(height), nil)...)
+	plan = append(plan, protoField(4, 0, []byte(info))...)
+	return protoField(1, 0, plan)
+}
+
+func TestDecodeCurrentPlan(t *testing.T) {
+	plan, err := decodeCurrentPlan(encodeCurrentPlan("v7-Seven", 8375044, `{"binaries":{}}`))
+	require.NoError(t, err)
+	assert.Equal(t, &UpgradeInfo{Name: "v7-Seven", Height: 8375044, Info: `{"binaries":{}}`}, plan)
+
+	// no plan scheduled
+	plan, err = decodeCurrentPlan(nil)
+	require.NoError(t, err)
+	assert.Nil(t, plan)
+
+	_, err = decodeCurrentPlan(encodeCurrentPlan("v7", 100, "")[:8])
+	assert.Error(t, err)
+}
+
+// planNode serves the current plan over a fake tendermint rpc, at the stored height
+type planNode struct {
+	height int64
+	plan   []byte
+}
+
+func (n *planNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/abci_query" || r.URL.Query().Get("path") != `"`+currentPlanPath+`"` {
+		http.NotFound(w, r)
+		return
+	}
+	fmt.Fprintf(w, `{"jsonrpc":"2.0","id":-1,"result":{"response":{"code":0,"value":"%s","height":"%d"}}}`,
+		base64.StdEncoding.EncodeToString(n.plan), atomic.LoadInt64(&n.height))
+}
+
+func TestPlanDetector(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+
+	node := &planNode{height: 90, plan: encodeCurrentPlan("chain2", 100, "{}")}
+	srv := httptest.NewServer(node)
+	defer srv.Close()
+
+	cfg := &Config{Home: home, Name: "dummyd", RPCAddress: srv.URL}
+	d := cfg.NewPlanDetector()
+	info, err := d.Check()
+	require.NoError(t, err)
+	assert.Nil(t, info)
+
+	// the block before the upgrade is committed, but x/upgrade didn't get to BeginBlock of the upgrade height yet
+	atomic.StoreInt64(&node.height, 99)
+	info, err = d.Check()
+	require.NoError(t, err)
+	assert.Nil(t, info)
+
+	// now it did, and stopped the node
+	require.NoError(t, os.MkdirAll(cfg.DataDir(), 0755))
+	require.NoError(t, ioutil.WriteFile(cfg.UpgradeInfoFile(), []byte(`{"name":"chain2","height":100}`), 0644))
+	info, err = d.Check()
+	require.NoError(t, err)
+	assert.Equal(t, &UpgradeInfo{Name: "chain2", Height: 100, Info: "{}"}, info)
+
+	// once we switched, the plan is ignored
+	require.NoError(t, cfg.SetCurrentUpgrade("chain2"))
+	info, err = d.Check()
+	require.NoError(t, err)
+	assert.Nil(t, info)
+
+	// a node which is down is no error
+	srv.Close()
+	info, err = d.Check()
+	require.NoError(t, err)
+	assert.Nil(t, info)
+}
+
+// TestLaunchProcessPlanQuery ensures we upgrade at the plan height, even though the daemon logs nothing
+func TestLaunchProcessPlanQuery(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+
+	srv := httptest.NewServer(&planNode{height: 99, plan: encodeCurrentPlan("chain2", 100, "{}")})
+	defer srv.Close()
+
+	cfg := &Config{Home: home, Name: "dummyd", RPCAddress: srv.URL, PollInterval: 50 * time.Millisecond,
+		Detectors: []string{"rpc"}}
+	// like x/upgrade at the plan height, with tendermint catching its panic and leaving the node up
+	script := fmt.Sprintf("#!/bin/sh\nsleep 0.2\nmkdir -p %s\necho '{\"name\":\"chain2\",\"height\":100}' > %s\nwhile true; do sleep 0.1; done\n",
+		cfg.DataDir(), cfg.UpgradeInfoFile())
+	require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+
+	var stdout, stderr bytes.Buffer
+	require.NoError(t, LaunchProcess(cfg, []string{"start"}, &stdout, &stderr))
+	assert.Equal(t, cfg.UpgradeBin("chain2"), cfg.CurrentBin())
+}
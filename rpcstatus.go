@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultRPCUnavailableAfter = time.Minute
+
+// rpcFeatures are what DAEMON_RPC_ADDRESS is used for, by the name DAEMON_RPC_DISABLE turns them off with,
+// and what each falls back to without the rpc
+var rpcFeatures = map[string]string{
+	"plan":         "upgrades are only taken from the output and upgrade-info.json",
+	"trigger":      "a trigger with a height waits for the other height sources, or for the daemon to exit",
+	"planned":      "a planned upgrade waits for the other height sources, or for the daemon to exit at its --halt-height",
+	"watchdog":     "stalls are only detected from the output and the other height sources",
+	"confirm":      "upgrade lines are confirmed with the other height sources, or accepted",
+	"expect":       expectFile + " is not checked",
+	"post-upgrade": "the post-upgrade hook waits for a block in the output or the other height sources",
+}
+
+// parseRPCDisable reads the features which must not use the rpc, separated by commas
+func parseRPCDisable(value string) (map[string]bool, error) {
+	disabled := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if _, ok := rpcFeatures[name]; !ok {
+			return nil, errors.Errorf("%s is not one of %s", name, strings.Join(rpcFeatureNames(), ", "))
+		}
+		disabled[name] = true
+	}
+	return disabled, nil
+}
+
+func rpcFeatureNames() []string {
+	var names []string
+	for name := range rpcFeatures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// usesRPC is whether feature asks the node, it only relies on the output otherwise
+func (cfg *Config) usesRPC(feature string) bool {
+	return cfg.RPCAddress != "" && !cfg.RPCDisable[feature]
+}
+
+// rpcOutage tracks whether the rpc answers, for all features together, so a node with its rpc disabled or
+// firewalled gets a single warning rather than one error per query
+type rpcOutage struct {
+	mutex sync.Mutex
+	// since is when the rpc stopped answering, zero while it answers
+	since  time.Time
+	warned bool
+}
+
+var rpcHealth = &rpcOutage{}
+
+// rpcResult records the outcome of a query to the rpc. Once it has failed for RPCUnavailableAfter (the
+// daemon may just be starting), the operator is warned once what is done without it.
+func (cfg *Config) rpcResult(err error) {
+	cfg.rpcResultAt(err, time.Now())
+}
+
+func (cfg *Config) rpcResultAt(err error, now time.Time) {
+	rpcHealth.mutex.Lock()
+	defer rpcHealth.mutex.Unlock()
+	if err == nil {
+		if rpcHealth.warned {
+			logger.Printf("the rpc at %s answers again", cfg.RPCAddress)
+		}
+		rpcHealth.since, rpcHealth.warned = time.Time{}, false
+		return
+	}
+	if rpcHealth.since.IsZero() {
+		rpcHealth.since = now
+	}
+	down := now.Sub(rpcHealth.since)
+	if rpcHealth.warned || down < orDefault(cfg.RPCUnavailableAfter, defaultRPCUnavailableAfter) {
+		return
+	}
+	rpcHealth.warned = true
+	var fallbacks []string
+	for _, name := range rpcFeatureNames() {
+		if cfg.usesRPC(name) && (name != "watchdog" || cfg.StallTimeout > 0) && (name != "confirm" || cfg.ConfirmHeight) {
+			fallbacks = append(fallbacks, rpcFeatures[name])
+		}
+	}
+	cfg.Notify(Event{
+		Type: "rpc_unavailable",
+		Message: fmt.Sprintf("WARNING: the rpc at %s did not answer for %s (%v), until it does %s",
+			cfg.RPCAddress, down.Round(time.Second), err, strings.Join(fallbacks, ", ")),
+		Fields: map[string]string{"DURATION": down.Round(time.Second).String()},
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRPCDisable(t *testing.T) {
+	cases := map[string]struct {
+		input    string
+		disabled map[string]bool
+		isErr    bool
+	}{
+		"empty":   {input: "", disabled: map[string]bool{}},
+		"one":     {input: "plan", disabled: map[string]bool{"plan": true}},
+		"several": {input: "watchdog, confirm,", disabled: map[string]bool{"watchdog": true, "confirm": true}},
+		"unknown": {input: "plan,top", isErr: true},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			disabled, err := parseRPCDisable(tc.input)
+			if tc.isErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.disabled, disabled)
+		})
+	}
+}
+
+func TestUsesRPC(t *testing.T) {
+	cfg := &Config{RPCAddress: "http://localhost:26657", RPCDisable: map[string]bool{"plan": true}}
+	assert.False(t, cfg.usesRPC("plan"))
+	assert.Nil(t, cfg.NewPlanDetector())
+	assert.True(t, cfg.usesRPC("watchdog"))
+	assert.False(t, (&Config{}).usesRPC("watchdog"))
+}
+
+func TestRPCResult(t *testing.T) {
+	defer func() { rpcHealth = &rpcOutage{} }()
+	rpcHealth = &rpcOutage{}
+	cfg := &Config{RPCAddress: "http://localhost:26657", RPCUnavailableAfter: time.Minute}
+	refused := errors.New("connection refused")
+	start := time.Now()
+
+	// the daemon may just be starting
+	cfg.rpcResultAt(refused, start)
+	cfg.rpcResultAt(refused, start.Add(30*time.Second))
+	assert.False(t, rpcHealth.warned)
+
+	cfg.rpcResultAt(refused, start.Add(time.Minute))
+	assert.True(t, rpcHealth.warned)
+
+	// it answers again, a new outage is warned about again
+	cfg.rpcResultAt(nil, start.Add(2*time.Minute))
+	assert.False(t, rpcHealth.warned)
+	assert.True(t, rpcHealth.since.IsZero())
+	cfg.rpcResultAt(refused, start.Add(3*time.Minute))
+	assert.False(t, rpcHealth.warned)
+	assert.Equal(t, start.Add(3*time.Minute), rpcHealth.since)
+}
@@ -2,42 +2,242 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"math/big"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
+	"unicode"
 
 	"github.com/pkg/errors"
 )
 
-// Trim off whitespace around the info - match least greedy, grab as much space on both sides
-var upgradeRegex = regexp.MustCompile(`UPGRADE "(.*)" NEEDED at height (\d+):\s+([^\s]*)`)
+// defaultMaxLineLength is how much of a line we look at, unless DAEMON_MAX_LINE_LENGTH is set
+const defaultMaxLineLength = 1024 * 1024
 
-// UpgradeInfo is the details from the regexp
+// upgradeMatcher recognizes how a range of SDK versions announces an upgrade, be it in an info or error
+// log line, or the panic right after it. The submatches are the name and when the upgrade is due,
+// the info follows the match.
+type upgradeMatcher struct {
+	versions string
+	regexp   *regexp.Regexp
+	// height reads when the upgrade is due
+	height func(due string) (int64, error)
+}
+
+// upgradeMatchers are tried in order on every line
+var upgradeMatchers = []upgradeMatcher{
+	{
+		// "at height: 123" since v0.38, "at height 123" before. The height is anything that looks like a number,
+		// parseHeight decides if it is one.
+		versions: "height plan, v0.38 and later",
+		regexp:   regexp.MustCompile(`UPGRADE "([^"]+)" NEEDED at height:? ["']?([0-9][0-9_,.eE+]*)["']?(:\s*|$)`),
+		height:   parseHeight,
+	},
+	{
+		// plans due at a time, until v0.46 removed them. We are past it once it is printed.
+		versions: "time plan, v0.38 to v0.45",
+		regexp:   regexp.MustCompile(`UPGRADE "([^"]+)" NEEDED at time: (\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d(?:\.\d+)?(?:Z|[+-]\d\d:\d\d))(:\s*|$)`),
+		height:   func(string) (int64, error) { return 0, nil },
+	},
+}
+
+// matchUpgrade returns the upgrade announced in msg, or nil if there is none
+func matchUpgrade(msg string) (*UpgradeInfo, error) {
+	for _, m := range upgradeMatchers {
+		loc := m.regexp.FindStringSubmatchIndex(msg)
+		if loc == nil {
+			continue
+		}
+		h, err := m.height(msg[loc[4]:loc[5]])
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s format", m.versions)
+		}
+		return &UpgradeInfo{Name: msg[loc[2]:loc[3]], Height: h, Info: upgradeInfoAt(msg[loc[1]:])}, nil
+	}
+	return nil, nil
+}
+
+// logField is how text loggers append fields to the message, eg. module=x/upgrade
+var logField = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*=`)
+
+// upgradeInfoAt returns the info at the start of rest: a json object (which may contain spaces), or the next word.
+// Without info, that word is the first field the logger appended.
+func upgradeInfoAt(rest string) string {
+	if strings.HasPrefix(rest, "{") {
+		var raw json.RawMessage
+		if err := json.NewDecoder(strings.NewReader(rest)).Decode(&raw); err == nil {
+			return string(raw)
+		}
+	}
+	if i := strings.IndexFunc(rest, unicode.IsSpace); i >= 0 {
+		rest = rest[:i]
+	}
+	if logField.MatchString(rest) {
+		return ""
+	}
+	return rest
+}
+
+// ansiEscape matches the color (and other CSI or OSC) escape sequences of colored log output
+var ansiEscape = regexp.MustCompile(`\x1b(\[[0-9;?]*[ -/]*[@-~]|\][^\x07\x1b]*(\x07|\x1b\\)|[@-Z\\-_])`)
+
+// UpgradeInfo is the details from the regexp (or upgrade-info.json)
 type UpgradeInfo struct {
-	Name   string
-	Height int
-	Info   string
+	Name   string `json:"name"`
+	Height int64  `json:"height"`
+	Info   string `json:"info"`
+}
+
+// UnmarshalJSON accepts the height as a number or a string, as written by different versions of the daemon
+func (u *UpgradeInfo) UnmarshalJSON(bz []byte) error {
+	var raw struct {
+		Name   string          `json:"name"`
+		Height json.RawMessage `json:"height"`
+		Info   string          `json:"info"`
+	}
+	if err := json.Unmarshal(bz, &raw); err != nil {
+		return err
+	}
+	*u = UpgradeInfo{Name: raw.Name, Info: raw.Info}
+	if len(raw.Height) == 0 || string(raw.Height) == "null" {
+		return nil
+	}
+	h, err := parseHeight(string(raw.Height))
+	if err != nil {
+		return err
+	}
+	u.Height = h
+	return nil
+}
+
+// parseHeight reads a block height the way daemons and their loggers print it: 1234, "1234", 1_234, 1,234
+// or 1.234e+03. Anything that is not a whole number in the range of int64 is an error, never a wrong height.
+func parseHeight(s string) (int64, error) {
+	clean := strings.Trim(strings.TrimSpace(s), `"'`)
+	clean = strings.NewReplacer("_", "", ",", "").Replace(clean)
+	var h int64
+	if i := strings.IndexAny(clean, ".eE"); i >= 0 {
+		// a huge exponent would take forever to expand, and overflows anyway
+		if e := strings.IndexAny(clean, "eE"); e >= 0 {
+			if exp, err := strconv.Atoi(strings.TrimPrefix(clean[e+1:], "+")); err != nil || exp > 19 {
+				return 0, errors.Errorf("invalid height %s", s)
+			}
+		}
+		r, ok := new(big.Rat).SetString(clean)
+		if !ok || !r.IsInt() || !r.Num().IsInt64() {
+			return 0, errors.Errorf("invalid height %s", s)
+		}
+		h = r.Num().Int64()
+	} else {
+		var err error
+		if h, err = strconv.ParseInt(clean, 10, 64); err != nil {
+			return 0, errors.Errorf("invalid height %s", s)
+		}
+	}
+	if h < 0 {
+		return 0, errors.Errorf("invalid height %s", s)
+	}
+	return h, nil
 }
 
-// WaitForUpdate will listen to the scanner until a line matches upgradeRegexp.
+// WaitForUpdate will listen to the scanner until a line matches one of the upgradeMatchers.
+// Color codes are removed, and json log lines are matched on their message.
 // It returns (info, nil) on a matching line
 // It returns (nil, err) if the input stream errored
 // It returns (nil, nil) if the input closed without ever matching the regexp
 func WaitForUpdate(scanner *bufio.Scanner) (*UpgradeInfo, error) {
+	return WatchOutput(scanner, nil)
+}
+
+// WatchOutput works like WaitForUpdate, but also passes every line to watch (if not nil).
+// If watch returns an error, it stops and returns (nil, err).
+func WatchOutput(scanner *bufio.Scanner, watch func(line string) error) (*UpgradeInfo, error) {
 	for scanner.Scan() {
-		line := scanner.Text()
-		if upgradeRegex.MatchString(line) {
-			subs := upgradeRegex.FindStringSubmatch(line)
-			h, err := strconv.Atoi(subs[2])
-			if err != nil {
-				return nil, errors.Wrap(err, "parse number from regexp")
-			}
-			info := UpgradeInfo{
-				Name:   subs[1],
-				Height: h,
-				Info:   subs[3],
+		// colors would split the message, whatever the log settings of the daemon
+		line := ansiEscape.ReplaceAllString(scanner.Text(), "")
+		if watch != nil {
+			if err := watch(line); err != nil {
+				return nil, err
 			}
-			return &info, nil
+		}
+		msg := logMessage(line)
+		info, err := matchUpgrade(msg)
+		if err != nil {
+			// keep watching, the daemon may print it again (or write upgrade-info.json)
+			logger.Printf("cannot parse upgrade line %q: %v", msg, err)
+			continue
+		}
+		if info != nil {
+			metrics.Detected(line, time.Now())
+			return info, nil
 		}
 	}
 	return nil, scanner.Err()
 }
+
+// messageKeys are where json loggers (zerolog with log_format = "json", logrus, zap) put the message
+var messageKeys = []string{"message", "msg", "_msg"}
+
+// logMessage returns the message of a json log line, with all escaping removed, or the line itself
+// if it is plain text
+func logMessage(line string) string {
+	trimmed := strings.TrimSpace(line)
+	if !strings.HasPrefix(trimmed, "{") {
+		return line
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(trimmed), &fields); err != nil {
+		return line
+	}
+	for _, key := range messageKeys {
+		if msg, ok := fields[key].(string); ok {
+			return msg
+		}
+	}
+	return line
+}
+
+// NewLineScanner returns a scanner over the lines of r, which cuts lines after max bytes rather than failing
+// with "token too long", as we only look for the upgrade line (a default size is used if max is 0)
+func NewLineScanner(r io.Reader, max int) *bufio.Scanner {
+	if max <= 0 {
+		max = defaultMaxLineLength
+	}
+	size := 4096
+	if max < size {
+		size = max
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, size), max)
+	scanner.Split(truncateLines(max))
+	return scanner
+}
+
+// truncateLines works like bufio.ScanLines, but returns only the first max bytes of longer lines
+// and drops the rest of them
+func truncateLines(max int) bufio.SplitFunc {
+	skipping := false
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if skipping {
+			if i := bytes.IndexByte(data, '\n'); i >= 0 {
+				skipping = false
+				return i + 1, nil, nil
+			}
+			return len(data), nil, nil
+		}
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if len(token) > max {
+			token = token[:max]
+		}
+		if advance > 0 || token != nil || err != nil || len(data) < max {
+			return advance, token, err
+		}
+		// the buffer is full without a newline
+		skipping = true
+		return max, data[:max], nil
+	}
+}
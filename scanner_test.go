@@ -2,7 +2,9 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"io"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -33,6 +35,95 @@ func TestWaitForInfo(t *testing.T) {
 				Info:   `{"foo":123}`,
 			},
 		},
+		"json log": {
+			write: []string{`{"level":"info","module":"consensus","height":122,"message":"committed state"}` + "\n",
+				`{"level":"error","module":"x/upgrade","message":"UPGRADE \"v2\" NEEDED at height 123: {\"binaries\":{\"linux/amd64\":\"https://example.com/gaiad\"}}","time":"2020-02-03T11:22:33Z"}` + "\n"},
+			expectUpgrade: &UpgradeInfo{
+				Name:   "v2",
+				Height: 123,
+				Info:   `{"binaries":{"linux/amd64":"https://example.com/gaiad"}}`,
+			},
+		},
+		"json with msg key": {
+			write: []string{`{"level":"error","msg":"UPGRADE \"v3\" NEEDED at height 9: https://example.com/v3.json"}` + "\n"},
+			expectUpgrade: &UpgradeInfo{
+				Name:   "v3",
+				Height: 9,
+				Info:   "https://example.com/v3.json",
+			},
+		},
+		"colored": {
+			write: []string{"\x1b[90m3:04PM\x1b[0m \x1b[31mERR\x1b[0m \x1b[1mUPGRADE \"v4\" NEEDED at height \x1b[36m42\x1b[0m: \x1b[0mhttps://example.com/v4.json\x1b[0m \x1b[36mmodule=\x1b[0mx/upgrade\n"},
+			expectUpgrade: &UpgradeInfo{
+				Name:   "v4",
+				Height: 42,
+				Info:   "https://example.com/v4.json",
+			},
+		},
+		"sdk v0.44": {
+			write: []string{`UPGRADE "v5" NEEDED at height: 1_234_567: {}` + "\n"},
+			expectUpgrade: &UpgradeInfo{
+				Name:   "v5",
+				Height: 1234567,
+				Info:   "{}",
+			},
+		},
+		"scientific height": {
+			write: []string{`{"message":"UPGRADE \"v6\" NEEDED at height \"1.234567e+06\": {}"}` + "\n"},
+			expectUpgrade: &UpgradeInfo{
+				Name:   "v6",
+				Height: 1234567,
+				Info:   "{}",
+			},
+		},
+		"bad height is skipped": {
+			write: []string{`UPGRADE "v7" NEEDED at height 99999999999999999999: {}` + "\n", `UPGRADE "v7" NEEDED at height 100: {}` + "\n"},
+			expectUpgrade: &UpgradeInfo{
+				Name:   "v7",
+				Height: 100,
+				Info:   "{}",
+			},
+		},
+		"sdk v0.38 log": {
+			write: []string{`E[2020-06-01|10:02:11.123] UPGRADE "v8" NEEDED at height: 1000: {"binaries": {"linux/amd64": "https://example.com/v8"}} module=main` + "\n"},
+			expectUpgrade: &UpgradeInfo{
+				Name:   "v8",
+				Height: 1000,
+				Info:   `{"binaries": {"linux/amd64": "https://example.com/v8"}}`,
+			},
+		},
+		"sdk v0.38 panic": {
+			write: []string{"panic: UPGRADE \"v9\" NEEDED at height: 1000: https://example.com/v9.json\n", "\n", "goroutine 1 [running]:\n"},
+			expectUpgrade: &UpgradeInfo{
+				Name:   "v9",
+				Height: 1000,
+				Info:   "https://example.com/v9.json",
+			},
+		},
+		"sdk v0.40 time plan": {
+			write: []string{`E[2021-02-18|14:00:01.003] UPGRADE "v10" NEEDED at time: 2021-02-18T14:00:00Z: {} module=x/upgrade` + "\n"},
+			expectUpgrade: &UpgradeInfo{
+				Name: "v10",
+				Info: "{}",
+			},
+		},
+		"sdk v0.46 without info": {
+			write: []string{`{"level":"error","module":"x/upgrade","time":"2022-09-01T10:00:00Z","message":"UPGRADE \"v11\" NEEDED at height: 5000: "}` + "\n"},
+			expectUpgrade: &UpgradeInfo{
+				Name:   "v11",
+				Height: 5000,
+			},
+		},
+		"sdk v0.47 console": {
+			write: []string{`10:00AM ERR UPGRADE "v12" NEEDED at height: 7000: module=x/upgrade` + "\n"},
+			expectUpgrade: &UpgradeInfo{
+				Name:   "v12",
+				Height: 7000,
+			},
+		},
+		"broken json": {
+			write: []string{`{"message":"UPGRADE \"v3\" NEEDED at height 9: x"` + "\n"},
+		},
 	}
 
 	for name, tc := range cases {
@@ -61,3 +152,88 @@ func TestWaitForInfo(t *testing.T) {
 		})
 	}
 }
+
+func TestNewLineScanner(t *testing.T) {
+	long := strings.Repeat("x", 100)
+	cases := map[string]struct {
+		input string
+		lines []string
+	}{
+		"short lines": {
+			input: "one\ntwo\r\nthree",
+			lines: []string{"one", "two", "three"},
+		},
+		"long line": {
+			input: "one\n" + long + "\ntwo\n",
+			lines: []string{"one", long[:32], "two"},
+		},
+		"exactly max": {
+			input: long[:32] + "\n" + long[:33] + "\n",
+			lines: []string{long[:32], long[:32]},
+		},
+		"long last line": {
+			input: "one\n" + long,
+			lines: []string{"one", long[:32]},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			scan := NewLineScanner(strings.NewReader(tc.input), 32)
+			var lines []string
+			for scan.Scan() {
+				lines = append(lines, scan.Text())
+			}
+			assert.NoError(t, scan.Err())
+			assert.Equal(t, tc.lines, lines)
+		})
+	}
+
+	// the upgrade is still found after a line far over the default buffer of bufio.Scanner
+	input := strings.Repeat("y", 200*1024) + "\n" + `UPGRADE "big" NEEDED at height 5: info` + "\n"
+	info, err := WaitForUpdate(NewLineScanner(strings.NewReader(input), 0))
+	assert.NoError(t, err)
+	assert.Equal(t, &UpgradeInfo{Name: "big", Height: 5, Info: "info"}, info)
+}
+
+func TestParseHeight(t *testing.T) {
+	cases := map[string]struct {
+		height int64
+		isErr  bool
+	}{
+		"1234":                {height: 1234},
+		`"1234"`:              {height: 1234},
+		"1_234_567":           {height: 1234567},
+		"1,234,567":           {height: 1234567},
+		"1.234567e+06":        {height: 1234567},
+		"1234567.0":           {height: 1234567},
+		"9223372036854775807": {height: 9223372036854775807},
+		"0":                   {height: 0},
+		"9223372036854775808": {isErr: true},
+		"9.3e18":              {isErr: true},
+		"1e400000000":         {isErr: true},
+		"1.5":                 {isErr: true},
+		"-5":                  {isErr: true},
+		"12a":                 {isErr: true},
+		"":                    {isErr: true},
+	}
+
+	for input, tc := range cases {
+		t.Run(input, func(t *testing.T) {
+			h, err := parseHeight(input)
+			if tc.isErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.height, h)
+		})
+	}
+
+	var info UpgradeInfo
+	assert.NoError(t, json.Unmarshal([]byte(`{"name":"v2","height":"123","info":"{}"}`), &info))
+	assert.Equal(t, UpgradeInfo{Name: "v2", Height: 123, Info: "{}"}, info)
+	assert.NoError(t, json.Unmarshal([]byte(`{"name":"v2","height":123}`), &info))
+	assert.Equal(t, UpgradeInfo{Name: "v2", Height: 123}, info)
+	assert.Error(t, json.Unmarshal([]byte(`{"name":"v2","height":1e30}`), &info))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const scheduleFile = "schedule.json"
+
+// ScheduleFile holds the next upgrade we know the height of, so we can tell the daemon to halt there
+func (cfg *Config) ScheduleFile() string {
+	return filepath.Join(cfg.Root(), scheduleFile)
+}
+
+// Schedule remembers the plan the node reported, for the next time we launch the daemon
+func (cfg *Config) Schedule(info *UpgradeInfo) error {
+	bz, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "encode schedule")
+	}
+	return errors.Wrap(ioutil.WriteFile(cfg.ScheduleFile(), bz, 0644), "writing schedule")
+}
+
+// ScheduledPlan returns the scheduled upgrade, or nil if there is none (or we already run it)
+func (cfg *Config) ScheduledPlan() (*UpgradeInfo, error) {
+	return cfg.pendingUpgrade(cfg.ScheduleFile())
+}
+
+// releaseSchedule removes the schedule once the named upgrade was applied
+func (cfg *Config) releaseSchedule(upgradeName string) {
+	releaseUpgradeFile(cfg.ScheduleFile(), upgradeName)
+}
+
+// cancelSchedule removes the schedule once the node no longer reports its plan, which was cancelled, so the daemon
+// is not halted for it again
+func (cfg *Config) cancelSchedule() {
+	scheduled, err := cfg.ScheduledPlan()
+	if err != nil || scheduled == nil {
+		return
+	}
+	logger.Printf("upgrade %s at height %d is no longer planned on chain, removing the schedule", scheduled.Name, scheduled.Height)
+	releaseUpgradeFile(cfg.ScheduleFile(), scheduled.Name)
+}
+
+// pendingUpgrade reads the upgrade info at path, or nil if there is no file or it names the upgrade we already run
+func (cfg *Config) pendingUpgrade(path string) (*UpgradeInfo, error) {
+	info, err := readUpgradeFile(path)
+	if err != nil || info == nil || cfg.isCurrentUpgrade(info.Name) {
+		return nil, err
+	}
+	return info, nil
+}
+
+// releaseUpgradeFile removes the file at path, if it holds the named upgrade
+func releaseUpgradeFile(path, upgradeName string) {
+	if info, err := readUpgradeFile(path); err == nil && info != nil && info.Name == upgradeName {
+		os.Remove(path)
+	}
+}
+
+// readUpgradeFile reads the upgrade info at path, or nil if there is no file
+func readUpgradeFile(path string) (*UpgradeInfo, error) {
+	bz, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s", path)
+	}
+	var info UpgradeInfo
+	if err := json.Unmarshal(bz, &info); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", path)
+	}
+	if info.Name == "" {
+		return nil, errors.Errorf("%s has no upgrade name", path)
+	}
+	return &info, nil
+}
+
+// withHaltHeight appends --halt-height to `start`, so the daemon stops at the next upgrade we know of (from
+// upgrades.json, and with HaltAtUpgrade the trigger or the schedule). A plan halts it at its height: x/upgrade stops
+// the daemon in BeginBlock of that height, having written upgrade-info.json for the store upgrades of the new binary,
+// and without the plan on chain the daemon commits it. A trigger halts it right after the block before, as the new
+// binary runs its height.
+func (cfg *Config) withHaltHeight(args []string) []string {
+	if len(args) == 0 || args[0] != "start" {
+		return args
+	}
+	for _, arg := range args {
+		if arg == "--halt-height" || strings.HasPrefix(arg, "--halt-height=") {
+			return args
+		}
+	}
+	type upgradeSource struct {
+		read func() (*UpgradeInfo, error)
+		// before is how many blocks before the upgrade height to halt
+		before int64
+	}
+	// the operator planned these, so they don't wait for HaltAtUpgrade
+	sources := []upgradeSource{{read: cfg.NextPlannedUpgrade}}
+	if cfg.HaltAtUpgrade {
+		sources = append(sources, upgradeSource{read: cfg.PendingTrigger, before: 1}, upgradeSource{read: cfg.ScheduledPlan})
+	}
+	var next *UpgradeInfo
+	var halt int64
+	for _, source := range sources {
+		info, err := source.read()
+		if err != nil {
+			logger.Printf("cannot read upgrade height: %v", err)
+			continue
+		}
+		if info == nil || info.Height <= 1 || cfg.skipsUpgrade(info) {
+			continue
+		}
+		if height := info.Height - source.before; next == nil || height < halt {
+			next, halt = info, height
+		}
+	}
+	if next == nil {
+		return args
+	}
+	logger.Printf("halting the daemon at height %d for upgrade %s", halt, next.Name)
+	return append(append([]string{}, args...), "--halt-height", strconv.FormatInt(halt, 10))
+}
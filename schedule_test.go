@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithHaltHeight(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd", HaltAtUpgrade: true}
+
+	cases := map[string]struct {
+		schedule string
+		trigger  string
+		args     []string
+		expected []string
+	}{
+		"nothing known": {
+			args:     []string{"start"},
+			expected: []string{"start"},
+		},
+		"scheduled": {
+			schedule: `{"name":"chain2","height":100}`,
+			args:     []string{"start", "--x-crisis-skip-assert-invariants"},
+			expected: []string{"start", "--x-crisis-skip-assert-invariants", "--halt-height", "100"},
+		},
+		"trigger first": {
+			schedule: `{"name":"chain2","height":100}`,
+			trigger:  `{"name":"chain3","height":"50"}`,
+			args:     []string{"start"},
+			expected: []string{"start", "--halt-height", "49"},
+		},
+		"set by operator": {
+			schedule: `{"name":"chain2","height":100}`,
+			args:     []string{"start", "--halt-height=80"},
+			expected: []string{"start", "--halt-height=80"},
+		},
+		"not start": {
+			schedule: `{"name":"chain2","height":100}`,
+			args:     []string{"version"},
+			expected: []string{"version"},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			os.Remove(cfg.ScheduleFile())
+			os.Remove(cfg.TriggerFile())
+			if tc.schedule != "" {
+				require.NoError(t, ioutil.WriteFile(cfg.ScheduleFile(), []byte(tc.schedule), 0644))
+			}
+			if tc.trigger != "" {
+				require.NoError(t, ioutil.WriteFile(cfg.TriggerFile(), []byte(tc.trigger), 0644))
+			}
+			assert.Equal(t, tc.expected, cfg.withHaltHeight(tc.args))
+		})
+	}
+
+	// only if enabled
+	cfg.HaltAtUpgrade = false
+	assert.Equal(t, []string{"start"}, cfg.withHaltHeight([]string{"start"}))
+}
+
+func TestLaunchProcessHaltHeight(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+
+	// the node tells us about the plan while it runs
+	srv := httptest.NewServer(&planNode{height: 10, plan: encodeCurrentPlan("chain2", 100, "{}")})
+	defer srv.Close()
+	cfg := &Config{Home: home, Name: "dummyd", RPCAddress: srv.URL, HaltAtUpgrade: true, UnsafeSkipBackup: true}
+	_, err = cfg.NewPlanDetector().Check()
+	require.NoError(t, err)
+	plan, err := cfg.ScheduledPlan()
+	require.NoError(t, err)
+	assert.Equal(t, &UpgradeInfo{Name: "chain2", Height: 100, Info: "{}"}, plan)
+	srv.Close()
+
+	// so the next start halts at it, and we switch once it did
+	cfg.RPCAddress = ""
+	script := "#!/bin/sh\necho $@\necho '%s'\n"
+	require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte(fmt.Sprintf(script, "INF committed state app_hash=AB height=60 module=state")), 0755))
+	var stdout, stderr bytes.Buffer
+	// not where it stopped elsewhere
+	require.NoError(t, LaunchProcess(cfg, []string{"start"}, &stdout, &stderr))
+	assert.Equal(t, cfg.GenesisBin(), cfg.CurrentBin())
+	require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte(fmt.Sprintf(script, "INF committed state app_hash=AB height=100 module=state")), 0755))
+	stdout.Reset()
+	require.NoError(t, LaunchProcess(cfg, []string{"start"}, &stdout, &stderr))
+	assert.Equal(t, "start --halt-height 100\nINF committed state app_hash=AB height=100 module=state\n", stdout.String())
+	assert.Equal(t, cfg.UpgradeBin("chain2"), cfg.CurrentBin())
+	_, err = os.Stat(cfg.ScheduleFile())
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCancelledSchedule(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	srv := httptest.NewServer(&planNode{height: 10, plan: encodeCurrentPlan("chain2", 100, "{}")})
+	defer srv.Close()
+	cfg := &Config{Home: home, Name: "dummyd", RPCAddress: srv.URL, HaltAtUpgrade: true}
+	d := cfg.NewPlanDetector()
+	_, err = d.Check()
+	require.NoError(t, err)
+	assert.FileExists(t, cfg.ScheduleFile())
+
+	// the plan is cancelled on chain
+	cancelled := httptest.NewServer(&planNode{height: 20})
+	defer cancelled.Close()
+	cfg.RPCAddress = cancelled.URL
+	_, err = d.Check()
+	require.NoError(t, err)
+	_, err = os.Stat(cfg.ScheduleFile())
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, []string{"start"}, cfg.withHaltHeight([]string{"start"}))
+}
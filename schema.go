@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// SchemaVersion is the version of everything written for other tools to read: the entries of history.json, the
+// fleet-compare report, the json of the admin api and the health endpoint, and the notifications. Within a version,
+// fields are only ever added. Renaming or removing a field, or changing what it holds, needs a new version, and
+// testdata/schema keeps an example of each output of the current version, which must still read back without
+// losing anything.
+const SchemaVersion = 1
+
+// schemaHeader carries the version of json served by the admin api and the fleet-compare agent
+const schemaHeader = "Cosmosd-Schema-Version"
+
+// writeJSON serves v as json of the current schema version
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	writeJSONStatus(w, http.StatusOK, v)
+}
+
+// writeJSONStatus serves v like writeJSON, with status
+func writeJSONStatus(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(schemaHeader, strconv.Itoa(SchemaVersion))
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// checkSchema refuses what a newer cosmosd wrote, as fields may have changed meaning since. Anything without a
+// version predates versioning, which only added the version to it.
+func checkSchema(what string, version int) error {
+	if version > SchemaVersion {
+		return errors.Errorf("%s has schema version %d, this cosmosd reads up to %d", what, version, SchemaVersion)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSchemaCompatibility enforces the compatibility policy of SchemaVersion: every example of the current version
+// must still decode, without unknown fields, and encode back with all its fields. A field that is renamed or removed
+// fails here, and needs a new version with new examples.
+func TestSchemaCompatibility(t *testing.T) {
+	outputs := map[string]func() interface{}{
+		"history_entry.json":   func() interface{} { return &HistoryEntry{} },
+		"node_report.json":     func() interface{} { return &NodeReport{} },
+		"detector_status.json": func() interface{} { return &DetectorStatus{} },
+		"remote_upgrade.json":  func() interface{} { return &RemoteUpgrade{} },
+		"health.json":          func() interface{} { return &Health{} },
+		"status.json":          func() interface{} { return &Dashboard{} },
+	}
+	dir := filepath.Join("testdata", "schema", fmt.Sprintf("v%d", SchemaVersion))
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	require.NoError(t, err)
+	require.Len(t, paths, len(outputs), "every output needs an example in %s", dir)
+
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			newValue, ok := outputs[filepath.Base(path)]
+			require.True(t, ok, "no type for %s", path)
+			example, err := ioutil.ReadFile(path)
+			require.NoError(t, err)
+
+			value := newValue()
+			dec := json.NewDecoder(bytes.NewReader(example))
+			dec.DisallowUnknownFields()
+			require.NoError(t, dec.Decode(value))
+			encoded, err := json.Marshal(value)
+			require.NoError(t, err)
+
+			var want, got interface{}
+			require.NoError(t, json.Unmarshal(example, &want))
+			require.NoError(t, json.Unmarshal(encoded, &got))
+			assert.Equal(t, want, got)
+		})
+	}
+}
+
+func TestSchemaVersions(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd", AdminToken: testAdminToken}
+
+	// entries from before versioning are of the first version
+	require.NoError(t, ioutil.WriteFile(cfg.HistoryFile(), []byte(`[{"time":"2020-06-01T12:00:00Z","type":"upgraded","upgrade":"v1"}]`), 0644))
+	require.NoError(t, cfg.RecordHistory(HistoryEntry{Type: "upgraded", Upgrade: "v2"}))
+	entries, err := cfg.History()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, 1, entries[0].SchemaVersion)
+	assert.Equal(t, SchemaVersion, entries[1].SchemaVersion)
+
+	// a report of a newer cosmosd is refused
+	report := NodeReport{SchemaVersion: SchemaVersion + 1, Name: "dummyd"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, report)
+	}))
+	defer server.Close()
+	_, err = cfg.FetchReport(server.URL)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "schema version 2")
+
+	rec := httptest.NewRecorder()
+	cfg.adminHandler().ServeHTTP(rec, adminRequest("GET", detectorsPath, nil))
+	assert.Equal(t, strconv.Itoa(SchemaVersion), rec.Header().Get(schemaHeader))
+	var detectors []DetectorStatus
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &detectors))
+	require.NotEmpty(t, detectors)
+	for _, status := range detectors {
+		assert.Equal(t, SchemaVersion, status.SchemaVersion)
+	}
+	assert.Equal(t, SchemaVersion, cfg.health().SchemaVersion)
+
+	// as does the json of top
+	var out bytes.Buffer
+	require.NoError(t, cmdTop(cfg, []string{"-output", "json"}, &out))
+	var d Dashboard
+	require.NoError(t, json.Unmarshal(out.Bytes(), &d))
+	assert.Equal(t, SchemaVersion, d.SchemaVersion)
+	assert.Equal(t, "genesis", d.Upgrade)
+	require.Len(t, d.Events, 2)
+	assert.Error(t, cmdTop(cfg, []string{"-output", "yaml"}, &out))
+}
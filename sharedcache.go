@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// sharedCacheEntry is where the artifact at url is kept in DAEMON_SHARED_CACHE, by its url and checksum, under the
+// name it is staged with so its extension still tells the archive. Only http(s) artifacts with a checksum are
+// cached, as what other urls serve may change, and it must be one we can verify the entry with ourselves.
+func (cfg *Config) sharedCacheEntry(artifact string) (string, bool) {
+	if cfg.SharedCache == "" {
+		return "", false
+	}
+	staged, ok := cfg.stagedDownload(artifact)
+	if !ok {
+		return "", false
+	}
+	u, err := url.Parse(artifact)
+	if err != nil {
+		return "", false
+	}
+	if sum, err := normalizeChecksum(u.Query().Get("checksum")); err != nil || sum == "" || strings.HasPrefix(sum, "file:") {
+		return "", false
+	}
+	query := u.Query()
+	query.Del("archive")
+	query.Del("filename")
+	u.RawQuery = query.Encode()
+	hash := sha256.Sum256([]byte(u.String()))
+	return filepath.Join(cfg.SharedCache, hex.EncodeToString(hash[:16]), filepath.Base(staged)), true
+}
+
+// fromSharedCache returns the cached artifact, if another daemon (or an earlier run) downloaded it already.
+// It is verified and unpacked like a fresh download.
+func (cfg *Config) fromSharedCache(artifact string) (string, bool) {
+	entry, ok := cfg.sharedCacheEntry(artifact)
+	if !ok {
+		return "", false
+	}
+	if _, err := os.Stat(entry); err != nil {
+		return "", false
+	}
+	// keep what is used from being removed by pruneSharedCache
+	now := time.Now()
+	os.Chtimes(entry, now, now)
+	logger.Printf("using %s from the shared cache", entry)
+	return entry, true
+}
+
+// addToSharedCache keeps the staged download of artifact, once it checked out. It is linked if the cache is on the
+// same filesystem, and written to a temp file and renamed otherwise, so no one ever reads a partial entry.
+// Failures are only logged, the upgrade has its binary anyway.
+func (cfg *Config) addToSharedCache(artifact string) {
+	entry, ok := cfg.sharedCacheEntry(artifact)
+	if !ok {
+		return
+	}
+	staged, _ := cfg.stagedDownload(artifact)
+	if _, err := os.Stat(staged); err != nil {
+		return
+	}
+	if _, err := os.Stat(entry); err == nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(entry), 0755); err != nil {
+		logger.Printf("cannot add %s to the shared cache: %v", artifact, err)
+		return
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(entry), ".download-")
+	if err != nil {
+		logger.Printf("cannot add %s to the shared cache: %v", artifact, err)
+		return
+	}
+	tmp.Close()
+	os.Remove(tmp.Name())
+	if err := os.Link(staged, tmp.Name()); err != nil {
+		err = copyFile(staged, tmp.Name(), 0644)
+		if err != nil {
+			os.Remove(tmp.Name())
+			logger.Printf("cannot add %s to the shared cache: %v", artifact, err)
+			return
+		}
+	}
+	if err := os.Rename(tmp.Name(), entry); err != nil {
+		os.Remove(tmp.Name())
+		logger.Printf("cannot add %s to the shared cache: %v", artifact, err)
+		return
+	}
+	cfg.pruneSharedCache()
+}
+
+// dropFromSharedCache removes a cached artifact whose upgrade failed, if it doesn't match the checksum in the url.
+// Any other failure, eg. a full disk while unpacking it, leaves it for the next try.
+func (cfg *Config) dropFromSharedCache(artifact string) {
+	entry, ok := cfg.sharedCacheEntry(artifact)
+	if !ok {
+		return
+	}
+	u, err := url.Parse(artifact)
+	if err != nil {
+		return
+	}
+	matches, err := matchesChecksum(entry, u.Query().Get("checksum"))
+	if err == nil && !matches {
+		logger.Printf("removing %s from the shared cache, it doesn't match its checksum", entry)
+		os.Remove(entry)
+	}
+}
+
+// pruneSharedCache removes the entries which were not used for SharedCacheMaxAge, by any upgrade manager
+func (cfg *Config) pruneSharedCache() {
+	if cfg.SharedCacheMaxAge <= 0 {
+		return
+	}
+	dirs, err := ioutil.ReadDir(cfg.SharedCache)
+	if err != nil {
+		logger.Printf("cannot prune the shared cache: %v", err)
+		return
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		path := filepath.Join(cfg.SharedCache, dir.Name())
+		files, err := ioutil.ReadDir(path)
+		if err != nil {
+			continue
+		}
+		used := dir.ModTime()
+		for _, file := range files {
+			if file.ModTime().After(used) {
+				used = file.ModTime()
+			}
+		}
+		if time.Since(used) > cfg.SharedCacheMaxAge {
+			logger.Printf("removing %s from the shared cache, it was not used for %s", path, time.Since(used).Round(time.Hour))
+			os.RemoveAll(path)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSharedCache(t *testing.T) {
+	bin, err := ioutil.ReadFile("testdata/repo/raw_binary/autod")
+	require.NoError(t, err)
+	var mutex sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if r.Method == http.MethodGet {
+			requests++
+		}
+		w.Write(bin)
+	}))
+	defer server.Close()
+	cache, err := ioutil.TempDir("", "shared-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(cache)
+
+	// several daemons on one host
+	download := func(url string) *Config {
+		home, err := copyTestData("download")
+		require.NoError(t, err)
+		cfg := &Config{Home: home, Name: "autod", AllowDownloadBinaries: true, DownloadRetries: 1, SharedCache: cache}
+		info := &UpgradeInfo{Name: "amazonas", Info: fmt.Sprintf(`{"binaries":{"%s": "%s"}}`, osArch(), url)}
+		require.NoError(t, cfg.downloadWithRetries(info))
+		hash, err := sha256File(cfg.UpgradeBin("amazonas"))
+		require.NoError(t, err)
+		assert.Equal(t, autodSHA256, hash)
+		return cfg
+	}
+	url := server.URL + "/v2/autod?checksum=sha256:" + autodSHA256
+	first := download(url)
+	defer os.RemoveAll(first.Home)
+	second := download(url)
+	defer os.RemoveAll(second.Home)
+	assert.Equal(t, 1, requests)
+	entry, ok := first.sharedCacheEntry(url)
+	require.True(t, ok)
+	_, err = os.Stat(entry)
+	require.NoError(t, err)
+
+	// a corrupt entry is dropped and downloaded again
+	require.NoError(t, ioutil.WriteFile(entry, []byte("corrupt"), 0644))
+	third := download(url)
+	defer os.RemoveAll(third.Home)
+	assert.Equal(t, 2, requests)
+	hash, err := sha256File(entry)
+	require.NoError(t, err)
+	assert.Equal(t, autodSHA256, hash)
+
+	// an entry which checks out is kept, whatever else went wrong with the upgrade
+	third.dropFromSharedCache(url)
+	_, err = os.Stat(entry)
+	require.NoError(t, err)
+
+	// entries not used for a while are removed, the others kept
+	third.SharedCacheMaxAge = time.Hour
+	third.pruneSharedCache()
+	_, err = os.Stat(entry)
+	require.NoError(t, err)
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(entry, old, old))
+	require.NoError(t, os.Chtimes(filepath.Dir(entry), old, old))
+	third.pruneSharedCache()
+	_, err = os.Stat(filepath.Dir(entry))
+	assert.True(t, os.IsNotExist(err))
+
+	// without a checksum, what the url serves may change, so it is always downloaded
+	unchecked := download(server.URL + "/v2/autod")
+	defer os.RemoveAll(unchecked.Home)
+	_, ok = unchecked.sharedCacheEntry(server.URL + "/v2/autod")
+	assert.False(t, ok)
+	assert.Equal(t, 3, requests)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"debug/pe"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// codesignTeam reads the TeamIdentifier from the output of `codesign -dv`
+func codesignTeam(out string) string {
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "TeamIdentifier=") {
+			team := strings.TrimSpace(strings.TrimPrefix(line, "TeamIdentifier="))
+			if team == "not set" {
+				return ""
+			}
+			return team
+		}
+	}
+	return ""
+}
+
+// checkAuthenticode judges the status and signer subject reported by Get-AuthenticodeSignature.
+// Unsigned binaries are only refused if signatures are required.
+func checkAuthenticode(status, subject string, required bool, signer string) error {
+	switch status {
+	case "Valid":
+		if signer != "" && !strings.Contains(subject, signer) {
+			return errors.Errorf("binary signed by %s, expected %s", subject, signer)
+		}
+		return nil
+	case "NotSigned":
+		if required {
+			return errors.New("binary is not signed")
+		}
+		return nil
+	default:
+		return errors.Errorf("invalid authenticode signature: %s", status)
+	}
+}
+
+// peSigned is whether bin, a windows executable, has a certificate table, where an Authenticode signature would be.
+// It fails on other files, which may be signed another way (eg. a script).
+func peSigned(bin string) (bool, error) {
+	f, err := pe.Open(bin)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	var dirs uint32
+	var security pe.DataDirectory
+	switch header := f.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		dirs, security = header.NumberOfRvaAndSizes, header.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_SECURITY]
+	case *pe.OptionalHeader64:
+		dirs, security = header.NumberOfRvaAndSizes, header.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_SECURITY]
+	}
+	return dirs > pe.IMAGE_DIRECTORY_ENTRY_SECURITY && security.Size > 0, nil
+}
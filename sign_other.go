@@ -0,0 +1,9 @@
+//go:build !darwin && !windows
+// +build !darwin,!windows
+
+package main
+
+// prepareBinary has nothing to do, there is no platform wide signing for binaries
+func (cfg *Config) prepareBinary(dir, bin string) error {
+	return nil
+}
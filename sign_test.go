@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodesignTeam(t *testing.T) {
+	out := `Executable=/Users/val/.gaia/upgrade_manager/upgrades/v5/bin/gaiad
+Identifier=gaiad
+Format=Mach-O thin (arm64)
+CodeDirectory v=20500 size=123 flags=0x10000(runtime) hashes=3+7 location=embedded
+Signature size=8986
+Timestamp=12 Oct 2026 at 10:12:02
+Info.plist=not bound
+TeamIdentifier=7Q4W2XJ8RZ
+Runtime Version=13.0.0
+`
+	assert.Equal(t, "7Q4W2XJ8RZ", codesignTeam(out))
+	assert.Equal(t, "", codesignTeam("Executable=/bin/gaiad\nTeamIdentifier=not set\n"))
+	assert.Equal(t, "", codesignTeam("code object is not signed at all"))
+}
+
+func TestCheckAuthenticode(t *testing.T) {
+	subject := "CN=Example Chain Foundation, O=Example Chain Foundation, L=Zug, C=CH"
+	cases := map[string]struct {
+		status   string
+		subject  string
+		required bool
+		signer   string
+		valid    bool
+	}{
+		"valid":              {status: "Valid", subject: subject, valid: true},
+		"valid from signer":  {status: "Valid", subject: subject, signer: "O=Example Chain Foundation", valid: true},
+		"valid other signer": {status: "Valid", subject: subject, signer: "O=Someone Else"},
+		"unsigned":           {status: "NotSigned", valid: true},
+		"unsigned required":  {status: "NotSigned", required: true},
+		"tampered":           {status: "HashMismatch", subject: subject},
+		"untrusted":          {status: "NotTrusted", subject: subject},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := checkAuthenticode(tc.status, tc.subject, tc.required, tc.signer)
+			if tc.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+// writePE writes a windows executable without sections, with a certificate table of size
+func writePE(t *testing.T, path string, size uint32) {
+	var buf bytes.Buffer
+	dos := make([]byte, 64)
+	copy(dos, "MZ")
+	binary.LittleEndian.PutUint32(dos[0x3c:], 64)
+	buf.Write(dos)
+	buf.WriteString("PE\x00\x00")
+	header := pe.OptionalHeader64{Magic: 0x20b, NumberOfRvaAndSizes: 16}
+	header.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_SECURITY] = pe.DataDirectory{VirtualAddress: 1024, Size: size}
+	require.NoError(t, binary.Write(&buf, binary.LittleEndian, pe.FileHeader{Machine: pe.IMAGE_FILE_MACHINE_AMD64,
+		SizeOfOptionalHeader: uint16(binary.Size(header))}))
+	require.NoError(t, binary.Write(&buf, binary.LittleEndian, header))
+	require.NoError(t, ioutil.WriteFile(path, buf.Bytes(), 0755))
+}
+
+func TestPESigned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pe-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writePE(t, filepath.Join(dir, "signed.exe"), 4096)
+	signed, err := peSigned(filepath.Join(dir, "signed.exe"))
+	require.NoError(t, err)
+	assert.True(t, signed)
+
+	writePE(t, filepath.Join(dir, "unsigned.exe"), 0)
+	signed, err = peSigned(filepath.Join(dir, "unsigned.exe"))
+	require.NoError(t, err)
+	assert.False(t, signed)
+
+	// a script is no executable we can tell about
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "gaiad.ps1"), []byte("Write-Output v1\n"), 0755))
+	_, err = peSigned(filepath.Join(dir, "gaiad.ps1"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// authenticodeScript prints the status and signer of the file passed as the first argument
+const authenticodeScript = `$s = Get-AuthenticodeSignature -LiteralPath $args[0]; $s.Status.ToString(); if ($s.SignerCertificate) { $s.SignerCertificate.Subject }`
+
+// prepareBinary verifies the Authenticode signature of bin, if it has one. With DAEMON_VERIFY_SIGNATURE,
+// it must be signed (by DAEMON_SIGNER, if set).
+func (cfg *Config) prepareBinary(dir, bin string) error {
+	// powershell is slow to start, and only needed for a signature
+	if signed, err := peSigned(bin); err == nil && !signed {
+		return checkAuthenticode("NotSigned", "", cfg.VerifySignature, cfg.Signer)
+	}
+	out, err := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", authenticodeScript, bin).Output()
+	if err != nil {
+		return errors.Wrap(err, "checking authenticode signature")
+	}
+	lines := strings.SplitN(strings.TrimSpace(string(out)), "\n", 2)
+	subject := ""
+	if len(lines) > 1 {
+		subject = strings.TrimSpace(lines[1])
+	}
+	return checkAuthenticode(strings.TrimSpace(lines[0]), subject, cfg.VerifySignature, cfg.Signer)
+}
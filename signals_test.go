@@ -0,0 +1,35 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestForwardSignals stops the daemon with the SIGTERM we get, eg. from systemctl stop, and waits for it to exit
+func TestForwardSignals(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	script := "#!/bin/sh\ntrap 'sleep 0.2; echo stopped cleanly; exit 0' TERM\necho started\nwhile true; do sleep 0.05; done\n"
+	cfg := &Config{Home: home, Name: "dummyd", RestartAfterUpgrade: true}
+	require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	}()
+	var stdout, stderr bytes.Buffer
+	err = LaunchProcess(cfg, []string{"start"}, &stdout, &stderr)
+	assert.Equal(t, errStopped, err)
+	assert.Equal(t, "started\nstopped cleanly\n", stdout.String())
+}
@@ -0,0 +1,39 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// forwardSignals passes SIGINT and SIGTERM on to the daemon (or the process group of its jailer, which no longer
+// shares ours, so it misses eg. ctrl-c in a terminal), rather than letting them kill us and leave the daemon
+// orphaned, until the returned function is called. stopping is called with every signal, before it is passed on.
+func forwardSignals(cmd *exec.Cmd, stopping func(os.Signal)) func() {
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case sig := <-signals:
+				stopping(sig)
+				_ = signalProcess(cmd, sig.(syscall.Signal))
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(signals)
+			close(done)
+		})
+	}
+}
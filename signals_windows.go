@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+)
+
+// forwardSignals keeps ctrl-c from killing us before the daemon, which gets it from the console itself, until the
+// returned function is called. stopping is called with every signal.
+func forwardSignals(cmd *exec.Cmd, stopping func(os.Signal)) func() {
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case sig := <-signals:
+				stopping(sig)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(signals)
+			close(done)
+		})
+	}
+}
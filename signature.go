@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	getter "github.com/hashicorp/go-getter"
+	"github.com/pkg/errors"
+)
+
+// verifiesArtifacts is whether downloaded artifacts must carry a signature (gpg, minisign or cosign), or provenance
+func (cfg *Config) verifiesArtifacts() bool {
+	return cfg.ArtifactKeyring != "" || cfg.MinisignKey != "" || cfg.verifiesCosign() || cfg.SLSASource != ""
+}
+
+func (cfg *Config) verifiesCosign() bool {
+	return cfg.CosignIdentity != "" || cfg.CosignKey != ""
+}
+
+// artifactSignatureURL is where the signature of artifact is published by convention, the url with ext
+// (.asc, .minisig, .sigstore.json or .intoto.jsonl) added to its path, and without what only tells us how to fetch the artifact
+func artifactSignatureURL(artifact, ext string) (string, error) {
+	u, err := url.Parse(artifact)
+	if err != nil {
+		return "", errors.Wrap(err, "parsing binary url")
+	}
+	query := u.Query()
+	for _, param := range []string{"checksum", "archive", "filename"} {
+		query.Del(param)
+	}
+	u.RawQuery = query.Encode()
+	u.Path += ext
+	return u.String(), nil
+}
+
+// localArtifact returns the file an artifact was downloaded (or staged) to, so its signature can be checked
+// before it is unpacked. Only http(s) downloads are staged, other remote artifacts cannot be verified.
+func localArtifact(source string) (string, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return "", errors.Wrap(err, "parsing binary url")
+	}
+	if u.Scheme != "" && u.Scheme != "file" {
+		return "", errors.Errorf("signatures are only verified for http(s) downloads and local files, not %s", source)
+	}
+	return u.Path, nil
+}
+
+// verifyArtifact checks the artifact downloaded from artifact (to source) against its signatures, the ones given in
+// the upgrade info by verifier or else the ones published next to it, with DAEMON_ARTIFACT_KEYRING,
+// DAEMON_MINISIGN_PUBKEY and the cosign identity or key, and against its SLSA provenance (given in the upgrade info,
+// or next to it)
+func (cfg *Config) verifyArtifact(artifact, source string, signatures map[string]string, provenance string, opts []getter.ClientOption) error {
+	file, err := localArtifact(source)
+	if err != nil {
+		return err
+	}
+	tmpDir, err := ioutil.TempDir("", "upgrade-manager-signature")
+	if err != nil {
+		return errors.Wrap(err, "create tempdir for signature")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	verifiers := []struct {
+		enabled bool
+		ext     string
+		given   string
+		verify  func(sig, file string) error
+	}{
+		{enabled: cfg.ArtifactKeyring != "", ext: ".asc", given: signatures["gpg"], verify: func(sig, file string) error {
+			return verifyGPG(cfg.ArtifactKeyring, sig, file)
+		}},
+		{enabled: cfg.MinisignKey != "", ext: ".minisig", given: signatures["minisign"], verify: func(sig, file string) error {
+			return verifyMinisign(cfg.MinisignKey, sig, file)
+		}},
+		{enabled: cfg.verifiesCosign(), ext: ".sigstore.json", given: signatures["cosign"], verify: cfg.verifyCosign},
+		{enabled: cfg.SLSASource != "", ext: ".intoto.jsonl", given: provenance, verify: cfg.verifySLSA},
+	}
+	for _, v := range verifiers {
+		if !v.enabled {
+			continue
+		}
+		sigURL := v.given
+		if sigURL == "" {
+			if sigURL, err = artifactSignatureURL(artifact, v.ext); err != nil {
+				return err
+			}
+		}
+		if sigURL, err = sourceURL(sigURL); err != nil {
+			return err
+		}
+		sigPath := filepath.Join(tmpDir, "artifact"+v.ext)
+		if err := getter.GetFile(sigPath, sigURL, opts...); err != nil {
+			return errors.Wrapf(err, "downloading signature %s", sigURL)
+		}
+		if err := v.verify(sigPath, file); err != nil {
+			return errors.Wrapf(err, "verifying %s", artifact)
+		}
+	}
+	return nil
+}
+
+// verifyMinisign checks the minisign signature of file, with key being the public key or a file holding it
+func verifyMinisign(key, sig, file string) error {
+	keyArgs := []string{"-P", key}
+	if _, err := os.Stat(key); err == nil {
+		keyArgs = []string{"-p", key}
+	}
+	out, err := exec.Command("minisign", append([]string{"-V", "-q", "-m", file, "-x", sig}, keyArgs...)...).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "minisign signature invalid: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// verifyCosign checks the cosign bundle of file, signed keyless by DAEMON_COSIGN_IDENTITY at DAEMON_COSIGN_ISSUER,
+// or with the key of DAEMON_COSIGN_PUBKEY
+func (cfg *Config) verifyCosign(bundle, file string) error {
+	args := []string{"verify-blob", "--bundle", bundle}
+	if cfg.CosignKey != "" {
+		args = append(args, "--key", cfg.CosignKey)
+	}
+	if cfg.CosignIdentity != "" {
+		args = append(args, "--certificate-identity-regexp", cfg.CosignIdentity, "--certificate-oidc-issuer", cfg.CosignIssuer)
+	}
+	out, err := exec.Command("cosign", append(args, file)...).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "cosign signature invalid: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// verifySLSA checks that file was built from DAEMON_SLSA_SOURCE, by its SLSA provenance
+func (cfg *Config) verifySLSA(provenance, file string) error {
+	out, err := exec.Command("slsa-verifier", "verify-artifact", file, "--provenance-path", provenance, "--source-uri", cfg.SLSASource).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "SLSA provenance invalid: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArtifactSignatureURL(t *testing.T) {
+	sig, err := artifactSignatureURL("https://example.com/gaiad.tar.gz?checksum=sha256:abc&archive=tar.gz&token=x", ".asc")
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/gaiad.tar.gz.asc?token=x", sig)
+
+	_, err = localArtifact("s3::https://s3.amazonaws.com/bucket/gaiad")
+	assert.Error(t, err)
+	file, err := localArtifact("/tmp/downloads/gaiad?checksum=sha256:abc")
+	require.NoError(t, err)
+	assert.Equal(t, "/tmp/downloads/gaiad", file)
+}
+
+func TestDownloadSignedBinary(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg not installed")
+	}
+	if _, err := exec.LookPath("gpgv"); err != nil {
+		t.Skip("gpgv not installed")
+	}
+	dir, err := ioutil.TempDir("", "signature-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// a throwaway release key
+	gpg := func(args ...string) {
+		cmd := exec.Command("gpg", append([]string{"--homedir", dir, "--batch", "--yes"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+	require.NoError(t, os.Chmod(dir, 0700))
+	defer exec.Command("gpgconf", "--homedir", dir, "--kill", "gpg-agent").Run()
+	gpg("--passphrase", "", "--quick-gen-key", "release@example.com", "ed25519", "sign", "never")
+	keyring := filepath.Join(dir, "release.gpg")
+	gpg("--output", keyring, "--export", "release@example.com")
+
+	bin, err := ioutil.ReadFile("testdata/repo/raw_binary/autod")
+	require.NoError(t, err)
+	binPath := filepath.Join(dir, "autod")
+	require.NoError(t, ioutil.WriteFile(binPath, bin, 0755))
+	tampered := filepath.Join(dir, "tampered")
+	require.NoError(t, ioutil.WriteFile(tampered, []byte("#!/bin/sh\necho pwned\n"), 0755))
+	server := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer server.Close()
+
+	home, err := copyTestData("download")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "autod", AllowDownloadBinaries: true, ArtifactKeyring: keyring}
+	download := func(upgrade, info string) error {
+		return DownloadBinary(cfg, &UpgradeInfo{Name: upgrade, Info: info})
+	}
+
+	// unsigned is refused
+	info := fmt.Sprintf(`{"binaries":{"%s": "%s/autod"}}`, osArch(), server.URL)
+	require.Error(t, download("unsigned", info))
+	_, err = os.Stat(cfg.UpgradeBin("unsigned"))
+	assert.True(t, os.IsNotExist(err))
+
+	gpg("--armor", "--output", binPath+".asc", "--detach-sign", binPath)
+	require.NoError(t, download("signed", info))
+	hash, err := sha256File(cfg.UpgradeBin("signed"))
+	require.NoError(t, err)
+	assert.Equal(t, autodSHA256, hash)
+
+	// a binary doesn't verify against the signature of another
+	info = fmt.Sprintf(`{"binaries":{"%s": "%s/tampered"}, "signatures":{"%s": {"gpg": "%s/autod.asc"}}}`, osArch(), server.URL, osArch(), server.URL)
+	err = download("tampered", info)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "gpg signature invalid")
+	staged, ok := cfg.stagedDownload(server.URL + "/tampered")
+	require.True(t, ok)
+	_, err = os.Stat(staged)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDownloadWithProvenance(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses shell scripts as cosign and slsa-verifier")
+	}
+	dir, err := ioutil.TempDir("", "provenance-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	// both tools log their args, and refuse a pwned file
+	tools := filepath.Join(dir, "tools")
+	require.NoError(t, os.MkdirAll(tools, 0755))
+	for _, tool := range []string{"cosign", "slsa-verifier"} {
+		script := fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %s/%s.log\nfor arg; do file=\"$arg\"; done\n"+
+			"if grep -q pwned \"$file\"; then echo \"none of the signatures verified\"; exit 1; fi\n", dir, tool)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(tools, tool), []byte(script), 0755))
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", tools+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	files := filepath.Join(dir, "files")
+	require.NoError(t, os.MkdirAll(files, 0755))
+	bin, err := ioutil.ReadFile("testdata/repo/raw_binary/autod")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(files, "autod"), bin, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(files, "tampered"), []byte("#!/bin/sh\necho pwned\n"), 0755))
+	for _, name := range []string{"autod.sigstore.json", "tampered.sigstore.json", "release.intoto.jsonl"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(files, name), []byte("{}"), 0644))
+	}
+	server := httptest.NewServer(http.FileServer(http.Dir(files)))
+	defer server.Close()
+
+	home, err := copyTestData("download")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "autod", AllowDownloadBinaries: true, SLSASource: "github.com/cosmos/gaia",
+		CosignIdentity: "^https://github.com/cosmos/gaia/", CosignIssuer: "https://token.actions.githubusercontent.com"}
+	info := func(binary string) string {
+		return fmt.Sprintf(`{"binaries":{"%s": "%s/%s"}, "provenance":{"%s": "%s/release.intoto.jsonl"}}`,
+			osArch(), server.URL, binary, osArch(), server.URL)
+	}
+
+	require.NoError(t, DownloadBinary(cfg, &UpgradeInfo{Name: "v2", Info: info("autod")}))
+	hash, err := sha256File(cfg.UpgradeBin("v2"))
+	require.NoError(t, err)
+	assert.Equal(t, autodSHA256, hash)
+	cosign, err := ioutil.ReadFile(filepath.Join(dir, "cosign.log"))
+	require.NoError(t, err)
+	assert.Regexp(t, `^verify-blob --bundle \S+\.sigstore\.json --certificate-identity-regexp \^https://github.com/cosmos/gaia/ `+
+		`--certificate-oidc-issuer https://token.actions.githubusercontent.com \S+/autod\n$`, string(cosign))
+	slsa, err := ioutil.ReadFile(filepath.Join(dir, "slsa-verifier.log"))
+	require.NoError(t, err)
+	assert.Regexp(t, `^verify-artifact \S+/autod --provenance-path \S+\.intoto\.jsonl --source-uri github.com/cosmos/gaia\n$`, string(slsa))
+
+	err = DownloadBinary(cfg, &UpgradeInfo{Name: "v3", Info: info("tampered")})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cosign signature invalid")
+	_, err = os.Stat(cfg.UpgradeBin("v3"))
+	assert.True(t, os.IsNotExist(err))
+}
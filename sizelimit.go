@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// tooLargeError is a download larger than DAEMON_DOWNLOAD_MAX_SIZE, env is the name of the variable as it was set
+type tooLargeError struct {
+	what string
+	// size is 0 if not known, eg. once a body without Content-Length read past max
+	size, max uint64
+	env       string
+}
+
+func (e *tooLargeError) Error() string {
+	if e.size == 0 {
+		return fmt.Sprintf("%s is larger than %s=%d bytes", e.what, e.env, e.max)
+	}
+	return fmt.Sprintf("%s is %d bytes, larger than %s=%d bytes", e.what, e.size, e.env, e.max)
+}
+
+// sizeLimitedTransport aborts every response larger than max, as soon as the server says so or else once more
+// was read, so a wrong url never fills the disk
+type sizeLimitedTransport struct {
+	base http.RoundTripper
+	max  uint64
+	env  string
+}
+
+func (t *sizeLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	// the rest of a resumed download counts along with what we have already
+	offset, total := contentRange(resp)
+	if total < 0 && resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+	if total > 0 && uint64(total) > t.max {
+		resp.Body.Close()
+		return nil, &tooLargeError{what: redactURL(req.URL.String()), size: uint64(total), max: t.max, env: t.env}
+	}
+	resp.Body = &sizeLimitedBody{ReadCloser: resp.Body, url: redactURL(req.URL.String()), read: uint64(offset), max: t.max, env: t.env}
+	return resp, nil
+}
+
+// contentRange reads the start and the total size of a partial response, total is -1 if unknown
+func contentRange(resp *http.Response) (offset, total int64) {
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, -1
+	}
+	// bytes 100-199/1000 or bytes 100-199/*
+	value := strings.TrimPrefix(resp.Header.Get("Content-Range"), "bytes ")
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return 0, -1
+	}
+	if start, err := strconv.ParseInt(strings.SplitN(parts[0], "-", 2)[0], 10, 64); err == nil {
+		offset = start
+	}
+	total, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return offset, -1
+	}
+	return offset, total
+}
+
+type sizeLimitedBody struct {
+	io.ReadCloser
+	url       string
+	read, max uint64
+	env       string
+}
+
+func (b *sizeLimitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += uint64(n)
+	if b.read > b.max {
+		return n, &tooLargeError{what: b.url, max: b.max, env: b.env}
+	}
+	return n, err
+}
+
+// checkUpgradeSize fails if the upgrade dir holds more than DAEMON_DOWNLOAD_MAX_SIZE, for downloads which don't go
+// through our http client (eg. S3 or git), and what archives were unpacked to
+func (cfg *Config) checkUpgradeSize(upgradeName string) error {
+	if cfg.DownloadMaxSize == 0 {
+		return nil
+	}
+	var size uint64
+	err := filepath.Walk(cfg.UpgradeDir(upgradeName), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += uint64(info.Size())
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "measuring download")
+	}
+	if size > cfg.DownloadMaxSize {
+		return &tooLargeError{what: "upgrade " + upgradeName, size: size, max: cfg.DownloadMaxSize, env: cfg.envName("DAEMON_DOWNLOAD_MAX_SIZE")}
+	}
+	return nil
+}
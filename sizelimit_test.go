@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	getter "github.com/hashicorp/go-getter"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadMaxSize(t *testing.T) {
+	big := bytes.Repeat([]byte("x"), 4096)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Write(big[:512])
+		case "/big":
+			w.Write(big)
+		case "/chunked":
+			// no Content-Length, the server doesn't tell
+			for i := 0; i < 4; i++ {
+				w.Write(big[:1024])
+				w.(http.Flusher).Flush()
+			}
+		case "/range":
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 512-4095/%d", len(big)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(big[512:])
+		}
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "size-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := &Config{DownloadMaxSize: 2048}
+	dest := filepath.Join(dir, "autod")
+	require.NoError(t, getter.GetFile(dest, server.URL+"/small", cfg.getterOptions()...))
+	for _, path := range []string{"/big", "/chunked", "/range"} {
+		err := getter.GetFile(dest, server.URL+path, cfg.getterOptions()...)
+		require.Error(t, err, path)
+		assert.Contains(t, err.Error(), "larger than DAEMON_DOWNLOAD_MAX_SIZE=2048 bytes", path)
+	}
+	require.NoError(t, getter.GetFile(dest, server.URL+"/big", (&Config{}).getterOptions()...))
+
+	// the error names the variable as it was set, and can be told apart from other failures
+	prefixed := &Config{DownloadMaxSize: 2048, EnvPrefix: "GAIA"}
+	_, err = prefixed.downloadClient().Get(server.URL + "/range")
+	require.Error(t, err)
+	tooLarge, ok := errors.Cause(err.(*url.Error).Err).(*tooLargeError)
+	require.True(t, ok, err.Error())
+	assert.Equal(t, uint64(4096), tooLarge.size)
+	assert.Contains(t, err.Error(), "/range is 4096 bytes, larger than GAIA_DAEMON_DOWNLOAD_MAX_SIZE=2048 bytes")
+	resp, err := prefixed.downloadClient().Get(server.URL + "/chunked")
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	_, ok = errors.Cause(err).(*tooLargeError)
+	require.True(t, ok, fmt.Sprint(err))
+	assert.Contains(t, err.Error(), "/chunked is larger than GAIA_DAEMON_DOWNLOAD_MAX_SIZE=2048 bytes")
+
+	offset, total := contentRange(&http.Response{StatusCode: http.StatusPartialContent, Header: http.Header{"Content-Range": {"bytes 100-199/*"}}})
+	assert.Equal(t, int64(100), offset)
+	assert.Equal(t, int64(-1), total)
+
+	// what other getters downloaded, or archives were unpacked to, is measured afterwards
+	cfg.Home = dir
+	cfg.Name = "autod"
+	require.NoError(t, os.MkdirAll(filepath.Dir(cfg.UpgradeBin("v2")), 0755))
+	require.NoError(t, ioutil.WriteFile(cfg.UpgradeBin("v2"), big[:1024], 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.UpgradeDir("v2"), "lib.so"), big[:1024], 0644))
+	assert.NoError(t, cfg.checkUpgradeSize("v2"))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.UpgradeDir("v2"), "lib.so"), big[:2048], 0644))
+	err = cfg.checkUpgradeSize("v2")
+	require.Error(t, err)
+	_, ok = errors.Cause(err).(*tooLargeError)
+	assert.True(t, ok, err.Error())
+	assert.Equal(t, "upgrade v2 is 3072 bytes, larger than DAEMON_DOWNLOAD_MAX_SIZE=2048 bytes", err.Error())
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// skipUpgradesFlag makes x/upgrade of the daemon ignore the plans at these heights
+const skipUpgradesFlag = "--unsafe-skip-upgrades"
+
+// parseSkipUpgrades reads a list of heights, separated by commas or spaces
+func parseSkipUpgrades(value string) ([]int64, error) {
+	var heights []int64
+	for _, field := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+		height, err := strconv.ParseInt(field, 10, 64)
+		if err != nil || height <= 0 {
+			return nil, errors.Errorf("invalid height %s", field)
+		}
+		heights = append(heights, height)
+	}
+	return heights, nil
+}
+
+// skipsUpgrade is true if the operator told us (and the daemon) to skip the upgrade at the height of info
+func (cfg *Config) skipsUpgrade(info *UpgradeInfo) bool {
+	if info == nil || info.Height <= 0 {
+		return false
+	}
+	for _, height := range cfg.UnsafeSkipUpgrades {
+		if height == info.Height {
+			return true
+		}
+	}
+	return false
+}
+
+// withSkipUpgrades appends --unsafe-skip-upgrades to `start`, unless it was given already
+func (cfg *Config) withSkipUpgrades(args []string) []string {
+	if len(cfg.UnsafeSkipUpgrades) == 0 || len(args) == 0 || args[0] != "start" {
+		return args
+	}
+	for _, arg := range args {
+		if arg == skipUpgradesFlag || strings.HasPrefix(arg, skipUpgradesFlag+"=") {
+			return args
+		}
+	}
+	heights := make([]string, len(cfg.UnsafeSkipUpgrades))
+	for i, height := range cfg.UnsafeSkipUpgrades {
+		heights[i] = strconv.FormatInt(height, 10)
+	}
+	return append(append([]string{}, args...), skipUpgradesFlag, strings.Join(heights, ","))
+}
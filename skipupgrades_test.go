@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSkipUpgrades(t *testing.T) {
+	cases := map[string]struct {
+		value    string
+		expected []int64
+		isErr    bool
+	}{
+		"one":         {value: "1200", expected: []int64{1200}},
+		"commas":      {value: "1200,3400", expected: []int64{1200, 3400}},
+		"spaces":      {value: " 1200 3400, 5600 ", expected: []int64{1200, 3400, 5600}},
+		"not a block": {value: "1200,v2", isErr: true},
+		"zero":        {value: "0", isErr: true},
+		"negative":    {value: "-5", isErr: true},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			heights, err := parseSkipUpgrades(tc.value)
+			if tc.isErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, heights)
+		})
+	}
+}
+
+func TestWithSkipUpgrades(t *testing.T) {
+	cfg := &Config{UnsafeSkipUpgrades: []int64{1200, 3400}}
+	cases := map[string]struct {
+		args     []string
+		expected []string
+	}{
+		"start": {
+			args:     []string{"start", "--pruning", "nothing"},
+			expected: []string{"start", "--pruning", "nothing", "--unsafe-skip-upgrades", "1200,3400"},
+		},
+		"set by operator": {
+			args:     []string{"start", "--unsafe-skip-upgrades=99"},
+			expected: []string{"start", "--unsafe-skip-upgrades=99"},
+		},
+		"not start": {
+			args:     []string{"export"},
+			expected: []string{"export"},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, cfg.withSkipUpgrades(tc.args))
+		})
+	}
+	assert.Equal(t, []string{"start"}, (&Config{}).withSkipUpgrades([]string{"start"}))
+
+	assert.True(t, cfg.skipsUpgrade(&UpgradeInfo{Name: "v2", Height: 3400}))
+	assert.False(t, cfg.skipsUpgrade(&UpgradeInfo{Name: "v2", Height: 3401}))
+	assert.False(t, cfg.skipsUpgrade(&UpgradeInfo{Name: "v2"}))
+	assert.False(t, cfg.skipsUpgrade(nil))
+}
+
+// TestLaunchProcessSkipsUpgrade runs the genesis binary past its upgrade line, as the height is skipped
+func TestLaunchProcessSkipsUpgrade(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd", UnsafeSkipUpgrades: []int64{49}}
+
+	var stdout, stderr bytes.Buffer
+	require.NoError(t, LaunchProcess(cfg, []string{"start"}, &stdout, &stderr))
+	assert.Equal(t, "Genesis start --unsafe-skip-upgrades 49\nUPGRADE \"chain2\" NEEDED at height 49: {}\nNever should be printed!!!\n", stdout.String())
+	assert.Equal(t, cfg.GenesisBin(), cfg.CurrentBin())
+}
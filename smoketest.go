@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// defaultSmokeTest is what a new binary is run with before we switch to it, every daemon built with the
+// cosmos sdk has it and it touches neither the data nor the config
+var defaultSmokeTest = []string{"version"}
+
+// smokeTestTail is how much of the output a failed smoke test reports
+const smokeTestTail = 512
+
+// smokeTest runs the staged binary of the upgrade with DAEMON_SMOKE_TEST, in the jailer like the daemon, so a
+// corrupt binary, one for another platform or the wrong release is never switched to. It returns the version the
+// binary reported.
+func (cfg *Config) smokeTest(info *UpgradeInfo) (string, error) {
+	if len(cfg.SmokeTest) == 0 {
+		return "", nil
+	}
+	timeout := orDefault(cfg.SmokeTestTimeout, defaultSmokeTestTimeout)
+	out, err := cfg.runJailed(cfg.UpgradeBin(info.Name), cfg.SmokeTest, timeout)
+	if errors.Cause(err) == context.DeadlineExceeded {
+		err = errors.Errorf("no answer within %s", timeout)
+	}
+	version := strings.TrimSpace(out)
+	if err == nil {
+		if expected := expectedVersion(info); expected != "" && !reportsVersion(version, expected) {
+			err = errors.Errorf("expected version %s", expected)
+		}
+	}
+	if err != nil {
+		if len(version) > smokeTestTail {
+			version = "..." + version[len(version)-smokeTestTail:]
+		}
+		cfg.Notify(Event{
+			Type:    "smoke_test_failed",
+			Message: "upgrade " + info.Name + " failed its smoke test, not switching to it",
+			Fields:  map[string]string{"UPGRADE": info.Name, "ERROR": err.Error(), "OUTPUT": version},
+		})
+		return "", errors.Wrapf(err, "smoke test %s of %s failed, output: %q", quoteArgs(cfg.SmokeTest), info.Name, version)
+	}
+	if i := strings.IndexByte(version, '\n'); i >= 0 {
+		version = strings.TrimSpace(version[:i])
+	}
+	return version, nil
+}
+
+// reportsVersion is whether expected is one of the words of the output of the smoke test, with or without a leading
+// v, so v2.0.1 matches "2.0.1" or "version: v2.0.1", but not v2.0.10 or v2.0.1-rc1
+func reportsVersion(output, expected string) bool {
+	expected = strings.TrimPrefix(expected, "v")
+	words := strings.FieldsFunc(output, func(r rune) bool {
+		return unicode.IsSpace(r) || strings.ContainsRune(`"',:;=()[]{}`, r)
+	})
+	for _, word := range words {
+		if strings.TrimPrefix(word, "v") == expected {
+			return true
+		}
+	}
+	return false
+}
+
+// expectedVersion is the version the upgrade info says the binary reports, if it is given inline. A linked
+// reference file is not fetched again just for this.
+func expectedVersion(info *UpgradeInfo) string {
+	doc := strings.TrimSpace(info.Info)
+	if !strings.HasPrefix(doc, "{") {
+		return ""
+	}
+	config, err := parseUpgradeConfig(doc)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(config.Version)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReportsVersion(t *testing.T) {
+	cases := []struct {
+		output   string
+		expected string
+		reports  bool
+	}{
+		{"v2.0.1", "v2.0.1", true},
+		{"2.0.1", "v2.0.1", true},
+		{"v2.0.1", "2.0.1", true},
+		{"version: v2.0.1\ncommit: abc", "v2.0.1", true},
+		{`{"version":"2.0.1","commit":"abc"}`, "v2.0.1", true},
+		{"v2.0.10", "v2.0.1", false},
+		{"v2.0.1-rc1", "v2.0.1", false},
+		{"v12.0.1", "v2.0.1", false},
+		{"", "v2.0.1", false},
+	}
+	for _, tc := range cases {
+		assert.Equal(t, tc.reports, reportsVersion(tc.output, tc.expected), "%q reports %s", tc.output, tc.expected)
+	}
+}
+
+func TestSmokeTest(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as binary")
+	}
+	home, err := ioutil.TempDir("", "upgrade-manager-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd", UnsafeSkipBackup: true, SmokeTest: defaultSmokeTest}
+	require.NoError(t, os.MkdirAll(cfg.DataDir(), 0755))
+	stage := func(name, script string) {
+		bin := cfg.UpgradeBin(name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(bin), 0755))
+		require.NoError(t, ioutil.WriteFile(bin, []byte(script), 0755))
+	}
+
+	// a binary that cannot run is not switched to
+	stage("broken", "#!/bin/sh\necho 'exec format error' >&2\nexit 126\n")
+	err = DoUpgrade(cfg, &UpgradeInfo{Name: "broken"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "smoke test version of broken failed")
+	assert.Contains(t, err.Error(), "exec format error")
+	assert.Equal(t, cfg.GenesisBin(), cfg.CurrentBin())
+
+	// nor one reporting another version than the upgrade info
+	stage("v2", "#!/bin/sh\n[ \"$1\" = version ] || exit 2\necho v2.0.0-rc1\n")
+	err = DoUpgrade(cfg, &UpgradeInfo{Name: "v2", Info: `{"binaries":{},"version":"v2.0.1"}`})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "expected version v2.0.1")
+	assert.Equal(t, cfg.GenesisBin(), cfg.CurrentBin())
+
+	// the version must match as a whole
+	stage("v2.0.10", "#!/bin/sh\necho 'version: v2.0.10'\n")
+	err = DoUpgrade(cfg, &UpgradeInfo{Name: "v2.0.10", Info: `{"binaries":{},"version":"v2.0.1"}`})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "expected version v2.0.1")
+
+	// nor one that hangs
+	stage("hangs", "#!/bin/sh\nexec sleep 30\n")
+	cfg.SmokeTestTimeout = 100 * time.Millisecond
+	start := time.Now()
+	err = DoUpgrade(cfg, &UpgradeInfo{Name: "hangs"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no answer within 100ms")
+	assert.True(t, time.Since(start) < 5*time.Second)
+	cfg.SmokeTestTimeout = 0
+
+	// the right one is, and the version it reports is kept
+	require.NoError(t, DoUpgrade(cfg, &UpgradeInfo{Name: "v2", Info: `{"binaries":{},"version":"v2.0.0-rc1"}`}))
+	assert.Equal(t, cfg.UpgradeBin("v2"), cfg.CurrentBin())
+	history, err := cfg.History()
+	require.NoError(t, err)
+	require.NotEmpty(t, history)
+	last := history[len(history)-1]
+	assert.Equal(t, "upgraded", last.Type)
+	assert.Equal(t, "v2.0.0-rc1", last.Fields["version"])
+
+	// it runs in the jailer, like the daemon
+	stage("jailed", "#!/bin/sh\n[ \"$JAILED\" = 1 ] || exit 2\necho 3.0.0\n")
+	cfg.Jailer, err = parseJailer(`/usr/bin/env JAILED=1 {{.Bin}}`)
+	require.NoError(t, err)
+	require.NoError(t, DoUpgrade(cfg, &UpgradeInfo{Name: "jailed", Info: `{"binaries":{},"version":"v3.0.0"}`}))
+	assert.Equal(t, cfg.UpgradeBin("jailed"), cfg.CurrentBin())
+	cfg.Jailer = nil
+
+	// without a smoke test anything goes
+	cfg.SmokeTest = nil
+	require.NoError(t, DoUpgrade(cfg, &UpgradeInfo{Name: "broken"}))
+	assert.Equal(t, cfg.UpgradeBin("broken"), cfg.CurrentBin())
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"regexp"
+	"sync"
+)
+
+// StopMarkers tracks the lines the daemon prints while it shuts down (eg. the WAL being flushed),
+// once all of them were seen, we need not wait for it to exit by itself
+type StopMarkers struct {
+	mutex   sync.Mutex
+	armed   bool
+	pending []*regexp.Regexp
+	seen    chan struct{}
+}
+
+// NewStopMarkers waits for all of patterns, without any Seen never fires
+func NewStopMarkers(patterns []*regexp.Regexp) *StopMarkers {
+	m := &StopMarkers{pending: append([]*regexp.Regexp{}, patterns...)}
+	if len(patterns) > 0 {
+		m.seen = make(chan struct{})
+	}
+	return m
+}
+
+// Arm starts matching lines, only what the daemon prints after we asked it to stop counts
+func (m *StopMarkers) Arm() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.armed = true
+}
+
+// Check marks the patterns matching line as seen
+func (m *StopMarkers) Check(line string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.armed || len(m.pending) == 0 {
+		return
+	}
+	pending := m.pending[:0]
+	for _, pattern := range m.pending {
+		if !pattern.MatchString(line) {
+			pending = append(pending, pattern)
+		}
+	}
+	m.pending = pending
+	if len(m.pending) == 0 {
+		close(m.seen)
+	}
+}
+
+// Seen is closed once every marker was printed
+func (m *StopMarkers) Seen() <-chan struct{} {
+	return m.seen
+}
+
+// Missing returns the markers not printed since Arm, or nil if we never asked the daemon to stop
+func (m *StopMarkers) Missing() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.armed {
+		return nil
+	}
+	missing := make([]string, len(m.pending))
+	for i, pattern := range m.pending {
+		missing[i] = pattern.String()
+	}
+	return missing
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStopMarkers(t *testing.T) {
+	patterns := []*regexp.Regexp{regexp.MustCompile("WAL flushed"), regexp.MustCompile("state saved")}
+	markers := NewStopMarkers(patterns)
+	assert.Nil(t, markers.Missing())
+
+	// lines before we asked to stop don't count
+	markers.Check("WAL flushed")
+	markers.Arm()
+	assert.Equal(t, []string{"WAL flushed", "state saved"}, markers.Missing())
+
+	markers.Check("I[2020-06-01] state saved height=120")
+	assert.Equal(t, []string{"WAL flushed"}, markers.Missing())
+	select {
+	case <-markers.Seen():
+		t.Fatal("not all markers seen")
+	default:
+	}
+
+	markers.Check("E[2020-06-01] WAL flushed")
+	assert.Empty(t, markers.Missing())
+	select {
+	case <-markers.Seen():
+	default:
+		t.Fatal("all markers seen")
+	}
+	// and more matching lines don't close it twice
+	markers.Check("WAL flushed")
+
+	// without markers, we only wait for the process
+	none := NewStopMarkers(nil)
+	none.Arm()
+	none.Check("WAL flushed")
+	assert.Nil(t, none.Seen())
+	assert.Empty(t, none.Missing())
+}
+
+// TestLaunchProcessStopMarkers ensures we switch once the daemon flushed, even if it hangs on exit
+func TestLaunchProcessStopMarkers(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+
+	script := `#!/bin/sh
+trap 'echo "WAL flushed"; echo "state saved" >&2; while true; do sleep 0.1; done' TERM
+echo 'UPGRADE "chain2" NEEDED at height 49: {}'
+while true; do sleep 0.1; done
+`
+	markers := []*regexp.Regexp{regexp.MustCompile("WAL flushed"), regexp.MustCompile("state saved")}
+	cfg := &Config{Home: home, Name: "dummyd", ShutdownGrace: 10 * time.Second, StopMarkers: markers}
+	require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+
+	var stdout, stderr bytes.Buffer
+	start := time.Now()
+	require.NoError(t, LaunchProcess(cfg, []string{"start"}, &stdout, &stderr))
+	assert.True(t, time.Since(start) < 5*time.Second, "waited for the grace period")
+	assert.Equal(t, "UPGRADE \"chain2\" NEEDED at height 49: {}\nWAL flushed\n", stdout.String())
+	assert.Equal(t, "state saved\n", stderr.String())
+	assert.Equal(t, cfg.UpgradeBin("chain2"), cfg.CurrentBin())
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultRPCTimeout             = 5 * time.Second
+	defaultFleetTimeout           = 10 * time.Second
+	defaultDownloadConnectTimeout = 30 * time.Second
+	defaultDownloadRetries        = 2
+	defaultDownloadRetryDelay     = 10 * time.Second
+	defaultDownloadRetryMaxDelay  = 2 * time.Minute
+	defaultDownloadTimeout        = 30 * time.Minute
+	defaultDownloadTotalTimeout   = 2 * time.Hour
+	defaultScannerStall           = time.Second
+	defaultConfigCheckTimeout     = time.Minute
+	defaultSmokeTestTimeout       = 30 * time.Second
+	defaultWaitForBinaryRemind    = 10 * time.Minute
+	defaultShutdownGrace          = 30 * time.Second
+	defaultCrashRestartDelay      = time.Second
+	defaultCrashRestartMaxDelay   = 5 * time.Minute
+	defaultSharedCacheMaxAge      = 30 * 24 * time.Hour
+	defaultTorrentSeedTime        = 30 * time.Minute
+)
+
+// timing is one of the timeouts, intervals, retry counts and retention limits of the upgrade manager,
+// they are all read, validated and documented the same way
+type timing struct {
+	env   string
+	def   string
+	usage string
+	// zero is valid, eg. to kill the daemon at once rather than waiting for it
+	zero bool
+	// millis reads a plain number as milliseconds, as cosmovisor does
+	millis bool
+	// exactly one of them points to the setting in cfg
+	duration func(cfg *Config) *time.Duration
+	count    func(cfg *Config) *int
+}
+
+var timings = []timing{
+	{
+		env: "DAEMON_POLL_INTERVAL", def: defaultPollInterval.String(), millis: true,
+		usage:    "how often upgrade-info.json, trigger.json and the node are checked",
+		duration: func(cfg *Config) *time.Duration { return &cfg.PollInterval },
+	},
+	{
+		env: "DAEMON_SHUTDOWN_GRACE", def: defaultShutdownGrace.String(), zero: true,
+		usage:    "how long the daemon may take to exit after DAEMON_SHUTDOWN_SIGNAL on upgrade, 0 kills it at once",
+		duration: func(cfg *Config) *time.Duration { return &cfg.ShutdownGrace },
+	},
+	{
+		env: "DAEMON_RPC_TIMEOUT", def: defaultRPCTimeout.String(),
+		usage:    "how long a query to DAEMON_RPC_ADDRESS may take",
+		duration: func(cfg *Config) *time.Duration { return &cfg.RPCTimeout },
+	},
+	{
+		env: "DAEMON_RPC_UNAVAILABLE_AFTER", def: defaultRPCUnavailableAfter.String(),
+		usage:    "how long DAEMON_RPC_ADDRESS may not answer before a warning, and carrying on without it",
+		duration: func(cfg *Config) *time.Duration { return &cfg.RPCUnavailableAfter },
+	},
+	{
+		env: "DAEMON_FLEET_TIMEOUT", def: defaultFleetTimeout.String(),
+		usage:    "how long fleet-compare waits for each agent",
+		duration: func(cfg *Config) *time.Duration { return &cfg.FleetTimeout },
+	},
+	{
+		env: "DAEMON_DOWNLOAD_CONNECT_TIMEOUT", def: defaultDownloadConnectTimeout.String(),
+		usage:    "how long connecting to a download server may take",
+		duration: func(cfg *Config) *time.Duration { return &cfg.DownloadConnectTimeout },
+	},
+	{
+		env: "DAEMON_DOWNLOAD_RETRIES", def: strconv.Itoa(defaultDownloadRetries), zero: true,
+		usage: "how often a failed download is retried at the upgrade height",
+		count: func(cfg *Config) *int { return &cfg.DownloadRetries },
+	},
+	{
+		env: "DAEMON_DOWNLOAD_RETRY_DELAY", def: defaultDownloadRetryDelay.String(), zero: true,
+		usage:    "how long to wait before retrying a download, doubled for every further retry",
+		duration: func(cfg *Config) *time.Duration { return &cfg.DownloadRetryDelay },
+	},
+	{
+		env: "DAEMON_DOWNLOAD_RETRY_MAX_DELAY", def: defaultDownloadRetryMaxDelay.String(),
+		usage:    "the longest wait between retries of a download",
+		duration: func(cfg *Config) *time.Duration { return &cfg.DownloadRetryMaxDelay },
+	},
+	{
+		env: "DAEMON_DOWNLOAD_TIMEOUT", def: defaultDownloadTimeout.String(), zero: true,
+		usage:    "how long each request of a download may take, reading what the server sends included, 0 for no limit",
+		duration: func(cfg *Config) *time.Duration { return &cfg.DownloadTimeout },
+	},
+	{
+		env: "DAEMON_DOWNLOAD_TOTAL_TIMEOUT", def: defaultDownloadTotalTimeout.String(), zero: true,
+		usage:    "how long the download of an upgrade may take, with all mirrors and retries, 0 for no limit",
+		duration: func(cfg *Config) *time.Duration { return &cfg.DownloadTotalTimeout },
+	},
+	{
+		env: "DAEMON_WAIT_FOR_BINARY_REMIND", def: defaultWaitForBinaryRemind.String(),
+		usage:    "how often the operator is reminded of a binary to stage, with DAEMON_WAIT_FOR_BINARY on",
+		duration: func(cfg *Config) *time.Duration { return &cfg.WaitForBinaryRemind },
+	},
+	{
+		env: "DAEMON_WAIT_FOR_BINARY_TIMEOUT", def: "0s", zero: true,
+		usage:    "how long to wait for a binary to be staged by hand before giving up, 0 waits until we are stopped",
+		duration: func(cfg *Config) *time.Duration { return &cfg.WaitForBinaryTimeout },
+	},
+	{
+		env: "DAEMON_SCANNER_STALL", def: defaultScannerStall.String(),
+		usage:    "how long reading the output may pause before it counts as a stall in the metrics",
+		duration: func(cfg *Config) *time.Duration { return &cfg.ScannerStall },
+	},
+	{
+		env: "DAEMON_STALL_TIMEOUT", def: "0s", zero: true,
+		usage:    "how long the daemon may go without a new block before DAEMON_STALL_ACTION is taken, 0 turns the watchdog off",
+		duration: func(cfg *Config) *time.Duration { return &cfg.StallTimeout },
+	},
+	{
+		env: "DAEMON_PREUPGRADE_MAX_RETRIES", def: "0", zero: true,
+		usage: "how often `pre-upgrade` is run again when it exits with 31, with DAEMON_PREUPGRADE on",
+		count: func(cfg *Config) *int { return &cfg.PreUpgradeRetries },
+	},
+	{
+		env: "DAEMON_CRASH_RESTART_DELAY", def: defaultCrashRestartDelay.String(), zero: true,
+		usage:    "how long to wait before starting a crashed daemon again, with DAEMON_RESTART_ON_CRASH on, doubled for every crash in a row",
+		duration: func(cfg *Config) *time.Duration { return &cfg.CrashRestartDelay },
+	},
+	{
+		env: "DAEMON_CRASH_RESTART_MAX_DELAY", def: defaultCrashRestartMaxDelay.String(),
+		usage:    "the longest wait before starting a crashed daemon again, a daemon running that long is no longer crashing in a row",
+		duration: func(cfg *Config) *time.Duration { return &cfg.CrashRestartMaxDelay },
+	},
+	{
+		env: "DAEMON_HISTORY_MAX_AGE", def: "0s", zero: true,
+		usage:    "how long entries of history.json are kept (except upgrades), 0 keeps them forever",
+		duration: func(cfg *Config) *time.Duration { return &cfg.HistoryMaxAge },
+	},
+	{
+		env: "DAEMON_HISTORY_MAX_ENTRIES", def: "0", zero: true,
+		usage: "how many entries history.json keeps (besides upgrades), 0 for no limit",
+		count: func(cfg *Config) *int { return &cfg.HistoryMaxEntries },
+	},
+	{
+		env: "DAEMON_BACKUPS_MAX_AGE", def: "0s", zero: true,
+		usage:    "how long backups of the data are kept, 0 keeps them until pruned for disk space",
+		duration: func(cfg *Config) *time.Duration { return &cfg.BackupsMaxAge },
+	},
+	{
+		env: "DAEMON_BACKUPS_KEEP", def: "0", zero: true,
+		usage: "how many of the newest backups are kept, 0 for no limit",
+		count: func(cfg *Config) *int { return &cfg.BackupsKeep },
+	},
+	{
+		env: "DAEMON_SHARED_CACHE_MAX_AGE", def: defaultSharedCacheMaxAge.String(), zero: true,
+		usage:    "how long files of DAEMON_SHARED_CACHE are kept after they were last used, 0 keeps them forever",
+		duration: func(cfg *Config) *time.Duration { return &cfg.SharedCacheMaxAge },
+	},
+	{
+		env: "DAEMON_TORRENT_SEED_TIME", def: defaultTorrentSeedTime.String(), zero: true,
+		usage:    "how long a torrent is seeded in the background once it was fetched, 0 doesn't seed",
+		duration: func(cfg *Config) *time.Duration { return &cfg.TorrentSeedTime },
+	},
+	{
+		env: "DAEMON_CONFIG_CHECK_TIMEOUT", def: defaultConfigCheckTimeout.String(),
+		usage:    "how long the new binary may take to write its default config or validate the config after an upgrade",
+		duration: func(cfg *Config) *time.Duration { return &cfg.ConfigCheckTimeout },
+	},
+	{
+		env: "DAEMON_SMOKE_TEST_TIMEOUT", def: defaultSmokeTestTimeout.String(),
+		usage:    "how long the new binary may take to answer DAEMON_SMOKE_TEST before we switch to it",
+		duration: func(cfg *Config) *time.Duration { return &cfg.SmokeTestTimeout },
+	},
+	{
+		env: "DAEMON_LEASE_TTL", def: defaultLeaseTTL.String(),
+		usage:    "how long a lease is valid without being renewed",
+		duration: func(cfg *Config) *time.Duration { return &cfg.LeaseTTL },
+	},
+}
+
+// readTimings sets all timings from the environment, or their defaults
+func (cfg *Config) readTimings() error {
+	for _, t := range timings {
+		value := cfg.getenv(t.env)
+		if value == "" {
+			value = t.def
+		}
+		if err := t.set(cfg, value); err != nil {
+			return errors.Errorf("%s must be %s, not %s", cfg.envName(t.env), err, value)
+		}
+	}
+	return nil
+}
+
+// set parses value into cfg, the error describes what value is expected
+func (t timing) set(cfg *Config, value string) error {
+	what := "a positive"
+	if t.zero {
+		what = "a non-negative"
+	}
+	if t.count != nil {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || (n == 0 && !t.zero) {
+			return errors.New(what + " number")
+		}
+		*t.count(cfg) = n
+		return nil
+	}
+	d, err := time.ParseDuration(value)
+	if ms, parseErr := strconv.ParseUint(value, 10, 63); err != nil && parseErr == nil && t.millis {
+		d, err = time.Duration(ms)*time.Millisecond, nil
+	}
+	if err != nil || d < 0 || (d == 0 && !t.zero) {
+		return errors.New(what + " duration")
+	}
+	*t.duration(cfg) = d
+	return nil
+}
+
+// value formats the current setting in cfg
+func (t timing) value(cfg *Config) string {
+	if t.count != nil {
+		return strconv.Itoa(*t.count(cfg))
+	}
+	return t.duration(cfg).String()
+}
+
+// orDefault returns d, or def if it was never set (eg. in a Config not read from the environment)
+func orDefault(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
+
+// rpcClient is used for all queries to the rpc of the node
+func (cfg *Config) rpcClient() *http.Client {
+	return &http.Client{Timeout: orDefault(cfg.RPCTimeout, defaultRPCTimeout)}
+}
+
+// cmdConfig prints the timings: `defaults` as an environment file, `show` the values we run with
+func cmdConfig(args []string, out io.Writer) error {
+	if len(args) != 1 || (args[0] != "defaults" && args[0] != "show") {
+		return errors.New("usage: config defaults|show")
+	}
+	if args[0] == "defaults" {
+		for _, t := range timings {
+			fmt.Fprintf(out, "# %s\n%s=%s\n", t.usage, t.env, t.def)
+		}
+		return nil
+	}
+	cfg, err := readConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	for _, t := range timings {
+		fmt.Fprintf(out, "%s=%s\n", cfg.envName(t.env), t.value(cfg))
+	}
+	return nil
+}
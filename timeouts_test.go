@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadTimings(t *testing.T) {
+	cases := map[string]struct {
+		env   map[string]string
+		check func(t *testing.T, cfg *Config)
+		isErr string
+	}{
+		"defaults": {
+			check: func(t *testing.T, cfg *Config) {
+				assert.Equal(t, defaultPollInterval, cfg.PollInterval)
+				assert.Equal(t, defaultShutdownGrace, cfg.ShutdownGrace)
+				assert.Equal(t, defaultRPCTimeout, cfg.RPCTimeout)
+				assert.Equal(t, defaultDownloadRetries, cfg.DownloadRetries)
+				assert.Equal(t, defaultLeaseTTL, cfg.LeaseTTL)
+			},
+		},
+		"set": {
+			env: map[string]string{"DAEMON_SHUTDOWN_GRACE": "0", "DAEMON_DOWNLOAD_RETRIES": "0", "DAEMON_RPC_TIMEOUT": "2s"},
+			check: func(t *testing.T, cfg *Config) {
+				assert.Equal(t, time.Duration(0), cfg.ShutdownGrace)
+				assert.Equal(t, 0, cfg.DownloadRetries)
+				assert.Equal(t, 2*time.Second, cfg.RPCTimeout)
+			},
+		},
+		"zero poll interval": {
+			env:   map[string]string{"DAEMON_POLL_INTERVAL": "0s"},
+			isErr: "DAEMON_POLL_INTERVAL must be a positive duration, not 0s",
+		},
+		"negative grace": {
+			env:   map[string]string{"DAEMON_SHUTDOWN_GRACE": "-1s"},
+			isErr: "DAEMON_SHUTDOWN_GRACE must be a non-negative duration, not -1s",
+		},
+		"retries": {
+			env:   map[string]string{"DAEMON_DOWNLOAD_RETRIES": "often"},
+			isErr: "DAEMON_DOWNLOAD_RETRIES must be a non-negative number, not often",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			env := map[string]string{}
+			for _, timing := range timings {
+				env[timing.env] = ""
+			}
+			for k, v := range tc.env {
+				env[k] = v
+			}
+			defer setEnv(env)()
+
+			cfg := &Config{}
+			err := cfg.readTimings()
+			if tc.isErr != "" {
+				require.Error(t, err)
+				assert.Equal(t, tc.isErr, err.Error())
+				return
+			}
+			require.NoError(t, err)
+			tc.check(t, cfg)
+		})
+	}
+}
+
+func TestConfigDefaults(t *testing.T) {
+	var out bytes.Buffer
+	require.NoError(t, cmdConfig([]string{"defaults"}, &out))
+	assert.Contains(t, out.String(), "# how long a query to DAEMON_RPC_ADDRESS may take\nDAEMON_RPC_TIMEOUT=5s\n")
+	assert.Contains(t, out.String(), "\nDAEMON_DOWNLOAD_RETRIES=2\n")
+
+	// every default is valid
+	cfg := &Config{}
+	for _, timing := range timings {
+		assert.NoError(t, timing.set(cfg, timing.def), timing.env)
+	}
+
+	assert.Error(t, cmdConfig(nil, &out))
+}
+
+// runDaemonCommand runs args as the upgrade manager does, with a daemon which only writes down its args
+func runDaemonCommand(t *testing.T, args ...string) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as daemon")
+	}
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+	argsFile := filepath.Join(home, "args")
+	script := "#!/bin/sh\necho \"$@\" > " + argsFile + "\n"
+	require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+	defer setEnv(map[string]string{"DAEMON_HOME": home, "DAEMON_NAME": "dummyd"})()
+
+	require.NoError(t, Run(args))
+	bz, err := ioutil.ReadFile(argsFile)
+	require.NoError(t, err)
+	return string(bz)
+}
+
+// TestConfigOfDaemon passes the config commands of the daemon, eg. of its client config, through
+func TestConfigOfDaemon(t *testing.T) {
+	assert.Equal(t, "config chain-id foo\n", runDaemonCommand(t, "config", "chain-id", "foo"))
+	assert.Equal(t, "config\n", runDaemonCommand(t, "config"))
+}
+
+func TestDownloadRetries(t *testing.T) {
+	home, err := copyTestData("download")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+
+	// the mirror fails the first attempt (for a file, and then a directory)
+	var mutex sync.Mutex
+	requests := 0
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		requests++
+		if requests <= 2 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "#!/bin/sh\necho retried\n")
+	}))
+	defer mirror.Close()
+	info := &UpgradeInfo{Name: "amazonas", Height: 789, Info: fmt.Sprintf(`{"binaries":{"%s": "%s/autod"}}`, osArch(), mirror.URL)}
+
+	cfg := &Config{Home: home, Name: "autod", AllowDownloadBinaries: true, UnsafeSkipBackup: true}
+	assert.Error(t, DoUpgrade(cfg, info))
+	require.NoError(t, os.RemoveAll(cfg.UpgradeDir("amazonas")))
+
+	mutex.Lock()
+	requests = 0
+	mutex.Unlock()
+	cfg.DownloadRetries = 1
+	require.NoError(t, DoUpgrade(cfg, info))
+	assert.Equal(t, cfg.UpgradeBin("amazonas"), cfg.CurrentBin())
+}
+
+func TestDownloadTimeouts(t *testing.T) {
+	home, err := copyTestData("download")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+
+	// the server starts sending the binary, and then stalls
+	release := make(chan struct{})
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			return
+		}
+		w.Header().Set("Content-Length", "1000")
+		fmt.Fprint(w, "#!/bin/sh\n")
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer stalled.Close()
+	defer close(release)
+	info := &UpgradeInfo{Name: "amazonas", Height: 789, Info: fmt.Sprintf(`{"binaries":{"%s": "%s/autod"}}`, osArch(), stalled.URL)}
+
+	cfg := &Config{Home: home, Name: "autod", AllowDownloadBinaries: true, DownloadTimeout: 100 * time.Millisecond}
+	start := time.Now()
+	assert.Error(t, DownloadBinary(cfg, info))
+	assert.True(t, time.Since(start) < 5*time.Second)
+
+	// retries stop with the total timeout, even while waiting for the next one
+	cfg.DownloadTimeout, cfg.DownloadTotalTimeout = 0, 200*time.Millisecond
+	cfg.DownloadRetries, cfg.DownloadRetryDelay = 3, time.Hour
+	start = time.Now()
+	err = cfg.downloadWithRetries(info)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "took longer than 200ms")
+	assert.True(t, time.Since(start) < 5*time.Second)
+	_, err = os.Stat(cfg.UpgradeDir("amazonas"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRetryDelay(t *testing.T) {
+	cfg := &Config{DownloadRetryDelay: 10 * time.Second, DownloadRetryMaxDelay: time.Minute}
+	assert.Equal(t, 5*time.Second, cfg.retryDelay(1, 0))
+	assert.Equal(t, 10*time.Second, cfg.retryDelay(1, 1))
+	assert.Equal(t, 15*time.Second, cfg.retryDelay(2, 0.5))
+	assert.Equal(t, 40*time.Second, cfg.retryDelay(3, 1))
+	assert.Equal(t, time.Minute, cfg.retryDelay(4, 1))
+	assert.Equal(t, 30*time.Second, cfg.retryDelay(40, 0))
+
+	cfg.DownloadRetryDelay = 0
+	assert.Equal(t, time.Duration(0), cfg.retryDelay(3, 1))
+}
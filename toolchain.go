@@ -0,0 +1,116 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Toolchain pins what an upgrade must be built with
+type Toolchain struct {
+	// Go is the version of go, eg. 1.21.5, or 1.21 for any patch release
+	Go string `json:"go,omitempty"`
+	// MakeTargets replace the build command with `make <targets>`
+	MakeTargets []string `json:"make_targets,omitempty"`
+}
+
+// ToolchainProvider makes a go version available
+type ToolchainProvider interface {
+	// Install returns the directory holding the go binary of version, or "" to use the one on PATH
+	Install(version string) (string, error)
+}
+
+// toolchainProviders are selected with DAEMON_TOOLCHAIN_PROVIDER
+var toolchainProviders = map[string]ToolchainProvider{
+	"path": pathToolchain{},
+	"asdf": asdfToolchain{},
+	"nix":  nixToolchain{},
+}
+
+// pathToolchain uses whatever go is installed, it only verifies the version
+type pathToolchain struct{}
+
+func (pathToolchain) Install(version string) (string, error) {
+	return "", nil
+}
+
+// asdfToolchain installs the exact version with the golang plugin of asdf
+type asdfToolchain struct{}
+
+func (asdfToolchain) Install(version string) (string, error) {
+	if out, err := exec.Command("asdf", "install", "golang", version).CombinedOutput(); err != nil {
+		return "", errors.Wrapf(err, "asdf install golang %s: %s", version, strings.TrimSpace(string(out)))
+	}
+	out, err := exec.Command("asdf", "where", "golang", version).Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "asdf where golang %s", version)
+	}
+	return filepath.Join(strings.TrimSpace(string(out)), "go", "bin"), nil
+}
+
+// nixToolchain builds go_<major>_<minor> from nixpkgs. Nix only pins the minor version,
+// so the patch release must be left out of the spec (or match what the channel has).
+type nixToolchain struct{}
+
+func (nixToolchain) Install(version string) (string, error) {
+	parts := strings.Split(version, ".")
+	if len(parts) < 2 {
+		return "", errors.Errorf("invalid go version %s", version)
+	}
+	attr := "nixpkgs#go_" + parts[0] + "_" + parts[1]
+	out, err := exec.Command("nix", "build", "--no-link", "--print-out-paths", attr).Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "nix build %s", attr)
+	}
+	return filepath.Join(strings.TrimSpace(string(out)), "bin"), nil
+}
+
+// PrepareToolchain installs the pinned go version with the configured provider and verifies it.
+// It returns the PATH the build must run with.
+func (cfg *Config) PrepareToolchain(toolchain *Toolchain) (string, error) {
+	path := os.Getenv("PATH")
+	if toolchain == nil || toolchain.Go == "" {
+		return path, nil
+	}
+	name := cfg.ToolchainProvider
+	if name == "" {
+		name = "path"
+	}
+	dir, err := toolchainProviders[name].Install(toolchain.Go)
+	if err != nil {
+		return "", errors.Wrapf(err, "installing go %s with %s", toolchain.Go, name)
+	}
+	if dir != "" {
+		path = dir + string(os.PathListSeparator) + path
+	}
+
+	goBin := "go"
+	if dir != "" {
+		goBin = filepath.Join(dir, "go")
+	}
+	out, err := exec.Command(goBin, "version").Output()
+	if err != nil {
+		return "", errors.Wrap(err, "running go version")
+	}
+	if actual := goVersion(string(out)); !matchGoVersion(toolchain.Go, actual) {
+		return "", errors.Errorf("need go %s to build, but %s has %s", toolchain.Go, name, actual)
+	}
+	return path, nil
+}
+
+// goVersion reads the version from the output of `go version`, eg. "go version go1.21.5 linux/amd64"
+func goVersion(out string) string {
+	fields := strings.Fields(out)
+	if len(fields) < 3 {
+		return ""
+	}
+	return strings.TrimPrefix(fields[2], "go")
+}
+
+// matchGoVersion returns true if actual is the version, or a patch release of it (1.21 matches 1.21.5)
+func matchGoVersion(version, actual string) bool {
+	return actual == version || strings.HasPrefix(actual, version+".")
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchGoVersion(t *testing.T) {
+	cases := map[string]struct {
+		version string
+		output  string
+		match   bool
+	}{
+		"exact":         {version: "1.21.5", output: "go version go1.21.5 linux/amd64", match: true},
+		"minor":         {version: "1.21", output: "go version go1.21.5 linux/amd64", match: true},
+		"other patch":   {version: "1.21.4", output: "go version go1.21.5 linux/amd64"},
+		"not a prefix":  {version: "1.2", output: "go version go1.21.5 linux/amd64"},
+		"garbage":       {version: "1.21", output: "command not found"},
+		"release cands": {version: "1.22", output: "go version go1.22rc1 linux/amd64"},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.match, matchGoVersion(tc.version, goVersion(tc.output)))
+		})
+	}
+}
+
+// TestPrepareToolchain uses fake go and asdf binaries on PATH
+func TestPrepareToolchain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "toolchain")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the system go, and what asdf installs
+	system := filepath.Join(dir, "system")
+	installed := filepath.Join(dir, "installs", "golang", "1.20.14", "go", "bin")
+	for path, script := range map[string]string{
+		filepath.Join(system, "go"):    "#!/bin/sh\necho go version go1.21.5 linux/amd64\n",
+		filepath.Join(installed, "go"): "#!/bin/sh\necho go version go1.20.14 linux/amd64\n",
+		filepath.Join(system, "asdf"):  "#!/bin/sh\n[ \"$1 $2 $3\" = \"install golang 1.20.14\" ] && exit 0\n[ \"$1 $2 $3\" = \"where golang 1.20.14\" ] && echo " + filepath.Join(dir, "installs", "golang", "1.20.14") + " && exit 0\nexit 1\n",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(script), 0755))
+	}
+	defer setEnv(map[string]string{"PATH": system + string(os.PathListSeparator) + os.Getenv("PATH")})()
+
+	cases := map[string]struct {
+		provider string
+		version  string
+		path     string
+		isErr    bool
+	}{
+		"path":           {version: "1.21", path: os.Getenv("PATH")},
+		"path mismatch":  {version: "1.20.14", isErr: true},
+		"asdf":           {provider: "asdf", version: "1.20.14", path: installed + string(os.PathListSeparator) + os.Getenv("PATH")},
+		"asdf cannot":    {provider: "asdf", version: "1.19", isErr: true},
+		"nothing to pin": {provider: "asdf", path: os.Getenv("PATH")},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cfg := &Config{ToolchainProvider: tc.provider}
+			path, err := cfg.PrepareToolchain(&Toolchain{Go: tc.version})
+			if tc.isErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.path, path)
+		})
+	}
+}
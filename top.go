@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// topEvents is how many history entries top shows
+const topEvents = 8
+
+// NodeStatus is the part of the tendermint /status we show
+type NodeStatus struct {
+	Height     int64     `json:"height"`
+	BlockTime  time.Time `json:"block_time"`
+	CatchingUp bool      `json:"catching_up"`
+}
+
+// Dashboard is everything top shows about the managed daemon at one point in time, `top -output json` prints it
+type Dashboard struct {
+	// SchemaVersion is the version of the dashboard, see SchemaVersion
+	SchemaVersion int `json:"schema_version"`
+
+	Time    time.Time `json:"time"`
+	Name    string    `json:"name"`
+	Node    string    `json:"node,omitempty"`
+	Upgrade string    `json:"upgrade"`
+	// Since is when current was last switched, zero if we still run genesis
+	Since  time.Time   `json:"since"`
+	Halted *FatalError `json:"halted,omitempty"`
+	Held   *Plan       `json:"held,omitempty"`
+	// OnHold is set while an operator holds upgrades
+	OnHold *UpgradeHold `json:"on_hold,omitempty"`
+	// Status and Scheduled are only known if the rpc is configured and reachable, StatusError tells why not
+	Status      *NodeStatus    `json:"status,omitempty"`
+	StatusErr   error          `json:"-"`
+	StatusError string         `json:"status_error,omitempty"`
+	Scheduled   *UpgradeInfo   `json:"scheduled,omitempty"`
+	Events      []HistoryEntry `json:"events"`
+}
+
+// Snapshot collects the state of the daemon from our files and its rpc
+func (cfg *Config) Snapshot() (*Dashboard, error) {
+	d := &Dashboard{SchemaVersion: SchemaVersion, Time: time.Now(), Name: cfg.Name, Node: cfg.NodeLabel, Upgrade: cfg.currentUpgradeName()}
+	_, d.Since, _ = cfg.CurrentUpgradeDir()
+	var err error
+	if d.Halted, err = cfg.Halted(); err != nil {
+		return nil, err
+	}
+	if d.Held, err = cfg.HeldPlan(); err != nil {
+		return nil, err
+	}
+	if d.OnHold, err = cfg.UpgradeHold(); err != nil {
+		return nil, err
+	}
+	history, err := cfg.History()
+	if err != nil {
+		return nil, err
+	}
+	if len(history) > topEvents {
+		history = history[len(history)-topEvents:]
+	}
+	d.Events = history
+
+	if detector := cfg.NewPlanDetector(); detector != nil {
+		if d.Status, d.StatusErr = cfg.NodeStatus(); d.StatusErr == nil {
+			d.Scheduled, _, d.StatusErr = detector.query()
+		}
+		if d.StatusErr != nil {
+			d.StatusError = d.StatusErr.Error()
+		}
+	}
+	return d, nil
+}
+
+// statusResponse is the part of the tendermint /status response we need
+type statusResponse struct {
+	Result struct {
+		SyncInfo struct {
+			LatestBlockHeight string    `json:"latest_block_height"`
+			LatestBlockTime   time.Time `json:"latest_block_time"`
+			CatchingUp        bool      `json:"catching_up"`
+		} `json:"sync_info"`
+	} `json:"result"`
+}
+
+// NodeStatus asks the rpc of the node for its latest block
+func (cfg *Config) NodeStatus() (*NodeStatus, error) {
+	req, err := http.NewRequest("GET", strings.TrimSuffix(cfg.RPCAddress, "/")+"/status", nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating request")
+	}
+	var res statusResponse
+	if err := getJSON(cfg.rpcClient(), req, &res); err != nil {
+		return nil, err
+	}
+	height, err := parseHeight(res.Result.SyncInfo.LatestBlockHeight)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing block height")
+	}
+	return &NodeStatus{Height: height, BlockTime: res.Result.SyncInfo.LatestBlockTime, CatchingUp: res.Result.SyncInfo.CatchingUp}, nil
+}
+
+// Render writes the dashboard as text. blockTime is the average time between blocks, to estimate
+// when the scheduled upgrade happens (0 if unknown).
+func (d *Dashboard) Render(w io.Writer, blockTime time.Duration) {
+	state := "running"
+	switch {
+	case d.Halted != nil:
+		state = "HALTED"
+	case d.Held != nil:
+		state = "WAITING FOR BINARY"
+	}
+	if d.Node != "" {
+		fmt.Fprintf(w, "%s on %s  %s\n\n", d.Name, d.Node, d.Time.Format(time.RFC3339))
+	} else {
+		fmt.Fprintf(w, "%s  %s\n\n", d.Name, d.Time.Format(time.RFC3339))
+	}
+	fmt.Fprintf(w, "%-12s %s\n", "state", state)
+	if d.Since.IsZero() {
+		fmt.Fprintf(w, "%-12s %s\n", "current", d.Upgrade)
+	} else {
+		fmt.Fprintf(w, "%-12s %s, since %s (%s)\n", "current", d.Upgrade, d.Since.Format(time.RFC3339), d.Time.Sub(d.Since).Round(time.Second))
+	}
+	if d.Halted != nil {
+		fmt.Fprintf(w, "%-12s %s\n", "halted", d.Halted.Error())
+	}
+	if d.Held != nil {
+		fmt.Fprintf(w, "%-12s %s at height %d has no binary\n", "held", d.Held.Name, d.Held.Height)
+	}
+	if d.OnHold != nil {
+		fmt.Fprintf(w, "%-12s upgrades held since %s, until approved\n", "hold", d.OnHold.Since.Format(time.RFC3339))
+	}
+
+	switch {
+	case d.Status != nil && d.StatusErr == nil:
+		sync := "in sync"
+		if d.Status.CatchingUp {
+			sync = "catching up"
+		}
+		fmt.Fprintf(w, "%-12s %d, %s, last block %s ago\n", "height", d.Status.Height, sync, d.Time.Sub(d.Status.BlockTime).Round(time.Second))
+	case d.StatusErr != nil:
+		fmt.Fprintf(w, "%-12s unreachable: %v\n", "height", d.StatusErr)
+	}
+	if d.Scheduled != nil && d.Status != nil {
+		left := d.Scheduled.Height - d.Status.Height
+		eta := ""
+		if blockTime > 0 && left > 0 {
+			eta = fmt.Sprintf(", about %s", (time.Duration(left) * blockTime).Round(time.Second))
+		}
+		fmt.Fprintf(w, "%-12s %s at height %d, in %d blocks%s\n", "upgrade", d.Scheduled.Name, d.Scheduled.Height, left, eta)
+	}
+
+	fmt.Fprintf(w, "\nrecent events\n")
+	if len(d.Events) == 0 {
+		fmt.Fprintf(w, "  none\n")
+	}
+	for i := len(d.Events) - 1; i >= 0; i-- {
+		e := d.Events[i]
+		fmt.Fprintf(w, "  %s  %-20s %s\n", e.Time.Format(time.RFC3339), e.Type, e.Upgrade)
+	}
+}
+
+// topKeys are the actions top takes through the admin api, by the key entered
+var topKeys = map[string]struct {
+	method, path string
+}{
+	"r": {"POST", restartPath},
+	"h": {"POST", holdPath},
+	"a": {"DELETE", holdPath},
+}
+
+// topAction takes the action of key through the admin api of the running upgrade manager, and returns its answer
+func (cfg *Config) topAction(key string) (string, error) {
+	action, ok := topKeys[key]
+	if !ok {
+		return "", errors.Errorf("unknown key %s", key)
+	}
+	answer, err := cfg.callAdmin(action.method, action.path, nil)
+	return strings.TrimSpace(answer), err
+}
+
+// cmdTop shows a live view of the daemon, refreshed every -interval until q is entered. r restarts the daemon,
+// h holds upgrades and a approves them, through the admin api. With -once, it prints the view once, for scripts,
+// and with -output json it prints the dashboard as json once.
+func cmdTop(cfg *Config, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("top", flag.ContinueOnError)
+	flags.SetOutput(out)
+	interval := flags.Duration("interval", 2*time.Second, "how often to refresh")
+	once := flags.Bool("once", false, "print once and exit")
+	output := flags.String("output", "text", "text, or json to print the dashboard as json once")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	switch *output {
+	case "json":
+		d, err := cfg.Snapshot()
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(d)
+	case "text":
+	default:
+		return errors.Errorf("-output must be text or json, not %s", *output)
+	}
+	if *once {
+		d, err := cfg.Snapshot()
+		if err != nil {
+			return err
+		}
+		d.Render(out, 0)
+		return nil
+	}
+
+	quit := make(chan struct{})
+	keys := make(chan string)
+	go func() {
+		input := bufio.NewScanner(os.Stdin)
+		for input.Scan() {
+			key := strings.TrimSpace(input.Text())
+			if key == "q" {
+				break
+			}
+			if key != "" {
+				keys <- key
+			}
+		}
+		close(quit)
+	}()
+	help := "q quits, r restarts the daemon, h holds upgrades, a approves them (each + enter)"
+	if cfg.AdminAddress == "" {
+		help = fmt.Sprintf("q + enter quits, r, h and a need %s", cfg.envName("DAEMON_ADMIN_ADDRESS"))
+	}
+	var answer string
+
+	// the block time is estimated from the heights we saw
+	var first *NodeStatus
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		d, err := cfg.Snapshot()
+		if err != nil {
+			return err
+		}
+		var blockTime time.Duration
+		if d.Status != nil && d.StatusErr == nil {
+			if first == nil {
+				first = d.Status
+			} else if d.Status.Height > first.Height {
+				blockTime = d.Status.BlockTime.Sub(first.BlockTime) / time.Duration(d.Status.Height-first.Height)
+			}
+		}
+		// clear the screen and draw from the top
+		fmt.Fprint(out, "\x1b[H\x1b[2J")
+		d.Render(out, blockTime)
+		if answer != "" {
+			fmt.Fprintf(out, "\n%s\n", answer)
+		}
+		fmt.Fprintf(out, "\n%s\n", help)
+		select {
+		case <-quit:
+			return nil
+		case key := <-keys:
+			if answer, err = cfg.topAction(key); err != nil {
+				answer = err.Error()
+			}
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTop(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+
+	plans := &planNode{height: 90, plan: encodeCurrentPlan("chain3", 100, "{}")}
+	blockTime := time.Now().Add(-3 * time.Second).UTC()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/status" {
+			fmt.Fprintf(w, `{"jsonrpc":"2.0","id":-1,"result":{"sync_info":{"latest_block_height":"90","latest_block_time":"%s","catching_up":false}}}`, blockTime.Format(time.RFC3339Nano))
+			return
+		}
+		plans.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	cfg := &Config{Home: home, Name: "dummyd", RPCAddress: srv.URL}
+	require.NoError(t, cfg.SetCurrentUpgrade("chain2"))
+	require.NoError(t, cfg.RecordHistory(HistoryEntry{Type: "upgraded", Upgrade: "chain2"}))
+	require.NoError(t, cfg.HoldPlan(&UpgradeInfo{Name: "chain3", Height: 100}))
+
+	d, err := cfg.Snapshot()
+	require.NoError(t, err)
+	assert.Equal(t, "chain2", d.Upgrade)
+	assert.False(t, d.Since.IsZero())
+	require.NoError(t, d.StatusErr)
+	assert.Equal(t, int64(90), d.Status.Height)
+	assert.Equal(t, &UpgradeInfo{Name: "chain3", Height: 100, Info: "{}"}, d.Scheduled)
+	require.Len(t, d.Events, 1)
+
+	var out bytes.Buffer
+	d.Render(&out, 6*time.Second)
+	assert.Contains(t, out.String(), "WAITING FOR BINARY")
+	assert.Contains(t, out.String(), "chain3 at height 100 has no binary")
+	assert.Contains(t, out.String(), "90, in sync, last block 3s ago")
+	assert.Contains(t, out.String(), "chain3 at height 100, in 10 blocks, about 1m0s")
+	assert.Contains(t, out.String(), "upgraded")
+
+	// the files alone are enough, if the node is down
+	srv.Close()
+	out.Reset()
+	require.NoError(t, cmdTop(cfg, []string{"-once"}, &out))
+	assert.Contains(t, out.String(), "current      chain2")
+	assert.Contains(t, out.String(), "unreachable")
+}
+
+func TestTopActions(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd", AdminToken: testAdminToken}
+	srv := httptest.NewServer(cfg.adminHandler())
+	defer srv.Close()
+	cfg.AdminAddress = strings.TrimPrefix(srv.URL, "http://")
+
+	answer, err := cfg.topAction("h")
+	require.NoError(t, err)
+	assert.Equal(t, "upgrades held", answer)
+	d, err := cfg.Snapshot()
+	require.NoError(t, err)
+	require.NotNil(t, d.OnHold)
+	var out bytes.Buffer
+	d.Render(&out, 0)
+	assert.Contains(t, out.String(), "upgrades held since")
+
+	answer, err = cfg.topAction("a")
+	require.NoError(t, err)
+	assert.Equal(t, "upgrades approved", answer)
+	hold, err := cfg.UpgradeHold()
+	require.NoError(t, err)
+	assert.Nil(t, hold)
+
+	// there is no daemon to restart
+	_, err = cfg.topAction("r")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not running")
+	_, err = cfg.topAction("x")
+	require.Error(t, err)
+
+	// nor an admin api without its address
+	cfg.AdminAddress = ""
+	_, err = cfg.topAction("h")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "DAEMON_ADMIN_ADDRESS")
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	getter "github.com/hashicorp/go-getter"
+	"github.com/pkg/errors"
+)
+
+// defaultTorrentClient fetches torrents unless DAEMON_TORRENT_CLIENT is set. Peers are served while it downloads,
+// and it is run with --seed-time=0 to return once the download is complete. Seeding afterwards is left to a run
+// of its own, see seed.
+var defaultTorrentClient = []string{"aria2c", "--follow-torrent=mem", "--bt-save-metadata=false",
+	"--summary-interval=0", "--console-log-level=warn"}
+
+// seedingDir holds what torrents are seeded from, until their seed time is over
+const seedingDir = "seeding"
+
+// isTorrent is whether artifact is fetched with BitTorrent, as a magnet: link or an http(s) url of a .torrent file
+func isTorrent(artifact string) bool {
+	u, err := url.Parse(artifact)
+	if err != nil {
+		return false
+	}
+	return u.Scheme == "magnet" || ((u.Scheme == "http" || u.Scheme == "https") && strings.HasSuffix(u.Path, ".torrent"))
+}
+
+// torrentStagedName is the name a torrent is staged with, the display name of a magnet: link (or its info hash), or
+// the name of the .torrent file without the extension
+func torrentStagedName(u *url.URL) string {
+	if u.Scheme != "magnet" {
+		return strings.TrimSuffix(path.Base(u.Path), ".torrent")
+	}
+	query := u.Query()
+	if name := query.Get("dn"); name != "" {
+		return path.Base(name)
+	}
+	return strings.TrimPrefix(strings.ToLower(query.Get("xt")), "urn:btih:")
+}
+
+// btihPattern is a BitTorrent info hash, hex or base32 encoded
+var btihPattern = regexp.MustCompile(`^(?i:[0-9a-f]{40}|[a-z2-7]{32})$`)
+
+// magnetLink builds the magnet: link for the client from the info hash of u, and its name, trackers and web seeds,
+// each escaped on its own, as the link u was parsed from is encoded again by go-getter. Anything else in the query,
+// eg. what go-getter took off, is left out.
+func magnetLink(u *url.URL) (string, error) {
+	query := u.Query()
+	hash := query.Get("xt")
+	if len(hash) < len("urn:btih:") || !strings.EqualFold(hash[:len("urn:btih:")], "urn:btih:") || !btihPattern.MatchString(hash[len("urn:btih:"):]) {
+		return "", errors.Errorf("magnet link has no info hash (xt=urn:btih:<hash>): %s", redactURL(u.String()))
+	}
+	parts := []string{"xt=urn:btih:" + hash[len("urn:btih:"):]}
+	for _, key := range []string{"dn", "xl", "tr", "ws"} {
+		for _, value := range query[key] {
+			parts = append(parts, key+"="+url.QueryEscape(value))
+		}
+	}
+	return "magnet:?" + strings.Join(parts, "&"), nil
+}
+
+// torrentGetter fetches magnet: links, and .torrent files given as torrent::<url>, with a BitTorrent client, so the
+// operators of a network share the load of an upgrade, rather than all hitting one server at its height. The
+// torrent must hold a single file, or one named after the daemon, which may be an archive. Pieces are verified by
+// the client, but the url should still carry a checksum.
+type torrentGetter struct {
+	ctx context.Context
+	// name is the daemon, the file named after it is taken from a torrent of several files
+	name    string
+	command []string
+	// what was fetched is seeded from seedDir for seedTime, if set
+	seedDir  string
+	seedTime time.Duration
+}
+
+func (g *torrentGetter) ClientMode(*url.URL) (getter.ClientMode, error) {
+	return getter.ClientModeFile, nil
+}
+
+func (g *torrentGetter) SetClient(*getter.Client) {}
+
+// Get only tells why the url cannot be fetched as a file, as fetching it as a directory is the fallback
+func (g *torrentGetter) Get(dst string, u *url.URL) error {
+	return singleFileOnly(u, "share")
+}
+
+// GetFile runs the client in a directory next to dst, which it resumes from if the download breaks off
+func (g *torrentGetter) GetFile(dst string, u *url.URL) error {
+	if len(g.command) == 0 {
+		return errors.New("no torrent client")
+	}
+	link := u.String()
+	if u.Scheme == "magnet" {
+		var err error
+		if link, err = magnetLink(u); err != nil {
+			return err
+		}
+	}
+
+	dir := dst + ".torrent"
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "creating torrent dir")
+	}
+	ctx := g.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var output bytes.Buffer
+	args := append(append([]string{}, g.command[1:]...), "--seed-time=0", "--dir="+dir, link)
+	cmd := exec.CommandContext(ctx, g.command[0], args...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	logger.Printf("fetching %s with %s", redactURL(link), g.command[0])
+	if err := cmd.Run(); err != nil {
+		out := strings.TrimSpace(output.String())
+		if len(out) > smokeTestTail {
+			out = "..." + out[len(out)-smokeTestTail:]
+		}
+		return errors.Wrapf(err, "running %s: %s", quoteArgs(cmd.Args), out)
+	}
+
+	file, err := g.pick(dir)
+	if err != nil {
+		return errors.Wrapf(err, "fetching %s", redactURL(link))
+	}
+	if g.seedTime <= 0 {
+		if err := os.Rename(file, dst); err != nil {
+			return errors.Wrap(err, "moving torrent download")
+		}
+		return os.RemoveAll(dir)
+	}
+	// the client seeds from the files as it fetched them, the upgrade gets a copy
+	if err := copyFile(file, dst, 0644); err != nil {
+		return errors.Wrap(err, "copying torrent download")
+	}
+	g.seed(dir, link)
+	return nil
+}
+
+// seed moves the fetched torrent in dir to seedDir, and has the client seed it from there for seedTime in the
+// background, so peers still fetching the upgrade are served. The client checks the files and seeds at once, as
+// they are complete. A failure is only logged, the upgrade has its binary anyway.
+func (g *torrentGetter) seed(dir, link string) {
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(g.seedDir, 0755); err != nil {
+		logger.Printf("not seeding %s: %v", redactURL(link), err)
+		return
+	}
+	// what is left from seeding when we exited is over by now
+	if previous, err := ioutil.ReadDir(g.seedDir); err == nil {
+		for _, info := range previous {
+			if time.Since(info.ModTime()) > g.seedTime+time.Minute {
+				os.RemoveAll(filepath.Join(g.seedDir, info.Name()))
+			}
+		}
+	}
+	seedDir, err := ioutil.TempDir(g.seedDir, "torrent-")
+	if err != nil {
+		logger.Printf("not seeding %s: %v", redactURL(link), err)
+		return
+	}
+	if err := os.Rename(dir, filepath.Join(seedDir, "files")); err != nil {
+		os.RemoveAll(seedDir)
+		logger.Printf("not seeding %s: %v", redactURL(link), err)
+		return
+	}
+	args := append(append([]string{}, g.command[1:]...), "--seed-time="+strconv.FormatFloat(g.seedTime.Minutes(), 'f', -1, 64),
+		"--check-integrity=true", "--dir="+filepath.Join(seedDir, "files"), link)
+	cmd := exec.Command(g.command[0], args...)
+	if err := cmd.Start(); err != nil {
+		os.RemoveAll(seedDir)
+		logger.Printf("not seeding %s: %v", redactURL(link), err)
+		return
+	}
+	logger.Printf("seeding %s for %s", redactURL(link), g.seedTime)
+	go func() {
+		// the client stops by itself once the seed time is over, this only keeps one that hangs from seeding forever
+		timer := time.AfterFunc(g.seedTime+time.Minute, func() { _ = cmd.Process.Kill() })
+		if err := cmd.Wait(); err != nil {
+			logger.Printf("seeding %s stopped: %v", redactURL(link), err)
+		}
+		timer.Stop()
+		os.RemoveAll(seedDir)
+	}()
+}
+
+// pick takes the only file the torrent held, or the one named after the daemon
+func (g *torrentGetter) pick(dir string) (string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// the client keeps its state in .aria2 files
+		if info.Mode().IsRegular() && !strings.HasSuffix(path, ".aria2") && !strings.HasSuffix(path, ".torrent") {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 1 {
+		return files[0], nil
+	}
+	var names []string
+	for _, file := range files {
+		if base := filepath.Base(file); base == g.name || base == g.name+".exe" {
+			return file, nil
+		}
+		rel, _ := filepath.Rel(dir, file)
+		names = append(names, rel)
+	}
+	if len(files) == 0 {
+		return "", errors.New("the torrent held no files")
+	}
+	return "", errors.Errorf("the torrent has no file named %s, only %s", g.name, strings.Join(names, ", "))
+}
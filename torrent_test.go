@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadTorrent(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as torrent client")
+	}
+	bin, err := filepath.Abs("testdata/repo/raw_binary/autod")
+	require.NoError(t, err)
+	dir, err := ioutil.TempDir("", "torrent-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	// the client "downloads" the binary, with a readme next to it for a torrent of several files
+	client := filepath.Join(dir, "aria2c")
+	require.NoError(t, ioutil.WriteFile(client, []byte(fmt.Sprintf(`#!/bin/sh
+for arg; do
+	case "$arg" in
+	--dir=*) dir="${arg#--dir=}" ;;
+	--seed-time=*) seed="${arg#--seed-time=}" ;;
+	esac
+	link="$arg"
+done
+if [ "$seed" != 0 ]; then
+	[ -f "$dir/release/autod" ] && echo "$seed $link" > %[1]s/seeded
+	exit 0
+fi
+echo "$link" > %[1]s/link
+case "$link" in
+*fail*) echo "no peers" >&2; exit 1 ;;
+esac
+mkdir -p "$dir/release"
+cp %[2]s "$dir/release/autod"
+echo "$dir" > "$dir/autod.aria2"
+case "$link" in
+*several*) echo "read me" > "$dir/release/README.md" ;;
+esac
+`, dir, bin)), 0755))
+
+	const hash = "c12fe1c06bba254a9dc9f519b335aa7c1367a88a"
+	cases := map[string]struct {
+		url  string
+		link string
+		seed time.Duration
+		err  string
+	}{
+		"magnet": {
+			url:  fmt.Sprintf("magnet:?xt=urn:btih:%s&dn=autod&checksum=sha256:%s", hash, autodSHA256),
+			link: fmt.Sprintf("magnet:?xt=urn:btih:%s&dn=autod", hash),
+		},
+		"magnet with trackers": {
+			url: fmt.Sprintf("magnet:?xt=urn:btih:%s&dn=autod&tr=%s&tr=%s&checksum=sha256:%s", hash,
+				url.QueryEscape("udp://tracker.example.com:1337/announce"), url.QueryEscape("https://t.example.org/announce?key=a&b"), autodSHA256),
+			link: fmt.Sprintf("magnet:?xt=urn:btih:%s&dn=autod&tr=%s&tr=%s", hash,
+				url.QueryEscape("udp://tracker.example.com:1337/announce"), url.QueryEscape("https://t.example.org/announce?key=a&b")),
+		},
+		"seeded": {
+			url:  fmt.Sprintf("magnet:?xt=urn:btih:%s&dn=autod&checksum=sha256:%s", hash, autodSHA256),
+			link: fmt.Sprintf("magnet:?xt=urn:btih:%s&dn=autod", hash),
+			seed: 90 * time.Second,
+		},
+		"no info hash": {
+			url: "magnet:?dn=autod&checksum=sha256:" + autodSHA256,
+			err: "no info hash",
+		},
+		"torrent file": {
+			url:  "https://example.com/several/autod.torrent?checksum=sha256:" + autodSHA256,
+			link: "https://example.com/several/autod.torrent",
+		},
+		"wrong checksum": {
+			url: fmt.Sprintf("magnet:?xt=urn:btih:%s&checksum=sha256:%064d", hash, 0),
+			err: "checksum",
+		},
+		"client fails": {
+			url: "https://example.com/fail/autod.torrent",
+			err: "no peers",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			home, err := copyTestData("download")
+			require.NoError(t, err)
+			defer os.RemoveAll(home)
+			os.Remove(filepath.Join(dir, "seeded"))
+			cfg := &Config{Home: home, Name: "autod", AllowDownloadBinaries: true, TorrentClient: []string{client}, TorrentSeedTime: tc.seed}
+			info := fmt.Sprintf(`{"binaries":{"%s":"%s"}}`, osArch(), tc.url)
+			err = DownloadBinary(cfg, &UpgradeInfo{Name: "v2", Info: info})
+			if tc.err != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+			hash, err := sha256File(cfg.UpgradeBin("v2"))
+			require.NoError(t, err)
+			assert.Equal(t, autodSHA256, hash)
+			link, err := ioutil.ReadFile(filepath.Join(dir, "link"))
+			require.NoError(t, err)
+			assert.Equal(t, tc.link+"\n", string(link))
+			// nothing stays staged
+			entries, _ := ioutil.ReadDir(filepath.Join(cfg.Root(), downloadsDir))
+			assert.Empty(t, entries)
+
+			// it is seeded from the files as fetched, in the background, which are removed afterwards
+			seeded, err := ioutil.ReadFile(filepath.Join(dir, "seeded"))
+			if tc.seed == 0 {
+				assert.True(t, os.IsNotExist(err))
+				return
+			}
+			require.Eventually(t, func() bool {
+				seeded, err = ioutil.ReadFile(filepath.Join(dir, "seeded"))
+				entries, _ := ioutil.ReadDir(filepath.Join(cfg.Root(), seedingDir))
+				return err == nil && len(entries) == 0
+			}, 5*time.Second, 10*time.Millisecond)
+			assert.Equal(t, "1.5 "+tc.link+"\n", string(seeded))
+		})
+	}
+}
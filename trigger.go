@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+const triggerFile = "trigger.json"
+
+// TriggerFile is where the operator drops an upgrade to force, outside of any on-chain plan
+func (cfg *Config) TriggerFile() string {
+	return filepath.Join(cfg.Root(), triggerFile)
+}
+
+// PendingTrigger returns the upgrade in the trigger file, or nil if there is none
+// (or it names the upgrade we already run)
+func (cfg *Config) PendingTrigger() (*UpgradeInfo, error) {
+	return cfg.pendingUpgrade(cfg.TriggerFile())
+}
+
+// WriteTrigger makes info the pending trigger, the file is replaced at once so a check never reads half of it
+func (cfg *Config) WriteTrigger(info *UpgradeInfo) error {
+	bz, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "encode trigger")
+	}
+	tmp := cfg.TriggerFile() + ".tmp"
+	if err := ioutil.WriteFile(tmp, bz, 0644); err != nil {
+		return errors.Wrap(err, "writing trigger")
+	}
+	return errors.Wrap(os.Rename(tmp, cfg.TriggerFile()), "writing trigger")
+}
+
+// releaseTrigger removes the trigger file once the named upgrade was applied
+func (cfg *Config) releaseTrigger(upgradeName string) {
+	releaseUpgradeFile(cfg.TriggerFile(), upgradeName)
+}
+
+// Trigger fires the pending trigger once the node reached its height (or right away without one).
+// SIGUSR1 forces it to fire on the next check, whatever the height.
+type Trigger struct {
+	cfg     *Config
+	heights *Heights
+	force   chan os.Signal
+}
+
+// NewTrigger starts listening for SIGUSR1, Stop must be called when the daemon exited
+func (cfg *Config) NewTrigger(heights *Heights) *Trigger {
+	t := &Trigger{cfg: cfg, heights: heights, force: make(chan os.Signal, 1)}
+	notifyForce(t.force)
+	return t
+}
+
+// Stop no longer listens for the signal
+func (t *Trigger) Stop() {
+	stopForce(t.force)
+}
+
+// Check returns the pending trigger, once it is due
+func (t *Trigger) Check() (*UpgradeInfo, error) {
+	forced := false
+	select {
+	case <-t.force:
+		forced = true
+	default:
+	}
+	info, err := t.cfg.PendingTrigger()
+	if err != nil || info == nil {
+		if forced && err == nil {
+			logger.Printf("received signal to force an upgrade, but there is no %s", t.cfg.TriggerFile())
+		}
+		return nil, err
+	}
+	if forced || info.Height <= 0 {
+		return info, nil
+	}
+	// like a plan, the new binary has to run block Height
+	height, err := t.heights.Height("trigger")
+	if err != nil {
+		return nil, nil
+	}
+	if height >= info.Height-1 {
+		return info, nil
+	}
+	return nil, nil
+}
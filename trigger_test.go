@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPendingTrigger(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd"}
+
+	cases := map[string]struct {
+		content string
+		info    *UpgradeInfo
+		isErr   bool
+	}{
+		"with height": {content: `{"name":"chain2","height":"120"}`, info: &UpgradeInfo{Name: "chain2", Height: 120}},
+		"right away":  {content: `{"name":"chain3"}`, info: &UpgradeInfo{Name: "chain3"}},
+		"no name":     {content: `{"height":120}`, isErr: true},
+		"broken":      {content: `{"name":`, isErr: true},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, ioutil.WriteFile(cfg.TriggerFile(), []byte(tc.content), 0644))
+			info, err := cfg.PendingTrigger()
+			if tc.isErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.info, info)
+		})
+	}
+
+	// the upgrade we run is no longer pending, and applying it removes the file
+	require.NoError(t, ioutil.WriteFile(cfg.TriggerFile(), []byte(`{"name":"chain2"}`), 0644))
+	require.NoError(t, cfg.SetCurrentUpgrade("chain2"))
+	info, err := cfg.PendingTrigger()
+	require.NoError(t, err)
+	assert.Nil(t, info)
+	cfg.releaseTrigger("chain3")
+	assert.FileExists(t, cfg.TriggerFile())
+	cfg.releaseTrigger("chain2")
+	_, err = os.Stat(cfg.TriggerFile())
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func notifyForce(c chan os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
+
+func stopForce(c chan os.Signal) {
+	signal.Stop(c)
+}
@@ -0,0 +1,88 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLaunchProcessTrigger(t *testing.T) {
+	script := `#!/bin/sh
+while true; do sleep 0.1; done
+`
+	cases := map[string]struct {
+		trigger string
+		signal  bool
+	}{
+		"right away":    {trigger: `{"name":"chain2"}`},
+		"forced signal": {trigger: `{"name":"chain2","height":1000}`, signal: true},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			home, err := copyTestData("validate")
+			require.NoError(t, err)
+			defer os.RemoveAll(home)
+
+			cfg := &Config{Home: home, Name: "dummyd", UnsafeSkipBackup: true, PollInterval: 50 * time.Millisecond}
+			require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+			require.NoError(t, ioutil.WriteFile(cfg.TriggerFile(), []byte(tc.trigger), 0644))
+			if tc.signal {
+				go func() {
+					time.Sleep(200 * time.Millisecond)
+					syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+				}()
+			}
+
+			var stdout, stderr bytes.Buffer
+			require.NoError(t, LaunchProcess(cfg, []string{"start"}, &stdout, &stderr))
+			assert.Equal(t, cfg.UpgradeBin("chain2"), cfg.CurrentBin())
+			_, err = os.Stat(cfg.TriggerFile())
+			assert.True(t, os.IsNotExist(err))
+		})
+	}
+
+	// a trigger with a height applies once the daemon cleanly stopped there
+	exits := map[string]struct {
+		script  string
+		err     bool
+		applied bool
+	}{
+		"at the height":     {script: "echo 'INF committed state app_hash=AB height=999 module=state'\nsleep 0.3\n", applied: true},
+		"at a halt there":   {script: "echo 'INF committed state app_hash=AB height=1000 module=state'\nsleep 0.3\n", applied: true},
+		"too early":         {script: "echo 'INF committed state app_hash=AB height=900 module=state'\nsleep 0.3\n"},
+		"at unknown height": {script: "sleep 0.3\n"},
+		"crashed":           {script: "echo 'INF committed state app_hash=AB height=998 module=state'\nsleep 0.3\nexit 1\n", err: true},
+	}
+	for name, tc := range exits {
+		t.Run(name, func(t *testing.T) {
+			home, err := copyTestData("validate")
+			require.NoError(t, err)
+			defer os.RemoveAll(home)
+			cfg := &Config{Home: home, Name: "dummyd", UnsafeSkipBackup: true, PollInterval: 50 * time.Millisecond, HeightSources: []string{"output"}}
+			require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte("#!/bin/sh\n"+tc.script), 0755))
+			require.NoError(t, ioutil.WriteFile(cfg.TriggerFile(), []byte(`{"name":"chain3","height":1000}`), 0644))
+			var stdout, stderr bytes.Buffer
+			err = LaunchProcess(cfg, []string{"start"}, &stdout, &stderr)
+			if tc.err {
+				assert.True(t, crashed(err), "%v", err)
+			} else {
+				assert.NoError(t, err)
+			}
+			if tc.applied {
+				assert.Equal(t, cfg.UpgradeBin("chain3"), cfg.CurrentBin())
+			} else {
+				assert.Equal(t, cfg.GenesisBin(), cfg.CurrentBin())
+			}
+		})
+	}
+}
@@ -0,0 +1,9 @@
+package main
+
+import "os"
+
+// there is no SIGUSR1 on windows, only the trigger file works
+
+func notifyForce(c chan os.Signal) {}
+
+func stopForce(c chan os.Signal) {}
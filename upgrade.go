@@ -1,14 +1,18 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
+	"time"
 
 	getter "github.com/hashicorp/go-getter"
 	"github.com/pkg/errors"
@@ -18,58 +22,339 @@ import (
 // We can now make any changes to the underlying directory without interferance and leave it
 // in a state, so we can make a proper restart
 func DoUpgrade(cfg *Config, info *UpgradeInfo) error {
+	// an operator may hold upgrades, eg. from top
+	if err := cfg.awaitApproval(context.Background(), info); err != nil {
+		return err
+	}
+	// wait for a download started ahead of time
+	downloading.Lock()
+	defer downloading.Unlock()
 	err := EnsureBinary(cfg.UpgradeBin(info.Name))
 
 	// Simplest case is to switch the link
 	if err == nil {
 		// we have the binary - do it
-		return cfg.SetCurrentUpgrade(info.Name)
+		return cfg.testAndSwitch(info)
 	}
 
-	// if auto-download is disabled, we fail
+	// if auto-download is disabled, we fail (or wait for the binary), but remember the plan so it can be exported
 	if !cfg.AllowDownloadBinaries {
-		return errors.Wrap(err, "binary not present, downloading disabled")
+		if err := cfg.HoldPlan(info); err != nil {
+			logger.Printf("cannot hold plan: %v", err)
+		}
+		if !cfg.WaitForBinary {
+			return errors.Wrap(err, "binary not present, downloading disabled")
+		}
+		// a download ahead of time of the next upgrade must not wait for us meanwhile
+		downloading.Unlock()
+		err := cfg.AwaitBinary(context.Background(), info)
+		downloading.Lock()
+		if err != nil {
+			return err
+		}
+		return cfg.testAndSwitch(info)
 	}
+	// another upgrade manager sharing the upgrades dir may be downloading it already, then we take its binary
+	lock, err := cfg.LockDownload(context.Background(), info.Name)
+	if err != nil {
+		return err
+	}
+	if err = EnsureBinary(cfg.UpgradeBin(info.Name)); err != nil {
+		err = cfg.downloadUpgrade(info)
+	}
+	lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return cfg.testAndSwitch(info)
+}
+
+// downloadUpgrade downloads the binary of an upgrade at its height, holding its download lock
+func (cfg *Config) downloadUpgrade(info *UpgradeInfo) error {
 	// if the dir is there already, don't download either
-	_, err = os.Stat(cfg.UpgradeDir(info.Name))
+	_, err := os.Stat(cfg.UpgradeDir(info.Name))
 	if !os.IsNotExist(err) {
 		return errors.Errorf("upgrade dir already exists, won't overwrite")
 	}
 
+	// make some room before downloading, if we are short on disk
+	if err := cfg.PruneIfLowOnSpace(); err != nil {
+		logger.Printf("cannot prune upgrades: %v", err)
+	}
+
 	// If not there, then we try to download it... maybe
-	if err := DownloadBinary(cfg, info); err != nil {
+	if err := cfg.downloadWithRetries(info); err != nil {
+		if err := cfg.HoldPlan(info); err != nil {
+			logger.Printf("cannot hold plan: %v", err)
+		}
 		return errors.Wrap(err, "cannot download binary")
 	}
 
 	// and then set the binary again
 	err = EnsureBinary(cfg.UpgradeBin(info.Name))
+	return errors.Wrap(err, "downloaded binary doesn't check out")
+}
+
+// testAndSwitch smoke tests the binary of the upgrade, and switches to it if it passes (and the pre-switch hook)
+func (cfg *Config) testAndSwitch(info *UpgradeInfo) error {
+	version, err := cfg.smokeTest(info)
 	if err != nil {
-		return errors.Wrap(err, "downloaded binary doesn't check out")
+		return err
+	}
+	if err := cfg.preSwitch(info); err != nil {
+		return err
 	}
-	return cfg.SetCurrentUpgrade(info.Name)
+	if err := cfg.switchUpgrade(info.Name, version); err != nil {
+		return err
+	}
+	if err := cfg.awaitPostUpgrade(info); err != nil {
+		logger.Printf("cannot record post-upgrade: %v", err)
+	}
+	return nil
+}
+
+// switchUpgrade backs up the data, points current to the named upgrade, and then cleans up
+// what we no longer need, if we are low on disk. version is what the binary reported, if it was smoke tested.
+func (cfg *Config) switchUpgrade(upgradeName, version string) error {
+	if err := cfg.BackupData(upgradeName); err != nil {
+		return err
+	}
+	cfg.compactBackups()
+	if err := cfg.SetCurrentUpgrade(upgradeName); err != nil {
+		return err
+	}
+	if err := cfg.preUpgrade(upgradeName); err != nil {
+		return err
+	}
+	cfg.releasePlan(upgradeName)
+	cfg.releaseTrigger(upgradeName)
+	cfg.releaseSchedule(upgradeName)
+	entry := HistoryEntry{Type: "upgraded", Upgrade: upgradeName}
+	if version != "" {
+		entry.Fields = map[string]string{"version": version}
+	}
+	if err := cfg.RecordHistory(entry); err != nil {
+		logger.Printf("cannot record history: %v", err)
+	}
+	if err := cfg.PruneIfLowOnSpace(); err != nil {
+		logger.Printf("cannot prune upgrades: %v", err)
+	}
+	return nil
+}
+
+// retryJitter spreads the retries of downloads, which are serialized by downloading
+var retryJitter = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// downloadWithRetries retries a failed download DownloadRetries times, each from an empty upgrade dir, for at
+// most DownloadTotalTimeout in all
+func (cfg *Config) downloadWithRetries(info *UpgradeInfo) error {
+	ctx := context.Background()
+	if cfg.DownloadTotalTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.DownloadTotalTimeout)
+		defer cancel()
+	}
+	err := cfg.downloadBinary(ctx, info)
+	for attempt := 1; err != nil && ctx.Err() == nil && attempt <= cfg.DownloadRetries; attempt++ {
+		delay := cfg.retryDelay(attempt, retryJitter.Float64())
+		logger.Printf("cannot download %s (%v), retrying in %s (%d/%d)", info.Name, err, delay.Round(time.Millisecond), attempt, cfg.DownloadRetries)
+		os.RemoveAll(cfg.UpgradeDir(info.Name))
+		select {
+		case <-time.After(delay):
+			err = cfg.downloadBinary(ctx, info)
+		case <-ctx.Done():
+		}
+	}
+	if err != nil && ctx.Err() != nil {
+		os.RemoveAll(cfg.UpgradeDir(info.Name))
+		return errors.Errorf("downloading %s took longer than %s (%s), last error: %v", info.Name, cfg.DownloadTotalTimeout,
+			cfg.envName("DAEMON_DOWNLOAD_TOTAL_TIMEOUT"), err)
+	}
+	return err
+}
+
+// retryDelay is how long to wait before retry attempt (from 1): DownloadRetryDelay doubled for every retry
+// before, at most DownloadRetryMaxDelay. So that a fleet halted at the same height doesn't retry in lockstep,
+// only half of it is certain, the rest is spread by jitter (from 0 to 1).
+func (cfg *Config) retryDelay(attempt int, jitter float64) time.Duration {
+	delay := cfg.DownloadRetryDelay
+	max := orDefault(cfg.DownloadRetryMaxDelay, defaultDownloadRetryMaxDelay)
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay/2 + time.Duration(jitter*float64(delay/2))
 }
 
 // DownloadBinary will grab the binary and place it in the proper directory
 func DownloadBinary(cfg *Config, info *UpgradeInfo) error {
-	url, err := GetDownloadURL(info)
+	return cfg.downloadBinary(context.Background(), info)
+}
+
+// downloadBinary works like DownloadBinary, but gives up once ctx is done
+func (cfg *Config) downloadBinary(ctx context.Context, info *UpgradeInfo) error {
+	opts := cfg.downloadOptions(ctx)
+	config, err := GetUpgradeConfig(info, opts...)
+	if err != nil {
+		return err
+	}
+	if cfg.ContainerRuntime != "" {
+		if config.Image == "" {
+			return errors.Errorf("upgrade %s has no image, and %s is set", info.Name, cfg.envName("DAEMON_CONTAINER_RUNTIME"))
+		}
+		return cfg.PullImage(cfg.UpgradeDir(info.Name), config.Image)
+	}
+	url, err := config.URL()
+	// a release reference is looked up with the api of the hosting site
+	var artifact *Artifact
+	if err == nil && isReleaseRef(url) {
+		artifact, err = cfg.ResolveRelease(url)
+	}
+	// without a prebuilt binary for this platform, we may build it ourselves
+	if errors.Cause(err) == errNoArtifact && cfg.BuildCommand != "" {
+		if source := config.BuildSource(url); source != nil {
+			return cfg.BuildBinary(info.Name, source)
+		}
+	}
 	if err != nil {
 		return err
 	}
+	if artifact != nil {
+		url = artifact.URL
+		if config.SHA256Sums == "" {
+			config.SHA256Sums = artifact.SHA256Sums
+		}
+	}
+	// the manifest tells us which checksum to expect
+	if config.SHA256Sums != "" {
+		if url, err = cfg.ChecksumFromManifest(url, config.SHA256Sums, opts...); err != nil {
+			return err
+		}
+	}
+	if sum := config.Checksum(); sum != "" {
+		if sum, err = parseSHA256(sum); err != nil {
+			return err
+		}
+		if url, err = withChecksum(url, sum); err != nil {
+			return err
+		}
+	}
+	if err := checkURLChecksum(url); err != nil {
+		return err
+	}
+	// an oci artifact pinned by digest is verified against it
+	if cfg.RequireChecksum && !hasChecksum(url) && !ociPinned(url) {
+		return errors.Errorf("no sha256 to verify %s with, and %s is on", url, cfg.envName("DAEMON_REQUIRE_CHECKSUM"))
+	}
 
-	// download into the bin dir (works for one file)
+	// a patch of the current binary is a fraction of the download, which is the fallback
+	patched := false
+	if cfg.DownloadPatches && len(config.BinaryPatches()) > 0 {
+		if err := cfg.patchBinary(info.Name, url, config.BinaryPatches(), opts); err != nil {
+			logger.Printf("cannot patch the binary of %s (%v), downloading it in full", info.Name, err)
+			os.RemoveAll(cfg.UpgradeDir(info.Name))
+		} else {
+			patched = true
+		}
+	}
+	if !patched {
+		// the release server is the first of the urls we try, mirrors take over if it fails
+		urls, err := cfg.downloadURLs(url, config.MirrorURLs())
+		if err != nil {
+			return err
+		}
+		for i, url := range urls {
+			if err = cfg.fetchBinary(info.Name, url, config.BinarySignatures(), config.BinaryProvenance(), config.Executable(), opts); err == nil {
+				break
+			}
+			if i+1 < len(urls) {
+				logger.Printf("cannot download %s from %s (%v), trying %s", info.Name, url, err, urls[i+1])
+				os.RemoveAll(cfg.UpgradeDir(info.Name))
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := cfg.checkUpgradeSize(info.Name); err != nil {
+		os.RemoveAll(cfg.UpgradeDir(info.Name))
+		return err
+	}
 	binPath := cfg.UpgradeBin(info.Name)
-	err = getter.GetFile(binPath, url)
+	// if it is successful, let's ensure the binary is executable
+	if err := MarkExecutable(binPath); err != nil {
+		return err
+	}
+	if err := cfg.prepareBinary(cfg.UpgradeDir(info.Name), binPath); err != nil {
+		return err
+	}
+	// and keep only one copy of identical files
+	if err := cfg.AddToCache(cfg.UpgradeDir(info.Name)); err != nil {
+		return err
+	}
+	if artifact != nil {
+		return cfg.writeReleaseNotes(info.Name, artifact)
+	}
+	return nil
+}
 
-	// if this fails, let's see if it is a zipped directory
+// fetchBinary downloads the binary of upgradeName from url, a single file or an archive of the upgrade dir.
+// If artifacts must be signed, it is verified against signatures (by verifier, or else the ones published next to it)
+// and provenance first. An archive is unpacked into the upgrade dir, with the binary at executable in it, or found by its name.
+func (cfg *Config) fetchBinary(upgradeName, url string, signatures map[string]string, provenance, executable string, opts []getter.ClientOption) error {
+	artifact := url
+	url, err := sourceURL(url)
 	if err != nil {
-		dirPath := cfg.UpgradeDir(info.Name)
-		err = getter.Get(dirPath, url)
+		return err
 	}
+	if err := cfg.requireHTTPS(url); err != nil {
+		return err
+	}
+	source, err := cfg.stageDownload(url, opts...)
 	if err != nil {
 		return err
 	}
-	// if it is successful, let's ensure the binary is executable
-	return MarkExecutable(binPath)
+	if cfg.verifiesArtifacts() {
+		if err := cfg.verifyArtifact(artifact, source, signatures, provenance, opts); err != nil {
+			cfg.removeStaged(url)
+			cfg.dropFromSharedCache(url)
+			return err
+		}
+	}
+	local := opts
+	if source != url {
+		local = copyingOptions(opts)
+	}
+	if source, err = detectArchive(source); err != nil {
+		return err
+	}
+
+	// download into the bin dir (works for one file)
+	err = getter.GetFile(cfg.UpgradeBin(upgradeName), source, local...)
+
+	// if this fails, let's see if it is a zipped directory, or a release archive with the binary somewhere in it
+	if err != nil {
+		// an archive of many files may have left its first one as the binary
+		os.Remove(cfg.UpgradeBin(upgradeName))
+		fileErr := err
+		err = getter.Get(cfg.UpgradeDir(upgradeName), source, local...)
+		if err == nil {
+			err = cfg.installExecutable(upgradeName, executable)
+		} else {
+			// the getters of single files only (see singleFileOnly) fail at once here, so tell both
+			err = errors.Errorf("%v (as a directory: %v)", fileErr, err)
+		}
+	}
+	// a staged file which doesn't check out is downloaded again from scratch
+	if err == nil {
+		cfg.addToSharedCache(url)
+	} else {
+		cfg.dropFromSharedCache(url)
+	}
+	cfg.removeStaged(url)
+	return err
 }
 
 // MarkExecutable will try to set the executable bits if not already set
@@ -91,43 +376,208 @@ func MarkExecutable(path string) error {
 // UpgradeConfig is expected format for the info field to allow auto-download
 type UpgradeConfig struct {
 	Binaries map[string]string `json:"binaries"`
+	// Checksums optionally hold the sha256 of each binary, by the same platforms
+	Checksums map[string]string `json:"checksums,omitempty"`
+	// Signatures optionally link to the signatures of each binary by verifier (gpg, minisign or cosign), if they
+	// aren't published next to it
+	Signatures map[string]map[string]string `json:"signatures,omitempty"`
+	// Provenance optionally links to the SLSA provenance of each binary, if it isn't published next to it
+	Provenance map[string]string `json:"provenance,omitempty"`
+	// Executables optionally tell where the binary is in each archive, if it isn't bin/$DAEMON_NAME
+	Executables map[string]string `json:"executables,omitempty"`
+	// Mirrors optionally list other urls of each binary, tried in order if the one in Binaries fails
+	Mirrors map[string][]string `json:"mirrors,omitempty"`
+	// SHA256Sums optionally links to a SHA256SUMS manifest listing the binaries
+	SHA256Sums string `json:"sha256sums,omitempty"`
+	// Image the upgrade runs in instead of a binary, with DAEMON_CONTAINER_RUNTIME set
+	Image string `json:"image,omitempty"`
+	// Version optionally is what the binary reports when smoke tested, eg. v2.0.1
+	Version string `json:"version,omitempty"`
+	// Patches optionally turn earlier binaries into the one for each platform, with DAEMON_DOWNLOAD_PATCHES on
+	Patches map[string][]Patch `json:"patches,omitempty"`
+	// Source is built from, if there is no binary for this platform and building is enabled
+	Source *UpgradeSource `json:"source,omitempty"`
+}
+
+// anyPlatform is the key of a binary that runs everywhere (eg. a script), as cosmovisor allows
+const anyPlatform = "any"
+
+// URL returns the binary for this os/arch, or the one for any platform
+func (c *UpgradeConfig) URL() (string, error) {
+	for _, platform := range []string{osArch(), anyPlatform} {
+		if url := c.Binaries[platform]; url != "" {
+			return url, nil
+		}
+	}
+	platforms := make([]string, 0, len(c.Binaries))
+	for platform := range c.Binaries {
+		platforms = append(platforms, platform)
+	}
+	sort.Strings(platforms)
+	return "", errors.Wrapf(errNoArtifact, "cannot find binary for os/arch %s (only for %s)", osArch(), strings.Join(platforms, ", "))
+}
+
+// Checksum returns the sha256 listed for the binary URL returns, if there is one
+func (c *UpgradeConfig) Checksum() string {
+	for _, platform := range []string{osArch(), anyPlatform} {
+		if c.Binaries[platform] != "" {
+			return c.Checksums[platform]
+		}
+	}
+	return ""
+}
+
+// BinarySignatures returns the signatures listed for the binary URL returns by verifier, if there are any
+func (c *UpgradeConfig) BinarySignatures() map[string]string {
+	for _, platform := range []string{osArch(), anyPlatform} {
+		if c.Binaries[platform] != "" {
+			return c.Signatures[platform]
+		}
+	}
+	return nil
+}
+
+// BinaryProvenance returns the provenance listed for the binary URL returns, if there is one
+func (c *UpgradeConfig) BinaryProvenance() string {
+	for _, platform := range []string{osArch(), anyPlatform} {
+		if c.Binaries[platform] != "" {
+			return c.Provenance[platform]
+		}
+	}
+	return ""
+}
+
+// Executable returns the path of the binary in the archive URL returns, if there is one
+func (c *UpgradeConfig) Executable() string {
+	for _, platform := range []string{osArch(), anyPlatform} {
+		if c.Binaries[platform] != "" {
+			return c.Executables[platform]
+		}
+	}
+	return ""
 }
 
 // GetDownloadURL will check if there is an arch-dependent binary specified in Info
-func GetDownloadURL(info *UpgradeInfo) (string, error) {
+// opts are used to download the reference file, if Info links to one
+func GetDownloadURL(info *UpgradeInfo, opts ...getter.ClientOption) (string, error) {
+	config, err := GetUpgradeConfig(info, opts...)
+	if err != nil {
+		return "", err
+	}
+	return config.URL()
+}
+
+// GetUpgradeConfig parses the Info field, following the link to a reference file if it holds one
+func GetUpgradeConfig(info *UpgradeInfo, opts ...getter.ClientOption) (*UpgradeConfig, error) {
 	doc := strings.TrimSpace(info.Info)
-	// if this is a url, then we download that and try to get a new doc with the real info
-	if _, err := url.Parse(doc); err == nil {
+	if doc == "" {
+		return nil, errors.New("upgrade info is empty, there is no binary map")
+	}
+	// a release reference is all we need, the asset for each platform is found when downloading
+	if isReleaseRef(doc) {
+		return &UpgradeConfig{Binaries: map[string]string{osArch(): doc}}, nil
+	}
+	// the info usually holds the binary map, otherwise we download the url (or path) it holds
+	// and try to get a new doc with the real info
+	if !strings.HasPrefix(doc, "{") {
 		tmpDir, err := ioutil.TempDir("", "upgrade-manager-reference")
 		if err != nil {
-			return "", errors.Wrap(err, "create tempdir for reference file")
+			return nil, errors.Wrap(err, "create tempdir for reference file")
 		}
 		defer os.RemoveAll(tmpDir)
 		refPath := filepath.Join(tmpDir, "ref")
-		err = getter.GetFile(refPath, doc)
+		source, err := sourceURL(doc)
 		if err != nil {
-			return "", errors.Wrapf(err, "downloading reference link %s", doc)
+			return nil, err
+		}
+		err = getter.GetFile(refPath, source, opts...)
+		if err != nil {
+			return nil, errors.Wrapf(err, "downloading reference link %s", doc)
 		}
 		refBytes, err := ioutil.ReadFile(refPath)
 		if err != nil {
-			return "", errors.Wrap(err, "reading downloaded reference")
+			return nil, errors.Wrap(err, "reading downloaded reference")
 		}
 		// if download worked properly, then we use this new file as the binary map to parse
 		doc = string(refBytes)
 	}
 
-	// check if it is the upgrade config
+	return parseUpgradeConfig(doc)
+}
+
+// parseUpgradeConfig decodes the binary map, with the platforms written like osArch returns them
+func parseUpgradeConfig(doc string) (*UpgradeConfig, error) {
 	var config UpgradeConfig
-	err := json.Unmarshal([]byte(doc), &config)
-	if err == nil {
-		url, ok := config.Binaries[osArch()]
-		if !ok {
-			return "", errors.Errorf("cannot find binary for os/arch: %s", osArch())
+	if err := json.Unmarshal([]byte(doc), &config); err != nil {
+		return nil, errors.Wrap(err, "upgrade info doesn't contain binary map")
+	}
+	// the same platform may be written several ways, eg. linux/x86_64 and linux/amd64, but must mean one binary
+	named := map[string]string{}
+	for key := range config.Binaries {
+		platform := platformKey(key)
+		if other, ok := named[platform]; ok && config.Binaries[other] != config.Binaries[key] {
+			return nil, errors.Errorf("%s and %s both name binaries for %s", other, key, platform)
+		}
+		named[platform] = key
+	}
+	binaries := make(map[string]string, len(config.Binaries))
+	for platform, url := range config.Binaries {
+		binaries[platformKey(platform)] = strings.TrimSpace(url)
+	}
+	config.Binaries = binaries
+	checksums := make(map[string]string, len(config.Checksums))
+	for platform, sum := range config.Checksums {
+		checksums[platformKey(platform)] = strings.TrimSpace(sum)
+	}
+	config.Checksums = checksums
+	signatures := make(map[string]map[string]string, len(config.Signatures))
+	for platform, sigs := range config.Signatures {
+		platform = platformKey(platform)
+		signatures[platform] = make(map[string]string, len(sigs))
+		for verifier, sig := range sigs {
+			signatures[platform][strings.ToLower(strings.TrimSpace(verifier))] = strings.TrimSpace(sig)
+		}
+	}
+	config.Signatures = signatures
+	executables := make(map[string]string, len(config.Executables))
+	for platform, path := range config.Executables {
+		executables[platformKey(platform)] = strings.TrimSpace(path)
+	}
+	config.Executables = executables
+	mirrors := make(map[string][]string, len(config.Mirrors))
+	for platform, urls := range config.Mirrors {
+		platform = platformKey(platform)
+		for _, url := range urls {
+			mirrors[platform] = append(mirrors[platform], strings.TrimSpace(url))
 		}
-		return url, nil
 	}
+	config.Mirrors = mirrors
+	return &config, nil
+}
 
-	return "", errors.New("upgrade info doesn't contain binary map")
+// platformKey writes a platform of the binary map like osArch does, regardless of case and the names other
+// tools use for the same os and arch: darwin/arm64 may be macos/aarch64, linux/amd64 linux-x86_64
+func platformKey(platform string) string {
+	platform = strings.ToLower(strings.TrimSpace(platform))
+	if platform == anyPlatform {
+		return platform
+	}
+	i := strings.IndexAny(platform, "/-_")
+	if i < 0 {
+		return platform
+	}
+	goos, goarch := platform[:i], x8664.ReplaceAllString(platform[i+1:], "amd64")
+	for name, aliases := range osNames {
+		if hasToken([]string{goos}, aliases) {
+			goos = name
+		}
+	}
+	for name, aliases := range archNames {
+		if hasToken([]string{goarch}, aliases) {
+			goarch = name
+		}
+	}
+	return goos + "/" + goarch
 }
 
 func osArch() string {
@@ -147,6 +597,15 @@ func (cfg *Config) SetCurrentUpgrade(upgradeName string) error {
 	safeName := url.PathEscape(upgradeName)
 	upgrade := filepath.Join(cfg.Root(), upgradesDir, safeName)
 
+	// or copy it, where we cannot create links
+	if cfg.CopySwitching {
+		return cfg.copyCurrent(upgrade)
+	}
+	// or just name it, where we may not create links, eg. on windows
+	if cfg.PointerSwitching {
+		return cfg.writePointer(upgrade)
+	}
+
 	// remove link if it exists
 	if _, err := os.Stat(link); err == nil {
 		os.Remove(link)
@@ -159,6 +618,56 @@ func (cfg *Config) SetCurrentUpgrade(upgradeName string) error {
 	return nil
 }
 
+// copyCurrent replaces current with a copy of the upgrade dir, for filesystems without symlinks.
+// The copy is made next to current first, so we never end up with half a binary.
+func (cfg *Config) copyCurrent(upgrade string) error {
+	cur := filepath.Join(cfg.Root(), currentLink)
+	tmp := cur + ".new"
+	if err := os.RemoveAll(tmp); err != nil {
+		return errors.Wrap(err, "cleaning up old copy")
+	}
+	if err := copyDir(upgrade, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return errors.Wrap(err, "copying upgrade to current")
+	}
+	rel, err := filepath.Rel(cfg.Root(), upgrade)
+	if err != nil {
+		return errors.Wrap(err, "copying upgrade to current")
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, currentMarker), []byte(filepath.ToSlash(rel)), 0644); err != nil {
+		os.RemoveAll(tmp)
+		return errors.Wrap(err, "marking current copy")
+	}
+
+	// this removes a symlink (not what it points to) as well as an older copy
+	if err := os.RemoveAll(cur); err != nil {
+		return errors.Wrap(err, "removing old current")
+	}
+	return errors.Wrap(os.Rename(tmp, cur), "replacing current")
+}
+
+// writePointer replaces current with a file naming the upgrade dir. It is written next to current first, so
+// current always names a whole dir.
+func (cfg *Config) writePointer(upgrade string) error {
+	cur := filepath.Join(cfg.Root(), currentLink)
+	rel, err := filepath.Rel(cfg.Root(), upgrade)
+	if err != nil {
+		return errors.Wrap(err, "writing current pointer")
+	}
+	tmp := cur + ".new"
+	if err := ioutil.WriteFile(tmp, []byte(filepath.ToSlash(rel)+"\n"), 0644); err != nil {
+		return errors.Wrap(err, "writing current pointer")
+	}
+	// a symlink or a copy from another mode cannot be renamed over
+	if info, err := os.Lstat(cur); err == nil && !info.Mode().IsRegular() {
+		if err := os.RemoveAll(cur); err != nil {
+			os.Remove(tmp)
+			return errors.Wrap(err, "removing old current")
+		}
+	}
+	return errors.Wrap(os.Rename(tmp, cur), "replacing current")
+}
+
 // EnsureBinary ensures the file exists and is executable, or returns an error
 func EnsureBinary(path string) error {
 	info, err := os.Stat(path)
@@ -168,10 +677,5 @@ func EnsureBinary(path string) error {
 	if !info.Mode().IsRegular() {
 		return errors.Errorf("%s is not a regular file", info.Name())
 	}
-	// this checks if the world-executable bit is set (we cannot check owner easily)
-	exec := info.Mode().Perm() & 0001
-	if exec == 0 {
-		return errors.Errorf("%s is not world executable", info.Name())
-	}
-	return nil
+	return checkExecutable(path, info)
 }
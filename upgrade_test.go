@@ -39,6 +39,86 @@ func TestCurrentBin(t *testing.T) {
 	}
 }
 
+func TestCurrentBinCopyMode(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+
+	cfg := Config{Home: home, Name: "dummyd", CopySwitching: true}
+	assert.Equal(t, cfg.GenesisBin(), cfg.CurrentBin())
+	_, _, ok := cfg.CurrentUpgradeDir()
+	assert.False(t, ok)
+
+	// a symlink from before is replaced by a copy
+	require.NoError(t, (&Config{Home: home, Name: "dummyd"}).SetCurrentUpgrade("chain3"))
+
+	current := filepath.Join(cfg.Root(), currentLink)
+	for _, upgrade := range []string{"chain2", "chain3", "chain2"} {
+		require.NoError(t, cfg.SetCurrentUpgrade(upgrade))
+		info, err := os.Lstat(current)
+		require.NoError(t, err)
+		assert.True(t, info.IsDir())
+
+		assert.Equal(t, filepath.Join(current, "bin", "dummyd"), cfg.CurrentBin())
+		assert.NoError(t, EnsureBinary(cfg.CurrentBin()))
+		expected, err := ioutil.ReadFile(cfg.UpgradeBin(upgrade))
+		require.NoError(t, err)
+		actual, err := ioutil.ReadFile(cfg.CurrentBin())
+		require.NoError(t, err)
+		assert.Equal(t, expected, actual)
+
+		dir, _, ok := cfg.CurrentUpgradeDir()
+		assert.True(t, ok)
+		assert.Equal(t, cfg.UpgradeDir(upgrade), dir)
+	}
+	_, err = os.Stat(current + ".new")
+	assert.True(t, os.IsNotExist(err))
+
+	// and an invalid upgrade leaves it alone
+	require.Error(t, cfg.SetCurrentUpgrade("noexec"))
+	dir, _, _ := cfg.CurrentUpgradeDir()
+	assert.Equal(t, cfg.UpgradeDir("chain2"), dir)
+}
+
+func TestCurrentBinPointerMode(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+
+	cfg := Config{Home: home, Name: "dummyd", PointerSwitching: true}
+	assert.Equal(t, cfg.GenesisBin(), cfg.CurrentBin())
+
+	// a copy from before is replaced by a pointer
+	require.NoError(t, (&Config{Home: home, Name: "dummyd", CopySwitching: true}).SetCurrentUpgrade("chain3"))
+
+	current := filepath.Join(cfg.Root(), currentLink)
+	for _, upgrade := range []string{"chain2", "chain3", "chain2"} {
+		require.NoError(t, cfg.SetCurrentUpgrade(upgrade))
+		info, err := os.Lstat(current)
+		require.NoError(t, err)
+		assert.True(t, info.Mode().IsRegular())
+		bz, err := ioutil.ReadFile(current)
+		require.NoError(t, err)
+		assert.Equal(t, "upgrades/"+upgrade+"\n", string(bz))
+
+		assert.Equal(t, cfg.UpgradeBin(upgrade), cfg.CurrentBin())
+		dir, _, ok := cfg.CurrentUpgradeDir()
+		assert.True(t, ok)
+		assert.Equal(t, cfg.UpgradeDir(upgrade), dir)
+		assert.Equal(t, upgrade, cfg.currentUpgradeName())
+	}
+	_, err = os.Stat(current + ".new")
+	assert.True(t, os.IsNotExist(err))
+
+	// and an invalid upgrade leaves it alone
+	require.Error(t, cfg.SetCurrentUpgrade("noexec"))
+	assert.Equal(t, cfg.UpgradeBin("chain2"), cfg.CurrentBin())
+
+	// a pointer out of the root is ignored
+	require.NoError(t, ioutil.WriteFile(current, []byte("../../bin"), 0644))
+	assert.Equal(t, cfg.GenesisBin(), cfg.CurrentBin())
+}
+
 // TODO: test with download (and test all download functions)
 func TestDoUpgradeNoDownloadUrl(t *testing.T) {
 	home, err := copyTestData("validate")
@@ -106,6 +186,30 @@ func TestGetDownloadURL(t *testing.T) {
 			info:  `{"binaries": {"linux/arm": "https://foo.bar/"}}`,
 			isErr: true,
 		},
+		"any platform": {
+			info: `{"binaries": {"windows/amd64": "https://something.else", "any": "https://foo.bar/script.sh"}}`,
+			url:  "https://foo.bar/script.sh",
+		},
+		"ours before any": {
+			info: `{"binaries": {"any": "https://foo.bar/script.sh", "linux/amd64": "https://foo.bar/"}}`,
+			url:  "https://foo.bar/",
+		},
+		"sloppy keys": {
+			info: `{"binaries": {" Linux/AMD64 ": " https://foo.bar/ "}}`,
+			url:  "https://foo.bar/",
+		},
+		"empty url": {
+			info:  `{"binaries": {"linux/amd64": ""}}`,
+			isErr: true,
+		},
+		"no binaries": {
+			info:  `{}`,
+			isErr: true,
+		},
+		"not json": {
+			info:  `{"binaries": `,
+			isErr: true,
+		},
 	}
 
 	for name, tc := range cases {
@@ -121,9 +225,33 @@ func TestGetDownloadURL(t *testing.T) {
 	}
 }
 
+func TestUpgradeConfigURL(t *testing.T) {
+	config, err := parseUpgradeConfig(`{"binaries": {"linux/arm64": "https://foo.bar/arm", "darwin/amd64": "https://foo.bar/mac"}}`)
+	require.NoError(t, err)
+	_, err = config.URL()
+	require.Error(t, err)
+	assert.Equal(t, errNoArtifact, errors.Cause(err))
+	// the error tells what the plan has
+	assert.Contains(t, err.Error(), "only for darwin/amd64, linux/arm64")
+
+	// other names of the same platform
+	config, err = parseUpgradeConfig(`{"binaries": {"Linux_x86_64": "https://foo.bar/amd", "macos/aarch64": "https://foo.bar/mac", "linux-armhf": "https://foo.bar/arm", "ANY": "https://foo.bar/sh"},
+		"checksums": {"linux/x86-64": "sha256:abc"}, "mirrors": {"osx/arm64": ["https://mirror/mac"]}}`)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"linux/amd64": "https://foo.bar/amd", "darwin/arm64": "https://foo.bar/mac", "linux/arm": "https://foo.bar/arm", "any": "https://foo.bar/sh"}, config.Binaries)
+	assert.Equal(t, map[string]string{"linux/amd64": "sha256:abc"}, config.Checksums)
+	assert.Equal(t, map[string][]string{"darwin/arm64": {"https://mirror/mac"}}, config.Mirrors)
+
+	_, err = parseUpgradeConfig(`{"binaries": {"linux/amd64": "https://foo.bar/one", "linux/x86_64": "https://foo.bar/other"}}`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "both name binaries for linux/amd64")
+}
+
 func TestDownloadBinary(t *testing.T) {
 	cases := map[string]struct {
 		url         string
+		checksum    string
+		require     bool
 		canDownload bool
 		validBinary bool
 	}{
@@ -138,6 +266,23 @@ func TestDownloadBinary(t *testing.T) {
 			canDownload: true,
 			validBinary: true,
 		},
+		"get raw binary with bare checksum in url": {
+			url:         "./testdata/repo/raw_binary/autod?checksum=E6BC7851600A2A9917F7BF88EB7BDEE1EC162C671101485690B4DEB089077B0D",
+			require:     true,
+			canDownload: true,
+			validBinary: true,
+		},
+		"get raw binary with checksum in url and listed": {
+			url:         "./testdata/repo/raw_binary/autod?checksum=" + autodSHA256,
+			checksum:    "sha256:" + autodSHA256,
+			require:     true,
+			canDownload: true,
+			validBinary: true,
+		},
+		"get raw binary with malformed checksum in url": {
+			url:         "./testdata/repo/raw_binary/autod?checksum=sha256:e6bc78",
+			canDownload: false,
+		},
 		"get raw binary with invalid checksum": {
 			url:         "./testdata/repo/raw_binary/autod?checksum=sha256:73e2bd6cbb99261733caf137015d5cc58e3f96248d8b01da68be8564989dd906",
 			canDownload: false,
@@ -157,6 +302,23 @@ func TestDownloadBinary(t *testing.T) {
 			url:         "./testdata/repo/zip_directory/autod.zip?checksum=sha256:73e2bd6cbb99261733caf137015d5cc58e3f96248d8b01da68be8564989dd906",
 			canDownload: false,
 		},
+		"get raw binary with listed checksum": {
+			url:         "./testdata/repo/raw_binary/autod",
+			checksum:    autodSHA256,
+			require:     true,
+			canDownload: true,
+			validBinary: true,
+		},
+		"get raw binary with invalid listed checksum": {
+			url:         "./testdata/repo/raw_binary/autod",
+			checksum:    "sha256:73e2bd6cbb99261733caf137015d5cc58e3f96248d8b01da68be8564989dd906",
+			canDownload: false,
+		},
+		"get raw binary without required checksum": {
+			url:         "./testdata/repo/raw_binary/autod",
+			require:     true,
+			canDownload: false,
+		},
 		"invalid url": {
 			url:         "./testdata/repo/bad_dir/autod",
 			canDownload: false,
@@ -174,6 +336,7 @@ func TestDownloadBinary(t *testing.T) {
 				Home:                  home,
 				Name:                  "autod",
 				AllowDownloadBinaries: true,
+				RequireChecksum:       tc.require,
 			}
 
 			// if we have a relative path, make it absolute, but don't change eg. https://... urls
@@ -187,7 +350,7 @@ func TestDownloadBinary(t *testing.T) {
 			info := &UpgradeInfo{
 				Name:   upgrade,
 				Height: 789,
-				Info:   fmt.Sprintf(`{"binaries":{"%s": "%s"}}`, osArch(), url),
+				Info:   fmt.Sprintf(`{"binaries":{"%s": "%s"}, "checksums":{"%s": "%s"}}`, osArch(), url, osArch(), tc.checksum),
 			}
 
 			err = DownloadBinary(cfg, info)
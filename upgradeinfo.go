@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	upgradeInfoFile     = "upgrade-info.json"
+	defaultPollInterval = time.Second
+)
+
+// UpgradeInfoFile is written by x/upgrade of newer SDKs, right before the daemon halts for an upgrade
+func (cfg *Config) UpgradeInfoFile() string {
+	return filepath.Join(cfg.DataDir(), upgradeInfoFile)
+}
+
+// UpgradeInfoWatcher notices when the daemon (re)writes upgrade-info.json.
+// The file stays around after the upgrade, so only changes since the watcher was created count.
+type UpgradeInfoWatcher struct {
+	path    string
+	modTime time.Time
+	size    int64
+	// the state of the file when the watcher was created, which Peek compares with
+	initialModTime time.Time
+	initialSize    int64
+}
+
+// NewUpgradeInfoWatcher remembers the current state of the file at path
+func NewUpgradeInfoWatcher(path string) *UpgradeInfoWatcher {
+	w := &UpgradeInfoWatcher{path: path}
+	if info, err := os.Stat(path); err == nil {
+		w.modTime, w.size = info.ModTime(), info.Size()
+	}
+	w.initialModTime, w.initialSize = w.modTime, w.size
+	return w
+}
+
+// Peek returns the upgrade info, if the file was written since the watcher was created, whether or not
+// Check reported it already
+func (w *UpgradeInfoWatcher) Peek() *UpgradeInfo {
+	info, err := os.Stat(w.path)
+	if err != nil || (info.ModTime().Equal(w.initialModTime) && info.Size() == w.initialSize) {
+		return nil
+	}
+	bz, err := ioutil.ReadFile(w.path)
+	if err != nil {
+		return nil
+	}
+	var upgrade UpgradeInfo
+	if err := json.Unmarshal(bz, &upgrade); err != nil || upgrade.Name == "" {
+		return nil
+	}
+	return &upgrade
+}
+
+// Check returns the upgrade info if the file changed since we last looked, and nil otherwise.
+// A file which doesn't parse (yet) is not reported as changed, so a half written file is read again
+// on the next check.
+func (w *UpgradeInfoWatcher) Check() (*UpgradeInfo, error) {
+	info, err := os.Stat(w.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "checking upgrade info")
+	}
+	if info.ModTime().Equal(w.modTime) && info.Size() == w.size {
+		return nil, nil
+	}
+
+	bz, err := ioutil.ReadFile(w.path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading upgrade info")
+	}
+	var upgrade UpgradeInfo
+	if err := json.Unmarshal(bz, &upgrade); err != nil || upgrade.Name == "" {
+		return nil, nil
+	}
+	w.modTime, w.size = info.ModTime(), info.Size()
+	return &upgrade, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpgradeInfoWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upgrade-info")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, upgradeInfoFile)
+
+	// left over from the last upgrade
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"name":"chain2","height":49}`), 0644))
+	w := NewUpgradeInfoWatcher(path)
+	info, err := w.Check()
+	require.NoError(t, err)
+	assert.Nil(t, info)
+
+	// half written
+	later := time.Now().Add(time.Second)
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"name":"chain3",`), 0644))
+	require.NoError(t, os.Chtimes(path, later, later))
+	info, err = w.Check()
+	require.NoError(t, err)
+	assert.Nil(t, info)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"name":"chain3","height":1234,"info":"{}"}`), 0644))
+	require.NoError(t, os.Chtimes(path, later, later))
+	info, err = w.Check()
+	require.NoError(t, err)
+	assert.Equal(t, &UpgradeInfo{Name: "chain3", Height: 1234, Info: "{}"}, info)
+
+	// reported only once
+	info, err = w.Check()
+	require.NoError(t, err)
+	assert.Nil(t, info)
+}
+
+// TestLaunchProcessUpgradeInfoFile ensures we upgrade if the daemon writes upgrade-info.json, without logging anything
+func TestLaunchProcessUpgradeInfoFile(t *testing.T) {
+	cases := map[string]string{
+		// we notice while it waits
+		"keeps running": `#!/bin/sh
+mkdir -p "$DAEMON_HOME/data"
+echo '{"name":"chain2","height":49,"info":"{}"}' > "$DAEMON_HOME/data/upgrade-info.json"
+while true; do sleep 0.1; done
+`,
+		// or once it halted by itself
+		"halts": `#!/bin/sh
+mkdir -p "$DAEMON_HOME/data"
+echo '{"name":"chain2","height":49,"info":"{}"}' > "$DAEMON_HOME/data/upgrade-info.json"
+exit 2
+`,
+	}
+
+	for name, script := range cases {
+		t.Run(name, func(t *testing.T) {
+			home, err := copyTestData("validate")
+			require.NoError(t, err)
+			defer os.RemoveAll(home)
+			defer setEnv(map[string]string{"DAEMON_HOME": home})()
+
+			cfg := &Config{Home: home, Name: "dummyd", UnsafeSkipBackup: true, PollInterval: 50 * time.Millisecond}
+			require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+
+			var stdout, stderr bytes.Buffer
+			require.NoError(t, LaunchProcess(cfg, []string{"start"}, &stdout, &stderr))
+			assert.Equal(t, cfg.UpgradeBin("chain2"), cfg.CurrentBin())
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// AwaitBinary waits for an operator to stage the binary of an upgrade we cannot download, eg. on an air-gapped
+// host, rather than exiting. The operator is notified at once and every DAEMON_WAIT_FOR_BINARY_REMIND, and the binary
+// is only taken once it stopped changing, so we never run one which is still being copied. It gives up after
+// DAEMON_WAIT_FOR_BINARY_TIMEOUT, and returns errStopped for SIGINT or SIGTERM, or if ctx is done.
+func (cfg *Config) AwaitBinary(ctx context.Context, info *UpgradeInfo) error {
+	if cfg.WaitForBinaryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.WaitForBinaryTimeout)
+		defer cancel()
+	}
+	ctx, stop := stopOnSignal(ctx)
+	defer stop()
+
+	bin := cfg.UpgradeBin(info.Name)
+	poll := orDefault(cfg.PollInterval, defaultPollInterval)
+	remind := orDefault(cfg.WaitForBinaryRemind, defaultWaitForBinaryRemind)
+	fields := map[string]string{"UPGRADE": info.Name, "HEIGHT": strconv.FormatInt(info.Height, 10), "PATH": bin}
+	waiting := func(since time.Duration) {
+		message := fmt.Sprintf("waiting for the binary of upgrade %s in %s", info.Name, bin)
+		if since > 0 {
+			message = fmt.Sprintf("%s, for %s now", message, since.Round(time.Second))
+		}
+		cfg.Notify(Event{Type: "waiting_for_binary", Message: message, Fields: fields})
+	}
+
+	start := time.Now()
+	waiting(0)
+	lastReminder := start
+	var last os.FileInfo
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return errors.Errorf("the binary of upgrade %s was not staged within %s", info.Name, cfg.WaitForBinaryTimeout)
+			}
+			return errStopped
+		}
+		if time.Since(lastReminder) >= remind {
+			waiting(time.Since(start))
+			lastReminder = time.Now()
+		}
+		if EnsureBinary(bin) != nil {
+			last = nil
+			continue
+		}
+		current, err := os.Stat(bin)
+		if err != nil {
+			last = nil
+			continue
+		}
+		if last != nil && current.Size() == last.Size() && current.ModTime().Equal(last.ModTime()) {
+			logger.Printf("found the binary of upgrade %s after %s", info.Name, time.Since(start).Round(time.Second))
+			return nil
+		}
+		last = current
+	}
+}
+
+// stopOnSignal returns a context which is done on SIGINT or SIGTERM, for waits which must not outlive a stop of the
+// upgrade manager. The returned function stops listening.
+func stopOnSignal(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			logger.Printf("stopped waiting for %s", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(signals)
+	}()
+	return ctx, cancel
+}
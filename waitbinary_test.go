@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAwaitBinary(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as binary")
+	}
+	home, err := ioutil.TempDir("", "upgrade-manager-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	cfg := &Config{Home: home, Name: "dummyd", UnsafeSkipBackup: true, WaitForBinary: true, PollInterval: 20 * time.Millisecond}
+	require.NoError(t, os.MkdirAll(cfg.DataDir(), 0755))
+	require.NoError(t, os.MkdirAll(cfg.Root(), 0755))
+
+	upgraded := make(chan error)
+	go func() {
+		upgraded <- DoUpgrade(cfg, &UpgradeInfo{Name: "v2", Height: 100})
+	}()
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case err := <-upgraded:
+		t.Fatalf("did not wait for the binary: %v", err)
+	default:
+	}
+	// downloads ahead of time are not held up meanwhile
+	downloading.Lock()
+	downloading.Unlock()
+	// the plan is held meanwhile, so it can be exported
+	plan, err := cfg.HeldPlan()
+	require.NoError(t, err)
+	require.NotNil(t, plan)
+	assert.Equal(t, "v2", plan.Name)
+
+	bin := cfg.UpgradeBin("v2")
+	require.NoError(t, os.MkdirAll(filepath.Dir(bin), 0755))
+	require.NoError(t, ioutil.WriteFile(bin, []byte("#!/bin/sh\necho v2\n"), 0755))
+	select {
+	case err := <-upgraded:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the binary was not taken")
+	}
+	assert.Equal(t, bin, cfg.CurrentBin())
+
+	// without waiting, the upgrade fails at once
+	cfg.WaitForBinary = false
+	err = DoUpgrade(cfg, &UpgradeInfo{Name: "v3", Height: 200})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "downloading disabled")
+
+	// nor does it wait forever
+	cfg.WaitForBinary = true
+	cfg.WaitForBinaryTimeout = 100 * time.Millisecond
+	err = DoUpgrade(cfg, &UpgradeInfo{Name: "v3", Height: 200})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not staged within 100ms")
+
+	// and stops when we do
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, errStopped, cfg.AwaitBinary(ctx, &UpgradeInfo{Name: "v3", Height: 200}))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// errStalled is returned by LaunchProcess if the watchdog stopped the daemon, to be restarted
+var errStalled = errors.New("chain stalled")
+
+// Watchdog notices when the daemon stops making progress, ie. no new height in its output or rpc
+type Watchdog struct {
+	cfg *Config
+	// heights are asked besides the output, if given
+	heights *Heights
+	mutex   sync.Mutex
+	// height is the highest we saw, at progress
+	height   int64
+	progress time.Time
+	// stalled is set once we acted on a stall, until the height moves again
+	stalled bool
+}
+
+// NewWatchdog returns a watchdog if DAEMON_STALL_TIMEOUT is set, or nil
+func (cfg *Config) NewWatchdog(heights *Heights) *Watchdog {
+	if cfg.StallTimeout <= 0 {
+		return nil
+	}
+	return &Watchdog{cfg: cfg, heights: heights, progress: time.Now()}
+}
+
+// Observe reads the height from a line of output, if it is a committed block (see committedHeight): the heights of
+// peers, proposals or upgrade plans tell nothing of the progress of the node
+func (w *Watchdog) Observe(line string) {
+	if height, ok := committedHeight(line); ok {
+		w.observe(height, time.Now())
+	}
+}
+
+func (w *Watchdog) observe(height int64, now time.Time) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if height <= w.height {
+		return
+	}
+	if w.stalled {
+		stall := now.Sub(w.progress).Round(time.Second)
+		w.cfg.Notify(Event{
+			Type:    "chain_resumed",
+			Message: fmt.Sprintf("chain resumed at height %d, after %s", height, stall),
+			Fields:  map[string]string{"HEIGHT": strconv.FormatInt(height, 10), "DURATION": stall.String()},
+		})
+	}
+	w.height, w.progress, w.stalled = height, now, false
+}
+
+// check returns true, the first time there was no progress for longer than the timeout
+func (w *Watchdog) check(now time.Time) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.stalled || now.Sub(w.progress) < w.cfg.StallTimeout {
+		return false
+	}
+	w.stalled = true
+	return true
+}
+
+// Run checks for progress until done, also asking the heights if there are any. On a stall, it alerts
+// or stops the daemon with errStalled sent to stalled, as DAEMON_STALL_ACTION says.
+func (w *Watchdog) Run(cmd *exec.Cmd, done <-chan struct{}, stalled chan<- error) {
+	ticker := time.NewTicker(w.interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if w.heights != nil {
+			if height, err := w.heights.Height("watchdog"); err == nil {
+				w.observe(height, time.Now())
+			}
+		}
+		if !w.check(time.Now()) {
+			continue
+		}
+		w.mutex.Lock()
+		height, since := w.height, time.Since(w.progress).Round(time.Second)
+		w.mutex.Unlock()
+		action := w.cfg.StallAction
+		if action != "restart" {
+			w.cfg.Notify(Event{
+				Type:    "chain_stalled",
+				Message: fmt.Sprintf("ALERT: no new block for %s, last height %d", since, height),
+				Fields:  map[string]string{"HEIGHT": strconv.FormatInt(height, 10), "ACTION": action, "DURATION": since.String()},
+			})
+		}
+		if action == "alert" {
+			continue
+		}
+		logger.Printf("restarting the daemon, no new block for %s since height %d", since, height)
+		stalled <- errStalled
+		StopProcess(cmd, w.cfg.ShutdownSignal, w.cfg.ShutdownGrace, done, NewStopMarkers(nil))
+		return
+	}
+}
+
+// interval is how often Run checks, often enough to act soon after the timeout
+func (w *Watchdog) interval() time.Duration {
+	interval := w.cfg.StallTimeout / 10
+	if poll := orDefault(w.cfg.PollInterval, defaultPollInterval); interval > poll {
+		interval = poll
+	}
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	return interval
+}
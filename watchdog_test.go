@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchdogObserve(t *testing.T) {
+	cases := map[string]struct {
+		line   string
+		height int64
+	}{
+		"tendermint":    {line: `I[2020-06-01|10:02:11.123] Committed state                              module=state height=1234 txs=0 appHash=AB`, height: 1234},
+		"zerolog":       {line: `{"level":"info","module":"state","height":1234,"num_txs":0,"message":"committed state"}`, height: 1234},
+		"quoted":        {line: `{"level":"info","module":"state","height":"1234","message":"committed state"}`, height: 1234},
+		"no height":     {line: `I[2020-06-01|10:02:11.123] Starting Node module=main`},
+		"other heights": {line: `I[2020-06-01|10:02:11.123] status latest_block_height=1234 max-height=99`},
+		// only committed blocks are progress of the node
+		"executed":     {line: `I[2020-06-01|10:02:11.123] executed block module=state height=1234 validTxs=0`},
+		"peer":         {line: `11:00AM INF received status from peer height=1300 module=blocksync`},
+		"upgrade":      {line: `11:00AM ERR UPGRADE "v2" NEEDED at height: 1300: {} module=x/upgrade`},
+		"upgrade json": {line: `{"level":"error","module":"x/upgrade","height":1300,"message":"UPGRADE \"v2\" NEEDED at height: 1300"}`},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			w := (&Config{StallTimeout: time.Minute}).NewWatchdog(nil)
+			w.Observe(tc.line)
+			assert.Equal(t, tc.height, w.height)
+		})
+	}
+	assert.Nil(t, (&Config{}).NewWatchdog(nil))
+}
+
+func TestWatchdogCheck(t *testing.T) {
+	w := (&Config{StallTimeout: time.Minute}).NewWatchdog(nil)
+	start := time.Now()
+	w.observe(10, start)
+	assert.False(t, w.check(start.Add(59*time.Second)))
+	assert.True(t, w.check(start.Add(61*time.Second)))
+	// only acted on once
+	assert.False(t, w.check(start.Add(2*time.Minute)))
+
+	// an old height is no progress
+	w.observe(9, start.Add(3*time.Minute))
+	assert.False(t, w.check(start.Add(5*time.Minute)))
+	w.observe(11, start.Add(5*time.Minute))
+	assert.False(t, w.check(start.Add(5*time.Minute+59*time.Second)))
+	assert.True(t, w.check(start.Add(6*time.Minute+time.Second)))
+}
+
+func TestLaunchProcessStalled(t *testing.T) {
+	home, err := copyTestData("validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	script := "#!/bin/sh\necho 'INF committed state height=1 module=state'\necho 'INF committed state height=2 module=state'\nexec sleep 30\n"
+
+	// with alert, the daemon keeps running
+	for _, action := range []string{"restart", "both"} {
+		t.Run(action, func(t *testing.T) {
+			cfg := &Config{Home: home, Name: "dummyd", StallTimeout: 300 * time.Millisecond, StallAction: action}
+			require.NoError(t, ioutil.WriteFile(cfg.GenesisBin(), []byte(script), 0755))
+			var stdout, stderr bytes.Buffer
+			start := time.Now()
+			err := LaunchProcess(cfg, []string{"start"}, &stdout, &stderr)
+			assert.Equal(t, errStalled, err)
+			assert.True(t, time.Since(start) < 5*time.Second, "%s", time.Since(start))
+			assert.Equal(t, cfg.GenesisBin(), cfg.CurrentBin())
+		})
+	}
+}